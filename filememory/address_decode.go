@@ -1,52 +1,120 @@
 package filememory
 
 import (
+	"errors"
+
 	"github.com/blocktree/go-owcdrivers/addressEncoder"
 	owcrypt "github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//AddressParams 地址编码参数
+type AddressParams struct {
+	Prefix  string                     //地址前缀
+	Encoder addressEncoder.AddressType //公钥哈希的编码
+}
+
+var (
+	//FMMainnetAddress 主网地址参数
+	FMMainnetAddress = AddressParams{Prefix: "FM", Encoder: addressEncoder.ETH_mainnetPublicAddress}
+	//FMTestnetAddress 测试网地址参数，目前与主网的编码相同
+	FMTestnetAddress = AddressParams{Prefix: "FM", Encoder: addressEncoder.ETH_mainnetPublicAddress}
 )
 
+//ErrInvalidPublicKey 公钥格式错误
+var ErrInvalidPublicKey = errors.New("invalid secp256k1 public key")
+
+//NetworkAddressParams 按网络选择地址参数
+func NetworkAddressParams(isTestnet bool) AddressParams {
+	if isTestnet {
+		return FMTestnetAddress
+	}
+	return FMMainnetAddress
+}
+
+//addressParamsFromOpts 从可选参数中取地址参数，支持AddressParams和是否测试网的bool，默认主网
+func addressParamsFromOpts(opts []interface{}) AddressParams {
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case AddressParams:
+			return v
+		case *AddressParams:
+			if v != nil {
+				return *v
+			}
+		case bool:
+			return NetworkAddressParams(v)
+		}
+	}
+	return FMMainnetAddress
+}
+
 //AddressDecoder 地址解析器
-type AddressDecoder struct{}
+type AddressDecoder struct {
+	openwallet.AddressDecoderV2Base
+}
 
-//PrivateKeyToWIF 私钥转WIF
+//PrivateKeyToWIF 私钥转WIF，FM链没有WIF格式，导出为十六进制私钥
 func (decoder *AddressDecoder) PrivateKeyToWIF(priv []byte, isTestnet bool) (string, error) {
-	return "", nil
-
+	return PrivateKeyToHex(priv)
 }
 
 //PublicKeyToAddress 公钥转地址
 func (decoder *AddressDecoder) PublicKeyToAddress(pub []byte, isTestnet bool) (string, error) {
+	return decoder.AddressEncode(pub, NetworkAddressParams(isTestnet))
+}
 
-	cfg := addressEncoder.ETH_mainnetPublicAddress
-	if isTestnet {
-		cfg = addressEncoder.ETH_mainnetPublicAddress
-	}
+//RedeemScriptToAddress 多重签名赎回脚本转地址，FM链的账户模型不支持
+func (decoder *AddressDecoder) RedeemScriptToAddress(pubs [][]byte, required uint64, isTestnet bool) (string, error) {
+	return "", errors.New("redeem script address is not supported")
+}
 
-	//pkHash := btcutil.Hash160(pub)
-	//address, err :=  btcutil.NewAddressPubKeyHash(pkHash, &cfg)
-	//if err != nil {
-	//	return "", err
-	//}
+//WIFToPrivateKey WIF转私钥，接受十六进制私钥
+func (decoder *AddressDecoder) WIFToPrivateKey(wif string, isTestnet bool) ([]byte, error) {
+	return HexToPrivateKey(wif)
+}
 
-	//log.Debug("public key:", common.ToHex(pub))
-	publickKey := owcrypt.PointDecompress(pub, owcrypt.ECC_CURVE_SECP256K1)
-	//log.Debug("after encode public key:", common.ToHex(publickKey))
-	pkHash := owcrypt.Hash(publickKey[1:len(publickKey)], 0, owcrypt.HASH_ALG_KECCAK256)
+//AddressEncode 公钥编码为地址，支持压缩和未压缩的secp256k1公钥，
+//opts可传入AddressParams或是否测试网的bool
+func (decoder *AddressDecoder) AddressEncode(pub []byte, opts ...interface{}) (string, error) {
 
-	//地址添加0x前缀
-	address := AppendFmToAddress(addressEncoder.AddressEncode(pkHash, cfg))
+	params := addressParamsFromOpts(opts)
 
-	return address, nil
+	var publickKey []byte
+	switch {
+	case len(pub) == 33 && (pub[0] == 0x02 || pub[0] == 0x03):
+		publickKey = owcrypt.PointDecompress(pub, owcrypt.ECC_CURVE_SECP256K1)
+	case len(pub) == 65 && pub[0] == 0x04:
+		publickKey = pub
+	case len(pub) == 64:
+		publickKey = append([]byte{0x04}, pub...)
+	default:
+		return "", ErrInvalidPublicKey
+	}
+	if len(publickKey) != 65 {
+		return "", ErrInvalidPublicKey
+	}
+	pkHash := owcrypt.Hash(publickKey[1:], 0, owcrypt.HASH_ALG_KECCAK256)
 
-}
+	a, err := ParseFMAddress(addressEncoder.AddressEncode(pkHash, params.Encoder))
+	if err != nil {
+		return "", err
+	}
 
-//RedeemScriptToAddress 多重签名赎回脚本转地址
-func (decoder *AddressDecoder) RedeemScriptToAddress(pubs [][]byte, required uint64, isTestnet bool) (string, error) {
-	return "", nil
+	//地址添加网络的前缀
+	return params.Prefix + a.Hex(), nil
 }
 
-//WIFToPrivateKey WIF转私钥
-func (decoder *AddressDecoder) WIFToPrivateKey(wif string, isTestnet bool) ([]byte, error) {
-	return nil, nil
+//AddressDecode 地址解析为20字节的账户地址
+func (decoder *AddressDecoder) AddressDecode(addr string, opts ...interface{}) ([]byte, error) {
+	a, err := ParseFMAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return a.Bytes(), nil
+}
 
+//AddressVerify 地址校验，接受的格式与创建交易单时的目标地址一致
+func (decoder *AddressDecoder) AddressVerify(address string, opts ...interface{}) bool {
+	return IsFMAddress(address)
 }
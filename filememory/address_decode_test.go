@@ -17,7 +17,10 @@ package filememory
 
 import (
 	"encoding/hex"
+	"strings"
 	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
 )
 
 func TestAddressDecoder_PublicKeyToAddress(t *testing.T) {
@@ -32,3 +35,92 @@ func TestAddressDecoder_PublicKeyToAddress(t *testing.T) {
 	}
 	t.Logf("addr: %s", addr)
 }
+
+func TestAddressDecoder_AddressEncode(t *testing.T) {
+	var decoder openwallet.AddressDecoderV2 = &AddressDecoder{}
+
+	//私钥1的公钥
+	compressed, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	uncompressed, _ := hex.DecodeString("0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+	want := "FM7e5f4552091a69125d5dfcb7b8c2659029395bdf"
+
+	for _, pub := range [][]byte{compressed, uncompressed, uncompressed[1:]} {
+		addr, err := decoder.AddressEncode(pub)
+		if err != nil || addr != want {
+			t.Errorf("AddressEncode(%x) = %s, err=%v; want %s", pub, addr, err, want)
+		}
+	}
+	if addr, err := decoder.PublicKeyToAddress(compressed, true); err != nil || addr != want {
+		t.Errorf("PublicKeyToAddress = %s, err=%v; want %s", addr, err, want)
+	}
+	//按isTestnet选择地址参数
+	mainnet, testnet := FMMainnetAddress, FMTestnetAddress
+	defer func() { FMMainnetAddress, FMTestnetAddress = mainnet, testnet }()
+	FMTestnetAddress.Prefix = "FT"
+	if addr, err := decoder.PublicKeyToAddress(compressed, true); err != nil || addr != "FT"+strings.TrimPrefix(want, "FM") {
+		t.Errorf("testnet PublicKeyToAddress = %s, err=%v", addr, err)
+	}
+	if addr, err := decoder.AddressEncode(compressed, false); err != nil || addr != want {
+		t.Errorf("mainnet AddressEncode = %s, err=%v; want %s", addr, err, want)
+	}
+	if _, err := decoder.AddressEncode(compressed[1:]); err != ErrInvalidPublicKey {
+		t.Errorf("AddressEncode of bad public key err=%v", err)
+	}
+
+	hash, err := decoder.AddressDecode(want)
+	if err != nil || hex.EncodeToString(hash) != strings.TrimPrefix(want, "FM") {
+		t.Errorf("AddressDecode = %x, err=%v", hash, err)
+	}
+}
+
+func TestAddressDecoder_AddressVerify(t *testing.T) {
+	wm := NewWalletManager()
+	decoder := wm.GetAddressDecoderV2()
+	if decoder == nil {
+		t.Fatalf("GetAddressDecoderV2 should not be nil")
+	}
+
+	cases := map[string]bool{
+		testDepositAddress: true,
+		"0x" + strings.TrimPrefix(testDepositAddress, "FM"):  true,
+		mustParseFMAddress(t, testDepositAddress).Checksum(): true,
+		"FM7E5F4552091A69125d5DfCb7b8C2659029395Bdf":         true,
+		"FM7E5F4552091A69125d5DfCb7b8C2659029395BDf":         false,
+		"FM7e5f4552091a69125d5dfcb7b8c2659029395b":           false,
+		"": false,
+	}
+	for address, want := range cases {
+		if decoder.AddressVerify(address) != want {
+			t.Errorf("AddressVerify(%s) = %v, want %v", address, !want, want)
+		}
+	}
+}
+
+func TestAddressDecoder_WIF(t *testing.T) {
+	decoder := AddressDecoder{}
+	priv, _ := hex.DecodeString(strings.Repeat("01", 32))
+
+	wif, err := decoder.PrivateKeyToWIF(priv, false)
+	if err != nil || wif != strings.Repeat("01", 32) {
+		t.Fatalf("PrivateKeyToWIF = %s, err=%v", wif, err)
+	}
+	for _, s := range []string{wif, "0x" + wif, strings.ToUpper(wif)} {
+		key, err := decoder.WIFToPrivateKey(s, false)
+		if err != nil || hex.EncodeToString(key) != wif {
+			t.Errorf("WIFToPrivateKey(%s) = %x, err=%v", s, key, err)
+		}
+	}
+	address, err := PrivateKeyToAddress(priv)
+	if err != nil || address.String() != testDepositAddress {
+		t.Errorf("PrivateKeyToAddress = %s, err=%v; want %s", address, err, testDepositAddress)
+	}
+
+	for _, s := range []string{"", wif[2:], "zz" + wif[2:], strings.Repeat("00", 32), strings.Repeat("ff", 32)} {
+		if _, err := decoder.WIFToPrivateKey(s, false); err != ErrInvalidPrivateKey {
+			t.Errorf("WIFToPrivateKey(%s) err=%v, want %v", s, err, ErrInvalidPrivateKey)
+		}
+	}
+	if _, err := decoder.RedeemScriptToAddress(nil, 1, false); err == nil {
+		t.Errorf("RedeemScriptToAddress should not be supported")
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/common"
+)
+
+//HD地址生成：地址从钱包的扩展公钥（HdPath，root/1'）按顺序派生非强化子密钥，路径为HdPath/index，
+//已用到的索引记录在钱包的AddressCount中。派生只需公钥，地址池补充时不需要钱包密码。
+//
+//充值地址池：预先生成DepositAddressPoolSize个Pooled的地址，GetDepositAddress按索引从小到大分配，
+//分配后清除Pooled并补充地址池。批量生成的地址直接视为已分配
+
+//DEFAULT_DEPOSIT_ADDRESS_POOL_SIZE 默认的充值地址池大小
+const DEFAULT_DEPOSIT_ADDRESS_POOL_SIZE = 20
+
+//MAX_CREATE_ADDRESS_COUNT 单次批量生成地址的上限
+const MAX_CREATE_ADDRESS_COUNT = 100000
+
+//ADDRESS_SAVE_BATCH_SIZE 批量生成地址时每个数据库事务保存的地址数
+const ADDRESS_SAVE_BATCH_SIZE = 1000
+
+//地址导出格式
+const (
+	AddressExportCSV  = "csv"
+	AddressExportJSON = "json"
+)
+
+//CreateAddresses 从钱包的下一个索引开始批量派生count个地址并保存到钱包数据库
+func (this *WalletManager) CreateAddresses(wallet *Wallet, count uint64) ([]*Address, error) {
+	this.addressLocker.Lock()
+	defer this.addressLocker.Unlock()
+	return this.deriveAddresses(wallet, count, false)
+}
+
+//CreateAddressesToFile 批量生成地址并按format（csv或json）导出到AddressDir，返回导出的文件路径
+func (this *WalletManager) CreateAddressesToFile(wallet *Wallet, count uint64, format string) ([]*Address, string, error) {
+	if format != AddressExportCSV && format != AddressExportJSON {
+		return nil, "", fmt.Errorf("address export format [%s] is not supported", format)
+	}
+	addrs, err := this.CreateAddresses(wallet, count)
+	if err != nil {
+		return nil, "", err
+	}
+	filename := fmt.Sprintf("address-%s-%s.%s", wallet.FileName(), common.TimeFormat(TIME_POSTFIX), format)
+	filePath := filepath.Join(this.GetConfig().AddressDir, filename)
+	err = this.exportAddressToFile(addrs, filePath)
+	if err != nil {
+		this.Log.Errorf("export address to file [%s] failed, err=%v", filePath, err)
+		return addrs, "", err
+	}
+	return addrs, filePath, nil
+}
+
+//GetDepositAddress 从充值地址池中分配一个未使用的地址，地址池为空时先生成
+func (this *WalletManager) GetDepositAddress(wallet *Wallet) (*Address, error) {
+	this.addressLocker.Lock()
+	defer this.addressLocker.Unlock()
+
+	pool, err := this.listDepositAddressPool(wallet)
+	if err != nil {
+		return nil, err
+	}
+	if len(pool) == 0 {
+		pool, err = this.deriveAddresses(wallet, 1, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addr := pool[0]
+	addr.Pooled = false
+	addr.AssignedAt = time.Now()
+	err = wallet.SaveAddress(this.GetConfig().DbPath, addr)
+	if err != nil {
+		this.Log.Errorf("save deposit address [%s] failed, err=%v", addr.Address, err)
+		return nil, err
+	}
+
+	//补充地址池，失败时不影响已分配的地址
+	_, err = this.fillDepositAddressPool(wallet)
+	if err != nil {
+		this.Log.Warningf("fill deposit address pool of wallet [%s] failed, err=%v", wallet.WalletID, err)
+	}
+	return addr, nil
+}
+
+//FillDepositAddressPool 把充值地址池补充到DepositAddressPoolSize，返回新生成的地址数
+func (this *WalletManager) FillDepositAddressPool(wallet *Wallet) (int, error) {
+	this.addressLocker.Lock()
+	defer this.addressLocker.Unlock()
+	return this.fillDepositAddressPool(wallet)
+}
+
+//ListDepositAddressPool 充值地址池中未分配的地址，按索引排序
+func (this *WalletManager) ListDepositAddressPool(wallet *Wallet) ([]*Address, error) {
+	this.addressLocker.Lock()
+	defer this.addressLocker.Unlock()
+	return this.listDepositAddressPool(wallet)
+}
+
+//GetAddresses 钱包数据库中的所有地址，按索引排序
+func (this *WalletManager) GetAddresses(wallet *Wallet) ([]*Address, error) {
+	db, err := wallet.OpenDB(this.GetConfig().DbPath)
+	if err != nil {
+		this.Log.Errorf("open db of wallet [%s] failed, err=%v", wallet.WalletID, err)
+		return nil, err
+	}
+	defer db.Close()
+
+	var addrs []*Address
+	err = db.All(&addrs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Index < addrs[j].Index })
+	return addrs, nil
+}
+
+func (this *WalletManager) fillDepositAddressPool(wallet *Wallet) (int, error) {
+	pool, err := this.listDepositAddressPool(wallet)
+	if err != nil {
+		return 0, err
+	}
+	size := this.GetConfig().DepositAddressPoolSize
+	if uint64(len(pool)) >= size {
+		return 0, nil
+	}
+	addrs, err := this.deriveAddresses(wallet, size-uint64(len(pool)), true)
+	return len(addrs), err
+}
+
+func (this *WalletManager) listDepositAddressPool(wallet *Wallet) ([]*Address, error) {
+	db, err := wallet.OpenDB(this.GetConfig().DbPath)
+	if err != nil {
+		this.Log.Errorf("open db of wallet [%s] failed, err=%v", wallet.WalletID, err)
+		return nil, err
+	}
+	defer db.Close()
+
+	var pool []*Address
+	err = db.Find("Pooled", true, &pool)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	sort.Slice(pool, func(i, j int) bool { return pool[i].Index < pool[j].Index })
+	return pool, nil
+}
+
+//deriveAddresses 派生并保存地址，更新钱包的AddressCount，调用方需持有addressLocker。
+//每ADDRESS_SAVE_BATCH_SIZE个地址与AddressCount在同一个事务中提交，中途失败时已提交的地址不会被重复派生
+func (this *WalletManager) deriveAddresses(wallet *Wallet, count uint64, pooled bool) ([]*Address, error) {
+	if count == 0 || count > MAX_CREATE_ADDRESS_COUNT {
+		return nil, fmt.Errorf("address count must be between 1 and %d", MAX_CREATE_ADDRESS_COUNT)
+	}
+	if len(wallet.PublicKey) == 0 || len(wallet.HdPath) == 0 {
+		return nil, errors.New("wallet public key or hd path is empty")
+	}
+	parent, err := owkeychain.OWDecode(wallet.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode wallet public key failed, err=%v", err)
+	}
+
+	db, err := wallet.OpenDB(this.GetConfig().DbPath)
+	if err != nil {
+		this.Log.Errorf("open db of wallet [%s] failed, err=%v", wallet.WalletID, err)
+		return nil, err
+	}
+	defer db.Close()
+
+	start, err := walletAddressCount(db, wallet)
+	if err != nil {
+		return nil, err
+	}
+	if start+count > 1<<31 {
+		return nil, errors.New("wallet address index exhausted")
+	}
+
+	addrs := make([]*Address, 0, count)
+	for from := start; from < start+count; from += ADDRESS_SAVE_BATCH_SIZE {
+		to := from + ADDRESS_SAVE_BATCH_SIZE
+		if to > start+count {
+			to = start + count
+		}
+		batch, err := this.deriveAddressBatch(parent, wallet, from, to, pooled)
+		if err != nil {
+			return addrs, err
+		}
+		err = saveAddressBatch(db, wallet, batch, to)
+		if err != nil {
+			this.Log.Errorf("save addresses [%d, %d) of wallet [%s] failed, err=%v", from, to, wallet.WalletID, err)
+			return addrs, err
+		}
+		addrs = append(addrs, batch...)
+	}
+	return addrs, nil
+}
+
+//deriveAddressBatch 派生索引[from, to)的地址
+func (this *WalletManager) deriveAddressBatch(parent *owkeychain.ExtendedKey, wallet *Wallet, from, to uint64, pooled bool) ([]*Address, error) {
+	isTestNet := this.GetConfig().IsTestNet
+	batch := make([]*Address, 0, to-from)
+	for index := from; index < to; index++ {
+		child, err := parent.GenPublicChild(uint32(index))
+		if err != nil {
+			return nil, fmt.Errorf("derive address [%d] failed, err=%v", index, err)
+		}
+		pub := child.GetPublicKeyBytes()
+		address, err := this.Decoder.PublicKeyToAddress(pub, isTestNet)
+		if err != nil {
+			return nil, fmt.Errorf("encode address [%d] failed, err=%v", index, err)
+		}
+		addr := &Address{
+			Address:   address,
+			Account:   wallet.WalletID,
+			HDPath:    fmt.Sprintf("%s/%d", wallet.HdPath, index),
+			Index:     int(index),
+			PublicKey: hex.EncodeToString(pub),
+			CreatedAt: time.Now(),
+			Pooled:    pooled,
+		}
+		if !pooled {
+			addr.AssignedAt = addr.CreatedAt
+		}
+		batch = append(batch, addr)
+	}
+	return batch, nil
+}
+
+//saveAddressBatch 在一个事务中保存地址和新的AddressCount
+func saveAddressBatch(db *storm.DB, wallet *Wallet, batch []*Address, count uint64) error {
+	dbTx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	for _, addr := range batch {
+		err = dbTx.Save(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := *wallet
+	err = dbTx.One("WalletID", wallet.WalletID, &w)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	w.AddressCount = count
+	err = dbTx.Save(&w)
+	if err != nil {
+		return err
+	}
+	err = dbTx.Commit()
+	if err != nil {
+		return err
+	}
+	wallet.AddressCount = count
+	return nil
+}
+
+//walletAddressCount 已派生的地址数，以钱包数据库中的记录为准
+func walletAddressCount(db *storm.DB, wallet *Wallet) (uint64, error) {
+	var w Wallet
+	err := db.One("WalletID", wallet.WalletID, &w)
+	if err == storm.ErrNotFound {
+		return wallet.AddressCount, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if w.AddressCount > wallet.AddressCount {
+		return w.AddressCount, nil
+	}
+	return wallet.AddressCount, nil
+}
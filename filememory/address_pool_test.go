@@ -0,0 +1,183 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//testCreateWallet 在临时数据目录中创建钱包
+func testCreateWallet(t *testing.T, wm *WalletManager) *Wallet {
+	wallet, _, err := wm.CreateWallet("pool", "password")
+	if err != nil {
+		t.Fatalf("CreateWallet failed, err=%v", err)
+	}
+	return wallet
+}
+
+func TestWalletManager_CreateAddresses(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wallet := testCreateWallet(t, wm)
+
+	addrs, err := wm.CreateAddresses(wallet, 3)
+	if err != nil || len(addrs) != 3 {
+		t.Fatalf("CreateAddresses = %d, err=%v", len(addrs), err)
+	}
+
+	//地址与私钥派生的结果一致
+	key, err := wallet.HDKey2("password")
+	if err != nil {
+		t.Fatalf("HDKey2 failed, err=%v", err)
+	}
+	for i, addr := range addrs {
+		if addr.Index != i || addr.HDPath != fmt.Sprintf("%s/%d", wallet.HdPath, i) || addr.Pooled {
+			t.Errorf("address %d = %+v", i, addr)
+		}
+		priv, err := addr.CalcPrivKey(key)
+		if err != nil {
+			t.Fatalf("CalcPrivKey failed, err=%v", err)
+		}
+		if a, err := PrivateKeyToAddress(priv); err != nil || a.String() != addr.Address {
+			t.Errorf("address %d = %s, private key gives %s", i, addr.Address, a)
+		}
+	}
+
+	//索引保存在钱包数据库中，重新加载的钱包从下一个索引继续
+	reloaded := *wallet
+	reloaded.AddressCount = 0
+	more, err := wm.CreateAddresses(&reloaded, 2)
+	if err != nil || more[0].Index != 3 || more[1].Index != 4 {
+		t.Fatalf("CreateAddresses again = %+v, err=%v", more, err)
+	}
+	saved, err := wm.GetAddresses(wallet)
+	if err != nil || len(saved) != 5 || saved[4].Address != more[1].Address {
+		t.Errorf("saved addresses = %d, err=%v", len(saved), err)
+	}
+
+	if _, err := wm.CreateAddresses(wallet, 0); err == nil {
+		t.Errorf("create 0 addresses should fail")
+	}
+}
+
+func TestWalletManager_CreateAddresses_Batches(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wallet := testCreateWallet(t, wm)
+
+	//跨越多个事务批次
+	count := uint64(ADDRESS_SAVE_BATCH_SIZE + 5)
+	addrs, err := wm.CreateAddresses(wallet, count)
+	if err != nil || uint64(len(addrs)) != count || wallet.AddressCount != count {
+		t.Fatalf("CreateAddresses = %d, AddressCount = %d, err=%v", len(addrs), wallet.AddressCount, err)
+	}
+	saved, err := wm.GetAddresses(wallet)
+	if err != nil || uint64(len(saved)) != count || saved[count-1].Address != addrs[count-1].Address {
+		t.Errorf("saved addresses = %d, err=%v", len(saved), err)
+	}
+}
+
+func TestWalletManager_CreateAddressesToFile(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wallet := testCreateWallet(t, wm)
+
+	addrs, csvFile, err := wm.CreateAddressesToFile(wallet, 2, AddressExportCSV)
+	if err != nil {
+		t.Fatalf("CreateAddressesToFile csv failed, err=%v", err)
+	}
+	content, _ := ioutil.ReadFile(csvFile)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 || lines[0] != "address,index,hdpath,publickey" ||
+		lines[2] != fmt.Sprintf("%s,1,%s,%s", addrs[1].Address, addrs[1].HDPath, addrs[1].PublicKey) {
+		t.Errorf("csv content = %s", content)
+	}
+
+	addrs, jsonFile, err := wm.CreateAddressesToFile(wallet, 2, AddressExportJSON)
+	if err != nil {
+		t.Fatalf("CreateAddressesToFile json failed, err=%v", err)
+	}
+	content, _ = ioutil.ReadFile(jsonFile)
+	var exported []struct {
+		Address string `json:"address"`
+		Index   int    `json:"index"`
+		HDPath  string `json:"hdpath"`
+	}
+	if err := json.Unmarshal(content, &exported); err != nil || len(exported) != 2 {
+		t.Fatalf("json content = %s, err=%v", content, err)
+	}
+	if exported[0].Address != addrs[0].Address || exported[0].Index != 2 || exported[1].HDPath != addrs[1].HDPath {
+		t.Errorf("exported = %+v", exported)
+	}
+
+	if _, _, err := wm.CreateAddressesToFile(wallet, 1, "xml"); err == nil {
+		t.Errorf("unsupported format should fail")
+	}
+}
+
+func TestWalletManager_DepositAddressPool(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wm.Config.DepositAddressPoolSize = 3
+	wallet := testCreateWallet(t, wm)
+
+	if n, err := wm.FillDepositAddressPool(wallet); err != nil || n != 3 {
+		t.Fatalf("FillDepositAddressPool = %d, err=%v", n, err)
+	}
+	if n, err := wm.FillDepositAddressPool(wallet); err != nil || n != 0 {
+		t.Errorf("fill a full pool = %d, err=%v", n, err)
+	}
+
+	//按索引分配，分配后补充地址池
+	for i := 0; i < 2; i++ {
+		addr, err := wm.GetDepositAddress(wallet)
+		if err != nil {
+			t.Fatalf("GetDepositAddress failed, err=%v", err)
+		}
+		if addr.Index != i || addr.Pooled || addr.AssignedAt.IsZero() {
+			t.Errorf("deposit address %d = %+v", i, addr)
+		}
+	}
+	pool, err := wm.ListDepositAddressPool(wallet)
+	if err != nil || len(pool) != 3 || pool[0].Index != 2 || pool[2].Index != 4 {
+		t.Errorf("pool = %+v, err=%v", pool, err)
+	}
+
+	//批量生成的地址不进入地址池
+	if _, err := wm.CreateAddresses(wallet, 1); err != nil {
+		t.Fatalf("CreateAddresses failed, err=%v", err)
+	}
+	if pool, _ := wm.ListDepositAddressPool(wallet); len(pool) != 3 {
+		t.Errorf("pool size = %d, want 3", len(pool))
+	}
+
+	//不预先生成时按需生成
+	wm.Config.DepositAddressPoolSize = 0
+	for range pool {
+		if _, err := wm.GetDepositAddress(wallet); err != nil {
+			t.Fatalf("GetDepositAddress failed, err=%v", err)
+		}
+	}
+	addr, err := wm.GetDepositAddress(wallet)
+	if err != nil || addr.Index != 6 {
+		t.Errorf("deposit address from empty pool = %+v, err=%v", addr, err)
+	}
+}
@@ -15,31 +15,36 @@
 package filememory
 
 import (
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/blocktree/go-owcrypt"
 
 	//"log"
 	"math/big"
-	"sort"
 	"strconv"
 	"strings"
 
 	"time"
 
-	tool "github.com/blocktree/openwallet/common"
 	"github.com/blocktree/openwallet/log"
 	"github.com/blocktree/openwallet/openwallet"
 
-	"github.com/imroc/req"
 	"github.com/tidwall/gjson"
 )
 
 type Client struct {
-	BaseURL string
-	Debug   bool
+	BaseURL   string
+	Debug     bool
+	Transport Transport    //节点通讯实现，为空时使用DefaultTransport
+	Retry     *RetryPolicy //超时和重试策略，为空时只请求一次
+	Pool      *NodePool    //多节点池，为空时只使用BaseURL
+	Auth      *GatewayAuth //网关认证，为空时使用内置密钥
+	//多节点时发往某个节点前的检查，未通过时跳过该节点
+	endpointCheck func(url string) error
+	//广播交易的回调地址，为空时不传
+	NotifyURL string
+	//申请手续费的回调地址，为空时不传
+	FeeNotifyURL string
 }
 
 type Response struct {
@@ -75,49 +80,28 @@ func (this *FMBlock) Init() error {
 
 type TxpoolContent struct {
 	Pending map[string]map[string]BlockTransaction `json:"pending"`
+	Queued  map[string]map[string]BlockTransaction `json:"queued"` //nonce不连续、等待前面的nonce的交易
 }
 
-func (this *TxpoolContent) GetSequentTxNonce(addr string) (uint64, uint64, uint64, error) {
-	txpool := this.Pending
-	var target map[string]BlockTransaction
-	for theAddr, _ := range txpool {
-		//log.Debugf("theAddr:%v, addr:%v", strings.ToLower(theAddr), strings.ToLower(addr))
-		if strings.ToLower(theAddr) == strings.ToLower(addr) {
-			target = txpool[theAddr]
-		}
-	}
-
-	nonceList := make([]interface{}, 0)
-	for n, _ := range target {
-		tn, err := strconv.ParseUint(n, 10, 64)
-		if err != nil {
-			log.Error("parse nonce[", n, "] in txpool to uint faile, err=", err)
-			return 0, 0, 0, err
-		}
-		nonceList = append(nonceList, tn)
-	}
-
-	sort.Slice(nonceList, func(i, j int) bool {
-		if nonceList[i].(uint64) < nonceList[j].(uint64) {
-			return true
-		}
-		return false
-	})
-
-	var min, max, count uint64
-	for i := 0; i < len(nonceList); i++ {
-		if i == 0 {
-			min = nonceList[i].(uint64)
-			max = min
-			count++
-		} else if nonceList[i].(uint64) != max+1 {
-			break
-		} else {
-			max++
-			count++
+//TxNonces 交易池中地址的nonce，包括pending和queued的交易
+func (this *TxpoolContent) TxNonces(addr string) (map[uint64]bool, error) {
+	key := indexAddressKey(addr)
+	nonces := make(map[uint64]bool)
+	for _, txpool := range []map[string]map[string]BlockTransaction{this.Pending, this.Queued} {
+		for from, txs := range txpool {
+			if indexAddressKey(from) != key {
+				continue
+			}
+			for n := range txs {
+				nonce, err := strconv.ParseUint(n, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("parse nonce[%s] in txpool failed, err=%v", n, err)
+				}
+				nonces[nonce] = true
+			}
 		}
 	}
-	return min, max, count, nil
+	return nonces, nil
 }
 
 func (this *TxpoolContent) GetPendingTxCountForAddr(addr string) int {
@@ -132,11 +116,8 @@ func (this *TxpoolContent) GetPendingTxCountForAddr(addr string) int {
 }
 
 func (this *Client) fmGetTransactionCount(addr string) (uint64, error) {
-	callTime := time.Now().Unix()
 	params := make(map[string]interface{})
 	params["address"] = AppendFmToAddress(addr)
-	params["time"] = fmt.Sprintf("%d", callTime)
-	params["token"] = GenToken(callTime)
 
 	result, err := this.FMCall("getnonce", params)
 	if err != nil {
@@ -196,6 +177,12 @@ func (this *Client) EthGetTransactionReceipt(transactionId string) (*EthTransact
 		return nil, err
 	}
 
+	if result.Type == gjson.Null {
+		e := NewGatewayError("eth_getTransactionReceipt", 0, fmt.Sprintf("tx[%v] receipt not found", transactionId), result.Raw)
+		e.Kind = ErrUnknownTx
+		return nil, e
+	}
+
 	if result.Type != gjson.JSON {
 		errInfo := fmt.Sprintf("get tx[%v] receipt result type failed, result type is %v", transactionId, result.Type)
 		log.Errorf(errInfo)
@@ -260,6 +247,12 @@ func (this *Client) EthGetTransactionByHash(txid string) (*BlockTransaction, err
 		return nil, err
 	}
 
+	if result.Type == gjson.Null {
+		e := NewGatewayError("eth_getTransactionByHash", 0, fmt.Sprintf("transaction[%v] not found", txid), result.Raw)
+		e.Kind = ErrUnknownTx
+		return nil, e
+	}
+
 	if result.Type != gjson.JSON {
 		errInfo := fmt.Sprintf("get transaction[%v] result type failed, result type is %v", AppendFmToAddress(txid), result.Type)
 		log.Errorf(errInfo)
@@ -275,12 +268,34 @@ func (this *Client) EthGetTransactionByHash(txid string) (*BlockTransaction, err
 	return &tx, nil
 }
 
+//EthGetTransactionGasPrice 获取交易的gasPrice
+func (this *Client) EthGetTransactionGasPrice(txid string) (string, error) {
+	params := []interface{}{
+		AppendFmToAddress(txid),
+	}
+
+	result, err := this.Call("eth_getTransactionByHash", 1, params)
+	if err != nil {
+		log.Errorf("get transaction[%v] failed, err = %v \n", AppendFmToAddress(txid), err)
+		return "", err
+	}
+
+	if result.Type == gjson.Null {
+		e := NewGatewayError("eth_getTransactionByHash", 0, fmt.Sprintf("transaction[%v] not found", txid), result.Raw)
+		e.Kind = ErrUnknownTx
+		return "", e
+	}
+
+	gasPrice := result.Get("gasPrice").String()
+	if len(gasPrice) == 0 {
+		return "", fmt.Errorf("transaction[%v] has no gas price", txid)
+	}
+	return gasPrice, nil
+}
+
 func (this *Client) fmGetBlockSpecByBlockNum2(blockNum uint64, showTransactionSpec bool) (*FMBlock, error) {
-	callTime := time.Now().Unix()
 	params := make(map[string]interface{})
 	params["number"] = blockNum
-	params["time"] = fmt.Sprintf("%d", callTime)
-	params["token"] = GenToken(callTime)
 	var fmBlock FMBlock
 
 	result, err := this.FMCall("blocktxs", params)
@@ -363,15 +378,20 @@ func makeTransactionData(methodId string, params []SolidityParam) (string, error
 	for i, _ := range params {
 		var param string
 		if params[i].ParamType == SOLIDITY_TYPE_ADDRESS {
-			param = strings.ToLower(params[i].ParamValue.(string))
-			if strings.Index(param, "fm") != -1 {
-				param = tool.Substr(param, 2, len(param))
+			var address FMAddress
+			switch value := params[i].ParamValue.(type) {
+			case FMAddress:
+				address = value
+			case string:
+				a, err := ParseFMAddress(value)
+				if err != nil {
+					return "", fmt.Errorf("address param [%s] error: %v", value, err)
+				}
+				address = a
+			default:
+				return "", ErrInvalidAddress
 			}
-
-			if len(param) != 40 {
-				return "", errors.New("length of address error.")
-			}
-			param = makeRepeatString("0", 24) + param
+			param = makeRepeatString("0", 24) + address.Hex()
 		} else if params[i].ParamType == SOLIDITY_TYPE_UINT256 {
 			intParam := params[i].ParamValue.(*big.Int)
 			param = intParam.Text(16)
@@ -438,13 +458,30 @@ func (this *Client) ERC20GetAddressBalance(address string, contractAddr string)
 	return this.ERC20GetAddressBalance2(address, contractAddr, "pending")
 }
 
+//EthCall 调用合约的只读方法，返回十六进制的返回数据
+func (this *Client) EthCall(contractAddr string, data string) (string, error) {
+	trans := map[string]interface{}{
+		"to":   "0x" + strings.TrimPrefix(contractAddr, "0x"),
+		"data": data,
+	}
+	params := []interface{}{
+		trans,
+		"latest",
+	}
+	result, err := this.Call("eth_call", 1, params)
+	if err != nil {
+		return "", err
+	}
+	if result.Type != gjson.String {
+		return "", fmt.Errorf("call contract[%v] result type error, result type is %v", contractAddr, result.Type)
+	}
+	return result.String(), nil
+}
+
 func (this *Client) GetAddrBalance2(address string, sign string) (*big.Int, error) {
 
 	params := make(map[string]interface{})
-	callTime := time.Now().Unix()
 	params["address"] = AppendFmToAddress(address)
-	params["time"] = fmt.Sprintf("%d", callTime)
-	params["token"] = GenToken(callTime)
 
 	result, err := this.FMCall("balance", params)
 	if err != nil {
@@ -467,21 +504,33 @@ func (this *Client) GetAddrBalance2(address string, sign string) (*big.Int, erro
 	return balance, nil
 }
 
+//AppendOxToAddress 地址转为节点eth_*接口的0x格式
 func AppendOxToAddress(addr string) string {
+	if a, err := ParseFMAddress(addr); err == nil {
+		return a.RPC()
+	}
 	if strings.Index(addr, "0x") == -1 {
 		return "0x" + addr
 	}
 	return addr
 }
 
+//AppendFmToAddress 地址转为网关的FM格式，不是地址时加上FM前缀
 func AppendFmToAddress(addr string) string {
+	if a, err := ParseFMAddress(addr); err == nil {
+		return a.Gateway()
+	}
 	if strings.Index(addr, "FM") == -1 {
 		return "FM" + addr
 	}
 	return addr
 }
 
+//ReplaceFmToAddress 0x格式或无前缀的地址转为规范的FM格式
 func ReplaceFmToAddress(addr string) string {
+	if a, err := ParseFMAddress(addr); err == nil {
+		return a.String()
+	}
 	if len(addr) == 42 {
 		return "FM" + addr[2:]
 	}
@@ -543,8 +592,8 @@ func makeERC20TokenTransData(contractAddr string, toAddr string, amount *big.Int
 
 func makeGasEstimatePara(fromAddr string, toAddr string, value *big.Int, data string) map[string]interface{} {
 	paraMap := make(map[string]interface{})
-	paraMap["from"] = AppendOxToAddress(fromAddr)
-	paraMap["to"] = AppendOxToAddress(toAddr)
+	paraMap["from"] = "0x" + indexAddressKey(fromAddr)
+	paraMap["to"] = "0x" + indexAddressKey(toAddr)
 	if data != "" {
 		paraMap["data"] = data
 	}
@@ -619,7 +668,7 @@ func (this *Client) ethGetGasEstimated(paraMap map[string]interface{}) (*big.Int
 		return big.NewInt(0), errors.New(errInfo)
 	}
 
-	gasLimit, err := ConvertToBigInt("500000", 10)
+	gasLimit, err := ConvertToBigInt(result.String(), 16)
 	if err != nil {
 		errInfo := fmt.Sprintf("convert estimated gas[%v] format to bigint failed, err = %v\n", result.String(), err)
 		log.Errorf(errInfo)
@@ -689,12 +738,11 @@ func (this *WalletManager) FmSendRawTransaction(signedTx string) (string, error)
 }
 
 func (this *Client) fmSendRawTransaction(signedTx string) (string, error) {
-	callTime := time.Now().Unix()
 	params := make(map[string]interface{})
 	params["signed"] = signedTx
-	params["notify"] = "https://exx.com/transfer/notify"
-	params["time"] = fmt.Sprintf("%d", callTime)
-	params["token"] = GenToken(callTime)
+	if len(this.NotifyURL) > 0 {
+		params["notify"] = this.NotifyURL
+	}
 
 	result, err := this.FMCall("pushtx", params)
 	if err != nil {
@@ -702,9 +750,11 @@ func (this *Client) fmSendRawTransaction(signedTx string) (string, error) {
 		return "", err
 	}
 	hash := result.Get("hash")
-	if hash.Type != gjson.String {
+	if hash.Type != gjson.String || len(hash.String()) == 0 {
 		log.Errorf("sendRawTransaction result type error")
-		return "", errors.New("sendRawTransaction result type error")
+		e := NewGatewayError("pushtx", 10000, "sendRawTransaction result type error", result.Raw)
+		e.Kind = ErrEmptyResponse
+		return "", e
 	}
 	return hash.String(), nil
 }
@@ -790,10 +840,7 @@ func (this *Client) ethGetAccounts() ([]string, error) {
 }
 
 func (this *Client) FmGetBlockNumber() (uint64, error) {
-	callTime := time.Now().Unix()
 	param := make(map[string]interface{})
-	param["time"] = fmt.Sprintf("%d", callTime)
-	param["token"] = GenToken(callTime)
 	result, err := this.FMCall("blocknumber", param)
 	if err != nil {
 		log.Errorf("get block number faield, err = %v \n", err)
@@ -815,18 +862,17 @@ func (this *Client) FmGetBlockNumber() (uint64, error) {
 }
 
 func (this *Client) FmGetFee(addr string) error {
-	callTime := time.Now().Unix()
 	params := make(map[string]interface{})
 	params["address"] = addr
-	params["notify"] = "exx.com"
-	params["time"] = fmt.Sprintf("%d", callTime)
-	params["token"] = GenToken(callTime)
+	if len(this.FeeNotifyURL) > 0 {
+		params["notify"] = this.FeeNotifyURL
+	}
 	result, err := this.FMCall("getfee", params)
 	if err != nil {
 		log.Errorf("get fee failed, err = %v \n", err)
 		return err
 	}
-	if err = isSuccess(result); err != nil {
+	if err = isSuccess("getfee", result); err != nil {
 		return err
 	}
 
@@ -835,7 +881,7 @@ func (this *Client) FmGetFee(addr string) error {
 }
 
 func (c *Client) Call(method string, id int64, params []interface{}) (*gjson.Result, error) {
-	authHeader := req.Header{
+	authHeader := map[string]string{
 		"Accept":       "application/json",
 		"Content-Type": "application/json",
 	}
@@ -845,102 +891,186 @@ func (c *Client) Call(method string, id int64, params []interface{}) (*gjson.Res
 	body["method"] = method
 	body["params"] = params
 
-	if c.Debug {
-		log.Debug("Start Request API...")
-	}
-
-	r, err := req.Post(c.BaseURL, req.BodyJSON(&body), authHeader)
-
-	if c.Debug {
-		log.Debug("Request API Completed")
+	var result gjson.Result
+	err := c.retryPolicy().do(method, func(timeout time.Duration) *callError {
+		return c.failover(func(baseURL string) *callError {
+			resp, cerr := c.post(baseURL, authHeader, &body, timeout)
+			if cerr != nil {
+				return cerr
+			}
+			if cerr = c.checkResponse(method, resp, isRPCError); cerr != nil {
+				return cerr
+			}
+			result = resp.Get("result")
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if c.Debug {
-		log.Debugf("%+v\n", r)
-	}
+	return &result, nil
+}
 
-	if err != nil {
-		return nil, err
+//isSuccess 网关应答成功时data不能为空
+func isSuccess(method string, result *gjson.Result) error {
+	if result.Type == gjson.Null {
+		e := NewGatewayError(method, 10000, "Response data is empty! ", result.Raw)
+		e.Kind = ErrEmptyResponse
+		return e
 	}
+	return nil
+}
 
-	resp := gjson.ParseBytes(r.Bytes())
-	err = isError(&resp)
+func (c *Client) FMCall(method string, body map[string]interface{}) (*gjson.Result, error) {
+	var result gjson.Result
+	err := c.retryPolicy().do(method, func(timeout time.Duration) *callError {
+		return c.failover(func(baseURL string) *callError {
+			resp, cerr := c.gatewayPost(baseURL+method, method, body, timeout)
+			if cerr != nil {
+				return cerr
+			}
+			result = resp.Get("data")
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result := resp.Get("result")
-
 	return &result, nil
 }
 
-func isSuccess(result *gjson.Result) error {
-	if result.Get("hash").Exists() {
-		return nil
-	}
-	return nil
-}
+//gatewayPost 带认证信息请求网关，当前密钥认证失败时换用备用密钥再请求一次
+func (c *Client) gatewayPost(url, method string, body map[string]interface{}, timeout time.Duration) (*gjson.Result, *callError) {
+	auth := c.auth()
+	for i := 0; ; i++ {
+		authHeader := map[string]string{
+			"Content-Type": "application/json",
+		}
+		key := auth.sign(authHeader, body)
 
-func (c *Client) FMCall(method string, body map[string]interface{}) (*gjson.Result, error) {
-	authHeader := req.Header{
-		"Content-Type": "application/json",
+		resp, cerr := c.post(url, authHeader, &body, timeout)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if cerr = c.checkResponse(method, resp, isError); cerr != nil {
+			if i == 0 && IsGatewayError(cerr.err, ErrAuth) && auth.failover(key) {
+				continue
+			}
+			return nil, cerr
+		}
+		return resp, nil
 	}
+}
 
+//post 发送一次请求，通讯错误和无法解析的应答都可以重试
+func (c *Client) post(url string, header map[string]string, body interface{}, timeout time.Duration) (*gjson.Result, *callError) {
 	if c.Debug {
 		log.Debug("Start Request API...")
 	}
 
-	r, err := req.Post(c.BaseURL+method, req.BodyJSON(&body), authHeader)
+	r, err := c.transport().Post(url, header, body, timeout)
 
 	if c.Debug {
 		log.Debug("Request API Completed")
 	}
 
 	if c.Debug {
-		log.Debugf("%+v\n", r)
+		log.Debugf("%s\n", r)
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, &callError{err: err, retryable: true}
 	}
 
-	resp := gjson.ParseBytes(r.Bytes())
-	err = isError(&resp)
-	if err != nil {
-		return nil, err
+	if !gjson.ValidBytes(r) {
+		return nil, &callError{err: fmt.Errorf("invalid response: %s", r), retryable: true}
 	}
 
-	result := resp.Get("data")
+	resp := gjson.ParseBytes(r)
+	return &resp, nil
+}
 
-	return &result, nil
+//checkResponse 检查应答是否报错，按错误码和错误分类判断能否重试
+func (c *Client) checkResponse(method string, resp *gjson.Result, check func(method string, result *gjson.Result) error) *callError {
+	err := check(method, resp)
+	if err == nil {
+		return nil
+	}
+	retryable := false
+	if e, ok := err.(*GatewayError); ok {
+		retryable = e.Kind == ErrRateLimited || c.retryPolicy().isRetryableCode(e.Code)
+	}
+	return &callError{err: err, retryable: retryable}
+}
+
+//transport 获取节点通讯实现
+func (c *Client) transport() Transport {
+	if c.Transport == nil {
+		return DefaultTransport
+	}
+	return c.Transport
+}
+
+//auth 获取网关认证
+func (c *Client) auth() *GatewayAuth {
+	if c.Auth == nil {
+		return defaultGatewayAuth
+	}
+	return c.Auth
+}
+
+//retryPolicy 获取超时和重试策略
+func (c *Client) retryPolicy() *RetryPolicy {
+	if c.Retry == nil {
+		return noRetryPolicy
+	}
+	return c.Retry
 }
 
 //isError 是否报错
-func isError(result *gjson.Result) error {
-	var (
-		err error
-	)
+func isError(method string, result *gjson.Result) error {
 
 	if result.Get("code").String() == "10000" {
 
 		if !result.Get("data").Exists() {
-			return errors.New("Response is empty! ")
+			e := NewGatewayError(method, 10000, "Response is empty! ", result.Raw)
+			e.Kind = ErrEmptyResponse
+			return e
 		}
 
 		return nil
 	}
 
-	errInfo := fmt.Sprintf("[%d]%s",
+	return NewGatewayError(method,
 		result.Get("code").Int(),
-		result.Get("msg").String())
-	err = errors.New(errInfo)
+		result.Get("msg").String(),
+		result.Raw)
+}
+
+//isRPCError JSON-RPC应答是否报错
+func isRPCError(method string, result *gjson.Result) error {
+
+	if rpcErr := result.Get("error"); rpcErr.Exists() && rpcErr.Type != gjson.Null {
+		return NewGatewayError(method,
+			rpcErr.Get("code").Int(),
+			rpcErr.Get("message").String(),
+			result.Raw)
+	}
 
-	return err
+	//经网关转发的应答带有code字段
+	if code := result.Get("code"); code.Exists() && code.String() != "10000" {
+		return NewGatewayError(method,
+			code.Int(),
+			result.Get("msg").String(),
+			result.Raw)
+	}
+
+	return nil
 }
 
-// 获取接口 Token
+// 获取接口 Token，使用内置密钥
 func GenToken(time int64) string {
-	key := []byte(TOKEN_KEY)
-	timeByte := []byte(fmt.Sprintf("%d", time))
-	return hex.EncodeToString(owcrypt.Hmac(key, timeByte, owcrypt.HMAC_SHA256_ALG))
+	return defaultGatewayAuth.Token(TOKEN_KEY, time)
 }
@@ -9,6 +9,15 @@ func (this *WalletManager) GetAddressDecode() openwallet.AddressDecoder {
 	return this.Decoder
 }
 
+//GetAddressDecoderV2 地址解析器，支持地址校验
+func (this *WalletManager) GetAddressDecoderV2() openwallet.AddressDecoderV2 {
+	decoder, ok := this.Decoder.(openwallet.AddressDecoderV2)
+	if !ok {
+		return nil
+	}
+	return decoder
+}
+
 //GetTransactionDecoder 交易单解析器
 func (this *WalletManager) GetTransactionDecoder() openwallet.TransactionDecoder {
 	return this.TxDecoder
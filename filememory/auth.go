@@ -0,0 +1,161 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/log"
+)
+
+const (
+	//AuthSchemeHMAC 请求参数带time和token，token为密钥对time的HMAC
+	AuthSchemeHMAC = "hmac"
+	//AuthSchemeBearer 请求头带Authorization: Bearer <密钥>
+	AuthSchemeBearer = "bearer"
+)
+
+//tokenAlgorithms 支持的token算法
+var tokenAlgorithms = map[string]uint32{
+	"hmac-sha256": owcrypt.HMAC_SHA256_ALG,
+	"hmac-sha512": owcrypt.HMAC_SHA512_ALG,
+	"hmac-sm3":    owcrypt.HMAC_SM3_ALG,
+}
+
+//GatewayAuth 网关认证，支持两把密钥轮换：当前密钥认证失败时切换到备用密钥
+type GatewayAuth struct {
+	mu        sync.RWMutex
+	keys      []string
+	active    int
+	Scheme    string //认证方式，hmac或bearer
+	Algorithm string //hmac方式的token算法
+}
+
+//NewGatewayAuth 创建网关认证，keys第一个为当前密钥，之后为备用密钥
+func NewGatewayAuth(scheme, algorithm string, keys ...string) (*GatewayAuth, error) {
+	scheme = strings.ToLower(scheme)
+	if scheme != AuthSchemeHMAC && scheme != AuthSchemeBearer {
+		return nil, fmt.Errorf("unsupported gateway auth scheme: %s", scheme)
+	}
+	algorithm = strings.ToLower(algorithm)
+	if _, exist := tokenAlgorithms[algorithm]; !exist {
+		return nil, fmt.Errorf("unsupported gateway token algorithm: %s", algorithm)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("gateway auth key is empty")
+	}
+	auth := GatewayAuth{
+		keys:      keys,
+		Scheme:    scheme,
+		Algorithm: algorithm,
+	}
+	return &auth, nil
+}
+
+//LoadGatewayAuth 从资产配置读取网关认证
+//
+//	GatewayAuthScheme = hmac          认证方式，hmac或bearer
+//	GatewayTokenAlgorithm = hmac-sha256   hmac方式的token算法，支持hmac-sha256、hmac-sha512、hmac-sm3
+//	GatewayTokenKey = key1            当前密钥
+//	GatewayTokenKeyNext = key2        轮换用的备用密钥
+//	GatewayBuiltinKey = false         未配置GatewayTokenKey时是否使用内置的TOKEN_KEY，默认false
+//
+//内置密钥随源码公开，只用于兼容旧网关，未配置GatewayTokenKey且没有开启GatewayBuiltinKey时加载失败
+func LoadGatewayAuth(c config.Configer) (*GatewayAuth, error) {
+	keys := make([]string, 0)
+	key := c.String("GatewayTokenKey")
+	if len(key) == 0 {
+		if !c.DefaultBool("GatewayBuiltinKey", false) {
+			return nil, fmt.Errorf("GatewayTokenKey is not set")
+		}
+		log.Warning("GatewayTokenKey is not set, use the built-in token key")
+		key = TOKEN_KEY
+	}
+	keys = append(keys, key)
+	if next := c.String("GatewayTokenKeyNext"); len(next) > 0 {
+		keys = append(keys, next)
+	}
+	return NewGatewayAuth(
+		c.DefaultString("GatewayAuthScheme", AuthSchemeHMAC),
+		c.DefaultString("GatewayTokenAlgorithm", "hmac-sha256"),
+		keys...)
+}
+
+//Key 当前使用的密钥
+func (auth *GatewayAuth) Key() string {
+	auth.mu.RLock()
+	defer auth.mu.RUnlock()
+	return auth.keys[auth.active]
+}
+
+//Rotate 换用新密钥，原密钥保留为备用，新密钥认证失败时可切回
+func (auth *GatewayAuth) Rotate(key string) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	current := auth.keys[auth.active]
+	auth.keys = []string{key, current}
+	auth.active = 0
+}
+
+//failover 当前密钥认证失败，切换到下一把密钥，没有其他密钥时返回false
+func (auth *GatewayAuth) failover(failedKey string) bool {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if len(auth.keys) < 2 {
+		return false
+	}
+	//其他请求已经切换过
+	if auth.keys[auth.active] != failedKey {
+		return true
+	}
+	auth.active = (auth.active + 1) % len(auth.keys)
+	log.Warningf("gateway auth failed, switch to key #%d", auth.active)
+	return true
+}
+
+//Token 用密钥对时间戳计算token
+func (auth *GatewayAuth) Token(key string, callTime int64) string {
+	timeByte := []byte(fmt.Sprintf("%d", callTime))
+	return hex.EncodeToString(owcrypt.Hmac([]byte(key), timeByte, tokenAlgorithms[auth.Algorithm]))
+}
+
+//sign 给请求加上认证信息，返回使用的密钥
+func (auth *GatewayAuth) sign(header map[string]string, body map[string]interface{}) string {
+	key := auth.Key()
+	switch auth.Scheme {
+	case AuthSchemeBearer:
+		header["Authorization"] = "Bearer " + key
+		delete(body, "time")
+		delete(body, "token")
+	default:
+		callTime := time.Now().Unix()
+		body["time"] = fmt.Sprintf("%d", callTime)
+		body["token"] = auth.Token(key, callTime)
+	}
+	return key
+}
+
+//defaultGatewayAuth Client未设置认证时使用内置密钥
+var defaultGatewayAuth = &GatewayAuth{
+	keys:      []string{TOKEN_KEY},
+	Scheme:    AuthSchemeHMAC,
+	Algorithm: "hmac-sha256",
+}
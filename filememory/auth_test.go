@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"os"
+	"testing"
+
+	"github.com/astaxie/beego/config"
+	"github.com/tidwall/gjson"
+)
+
+func TestLoadGatewayAuth(t *testing.T) {
+	c, _ := config.NewConfigData("ini", []byte(`
+GatewayAuthScheme = bearer
+GatewayTokenAlgorithm = hmac-sha512
+GatewayTokenKey = key1
+GatewayTokenKeyNext = key2
+`))
+	auth, err := LoadGatewayAuth(c)
+	if err != nil {
+		t.Fatalf("LoadGatewayAuth failed, err=%v", err)
+	}
+	if auth.Scheme != AuthSchemeBearer || auth.Key() != "key1" || len(auth.keys) != 2 {
+		t.Errorf("unexpected auth: %+v", auth)
+	}
+	if len(auth.Token("key1", 1)) != 128 {
+		t.Errorf("hmac-sha512 token length = %d, want 128", len(auth.Token("key1", 1)))
+	}
+
+	//未配置密钥时加载失败
+	c, _ = config.NewConfigData("ini", []byte(""))
+	if _, err := LoadGatewayAuth(c); err == nil {
+		t.Errorf("missing GatewayTokenKey should fail")
+	}
+
+	//开启GatewayBuiltinKey时使用内置密钥，与GenToken一致
+	c, _ = config.NewConfigData("ini", []byte("GatewayBuiltinKey = true"))
+	auth, err = LoadGatewayAuth(c)
+	if err != nil || auth.Key() != TOKEN_KEY || auth.Token(auth.Key(), 100) != GenToken(100) {
+		t.Errorf("built-in key auth = %+v, %v", auth, err)
+	}
+
+	c, _ = config.NewConfigData("ini", []byte("GatewayTokenKey = key1\nGatewayTokenAlgorithm = md5"))
+	if _, err := LoadGatewayAuth(c); err == nil {
+		t.Errorf("unsupported algorithm should fail")
+	}
+}
+
+func TestClient_GatewayAuth(t *testing.T) {
+	node := NewFakeNode()
+	node.SetTip(5)
+	client := node.NewClient()
+	client.Auth, _ = NewGatewayAuth(AuthSchemeHMAC, "hmac-sha256", "secret")
+
+	node.RequireAuth(AuthSchemeHMAC, "hmac-sha256", "secret")
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Errorf("hmac auth failed, err=%v", err)
+	}
+
+	node.RequireAuth(AuthSchemeBearer, "hmac-sha256", "secret")
+	if _, err := client.FmGetBlockNumber(); !IsGatewayError(err, ErrAuth) {
+		t.Errorf("hmac token should be rejected by bearer gateway, err=%v", err)
+	}
+	client.Auth.Scheme = AuthSchemeBearer
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Errorf("bearer auth failed, err=%v", err)
+	}
+}
+
+func TestClient_GatewayAuthRotation(t *testing.T) {
+	node := NewFakeNode()
+	node.SetTip(5)
+	client := node.NewClient()
+	client.Auth, _ = NewGatewayAuth(AuthSchemeHMAC, "hmac-sha256", "old", "new")
+
+	//网关已换用新密钥，认证失败后切换到备用密钥
+	node.RequireAuth(AuthSchemeHMAC, "hmac-sha256", "new")
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Fatalf("FmGetBlockNumber failed, err=%v", err)
+	}
+	if node.Calls("blocknumber") != 2 || client.Auth.Key() != "new" {
+		t.Errorf("calls = %d, key = %s; want 2, new", node.Calls("blocknumber"), client.Auth.Key())
+	}
+	client.FmGetBlockNumber()
+	if node.Calls("blocknumber") != 3 {
+		t.Errorf("calls = %d, want 3", node.Calls("blocknumber"))
+	}
+
+	//运行中换用新密钥
+	node.RequireAuth(AuthSchemeHMAC, "hmac-sha256", "newer")
+	client.Auth.Rotate("newer")
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Errorf("FmGetBlockNumber after rotate failed, err=%v", err)
+	}
+}
+
+func TestWalletManager_GatewayConfig(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	if wm.WalletClient.NotifyURL != "https://wallet.example.com/notify/pushtx" ||
+		wm.WalletClient.FeeNotifyURL != "https://wallet.example.com/notify/getfee" {
+		t.Errorf("unexpected notify url: %s, %s", wm.WalletClient.NotifyURL, wm.WalletClient.FeeNotifyURL)
+	}
+
+	var notify string
+	node.Handle("getfee", func(params gjson.Result) (interface{}, int64, string) {
+		notify = params.Get("notify").String()
+		return map[string]interface{}{"address": params.Get("address").String()}, 0, ""
+	})
+	node.RequireAuth(AuthSchemeHMAC, "hmac-sha256", "test-gateway-key")
+	if err := wm.WalletClient.FmGetFee(testDepositAddress); err != nil {
+		t.Fatalf("FmGetFee failed, err=%v", err)
+	}
+	if notify != wm.WalletClient.FeeNotifyURL {
+		t.Errorf("getfee notify = %s, want %s", notify, wm.WalletClient.FeeNotifyURL)
+	}
+
+	node.RequireAuth(AuthSchemeHMAC, "hmac-sha256", "rotated-key")
+	if err := wm.RotateGatewayKey("rotated-key"); err != nil {
+		t.Fatalf("RotateGatewayKey failed, err=%v", err)
+	}
+	if err := wm.WalletClient.FmGetFee(testDepositAddress); err != nil {
+		t.Errorf("FmGetFee after rotate failed, err=%v", err)
+	}
+}
@@ -22,6 +22,7 @@ package filememory
 import (
 	"github.com/blocktree/openwallet/common"
 	"math/big"
+	"sort"
 	"strings"
 	"time"
 
@@ -40,21 +41,34 @@ const (
 	//BLOCK_CHAIN_BUCKET = "blockchain" //区块链数据集合
 	//periodOfTask      = 5 * time.Second //定时任务执行隔间
 	MAX_EXTRACTING_SIZE = 15 //并发的扫描线程数
+	MAX_REORG_DEPTH     = 64 //默认最大回滚深度
+
+	DEFAULT_REQUIRED_CONFIRMATIONS = 1 //默认入账确认数
 
 )
 
 type FMBLockScanner struct {
 	*openwallet.BlockScannerBase
-	CurrentBlockHeight   uint64         //当前区块高度
-	extractingCH         chan struct{}  //扫描工作令牌
-	wm                   *WalletManager //钱包管理者
-	IsScanMemPool        bool           //是否扫描交易池
-	RescanLastBlockCount uint64         //重扫上N个区块数量
+	CurrentBlockHeight    uint64         //当前区块高度
+	extractingCH          chan struct{}  //扫描工作令牌
+	wm                    *WalletManager //钱包管理者
+	IsScanMemPool         bool           //是否扫描交易池
+	RescanLastBlockCount  uint64         //重扫上N个区块数量
+	ScanLookahead         uint64         //每轮预取的区块数
+	MaxReorgDepth         uint64         //最大回滚深度，超过后暂停扫描，0表示不限制
+	ReorgAlertFunc        ReorgAlertFunc //回滚深度超过上限时的告警回调
+	RequiredConfirmations uint64         //入账需要的确认数，不足时先发送临时通知，0或1表示首次发现即最终通知
+	watched               watchedTokens  //监听的代币合约
 }
 
+//ReorgAlertFunc 回滚深度超过上限的告警，height为发现分叉的高度，depth为已回溯的深度
+type ReorgAlertFunc func(height, depth uint64)
+
 //ExtractResult 扫描完成的提取结果
 type ExtractResult struct {
 	extractData map[string][]*openwallet.TxExtractData
+	//需要记录为未扫交易的原因，区块按顺序提交时才保存，预取后丢弃的区块不留下记录
+	unscanReason string
 
 	//Recharges   []*openwallet.Recharge
 	TxID        string
@@ -76,6 +90,9 @@ func NewETHBlockScanner(wm *WalletManager) *FMBLockScanner {
 	}
 
 	bs.extractingCH = make(chan struct{}, MAX_EXTRACTING_SIZE)
+	bs.ScanLookahead = MAX_EXTRACTING_SIZE
+	bs.MaxReorgDepth = MAX_REORG_DEPTH
+	bs.RequiredConfirmations = DEFAULT_REQUIRED_CONFIRMATIONS
 	bs.wm = wm
 	bs.IsScanMemPool = false
 	bs.RescanLastBlockCount = 0
@@ -116,6 +133,8 @@ func (this *FMBLockScanner) newBlockNotify(block *FMBlock, isFork bool) {
 }
 
 func (this *FMBLockScanner) ScanBlock(height uint64) error {
+	this.reloadWatchedTokens()
+
 	curBlock, err := this.wm.WalletClient.FMGetBlockSpecByBlockNum(height, true)
 	if err != nil {
 		this.wm.Log.Errorf("FMGetBlockSpecByBlockNum failed, err = %v", err)
@@ -128,6 +147,11 @@ func (this *FMBLockScanner) ScanBlock(height uint64) error {
 		return err
 	}
 
+	err = this.SaveIndexedBlock(curBlock)
+	if err != nil {
+		this.wm.Log.Errorf("save block index on height %v failed, err=%v", curBlock.BlockHeight, err)
+	}
+
 	this.newBlockNotify(curBlock, false)
 
 	return nil
@@ -163,21 +187,31 @@ func (this *FMBLockScanner) RescanFailedTransactions() error {
 		return err
 	}
 
+	//先删除记录，重扫时仍然失败的交易会重新记录
+	for _, record := range unscannedTxs {
+		this.DeleteUnscanRecordByID(record.ID)
+	}
+
 	err = this.BatchExtractTransaction(txs)
 	if err != nil {
 		this.wm.Log.Errorf("batch extract transactions failed, err=%v", err)
+		for _, record := range unscannedTxs {
+			this.SaveUnscanRecord(record)
+		}
 		return err
 	}
 
-	for _, record := range unscannedTxs {
-		this.DeleteUnscanRecordByID(record.ID)
-	}
-
 	return nil
 }
 
 func (this *FMBLockScanner) ScanBlockTask() {
 
+	//节点所在网络与配置不一致时不扫描
+	if err := this.wm.networkReady(); err != nil {
+		this.wm.Log.Errorf("block scanner stopped by network check, err=%v", err)
+		return
+	}
+
 	//获取本地区块高度
 	blockHeader, err := this.GetScannedBlockHeader()
 	if err != nil {
@@ -187,7 +221,10 @@ func (this *FMBLockScanner) ScanBlockTask() {
 
 	curBlockHeight := blockHeader.Height
 	curBlockHash := blockHeader.Hash
-	var previousHeight uint64 = 0
+
+	//每轮扫描开始时加载监听的代币合约，新增的合约在下一轮生效
+	this.reloadWatchedTokens()
+
 	for {
 
 		if !this.Scanning {
@@ -202,91 +239,75 @@ func (this *FMBLockScanner) ScanBlockTask() {
 		}
 
 		this.wm.Log.Info("current block height:", curBlockHeight, " maxBlockHeight:", maxBlockHeight)
-		if curBlockHeight == maxBlockHeight {
+		if curBlockHeight >= maxBlockHeight {
 			this.wm.Log.Infof("block scanner has done with scan. current height:%v", maxBlockHeight)
 			break
 		}
 
-		//扫描下一个区块
-		curBlockHeight += 1
-		this.wm.Log.Infof("block scanner try to scan block No.%v", curBlockHeight)
-
-		curBlock, err := this.wm.WalletClient.FMGetBlockSpecByBlockNum(curBlockHeight, true)
-		if err != nil {
-			this.wm.Log.Errorf("FMGetBlockSpecByBlockNum failed, err = %v", err)
-			break
+		//预取后续区块并发提取交易，按高度顺序提交
+		endHeight := curBlockHeight + this.ScanLookahead
+		if this.ScanLookahead == 0 {
+			endHeight = curBlockHeight + 1
 		}
+		if endHeight > maxBlockHeight {
+			endHeight = maxBlockHeight
+		}
+		this.wm.Log.Infof("block scanner try to scan block No.%v - No.%v", curBlockHeight+1, endHeight)
 
-		isFork := false
-
-		if curBlock.PreviousHash != curBlockHash {
-			previousHeight = curBlockHeight - 1
-			this.wm.Log.Infof("block has been fork on height: %v.", curBlockHeight)
-			this.wm.Log.Infof("block height: %v local hash = %v ", previousHeight, curBlockHash)
-			this.wm.Log.Infof("block height: %v mainnet hash = %v ", previousHeight, curBlock.PreviousHash)
-
-			this.wm.Log.Infof("delete recharge records on block height: %v.", previousHeight)
-
-			//本地数据库并不存储交易
-			//err = this.DeleteTransactionsByHeight(previousHeight)
-			//if err != nil {
-			//	this.wm.Log.Errorf("DeleteTransactionsByHeight failed, height=%v, err=%v", "0x"+strconv.FormatUint(previousHeight, 16), err)
-			//	break
-			//}
-
-			//查询本地分叉的区块
-			forkBlock, _ := this.GetLocalBlock(previousHeight)
-
-			this.DeleteUnscanRecord(previousHeight)
-
-			curBlockHeight = previousHeight - 1 //倒退2个区块重新扫描
+		jobs := this.prefetchBlocks(curBlockHeight+1, endHeight)
+		stop := false
+		for _, job := range jobs {
+			<-job.done
 
-			curBlock, err = this.GetLocalBlock(curBlockHeight)
-			if err != nil && err != storm.ErrNotFound {
-				this.wm.Log.Errorf("RecoverBlockHeader failed, block number=%v, err=%v", curBlockHeight, err)
-				break
-			} else if err == storm.ErrNotFound {
-				curBlock, err = this.wm.WalletClient.FMGetBlockSpecByBlockNum(curBlockHeight, false)
-				if err != nil {
-					this.wm.Log.Errorf("FMGetBlockSpecByBlockNum  failed, block number=%v, err=%v", curBlockHeight, err)
-					break
-				}
+			if !this.Scanning {
+				return
 			}
-			curBlockHash = curBlock.BlockHash
-			this.wm.Log.Infof("rescan block on height:%v, hash:%v.", curBlockHeight, curBlockHash)
 
-			err = this.SaveLocalBlockHead(curBlock.BlockHeight, curBlock.BlockHash)
-			if err != nil {
-				this.wm.Log.Errorf("save local block unscaned failed, err=%v", err)
+			if job.err != nil {
+				this.wm.Log.Errorf("block scanner can not scan block No.%v; unexpected error: %v", job.height, job.err)
+				stop = true
 				break
 			}
 
-			isFork = true
-
-			if forkBlock != nil {
-
-				//通知分叉区块给观测者，异步处理
-				this.newBlockNotify(forkBlock, isFork)
+			curBlock := job.block
+			if curBlock.PreviousHash != curBlockHash {
+				//分叉后丢弃预取的区块，从回退的高度重新扫描
+				curBlockHeight, curBlockHash, err = this.rollbackForkBlock(curBlock, curBlockHash)
+				if err != nil {
+					stop = true
+				}
+				break
 			}
 
-		} else {
-			err = this.BatchExtractTransaction(curBlock.Transactions)
+			err = this.notifyExtractResults(maxBlockHeight, curBlock.Transactions, job.results)
 			if err != nil {
 				this.wm.Log.Errorf("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+				stop = true
 				break
 			}
 
 			this.SaveLocalBlockHead(curBlock.BlockHeight, curBlock.BlockHash)
 			this.SaveLocalBlock(curBlock)
+			err = this.SaveIndexedBlock(curBlock)
+			if err != nil {
+				this.wm.Log.Errorf("save block index on height %v failed, err=%v", curBlock.BlockHeight, err)
+			}
 
-			isFork = false
+			this.newBlockNotify(curBlock, false)
 
-			this.newBlockNotify(curBlock, isFork)
-		}
+			//按节点最新高度计算之前区块的确认数
+			err = this.confirmPendingTransactions(maxBlockHeight)
+			if err != nil {
+				this.wm.Log.Errorf("confirm pending transactions failed, err=%v", err)
+			}
 
-		curBlockHeight = curBlock.BlockHeight
-		curBlockHash = curBlock.BlockHash
+			curBlockHeight = curBlock.BlockHeight
+			curBlockHash = curBlock.BlockHash
+		}
 
+		if stop {
+			break
+		}
 	}
 
 	if this.IsScanMemPool {
@@ -294,14 +315,145 @@ func (this *FMBLockScanner) ScanBlockTask() {
 	}
 
 	this.RescanFailedTransactions()
+
+	this.trackSentTransactions()
 }
 
-//newExtractDataNotify 发送通知
-func (this *FMBLockScanner) newExtractDataNotify(height uint64, tx *BlockTransaction, extractDataList map[string][]*openwallet.TxExtractData) error {
+//rollbackForkBlock 区块分叉时沿本地区块记录向前回溯，直到找到与节点一致的共同祖先，
+//每个被孤立的高度都发送分叉通知并删除未扫记录，返回共同祖先的高度和哈希。
+//回溯深度超过MaxReorgDepth时暂停扫描并告警
+func (this *FMBLockScanner) rollbackForkBlock(curBlock *FMBlock, localHash string) (uint64, string, error) {
+	headHeight := curBlock.BlockHeight - 1
+	this.wm.Log.Infof("block has been fork on height: %v.", curBlock.BlockHeight)
+	this.wm.Log.Infof("block height: %v local hash = %v ", headHeight, localHash)
+	this.wm.Log.Infof("block height: %v mainnet hash = %v ", headHeight, curBlock.PreviousHash)
+
+	orphans := make([]*FMBlock, 0)
+	height := headHeight
+	remoteHash := curBlock.PreviousHash
+	var ancestor *FMBlock
+	for {
+		//本地记录的区块哈希，本地头部以外没有记录时无法比较，视为共同祖先
+		local, err := this.GetLocalBlock(height)
+		if err != nil && err != storm.ErrNotFound {
+			this.wm.Log.Errorf("GetLocalBlock failed, block number=%v, err=%v", height, err)
+			return 0, "", err
+		}
+		hash := localHash
+		if height != headHeight {
+			if local == nil {
+				this.wm.Log.Warningf("local block %v not found, take it as common ancestor", height)
+				hash = remoteHash
+			} else {
+				hash = local.BlockHash
+			}
+		}
+
+		if hash == remoteHash {
+			ancestor = &FMBlock{BlockHeader: BlockHeader{BlockHeight: height, BlockHash: hash}}
+			break
+		}
+
+		if this.MaxReorgDepth > 0 && uint64(len(orphans)) >= this.MaxReorgDepth {
+			this.reorgAlert(curBlock.BlockHeight, uint64(len(orphans))+1)
+			return 0, "", fmt.Errorf("block reorg on height %d exceeds max depth %d", curBlock.BlockHeight, this.MaxReorgDepth)
+		}
+
+		orphan := &FMBlock{BlockHeader: BlockHeader{BlockHeight: height, BlockHash: hash}}
+		if local != nil {
+			orphan.PreviousHash = local.PreviousHash
+		}
+		orphans = append(orphans, orphan)
+
+		if height == 0 {
+			return 0, "", fmt.Errorf("block reorg on height %d can not find common ancestor", curBlock.BlockHeight)
+		}
+		height--
+
+		remoteBlock, err := this.wm.WalletClient.FMGetBlockSpecByBlockNum(height, false)
+		if err != nil {
+			this.wm.Log.Errorf("FMGetBlockSpecByBlockNum  failed, block number=%v, err=%v", height, err)
+			return 0, "", err
+		}
+		remoteHash = remoteBlock.BlockHash
+	}
+
+	this.wm.Log.Infof("rescan block on height:%v, hash:%v, reorg depth: %d.", ancestor.BlockHeight, ancestor.BlockHash, len(orphans))
 
+	err := this.SaveLocalBlockHead(ancestor.BlockHeight, ancestor.BlockHash)
+	if err != nil {
+		this.wm.Log.Errorf("save local block unscaned failed, err=%v", err)
+		return 0, "", err
+	}
+
+	for _, orphan := range orphans {
+		this.wm.Log.Infof("delete recharge records on block height: %v.", orphan.BlockHeight)
+		this.DeleteUnscanRecord(orphan.BlockHeight)
+
+		//按本地索引给孤立区块上已通知的交易发送撤销通知
+		err = this.revertIndexedBlock(orphan.BlockHeight)
+		if err != nil {
+			this.wm.Log.Errorf("revert indexed block on height %v failed, err=%v", orphan.BlockHeight, err)
+		}
+
+		//通知分叉区块给观测者，异步处理
+		this.newBlockNotify(orphan, true)
+	}
+
+	return ancestor.BlockHeight, ancestor.BlockHash, nil
+}
+
+//reorgAlert 回滚深度超过上限，暂停扫描等待人工处理
+func (this *FMBLockScanner) reorgAlert(height, depth uint64) {
+	this.wm.Log.Errorf("ALERT: block reorg on height %d is deeper than %d blocks, block scanner paused", height, this.MaxReorgDepth)
+	this.Pause()
+	this.Scanning = false
+	if this.ReorgAlertFunc != nil {
+		this.ReorgAlertFunc(height, depth)
+	}
+}
+
+//scanJob 预取区块的任务，done关闭后block、results、err可读
+type scanJob struct {
+	height  uint64
+	block   *FMBlock
+	results []*ExtractResult
+	err     error
+	done    chan struct{}
+}
+
+//prefetchBlocks 并发获取[from, to]的区块并提取交易，并发数由extractingCH限制，
+//返回的任务按高度排列
+func (this *FMBLockScanner) prefetchBlocks(from, to uint64) []*scanJob {
+	jobs := make([]*scanJob, 0, to-from+1)
+	for height := from; height <= to; height++ {
+		job := &scanJob{height: height, done: make(chan struct{})}
+		jobs = append(jobs, job)
+		go func(job *scanJob) {
+			this.extractingCH <- struct{}{}
+			defer func() {
+				<-this.extractingCH
+				close(job.done)
+			}()
+
+			job.block, job.err = this.wm.WalletClient.FMGetBlockSpecByBlockNum(job.height, true)
+			if job.err != nil {
+				return
+			}
+			job.results, job.err = this.extractTransactions(job.block.Transactions)
+		}(job)
+	}
+	return jobs
+}
+
+//newExtractDataNotify 发送通知，tip为节点最新高度，确认数不足时发送临时通知并等待确认
+func (this *FMBLockScanner) newExtractDataNotify(height, tip uint64, tx *BlockTransaction, extractDataList map[string][]*openwallet.TxExtractData) error {
+
+	confirms, final := this.confirmState(height, tip)
 	for o, _ := range this.Observers {
 		for key, extractData := range extractDataList {
 			for _, data := range extractData {
+				setConfirmState(data.Transaction, confirms, final)
 				this.wm.Log.Debugf("before notify, data.tx.Amount:%v", data.Transaction.Amount)
 				err := o.BlockExtractDataNotify(key, data)
 				if err != nil {
@@ -321,31 +473,99 @@ func (this *FMBLockScanner) newExtractDataNotify(height uint64, tx *BlockTransac
 		}
 	}
 
+	//记录发送过的提取结果，临时通知的结果等待确认，分叉时按记录撤销
+	if height > 0 {
+		err := this.saveIndexedExtractData(extractDataList)
+		if err != nil {
+			this.wm.Log.Errorf("block height: %d, save extract data index failed. unexpected error: %v", height, err)
+			return err
+		}
+	}
+
 	return nil
 }
 
 //BatchExtractTransaction 批量提取交易单
 //bitcoin 1M的区块链可以容纳3000笔交易，批量多线程处理，速度更快
 func (this *FMBLockScanner) BatchExtractTransaction(txs []BlockTransaction) error {
+	tip, err := this.wm.WalletClient.FmGetBlockNumber()
+	if err != nil {
+		this.wm.Log.Errorf("get max height of eth failed, err=%v", err)
+		return err
+	}
+	results, err := this.extractTransactions(txs)
+	if err != nil {
+		return err
+	}
+	return this.notifyExtractResults(tip, txs, results)
+}
+
+//normalizedScanAddressFunc 地址转为规范的FM格式后再查询，网关返回的地址大小写和前缀不统一
+func normalizedScanAddressFunc(scanAddressFunc openwallet.BlockScanAddressFunc) openwallet.BlockScanAddressFunc {
+	return func(address string) (string, bool) {
+		return scanAddressFunc(NormalizeFMAddress(address))
+	}
+}
+
+//extractTransactions 提取交易单，结果与txs一一对应
+func (this *FMBLockScanner) extractTransactions(txs []BlockTransaction) ([]*ExtractResult, error) {
+	results := make([]*ExtractResult, len(txs))
 	for i := range txs {
-		txs[i].FilterFunc = this.ScanAddressFunc
+		txs[i].FilterFunc = normalizedScanAddressFunc(this.ScanAddressFunc)
 		extractResult, err := this.TransactionScanning(&txs[i])
 		if err != nil {
 			this.wm.Log.Errorf("transaction  failed, err=%v", err)
-			return err
+			return nil, err
 		}
+		results[i] = extractResult
+	}
+	return results, nil
+}
 
-		if extractResult.extractData != nil {
-			err := this.newExtractDataNotify(txs[i].BlockHeight, &txs[i], extractResult.extractData)
+//notifyExtractResults 按交易顺序发送提取结果通知并保存未扫交易，tip为计算确认数的节点最新高度
+func (this *FMBLockScanner) notifyExtractResults(tip uint64, txs []BlockTransaction, results []*ExtractResult) error {
+	for i := range txs {
+		if len(results[i].unscanReason) > 0 {
+			err := this.SaveUnscannedTransaction(&txs[i], results[i].unscanReason)
+			if err != nil {
+				this.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", txs[i].BlockHeight, err)
+				return err
+			}
+			continue
+		}
+		if results[i].extractData != nil {
+			err := this.newExtractDataNotify(txs[i].BlockHeight, tip, &txs[i], results[i].extractData)
 			if err != nil {
 				this.wm.Log.Errorf("newExtractDataNotify failed, err=%v", err)
 				return err
 			}
+			this.requestGasFee(results[i].extractData)
 		}
 	}
 	return nil
 }
 
+//requestGasFee 收到主币的地址请求网关补充GAS，只在区块提交时调用，预取后因分叉丢弃的区块不会请求
+func (this *FMBLockScanner) requestGasFee(extractDataList map[string][]*openwallet.TxExtractData) {
+	for _, extractData := range extractDataList {
+		for _, data := range extractData {
+			if data.Transaction.Coin.IsContract || len(data.Transaction.To) == 0 {
+				continue
+			}
+			this.wm.WalletClient.FmGetFee(strings.Split(data.Transaction.To[0], ":")[0])
+		}
+	}
+}
+
+//SetScanConcurrency 设置并发提取的线程数和预取的区块数
+func (this *FMBLockScanner) SetScanConcurrency(workers int, lookahead uint64) {
+	if workers <= 0 {
+		workers = MAX_EXTRACTING_SIZE
+	}
+	this.extractingCH = make(chan struct{}, workers)
+	this.ScanLookahead = lookahead
+}
+
 func (this *FMBLockScanner) GetTxPoolPendingTxs() ([]BlockTransaction, error) {
 	txpoolContent, err := this.wm.WalletClient.EthGetTxPoolContent()
 	if err != nil {
@@ -355,13 +575,13 @@ func (this *FMBLockScanner) GetTxPoolPendingTxs() ([]BlockTransaction, error) {
 
 	var txs []BlockTransaction
 	for from, txsets := range txpoolContent.Pending {
-		if _, ok := this.ScanAddressFunc(strings.ToLower(from)); ok {
+		if _, ok := this.ScanAddressFunc(NormalizeFMAddress(from)); ok {
 			for nonce, _ := range txsets {
 				txs = append(txs, txsets[nonce])
 			}
 		} else {
 			for nonce, _ := range txsets {
-				if _, ok2 := this.ScanAddressFunc(strings.ToLower(txsets[nonce].To)); ok2 {
+				if _, ok2 := this.ScanAddressFunc(NormalizeFMAddress(txsets[nonce].To)); ok2 {
 					txs = append(txs, txsets[nonce])
 				}
 
@@ -386,33 +606,68 @@ func (this *WalletManager) GetErc20TokenEvent(transactionID string) (map[string]
 	return transEvent, nil
 }
 
+//GetTxFeeEthString 交易实际支付的手续费。网关没有返回手续费时，
+//从交易回执获取gasUsed，从回执或交易详情获取gasPrice，并记录到tx中
+func (this *FMBLockScanner) GetTxFeeEthString(tx *BlockTransaction) (string, error) {
+	if len(tx.Fee) == 0 && len(tx.GasUsed) == 0 {
+		receipt, err := this.wm.WalletClient.EthGetTransactionReceipt(tx.Hash)
+		if err != nil {
+			this.wm.Log.Errorf("get transaction[%v] receipt failed, err=%v", tx.Hash, err)
+			return "", err
+		}
+		tx.GasUsed = receipt.GasUsed
+		if len(tx.GasPrice) == 0 {
+			tx.GasPrice = receipt.EffectiveGasPrice
+		}
+	}
+
+	if len(tx.Fee) == 0 && len(tx.GasPrice) == 0 {
+		gasPrice, err := this.wm.WalletClient.EthGetTransactionGasPrice(tx.Hash)
+		if err != nil {
+			this.wm.Log.Errorf("get transaction[%v] gas price failed, err=%v", tx.Hash, err)
+			return "", err
+		}
+		tx.GasPrice = gasPrice
+	}
+
+	return tx.GetTxFeeEthString()
+}
+
+//UpdateTxByReceipt 从交易回执解析监听合约的Transfer事件，按合约地址分组，
+//同时记录gasUsed用于计算手续费。没有监听的合约时不查询回执
 func (this *FMBLockScanner) UpdateTxByReceipt(tx *BlockTransaction) (map[string][]*TransferEvent, error) {
 	//过滤掉未打包交易
 	if tx.BlockHeight == 0 || tx.BlockHash == "" {
 		return nil, nil
 	}
 
+	if !this.hasWatchedTokens() {
+		return nil, nil
+	}
+
 	receipt, err := this.wm.WalletClient.EthGetTransactionReceipt(tx.Hash)
 	if err != nil {
 		this.wm.Log.Errorf("get transaction receipt failed, err=%v", err)
 		return nil, err
 	}
 
-	/*
-		20200310
-		tx.Gas = receipt.GasUsed
-		tx.Status, err = ConvertToUint64(receipt.Status, 16)
-		if err != nil {
-			return nil, err
-		}*/
+	if len(tx.GasUsed) == 0 {
+		tx.GasUsed = receipt.GasUsed
+	}
+	if len(tx.GasPrice) == 0 {
+		tx.GasPrice = receipt.EffectiveGasPrice
+	}
 
-	// transEvent := receipt.ParseTransferEvent()
-	// if transEvent == nil {
-	// 	return nil, nil
-	// }
-	return receipt.ParseTransferEvent(), nil
+	tokenEvents := make(map[string][]*TransferEvent)
+	for contractAddress, events := range receipt.ParseTransferEvent() {
+		if _, ok := this.WatchedToken(contractAddress); ok {
+			tokenEvents[contractAddress] = events
+		}
+	}
+	return tokenEvents, nil
 }
 
+//MakeToExtractData 按接收地址生成一笔交易的提取结果，tokenEvent为空时是主币交易
 func (this *FMBLockScanner) MakeToExtractData(tx *BlockTransaction, tokenEvent *TransferEvent) (string, []*openwallet.TxExtractData, error) {
 	if tokenEvent == nil {
 		return this.MakeSimpleToExtractData(tx)
@@ -428,12 +683,11 @@ func (this *FMBLockScanner) MakeSimpleToExtractData(tx *BlockTransaction) (strin
 		return "", extractDataList, nil
 	}
 
-	// 20200310
-	//feeprice, err := tx.GetTxFeeEthString()
-	//if err != nil {
-	//	this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
-	//	return "", extractDataList, err
-	//}
+	feeprice, err := this.GetTxFeeEthString(tx)
+	if err != nil {
+		this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
+		return "", extractDataList, err
+	}
 
 	amountVal, err := tx.GetAmountEthString()
 	if err != nil {
@@ -472,10 +726,10 @@ func (this *FMBLockScanner) MakeSimpleToExtractData(tx *BlockTransaction) (strin
 		TxID:        tx.Hash,
 		From:        from,
 		To:          to,
-		Decimal:     8,
+		Decimal:     this.wm.Decimal(),
 		BlockHash:   tx.BlockHash,
 		BlockHeight: tx.BlockHeight,
-		//Fees:        feeprice,
+		Fees:        feeprice,
 		Coin: openwallet.Coin{
 			Symbol:     this.wm.Symbol(),
 			IsContract: false,
@@ -500,6 +754,7 @@ func (this *FMBLockScanner) GetBalanceByAddress(address ...string) ([]*openwalle
 		Address string
 		Index   uint64
 		Balance *openwallet.Balance
+		Err     error
 	}
 
 	threadControl := make(chan int, this.wm.Config.SumThreadControl)
@@ -510,6 +765,7 @@ func (this *FMBLockScanner) GetBalanceByAddress(address ...string) ([]*openwalle
 	count := len(address)
 	resultBalance := make([]*openwallet.Balance, count)
 	resultSaveFailed := false
+	var resultErr error
 	//save result
 	go func() {
 		for i := 0; i < count; i++ {
@@ -518,6 +774,9 @@ func (this *FMBLockScanner) GetBalanceByAddress(address ...string) ([]*openwalle
 				resultBalance[addr.Index] = addr.Balance
 			} else {
 				resultSaveFailed = true
+				if resultErr == nil {
+					resultErr = addr.Err
+				}
 			}
 		}
 		done <- 1
@@ -533,6 +792,7 @@ func (this *FMBLockScanner) GetBalanceByAddress(address ...string) ([]*openwalle
 		balanceConfirmed, err := this.wm.WalletClient.GetAddrBalance2(ReplaceFmToAddress(addr.Address), "latest")
 		if err != nil {
 			this.wm.Log.Error("get address[", addr.Address, "] balance failed, err=", err)
+			addr.Err = err
 			return
 		}
 
@@ -584,6 +844,9 @@ func (this *FMBLockScanner) GetBalanceByAddress(address ...string) ([]*openwalle
 
 	<-done
 	if resultSaveFailed {
+		if resultErr != nil {
+			return nil, ConvertGatewayError(resultErr, openwallet.ErrCallFullNodeAPIFailed, "get balance of addresses failed")
+		}
 		return nil, errors.New("get balance of addresses failed.")
 	}
 	return resultBalance, nil
@@ -596,31 +859,18 @@ func (this *FMBLockScanner) MakeTokenToExtractData(tx *BlockTransaction, tokenEv
 	if sourceKey, exist = tx.FilterFunc(tokenEvent.TokenTo); !exist { //this.GetSourceKeyByAddress(tokenEvent.TokenTo)
 		return "", extractDataList, nil
 	}
-	// fee, err := tx.GetTxFeeEthString()
-	// if err != nil {
-	// 	this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
-	// 	return "", extractDataList, err
-	// }
-
-	contractId := openwallet.GenContractID(this.wm.Symbol(), tx.To) //base64.StdEncoding.EncodeToString(crypto.SHA256([]byte(fmt.Sprintf("{%v}_{%v}", this.wm.Symbol(), tx.To))))
-	nowUnix := time.Now().Unix()
-
-	coin := openwallet.Coin{
-		Symbol:     this.wm.Symbol(),
-		IsContract: true,
-		ContractID: contractId,
-		Contract: openwallet.SmartContract{
-			ContractID: contractId,
-			Address:    tx.To,
-			Symbol:     this.wm.Symbol(),
-		},
+	feeprice, err := this.GetTxFeeEthString(tx)
+	if err != nil {
+		this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
+		return "", extractDataList, err
 	}
 
-	tokenValue, err := ConvertToBigInt(tokenEvent.Value, 16)
+	coin, tokenValue, err := this.tokenEventAmount(tx, tokenEvent)
 	if err != nil {
-		this.wm.Log.Errorf("convert token value to big.int failed, err=%v", err)
 		return "", extractDataList, err
 	}
+	contractId := coin.ContractID
+	nowUnix := time.Now().Unix()
 
 	tokenBalanceTxOutput := openwallet.TxOutPut{
 		Recharge: openwallet.Recharge{
@@ -629,28 +879,28 @@ func (this *FMBLockScanner) MakeTokenToExtractData(tx *BlockTransaction, tokenEv
 			TxID:        tx.Hash,
 			Address:     tokenEvent.TokenTo,
 			Coin:        coin,
-			Amount:      tokenValue.String(),
+			Amount:      tokenValue,
 			BlockHash:   tx.BlockHash,
 			BlockHeight: tx.BlockHeight,
 			TxType:      0,
 		},
 	}
 	from := []string{
-		tokenEvent.TokenFrom + ":" + tokenValue.String(),
+		tokenEvent.TokenFrom + ":" + tokenValue,
 	}
 	to := []string{
-		tokenEvent.TokenTo + ":" + tokenValue.String(),
+		tokenEvent.TokenTo + ":" + tokenValue,
 	}
 
 	tokentransx := &openwallet.Transaction{
-		WxID: openwallet.GenTransactionWxID2(tx.Hash, this.wm.Symbol(), contractId),
-		TxID: tx.Hash,
-		From: from,
-		To:   to,
-		//		Decimal:     18,
+		WxID:        openwallet.GenTransactionWxID2(tx.Hash, this.wm.Symbol(), contractId),
+		TxID:        tx.Hash,
+		From:        from,
+		To:          to,
+		Decimal:     int32(coin.Contract.Decimals),
 		BlockHash:   tx.BlockHash,
 		BlockHeight: tx.BlockHeight,
-		Fees:        "0", //tx.GasPrice, //totalSpent.Sub(totalReceived).StringFixed(8),
+		Fees:        feeprice,
 		Coin:        coin,
 		SubmitTime:  nowUnix,
 		ConfirmTime: nowUnix,
@@ -666,6 +916,7 @@ func (this *FMBLockScanner) MakeTokenToExtractData(tx *BlockTransaction, tokenEv
 	return sourceKey, extractDataList, nil
 }
 
+//MakeFromExtractData 按发送地址生成一笔交易的提取结果，tokenEvent为空时是主币交易
 func (this *FMBLockScanner) MakeFromExtractData(tx *BlockTransaction, tokenEvent *TransferEvent) (string, []*openwallet.TxExtractData, error) {
 	if tokenEvent == nil {
 		return this.MakeSimpleTxFromExtractData(tx)
@@ -681,7 +932,7 @@ func (this *FMBLockScanner) MakeSimpleTxFromExtractData(tx *BlockTransaction) (s
 		return "", extractDataList, nil
 	}
 
-	feeprice, err := tx.GetTxFeeEthString()
+	feeprice, err := this.GetTxFeeEthString(tx)
 	if err != nil {
 		this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
 		return "", extractDataList, err
@@ -741,10 +992,10 @@ func (this *FMBLockScanner) MakeSimpleTxFromExtractData(tx *BlockTransaction) (s
 		TxID:        tx.Hash,
 		From:        from,
 		To:          to,
-		Decimal:     8,
+		Decimal:     this.wm.Decimal(),
 		BlockHash:   tx.BlockHash,
 		BlockHeight: tx.BlockHeight,
-		//Fees:        feeprice, //tx.GasPrice, //totalSpent.Sub(totalReceived).StringFixed(8),
+		Fees:        feeprice,
 		Coin: openwallet.Coin{
 			Symbol:     this.wm.Symbol(),
 			IsContract: false,
@@ -773,29 +1024,16 @@ func (this *FMBLockScanner) MakeTokenTxFromExtractData(tx *BlockTransaction, tok
 		return "", extractDataList, nil
 	}
 
-	contractId := openwallet.GenContractID(this.wm.Symbol(), tx.To) //base64.StdEncoding.EncodeToString(crypto.SHA256([]byte(fmt.Sprintf("{%v}_{%v}", this.wm.Symbol(), tx.To))))
-	nowUnix := time.Now().Unix()
-
-	coin := openwallet.Coin{
-		Symbol:     this.wm.Symbol(),
-		IsContract: true,
-		ContractID: contractId,
-		Contract: openwallet.SmartContract{
-			ContractID: contractId,
-			Address:    tx.To,
-			Symbol:     this.wm.Symbol(),
-		},
-	}
-
-	feeprice, err := tx.GetTxFeeEthString()
+	coin, tokenValue, err := this.tokenEventAmount(tx, tokenEvent)
 	if err != nil {
-		this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
 		return "", extractDataList, err
 	}
+	contractId := coin.ContractID
+	nowUnix := time.Now().Unix()
 
-	tokenValue, err := ConvertToBigInt(tokenEvent.Value, 16)
+	feeprice, err := this.GetTxFeeEthString(tx)
 	if err != nil {
-		this.wm.Log.Errorf("convert token value to big.int failed, err=%v", err)
+		this.wm.Log.Errorf("calc tx fee in eth failed, err=%v", err)
 		return "", extractDataList, err
 	}
 
@@ -806,28 +1044,28 @@ func (this *FMBLockScanner) MakeTokenTxFromExtractData(tx *BlockTransaction, tok
 			TxID:        tx.Hash,
 			Address:     tx.From,
 			Coin:        coin,
-			Amount:      tokenValue.String(),
+			Amount:      tokenValue,
 			BlockHash:   tx.BlockHash,
 			BlockHeight: tx.BlockHeight,
 			TxType:      0,
 		},
 	}
 	from := []string{
-		tokenEvent.TokenFrom + ":" + tokenValue.String(),
+		tokenEvent.TokenFrom + ":" + tokenValue,
 	}
 	to := []string{
-		tokenEvent.TokenTo + ":" + tokenValue.String(),
+		tokenEvent.TokenTo + ":" + tokenValue,
 	}
 
 	tokentransx := &openwallet.Transaction{
-		WxID: openwallet.GenTransactionWxID2(tx.Hash, this.wm.Symbol(), contractId),
-		TxID: tx.Hash,
-		From: from,
-		To:   to,
-		//		Decimal:     18,
+		WxID:        openwallet.GenTransactionWxID2(tx.Hash, this.wm.Symbol(), contractId),
+		TxID:        tx.Hash,
+		From:        from,
+		To:          to,
+		Decimal:     int32(coin.Contract.Decimals),
 		BlockHash:   tx.BlockHash,
 		BlockHeight: tx.BlockHeight,
-		Fees:        "0", //tx.GasPrice, //totalSpent.Sub(totalReceived).StringFixed(8),
+		Fees:        feeprice,
 		Coin:        coin,
 		SubmitTime:  nowUnix,
 		ConfirmTime: nowUnix,
@@ -867,10 +1105,10 @@ func (this *FMBLockScanner) MakeTokenTxFromExtractData(tx *BlockTransaction, tok
 		TxID:        tx.Hash,
 		From:        from,
 		To:          to,
-		Decimal:     8,
+		Decimal:     this.wm.Decimal(),
 		BlockHash:   tx.BlockHash,
 		BlockHeight: tx.BlockHeight,
-		//Fees:        feeprice, //tx.GasPrice, //totalSpent.Sub(totalReceived).StringFixed(8),
+		Fees:        feeprice,
 		Coin: openwallet.Coin{
 			Symbol:     this.wm.Symbol(),
 			IsContract: false,
@@ -891,13 +1129,36 @@ func (this *FMBLockScanner) MakeTokenTxFromExtractData(tx *BlockTransaction, tok
 	return sourceKey, extractDataList, nil
 }
 
+//tokenEventAmount 代币事件的币种和按合约精度换算后的数量，只支持监听的代币合约
+func (this *FMBLockScanner) tokenEventAmount(tx *BlockTransaction, tokenEvent *TransferEvent) (openwallet.Coin, string, error) {
+	contract := tokenEvent.ContractAddress
+	if len(contract) == 0 {
+		contract = tx.To
+	}
+	token, ok := this.WatchedToken(contract)
+	if !ok {
+		return openwallet.Coin{}, "", fmt.Errorf("token contract [%s] is not watched", contract)
+	}
+	coin := this.tokenCoin(token)
+	tokenValue, err := ConvertToBigInt(tokenEvent.Value, 16)
+	if err != nil {
+		this.wm.Log.Errorf("convert token value to big.int failed, err=%v", err)
+		return coin, "", err
+	}
+	amount, err := ConvertAmountToFloatDecimal(tokenValue.String(), int(coin.Contract.Decimals))
+	if err != nil {
+		return coin, "", err
+	}
+	return coin, amount.String(), nil
+}
+
 //ExtractTransactionData 扫描一笔交易
 func (this *FMBLockScanner) ExtractTransactionData(txid string, scanTargetFunc openwallet.BlockScanTargetFunc) (map[string][]*openwallet.TxExtractData, error) {
 	//result := bs.ExtractTransaction(0, "", txid, scanAddressFunc)
 	tx, err := this.wm.WalletClient.EthGetTransactionByHash(txid)
 	if err != nil {
 		this.wm.Log.Errorf("get transaction by has failed, err=%v", err)
-		return nil, fmt.Errorf("get transaction by has failed, err=%v", err)
+		return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get transaction by has failed")
 	}
 	scanAddressFunc := func(address string) (string, bool) {
 		target := openwallet.ScanTarget{
@@ -906,12 +1167,20 @@ func (this *FMBLockScanner) ExtractTransactionData(txid string, scanTargetFunc o
 		}
 		return scanTargetFunc(target)
 	}
-	tx.FilterFunc = scanAddressFunc
+	tx.FilterFunc = normalizedScanAddressFunc(scanAddressFunc)
+	this.reloadWatchedTokens()
 	result, err := this.TransactionScanning(tx)
 	if err != nil {
 		this.wm.Log.Errorf("scan transaction[%v] failed, err=%v", txid, err)
 		return nil, fmt.Errorf("scan transaction[%v] failed, err=%v", txid, err)
 	}
+	if len(result.unscanReason) > 0 {
+		err = this.SaveUnscannedTransaction(tx, result.unscanReason)
+		if err != nil {
+			this.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", tx.BlockHeight, err)
+			return nil, err
+		}
+	}
 	return result.extractData, nil
 }
 
@@ -936,57 +1205,32 @@ func (this *FMBLockScanner) TransactionScanning(tx *BlockTransaction) (*ExtractR
 		Success:     true,
 	}
 
-	//tokenEvent, err := this.UpdateTxByReceipt(tx)
-	//if err != nil && strings.Index(err.Error(), "result type is Null") == -1 {
-	//	this.wm.Log.Errorf("UpdateTxByReceipt failed, err=%v", err)
-	//	return nil, err
-	//} else if err != nil && strings.Index(err.Error(), "result type is Null") != -1 {
-	//	err = this.SaveUnscannedTransaction(tx, "get tx receipt reply with null result")
-	//	if err != nil {
-	//		this.wm.Log.Errorf("block height: %d, save unscan record failed. unexpected error: %v", tx.BlockHeight, err)
-	//		return nil, err
-	//	}
-	//	return &result, nil
-	//}
-
-	//FromSourceKey, fromExtractDataList, err := this.MakeFromExtractData(tx, tokenEvent)
-	//if err != nil {
-	//	this.wm.Log.Errorf("MakeFromExtractData failed, err=%v", err)
-	//	return nil, err
-	//}
-	//
-	//ToSourceKey, toExtractDataList, err := this.MakeToExtractData(tx, tokenEvent)
-	//if err != nil {
-	//	this.wm.Log.Errorf("MakeToExtractData failed, err=%v", err)
-	//	return nil, err
-	//}
-	//
-	//if FromSourceKey == ToSourceKey && FromSourceKey != "" {
-	//	for i, _ := range fromExtractDataList {
-	//		for j, _ := range toExtractDataList {
-	//			if fromExtractDataList[i].Transaction.To[0] == toExtractDataList[j].Transaction.To[0] {
-	//				fromExtractDataList[i].TxOutputs = toExtractDataList[j].TxOutputs
-	//			}
-	//		}
-	//	}
-	//
-	//	result.extractData[FromSourceKey] = fromExtractDataList
-	//} else if FromSourceKey != "" && ToSourceKey != "" {
-	//	result.extractData[FromSourceKey] = fromExtractDataList
-	//	result.extractData[ToSourceKey] = toExtractDataList
-	//} else if FromSourceKey != "" {
-	//	result.extractData[FromSourceKey] = fromExtractDataList
-	//} else if ToSourceKey != "" {
-	//	result.extractData[ToSourceKey] = toExtractDataList
-	//}
-	//
-	//isTokenTransfer := false
-	//if len(tokenEvent) > 0 {
-	//	isTokenTransfer = true
-	//}
+	//节点还没有交易回执，无法得到代币事件和手续费，由调用方记录为未扫交易等待重扫
+	receiptNotFound := func() (*ExtractResult, error) {
+		result.Success = false
+		result.unscanReason = "get tx receipt reply with null result"
+		return &result, nil
+	}
+
+	tokenEvent, err := this.UpdateTxByReceipt(tx)
+	if IsGatewayError(err, ErrUnknownTx) {
+		return receiptNotFound()
+	}
+	if err != nil {
+		this.wm.Log.Errorf("UpdateTxByReceipt failed, err=%v", err)
+		return nil, err
+	}
+
+	isTokenTransfer := false
+	if len(tokenEvent) > 0 {
+		isTokenTransfer = true
+	}
 
 	//提出主币交易单
-	extractData, err := this.extractETHTransaction(tx, false)
+	extractData, err := this.extractETHTransaction(tx, isTokenTransfer)
+	if IsGatewayError(err, ErrUnknownTx) {
+		return receiptNotFound()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -997,25 +1241,28 @@ func (this *FMBLockScanner) TransactionScanning(tx *BlockTransaction) (*ExtractR
 		}
 		extractDataArray = append(extractDataArray, data)
 		result.extractData[sourceKey] = extractDataArray
-		this.wm.WalletClient.FmGetFee(strings.Split(data.Transaction.To[0], ":")[0])
-	}
-
-	//提取代币交易单
-	//for contractAddress, tokenEventArray := range tokenEvent {
-	//	//提出主币交易单
-	//	extractERC20Data, err := this.extractERC20Transaction(tx, contractAddress, tokenEventArray)
-	//	if err != nil {
-	//		return nil, err
-	//	}
-	//	for sourceKey, data := range extractERC20Data {
-	//		extractDataArray := result.extractData[sourceKey]
-	//		if extractDataArray == nil {
-	//			extractDataArray = make([]*openwallet.TxExtractData, 0)
-	//		}
-	//		extractDataArray = append(extractDataArray, data)
-	//		result.extractData[sourceKey] = extractDataArray
-	//	}
-	//}
+	}
+
+	//提取代币交易单，一笔交易可能同时转出多个合约的代币，按合约地址排序保证结果顺序固定
+	contracts := make([]string, 0, len(tokenEvent))
+	for contractAddress := range tokenEvent {
+		contracts = append(contracts, contractAddress)
+	}
+	sort.Strings(contracts)
+	for _, contractAddress := range contracts {
+		extractERC20Data, err := this.extractERC20Transaction(tx, contractAddress, tokenEvent[contractAddress])
+		if err != nil {
+			return nil, err
+		}
+		for sourceKey, data := range extractERC20Data {
+			extractDataArray := result.extractData[sourceKey]
+			if extractDataArray == nil {
+				extractDataArray = make([]*openwallet.TxExtractData, 0)
+			}
+			extractDataArray = append(extractDataArray, data)
+			result.extractData[sourceKey] = extractDataArray
+		}
+	}
 
 	return &result, nil
 }
@@ -1045,12 +1292,7 @@ func (this *FMBLockScanner) extractETHTransaction(tx *BlockTransaction, isTokenT
 		return nil, err
 	}
 
-	// 20200310
-	//feeprice, err := tx.GetTxFeeEthString()
-	//if err != nil {
-	//	return nil, err
-	//}
-
+	var feeInput *openwallet.TxInput
 	sourceKey, ok := tx.FilterFunc(from)
 	if ok {
 		input := &openwallet.TxInput{}
@@ -1076,12 +1318,11 @@ func (this *FMBLockScanner) extractETHTransaction(tx *BlockTransaction, isTokenT
 		ed.TxInputs = append(ed.TxInputs, input)
 
 		//手续费作为一个输入
-		feeInput := &openwallet.TxInput{}
+		feeInput = &openwallet.TxInput{}
 		feeInput.Recharge.Sid = openwallet.GenTxInputSID(tx.Hash, this.wm.Symbol(), "", uint64(1))
 		feeInput.Recharge.TxID = tx.Hash
 		feeInput.Recharge.Address = from
 		feeInput.Recharge.Coin = coin
-		//feeInput.Recharge.Amount = feeprice
 		feeInput.Recharge.BlockHash = tx.BlockHash
 		feeInput.Recharge.BlockHeight = tx.BlockHeight
 		feeInput.Recharge.Index = 1 //账户模型填0
@@ -1115,10 +1356,22 @@ func (this *FMBLockScanner) extractETHTransaction(tx *BlockTransaction, isTokenT
 		ed.TxOutputs = append(ed.TxOutputs, output)
 	}
 
+	//只有涉及监听地址的交易才获取手续费
+	feeprice := "0"
+	if len(txExtractMap) > 0 {
+		feeprice, err = this.GetTxFeeEthString(tx)
+		if err != nil {
+			return nil, err
+		}
+		if feeInput != nil {
+			feeInput.Amount = feeprice
+		}
+	}
+
 	for _, extractData := range txExtractMap {
 
 		tx := &openwallet.Transaction{
-			//Fees:        feeprice,
+			Fees:        feeprice,
 			Coin:        coin,
 			BlockHash:   tx.BlockHash,
 			BlockHeight: tx.BlockHeight,
@@ -1131,7 +1384,6 @@ func (this *FMBLockScanner) extractETHTransaction(tx *BlockTransaction, isTokenT
 			Status:      status,
 			Reason:      reason,
 			TxType:      txType,
-			Fees:        "0",
 		}
 
 		wxID := openwallet.GenTransactionWxID(tx)
@@ -1142,7 +1394,7 @@ func (this *FMBLockScanner) extractETHTransaction(tx *BlockTransaction, isTokenT
 	return txExtractMap, nil
 }
 
-//extractERC20Transaction
+//extractERC20Transaction 提取监听合约的代币交易单，金额按合约精度换算
 func (this *FMBLockScanner) extractERC20Transaction(tx *BlockTransaction, contractAddress string, tokenEvent []*TransferEvent) (map[string]*openwallet.TxExtractData, error) {
 
 	nowUnix := time.Now().Unix()
@@ -1150,43 +1402,60 @@ func (this *FMBLockScanner) extractERC20Transaction(tx *BlockTransaction, contra
 	reason := ""
 	txExtractMap := make(map[string]*openwallet.TxExtractData)
 
-	contractId := openwallet.GenContractID(this.wm.Symbol(), contractAddress)
-	coin := openwallet.Coin{
-		Symbol:     this.wm.Symbol(),
-		IsContract: true,
-		ContractID: contractId,
-		Contract: openwallet.SmartContract{
-			ContractID: contractId,
-			Address:    contractAddress,
-			Symbol:     this.wm.Symbol(),
-		},
+	token, ok := this.WatchedToken(contractAddress)
+	if !ok {
+		return txExtractMap, nil
 	}
+	coin := this.tokenCoin(token)
 
 	//提取出账部分记录
-	from, err := this.extractERC20Detail(tx, contractAddress, tokenEvent, true, txExtractMap)
+	from, err := this.extractERC20Detail(tx, coin, tokenEvent, true, txExtractMap)
 	if err != nil {
 		return nil, err
 	}
 	//提取入账部分记录
-	to, err := this.extractERC20Detail(tx, contractAddress, tokenEvent, false, txExtractMap)
+	to, err := this.extractERC20Detail(tx, coin, tokenEvent, false, txExtractMap)
+	if err != nil {
+		return nil, err
+	}
+
+	//代币交易的手续费以主币支付
+	feeprice := "0"
+	if len(txExtractMap) > 0 {
+		feeprice, err = this.GetTxFeeEthString(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	totalValue := big.NewInt(0)
+	for _, te := range tokenEvent {
+		tokenValue, err := ConvertToBigInt(te.Value, 16)
+		if err != nil {
+			return nil, err
+		}
+		totalValue.Add(totalValue, tokenValue)
+	}
+	amount, err := ConvertAmountToFloatDecimal(totalValue.String(), token.Decimals)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, extractData := range txExtractMap {
 		tx := &openwallet.Transaction{
-			Fees:        "0",
+			Fees:        feeprice,
 			Coin:        coin,
 			BlockHash:   tx.BlockHash,
 			BlockHeight: tx.BlockHeight,
 			TxID:        tx.Hash,
-			Amount:      "0",
+			Decimal:     int32(token.Decimals),
+			Amount:      amount.String(),
 			ConfirmTime: nowUnix,
 			From:        from,
 			To:          to,
 			Status:      status,
 			Reason:      reason,
-			TxType:      0,
+			TxType:      1,
 		}
 
 		wxID := openwallet.GenTransactionWxID(tx)
@@ -1197,25 +1466,31 @@ func (this *FMBLockScanner) extractERC20Transaction(tx *BlockTransaction, contra
 	return txExtractMap, nil
 }
 
-//extractERC20Detail
-func (this *FMBLockScanner) extractERC20Detail(tx *BlockTransaction, contractAddress string, tokenEvent []*TransferEvent, isInput bool, extractData map[string]*openwallet.TxExtractData) ([]string, error) {
-
-	var (
-		addrs  = make([]string, 0)
-		txType = uint64(0)
-	)
-
-	contractId := openwallet.GenContractID(this.wm.Symbol(), contractAddress)
-	coin := openwallet.Coin{
+//tokenCoin 代币合约对应的币种信息
+func (this *FMBLockScanner) tokenCoin(token *ERC20Token) openwallet.Coin {
+	contractId := openwallet.GenContractID(this.wm.Symbol(), token.Address)
+	return openwallet.Coin{
 		Symbol:     this.wm.Symbol(),
 		IsContract: true,
 		ContractID: contractId,
 		Contract: openwallet.SmartContract{
 			ContractID: contractId,
-			Address:    contractAddress,
+			Address:    token.Address,
 			Symbol:     this.wm.Symbol(),
+			Token:      token.Symbol,
+			Name:       token.Name,
+			Protocol:   "ERC20",
+			Decimals:   uint64(token.Decimals),
 		},
 	}
+}
+
+func (this *FMBLockScanner) extractERC20Detail(tx *BlockTransaction, coin openwallet.Coin, tokenEvent []*TransferEvent, isInput bool, extractData map[string]*openwallet.TxExtractData) ([]string, error) {
+
+	var (
+		addrs  = make([]string, 0)
+		txType = uint64(1)
+	)
 
 	createAt := time.Now().Unix()
 	for i, te := range tokenEvent {
@@ -1226,11 +1501,17 @@ func (this *FMBLockScanner) extractERC20Detail(tx *BlockTransaction, contractAdd
 		} else {
 			address = te.TokenTo
 		}
+		//事件中的地址为0x格式，转为链上的FM格式
+		address = ReplaceFmToAddress(address)
 
 		tokenValue, err := ConvertToBigInt(te.Value, 16)
 		if err != nil {
 			return nil, err
 		}
+		amount, err := ConvertAmountToFloatDecimal(tokenValue.String(), int(coin.Contract.Decimals))
+		if err != nil {
+			return nil, err
+		}
 
 		sourceKey, ok := tx.FilterFunc(address)
 		if ok {
@@ -1240,7 +1521,7 @@ func (this *FMBLockScanner) extractERC20Detail(tx *BlockTransaction, contractAdd
 			detail.TxID = tx.Hash
 			detail.Address = address
 			detail.Coin = coin
-			detail.Amount = tokenValue.String()
+			detail.Amount = amount.String()
 			detail.BlockHash = tx.BlockHash
 			detail.BlockHeight = tx.BlockHeight
 			detail.Index = uint64(i) //账户模型填0
@@ -1263,7 +1544,7 @@ func (this *FMBLockScanner) extractERC20Detail(tx *BlockTransaction, contractAdd
 
 		}
 
-		addrs = append(addrs, address+":"+tokenValue.String())
+		addrs = append(addrs, address+":"+amount.String())
 
 	}
 	return addrs, nil
@@ -1289,7 +1570,7 @@ func (this *FMBLockScanner) GetScannedBlockHeader() (*openwallet.BlockHeader, er
 		blockHeight, err = this.wm.WalletClient.FmGetBlockNumber()
 		if err != nil {
 			this.wm.Log.Errorf("FmGetBlockNumber failed, err=%v", err)
-			return nil, err
+			return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get block number failed")
 		}
 
 		//就上一个区块链为当前区块
@@ -1298,7 +1579,7 @@ func (this *FMBLockScanner) GetScannedBlockHeader() (*openwallet.BlockHeader, er
 		block, err := this.wm.WalletClient.FMGetBlockSpecByBlockNum(blockHeight, false)
 		if err != nil {
 			this.wm.Log.Errorf("get block spec by block number failed, err=%v", err)
-			return nil, err
+			return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get block[%d] failed", blockHeight)
 		}
 		hash = block.BlockHash
 	}
@@ -1318,13 +1599,13 @@ func (this *FMBLockScanner) GetCurrentBlockHeader() (*openwallet.BlockHeader, er
 	blockHeight, err = this.wm.WalletClient.FmGetBlockNumber()
 	if err != nil {
 		this.wm.Log.Errorf("FmGetBlockNumber failed, err=%v", err)
-		return nil, err
+		return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get block number failed")
 	}
 
 	block, err := this.wm.WalletClient.FMGetBlockSpecByBlockNum(blockHeight, false)
 	if err != nil {
 		this.wm.Log.Errorf("get block spec by block number failed, err=%v", err)
-		return nil, err
+		return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get block[%d] failed", blockHeight)
 	}
 	hash = block.BlockHash
 
@@ -1343,12 +1624,7 @@ func (this *FMBLockScanner) GetGlobalMaxBlockHeight() uint64 {
 
 func (this *FMBLockScanner) SaveUnscannedTransaction(tx *BlockTransaction, reason string) error {
 
-	unscannedRecord := &openwallet.UnscanRecord{
-		TxID:        tx.Hash,
-		BlockHeight: tx.BlockHeight,
-		Reason:      reason,
-		Symbol:      this.wm.Symbol(),
-	}
+	unscannedRecord := openwallet.NewUnscanRecord(tx.BlockHeight, tx.Hash, reason, this.wm.Symbol())
 	return this.SaveUnscanRecord(unscannedRecord)
 }
 
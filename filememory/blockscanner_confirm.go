@@ -0,0 +1,164 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//交易通知的阶段，观测者可通过TxStage判断
+//
+//	provisional 首次发现，确认数不足，ConfirmTime为0，Confirm为当前确认数
+//	final       达到RequiredConfirmations，ConfirmTime为最终确认的时间
+//	reverted    已通知的交易所在区块被孤立，Status为"0"，Reason为reverted
+const (
+	TxStageProvisional = "provisional"
+	TxStageFinal       = "final"
+	TxStageReverted    = "reverted"
+)
+
+//TxStage 获取交易通知所处的阶段
+func TxStage(tx *openwallet.Transaction) string {
+	if tx.Reason == TxStageReverted {
+		return TxStageReverted
+	}
+	if tx.ConfirmTime == 0 {
+		return TxStageProvisional
+	}
+	return TxStageFinal
+}
+
+//confirmState 区块在节点最新高度tip下的确认数，以及是否已达到入账确认数。
+//交易池的交易没有区块高度，沿用首次发现即最终通知
+func (this *FMBLockScanner) confirmState(height, tip uint64) (int64, bool) {
+	if height == 0 {
+		return 0, true
+	}
+	confirms := uint64(1)
+	if tip > height {
+		confirms = tip - height + 1
+	}
+	return int64(confirms), this.RequiredConfirmations <= 1 || confirms >= this.RequiredConfirmations
+}
+
+//setConfirmState 按确认状态设置通知的交易
+func setConfirmState(tx *openwallet.Transaction, confirms int64, final bool) {
+	tx.Confirm = confirms
+	if final {
+		tx.ConfirmTime = time.Now().Unix()
+	} else {
+		tx.ConfirmTime = 0
+	}
+}
+
+//GetPendingConfirmations 获取已发送临时通知、等待达到确认数的提取结果
+func (this *FMBLockScanner) GetPendingConfirmations() ([]*IndexedExtractData, error) {
+	return this.findIndexedExtractData(q.Eq("Stage", TxStageProvisional))
+}
+
+//confirmPendingTransactions 节点最新高度为tip时，发送达到确认数的最终通知。
+//所在高度的索引区块哈希已改变的视为被孤立，发送撤销通知
+func (this *FMBLockScanner) confirmPendingTransactions(tip uint64) error {
+	if this.RequiredConfirmations <= 1 || tip+1 < this.RequiredConfirmations {
+		return nil
+	}
+	maxHeight := tip + 1 - this.RequiredConfirmations
+
+	db, err := this.openIndexDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var records []*IndexedExtractData
+	err = db.Select(q.Eq("Stage", TxStageProvisional), q.Lte("BlockHeight", maxHeight)).Find(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, record := range records {
+		local, err := getIndexedBlock(db, record.BlockHeight, false)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		if local != nil && local.BlockHash != record.BlockHash {
+			this.notifyReverted(record)
+			err = db.DeleteStruct(record)
+		} else {
+			confirms, _ := this.confirmState(record.BlockHeight, tip)
+			setConfirmState(record.Data.Transaction, confirms, true)
+			if !this.notifyIndexedExtractData(record) {
+				//通知失败保留临时状态，下次再发送
+				continue
+			}
+			record.Stage = TxStageFinal
+			err = db.Save(record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//revertIndexedBlock 区块被孤立，给该高度发送过的提取结果发送撤销通知，并删除该高度的索引
+func (this *FMBLockScanner) revertIndexedBlock(height uint64) error {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var records []*IndexedExtractData
+	err = db.Find("BlockHeight", height, &records)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, record := range records {
+		this.notifyReverted(record)
+	}
+
+	return deleteIndexedBlock(db, height)
+}
+
+//notifyReverted 发送撤销通知，撤销通知只发送一次
+func (this *FMBLockScanner) notifyReverted(record *IndexedExtractData) {
+	this.wm.Log.Warningf("transaction %s on orphaned block %d reverted", record.TxID, record.BlockHeight)
+	tx := record.Data.Transaction
+	tx.Confirm = 0
+	tx.ConfirmTime = 0
+	tx.Status = "0"
+	tx.Reason = TxStageReverted
+	record.Stage = TxStageReverted
+	this.notifyIndexedExtractData(record)
+}
+
+//notifyIndexedExtractData 把索引的提取结果通知给所有观测者，全部成功时返回true
+func (this *FMBLockScanner) notifyIndexedExtractData(record *IndexedExtractData) bool {
+	success := true
+	for o := range this.Observers {
+		err := o.BlockExtractDataNotify(record.SourceKey, record.Data)
+		if err != nil {
+			this.wm.Log.Errorf("BlockExtractDataNotify account[%v] failed, err = %v", record.SourceKey, err)
+			success = false
+		}
+	}
+	return success
+}
@@ -17,6 +17,7 @@ package filememory
 
 import (
 	"fmt"
+	"github.com/asdine/storm"
 	"github.com/blocktree/openwallet/openwallet"
 )
 
@@ -69,21 +70,30 @@ func (bs *FMBLockScanner) SaveLocalBlock(blockHeader *FMBlock) error {
 	return bs.BlockchainDAI.SaveLocalBlockHead(header)
 }
 
-//GetLocalBlock 获取本地区块数据
+//GetLocalBlock 获取本地区块数据，本地索引有记录时包括区块中的交易
 func (bs *FMBLockScanner) GetLocalBlock(height uint64) (*FMBlock, error) {
 
 	if bs.BlockchainDAI == nil {
 		return nil, fmt.Errorf("Blockchain DAI is not setup ")
 	}
 
+	block, err := bs.GetIndexedBlock(height)
+	if err == nil {
+		return block, nil
+	}
+	if err != storm.ErrNotFound {
+		bs.wm.Log.Warningf("get block index on height %v failed, err=%v", height, err)
+	}
+
 	header, err := bs.BlockchainDAI.GetLocalBlockHeadByHeight(height, bs.wm.Symbol())
 	if err != nil {
 		return nil, err
 	}
 
-	block := &FMBlock{
+	block = &FMBlock{
 		BlockHeader: BlockHeader{
 			BlockHash:       header.Hash,
+			PreviousHash:    header.Previousblockhash,
 			BlockHeight:     header.Height,
 		},
 	}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//本地索引记录已扫区块、区块中的交易和发送过的提取结果，
+//区块分叉时按索引给孤立区块上已通知的交易发送撤销通知
+
+//LOCAL_INDEX_DB 本地索引数据库文件名
+const LOCAL_INDEX_DB = "block_index.db"
+
+//IndexedBlock 已扫区块
+type IndexedBlock struct {
+	Height       uint64 `storm:"id"`
+	Hash         string `storm:"index"`
+	PreviousHash string
+	TxCount      int
+	ScanTime     int64
+}
+
+//IndexedTransaction 已扫区块中的交易，FromKey、ToKey为统一格式的地址，用于按地址查询
+type IndexedTransaction struct {
+	TxID             string `storm:"id"`
+	BlockTransaction `storm:"inline"`
+	FromKey          string `storm:"index"`
+	ToKey            string `storm:"index"`
+}
+
+//IndexedExtractData 发送过的提取结果，Stage为最近一次通知的阶段，FromKey、ToKey为首个输入和输出的统一格式地址，用于按地址查询
+type IndexedExtractData struct {
+	ID          string `storm:"id"`
+	SourceKey   string `storm:"index"`
+	TxID        string `storm:"index"`
+	BlockHeight uint64 `storm:"index"`
+	BlockHash   string
+	Stage       string `storm:"index"`
+	FromKey     string `storm:"index"`
+	ToKey       string `storm:"index"`
+	Data        *openwallet.TxExtractData
+}
+
+//indexAddressKey 地址统一为小写、去掉FM或0x前缀的格式
+func indexAddressKey(address string) string {
+	if a, err := ParseFMAddress(address); err == nil {
+		return a.Hex()
+	}
+	key := strings.ToLower(address)
+	key = strings.TrimPrefix(key, "fm")
+	key = strings.TrimPrefix(key, "0x")
+	return key
+}
+
+//newIndexedExtractData 创建提取结果的索引记录，同一交易同一账户的第i个结果使用固定ID
+func newIndexedExtractData(sourceKey string, index int, data *openwallet.TxExtractData) *IndexedExtractData {
+	tx := data.Transaction
+	record := &IndexedExtractData{
+		ID:          fmt.Sprintf("%s_%s_%d", sourceKey, tx.WxID, index),
+		SourceKey:   sourceKey,
+		TxID:        tx.TxID,
+		BlockHeight: tx.BlockHeight,
+		BlockHash:   tx.BlockHash,
+		Stage:       TxStage(tx),
+		Data:        data,
+	}
+	if len(data.TxInputs) > 0 {
+		record.FromKey = indexAddressKey(data.TxInputs[0].Address)
+	}
+	if len(data.TxOutputs) > 0 {
+		record.ToKey = indexAddressKey(data.TxOutputs[0].Address)
+	}
+	return record
+}
+
+//openIndexDB 打开本地索引数据库
+func (this *FMBLockScanner) openIndexDB() (*storm.DB, error) {
+	return OpenDB(this.wm.Config.DbPath, LOCAL_INDEX_DB)
+}
+
+//SaveIndexedBlock 记录已扫区块和区块中的全部交易
+func (this *FMBLockScanner) SaveIndexedBlock(block *FMBlock) error {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbTx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	err = dbTx.Save(&IndexedBlock{
+		Height:       block.BlockHeight,
+		Hash:         block.BlockHash,
+		PreviousHash: block.PreviousHash,
+		TxCount:      len(block.Transactions),
+		ScanTime:     time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		tx.BlockNumber = block.BlockHeight
+		tx.BlockHash = block.BlockHash
+		err = dbTx.Save(&IndexedTransaction{
+			TxID:             tx.Hash,
+			BlockTransaction: tx,
+			FromKey:          indexAddressKey(tx.From),
+			ToKey:            indexAddressKey(tx.To),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return dbTx.Commit()
+}
+
+//saveIndexedExtractData 记录发送过的提取结果
+func (this *FMBLockScanner) saveIndexedExtractData(extractDataList map[string][]*openwallet.TxExtractData) error {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for key, extractData := range extractDataList {
+		for i, data := range extractData {
+			err = db.Save(newIndexedExtractData(key, i, data))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//getIndexedBlock 在已打开的索引数据库中获取区块，withTxs为true时同时读取交易
+func getIndexedBlock(db *storm.DB, height uint64, withTxs bool) (*FMBlock, error) {
+	var indexed IndexedBlock
+	err := db.One("Height", height, &indexed)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &FMBlock{
+		BlockHeader: BlockHeader{
+			BlockNumber:  fmt.Sprintf("%d", indexed.Height),
+			BlockHash:    indexed.Hash,
+			PreviousHash: indexed.PreviousHash,
+			BlockHeight:  indexed.Height,
+		},
+		Transactions: make([]BlockTransaction, 0, indexed.TxCount),
+	}
+	if !withTxs || indexed.TxCount == 0 {
+		return block, nil
+	}
+
+	var txs []*IndexedTransaction
+	err = db.Find("BlockHash", indexed.Hash, &txs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	for _, tx := range txs {
+		block.Transactions = append(block.Transactions, tx.BlockTransaction)
+	}
+	return block, nil
+}
+
+//GetIndexedBlock 获取本地索引的区块，包括区块中的交易
+func (this *FMBLockScanner) GetIndexedBlock(height uint64) (*FMBlock, error) {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return getIndexedBlock(db, height, true)
+}
+
+//GetIndexedTransaction 按txid获取本地索引的交易
+func (this *FMBLockScanner) GetIndexedTransaction(txid string) (*BlockTransaction, error) {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var indexed IndexedTransaction
+	err = db.One("TxID", txid, &indexed)
+	if err != nil {
+		return nil, err
+	}
+	return &indexed.BlockTransaction, nil
+}
+
+//GetIndexedTransactionsByHeight 获取本地索引中指定高度的交易
+func (this *FMBLockScanner) GetIndexedTransactionsByHeight(height uint64) ([]*BlockTransaction, error) {
+	return this.findIndexedTransactions(q.Eq("BlockNumber", height))
+}
+
+//GetIndexedTransactionsByAddress 获取本地索引中发送方或接收方为address的交易
+func (this *FMBLockScanner) GetIndexedTransactionsByAddress(address string) ([]*BlockTransaction, error) {
+	key := indexAddressKey(address)
+	return this.findIndexedTransactions(q.Or(q.Eq("FromKey", key), q.Eq("ToKey", key)))
+}
+
+//findIndexedTransactions 按条件查询本地索引的交易，按高度排序
+func (this *FMBLockScanner) findIndexedTransactions(matcher q.Matcher) ([]*BlockTransaction, error) {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var indexed []*IndexedTransaction
+	err = db.Select(matcher).OrderBy("BlockNumber").Find(&indexed)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	txs := make([]*BlockTransaction, 0, len(indexed))
+	for _, tx := range indexed {
+		txs = append(txs, &tx.BlockTransaction)
+	}
+	return txs, nil
+}
+
+//GetIndexedExtractDataByTxID 获取交易发送过的提取结果
+func (this *FMBLockScanner) GetIndexedExtractDataByTxID(txid string) ([]*IndexedExtractData, error) {
+	return this.findIndexedExtractData(q.Eq("TxID", txid))
+}
+
+//GetIndexedExtractDataByHeight 获取指定高度发送过的提取结果
+func (this *FMBLockScanner) GetIndexedExtractDataByHeight(height uint64) ([]*IndexedExtractData, error) {
+	return this.findIndexedExtractData(q.Eq("BlockHeight", height))
+}
+
+//GetIndexedExtractDataByAddress 获取输入或输出涉及address的提取结果
+func (this *FMBLockScanner) GetIndexedExtractDataByAddress(address string) ([]*IndexedExtractData, error) {
+	key := indexAddressKey(address)
+	return this.findIndexedExtractData(q.Or(q.Eq("FromKey", key), q.Eq("ToKey", key)))
+}
+
+//findIndexedExtractData 按条件查询提取结果，按高度排序
+func (this *FMBLockScanner) findIndexedExtractData(matcher q.Matcher) ([]*IndexedExtractData, error) {
+	db, err := this.openIndexDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []*IndexedExtractData
+	err = db.Select(matcher).OrderBy("BlockHeight").Find(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if records == nil {
+		records = make([]*IndexedExtractData, 0)
+	}
+	return records, nil
+}
+
+//deleteIndexedBlock 删除孤立区块的索引，包括区块、交易和提取结果
+func deleteIndexedBlock(db *storm.DB, height uint64) error {
+	dbTx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	err = dbTx.Select(q.Eq("Height", height)).Delete(&IndexedBlock{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = dbTx.Select(q.Eq("BlockNumber", height)).Delete(&IndexedTransaction{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = dbTx.Select(q.Eq("BlockHeight", height)).Delete(&IndexedExtractData{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return dbTx.Commit()
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"sync"
+)
+
+//watchedTokens 扫描时监听的代币合约，按统一格式的合约地址索引
+type watchedTokens struct {
+	mu     sync.RWMutex
+	tokens map[string]*ERC20Token
+}
+
+//LoadWatchedTokens 从ERC20Token库重新加载未停用的代币合约，每轮扫描开始时调用
+func (this *FMBLockScanner) LoadWatchedTokens() error {
+	list, err := this.wm.GetERC20TokenList()
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]*ERC20Token, len(list))
+	for i := range list {
+		if list[i].Disabled {
+			continue
+		}
+		tokens[indexAddressKey(list[i].Address)] = &list[i]
+	}
+
+	this.watched.mu.Lock()
+	this.watched.tokens = tokens
+	this.watched.mu.Unlock()
+	return nil
+}
+
+//WatchedToken 获取监听的代币合约，合约未监听时返回false
+func (this *FMBLockScanner) WatchedToken(contractAddress string) (*ERC20Token, bool) {
+	this.watched.mu.RLock()
+	defer this.watched.mu.RUnlock()
+	token, ok := this.watched.tokens[indexAddressKey(contractAddress)]
+	return token, ok
+}
+
+//hasWatchedTokens 是否有监听的代币合约
+func (this *FMBLockScanner) hasWatchedTokens() bool {
+	this.watched.mu.RLock()
+	defer this.watched.mu.RUnlock()
+	return len(this.watched.tokens) > 0
+}
+
+//reloadWatchedTokens 重新加载监听的代币合约，失败时沿用上次加载的结果
+func (this *FMBLockScanner) reloadWatchedTokens() {
+	err := this.LoadWatchedTokens()
+	if err != nil {
+		this.wm.Log.Errorf("load watched tokens failed, err=%v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"path/filepath"
 	"strings"
+	"time"
 
 	//	"github.com/astaxie/beego/config"
 
@@ -52,6 +53,9 @@ const (
 	ETH_GET_TOKEN_BALANCE_METHOD      = "0x70a08231"
 	ETH_TRANSFER_TOKEN_BALANCE_METHOD = "0xa9059cbb"
 	ETH_TRANSFER_EVENT_ID             = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	ETH_GET_TOKEN_NAME_METHOD         = "0x06fdde03"
+	ETH_GET_TOKEN_SYMBOL_METHOD       = "0x95d89b41"
+	ETH_GET_TOKEN_DECIMALS_METHOD     = "0x313ce567"
 )
 
 const (
@@ -83,7 +87,7 @@ type WalletConfig struct {
 	//CertFileName string
 	//区块链数据文件
 	//BlockchainFile string
-	//是否测试网络
+	//是否测试网络，决定地址参数
 	IsTestNet bool
 	// 核心钱包是否只做监听
 	//CoreWalletWatchOnly bool
@@ -95,6 +99,8 @@ type WalletConfig struct {
 	BackupDir string
 	//钱包服务API
 	ServerAPI string
+	//钱包服务API节点列表
+	ServerAPIList []string
 	//钱包安装的路径
 	//NodeInstallPath string
 	//钱包数据文件目录
@@ -113,17 +119,57 @@ type WalletConfig struct {
 	//小数位长度
 	//	CoinDecimal decimal.Decimal `json:"-"`
 	EthereumKeyPath string
-	//是否完全依靠本地维护nonce
+	//是否使用本地nonce账本分配nonce
 	LocalNonce bool
-	ChainID    uint64
+	//本地nonce账本中预留未广播的nonce的有效时间，单位秒，0表示不过期
+	NonceReserveTimeout int64
+	//nonce缺口检查间隔，单位秒，0表示不检查
+	NonceGapCheckInterval int64
+	//是否自动用转给自己的交易填补nonce缺口
+	NonceGapAutoFill bool
+	ChainID          uint64
+	//节点中找不到已广播交易多久后视为丢弃，单位秒，0表示只在nonce被其他交易使用时视为丢弃
+	SentTxDropTimeout int64
+	//扫描和签名前是否与节点握手，比对链ID、网络ID和参考区块
+	NetworkCheck bool
+	//节点的网络ID，为空时不比对
+	NetworkID string
+	//参考区块的高度，默认为创世区块
+	ReferenceBlockHeight uint64
+	//参考区块的哈希，为空时不比对
+	ReferenceBlockHash string
 	//数据目录
 	DataDir string
 	//固定gasLimit值
 	GasLimit *big.Int
 	// 固定 gasPrice 值
 	GasPrice *big.Int
+	//手续费策略：fixed、estimate、multiplier
+	FeePolicy string
+	//multiplier策略的估算值倍率
+	FeeMultiplier string
+	//multiplier策略的gasLimit上限，0表示不限制
+	MaxGasLimit *big.Int
+	//multiplier策略的gasPrice上限，0表示不限制
+	MaxGasPrice *big.Int
 	// 汇总并发控制
 	SumThreadControl int
+	//区块扫描并发提取的线程数
+	ScanWorkers int
+	//区块扫描每轮预取的区块数
+	ScanLookahead uint64
+	//最大回滚深度
+	MaxReorgDepth uint64
+	//入账需要的确认数，区块达到该深度后发送最终通知
+	RequiredConfirmations uint64
+	//充值地址池中预先生成的未分配地址数，0表示不预先生成
+	DepositAddressPoolSize uint64
+	//节点请求的超时和重试策略
+	RetryPolicy *RetryPolicy
+	//广播交易的回调地址
+	NotifyURL string
+	//申请手续费的回调地址
+	FeeNotifyURL string
 }
 
 func makeEthDefaultConfig(ConfigFilePath string) string {
@@ -177,7 +223,7 @@ func (this *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	//this.Config.ConfigFileName = c.String("ConfigFileName") //"eth.ini"
 	//区块链数据文件
 	//this.Config.BlockchainFile = c.String("BlockchainFile") //"blockchain.db"
-	//是否测试网络
+	//是否测试网络，决定地址参数
 	//isTestNet, err := c.Bool("isTestNet")
 	//if err != nil {
 	//	log.Error("isTestNet error, err=", err)
@@ -189,8 +235,9 @@ func (this *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	//this.Config.DbPath = c.String("DbPath") //filepath.Join(rootDir, "eth", "db")
 	//备份路径
 	//this.Config.BackupDir = c.String("BackupDir") //filepath.Join(rootDir, "eth", "backup")
-	//钱包服务API
+	//钱包服务API，多个节点用逗号分隔
 	this.Config.ServerAPI = c.String("ServerAPI") //"http://127.0.0.1:8545"
+	this.Config.ServerAPIList = splitConfigList(this.Config.ServerAPI)
 
 	//threshold, err := c.Int64("Threshold")
 	//if err != nil {
@@ -210,13 +257,12 @@ func (this *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	//this.Config.CycleSeconds = uint64(cycleSeconds) //c.Int64("CycleSeconds")
 	//	this.ChainId = 12
 	//this.Config.EthereumKeyPath = c.String("EthereumKeyPath") //"/Users/peter/workspace/bitcoin/wallet/src/github.com/filememory/go-filememory/chain/keystore"
-	//每次都向节点查询nonce
-	//localnonce, err := c.Bool("LocalNonce")
-	//if err != nil {
-	//	log.Error("LocalNonce error, err=", err)
-	//	return err
-	//}
-	//this.Config.LocalNonce = localnonce //c.Bool("LocalNonce")
+	//使用本地nonce账本，关闭时每次都向节点查询nonce
+	this.Config.LocalNonce = c.DefaultBool("LocalNonce", false)
+	this.Config.NonceReserveTimeout = c.DefaultInt64("NonceReserveTimeout", DEFAULT_NONCE_RESERVE_TIMEOUT)
+	this.Config.NonceGapCheckInterval = c.DefaultInt64("NonceGapCheckInterval", DEFAULT_NONCE_GAP_CHECK_INTERVAL)
+	this.Config.NonceGapAutoFill = c.DefaultBool("NonceGapAutoFill", false)
+	this.Config.SentTxDropTimeout = c.DefaultInt64("SentTxDropTimeout", DEFAULT_SENT_TX_DROP_TIMEOUT)
 	//区块链ID
 	chainId, err := c.Int64("ChainID")
 	if err != nil {
@@ -224,11 +270,55 @@ func (this *WalletManager) LoadAssetsConfig(c config.Configer) error {
 		return err
 	}
 	this.Config.ChainID = uint64(chainId) //c.Int64("ChainID") //12
+	//是否测试网络，决定地址参数
+	this.Config.IsTestNet = c.DefaultBool("isTestNet", false)
+	//与节点握手比对的网络信息
+	this.Config.NetworkCheck = c.DefaultBool("NetworkCheck", true)
+	this.Config.NetworkID = c.String("NetworkID")
+	this.Config.ReferenceBlockHeight = uint64(c.DefaultInt64("ReferenceBlockHeight", 0))
+	this.Config.ReferenceBlockHash = c.String("ReferenceBlockHash")
+	//重新加载配置后重新握手
+	this.networkLocker.Lock()
+	this.networkInfo = nil
+	this.networkRejected = nil
+	this.networkLocker.Unlock()
 
 	//this.StorageOld = keystore.NewHDKeystore(this.Config.KeyDir, keystore.StandardScryptN, keystore.StandardScryptP)
 	//storage := hdkeystore.NewHDKeystore(this.Config.KeyDir, hdkeystore.StandardScryptN, hdkeystore.StandardScryptP)
 	//this.Storage = storage
-	client := &Client{BaseURL: this.Config.ServerAPI, Debug: false}
+	//超时和重试策略
+	retry, err := LoadRetryPolicy(c)
+	if err != nil {
+		log.Error("retry policy error, err=", err)
+		return err
+	}
+	this.Config.RetryPolicy = retry
+	//多节点探测和切换
+	//网关认证和回调地址
+	auth, err := LoadGatewayAuth(c)
+	if err != nil {
+		log.Error("gateway auth error, err=", err)
+		return err
+	}
+	this.Config.NotifyURL = c.String("NotifyURL")
+	this.Config.FeeNotifyURL = c.String("FeeNotifyURL")
+	client := &Client{
+		BaseURL:      this.Config.ServerAPI,
+		Debug:        false,
+		Retry:        retry,
+		Auth:         auth,
+		NotifyURL:    this.Config.NotifyURL,
+		FeeNotifyURL: this.Config.FeeNotifyURL,
+	}
+	if len(this.Config.ServerAPIList) > 0 {
+		pool := NewNodePool(this.Config.ServerAPIList)
+		pool.CheckInterval = time.Duration(c.DefaultInt64("ServerAPICheckInterval", int64(DefaultNodeCheckInterval/time.Second))) * time.Second
+		pool.MaxLag = uint64(c.DefaultInt64("ServerAPIMaxLag", DefaultNodeMaxLag))
+		client.BaseURL = this.Config.ServerAPIList[0]
+		client.Pool = pool
+		//切换到未握手的节点前先握手
+		client.endpointCheck = this.endpointReady
+	}
 	this.WalletClient = client
 	this.Config.DataDir = c.String("dataDir")
 	GasLimit := c.String("GasLimit")
@@ -237,7 +327,34 @@ func (this *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	gasPrice := c.String("GasPrice")
 	this.Config.GasPrice = new(big.Int)
 	this.Config.GasPrice.SetString(gasPrice, 10)
+	//手续费策略
+	this.Config.FeePolicy = c.DefaultString("FeePolicy", FeePolicyFixed)
+	this.Config.FeeMultiplier = c.DefaultString("FeeMultiplier", DEFAULT_FEE_MULTIPLIER)
+	this.Config.MaxGasLimit, _ = new(big.Int).SetString(c.DefaultString("MaxGasLimit", "0"), 10)
+	this.Config.MaxGasPrice, _ = new(big.Int).SetString(c.DefaultString("MaxGasPrice", "0"), 10)
+	if this.Config.MaxGasLimit == nil || this.Config.MaxGasPrice == nil {
+		return errors.New("MaxGasLimit and MaxGasPrice must be integers")
+	}
+	_, err = NewFeePolicy(this.Config.FeePolicy, this.Config.GasLimit, this.Config.GasPrice,
+		this.Config.FeeMultiplier, this.Config.MaxGasLimit, this.Config.MaxGasPrice)
+	if err != nil {
+		return err
+	}
 	this.Config.SumThreadControl = c.DefaultInt("SumThreadControl", 5)
+	//区块扫描并发数和预取区块数
+	this.Config.ScanWorkers = c.DefaultInt("ScanWorkers", MAX_EXTRACTING_SIZE)
+	this.Config.ScanLookahead = uint64(c.DefaultInt64("ScanLookahead", MAX_EXTRACTING_SIZE))
+	//最大回滚深度，超过后暂停扫描
+	this.Config.MaxReorgDepth = uint64(c.DefaultInt64("MaxReorgDepth", MAX_REORG_DEPTH))
+	//入账需要的确认数，不足时先发送临时通知
+	this.Config.RequiredConfirmations = uint64(c.DefaultInt64("RequiredConfirmations", DEFAULT_REQUIRED_CONFIRMATIONS))
+	//充值地址池大小
+	this.Config.DepositAddressPoolSize = uint64(c.DefaultInt64("DepositAddressPoolSize", DEFAULT_DEPOSIT_ADDRESS_POOL_SIZE))
+	if bs, ok := this.Blockscanner.(*FMBLockScanner); ok {
+		bs.SetScanConcurrency(this.Config.ScanWorkers, this.Config.ScanLookahead)
+		bs.MaxReorgDepth = this.Config.MaxReorgDepth
+		bs.RequiredConfirmations = this.Config.RequiredConfirmations
+	}
 
 	//数据文件夹
 	this.Config.makeDataDir()
@@ -275,7 +392,7 @@ func (this *WalletConfig) LoadConfig(configFilePath string, configFileName strin
 	this.ConfigFileName = c.String("ConfigFileName") //"eth.ini"
 	//区块链数据文件
 	//this.BlockchainFile = c.String("BlockchainFile") //"blockchain.db"
-	//是否测试网络
+	//是否测试网络，决定地址参数
 	isTestNet, err := c.Bool("isTestNet")
 	if err != nil {
 		log.Error("isTestNet error, err=", err)
@@ -354,7 +471,7 @@ func (this *WalletConfig) LoadConfig(configFilePath string, configFileName strin
 //	//c.CertFileName = "rpc.cert"
 //	//区块链数据文件
 //	c.BlockchainFile = "blockchain.db"
-//	//是否测试网络
+//	//是否测试网络，决定地址参数
 //	c.IsTestNet = true
 //	// 核心钱包是否只做监听
 //	//c.CoreWalletWatchOnly = true
@@ -530,6 +647,13 @@ func (wc *WalletConfig) makeDataDir() {
 
 	//本地数据库文件路径
 	wc.DbPath = filepath.Join(wc.DataDir, strings.ToLower(wc.Symbol), "db")
+	//钱包密钥和地址导出路径，未配置时放在数据目录下
+	if len(wc.KeyDir) == 0 {
+		wc.KeyDir = filepath.Join(wc.DataDir, strings.ToLower(wc.Symbol), "key")
+	}
+	if len(wc.AddressDir) == 0 {
+		wc.AddressDir = filepath.Join(wc.DataDir, strings.ToLower(wc.Symbol), "address")
+	}
 
 	//创建目录
 	file.MkdirAll(wc.DbPath)
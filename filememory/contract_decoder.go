@@ -2,7 +2,6 @@ package filememory
 
 import (
 	"errors"
-	"github.com/blocktree/openwallet/common"
 	"math/big"
 	"strings"
 
@@ -92,6 +91,11 @@ func (this *WalletManager) GetTokenBalanceByAddress(contractAddr string, addrs .
 }
 
 func (this *EthContractDecoder) GetTokenBalanceByAddress(contract openwallet.SmartContract, address ...string) ([]*openwallet.TokenBalance, error) {
+	contract, err := this.wm.ResolveContract(contract)
+	if err != nil {
+		return nil, err
+	}
+
 	threadControl := make(chan int, 20)
 	defer close(threadControl)
 	resultChan := make(chan *openwallet.TokenBalance, 1024)
@@ -120,62 +124,17 @@ func (this *EthContractDecoder) GetTokenBalanceByAddress(contract openwallet.Sma
 			<-threadControl
 		}()
 
-		balanceConfirmed := new(big.Int)
-
-		////		log.Debugf("in query thread.")
-		//balanceConfirmed, err := this.wm.WalletClient.ERC20GetAddressBalance2(address, contract.Address, "latest")
-		//if err != nil {
-		//	log.Errorf("get address[%v] erc20 token balance failed, err=%v", address, err)
-		//	return
-		//}
-
-		//		log.Debugf("got balanceConfirmed of [%v] :%v", address, balanceConfirmed)
-
-		balances, err := this.wm.Blockscanner.GetBalanceByAddress(address)
-		if err != nil {
+		//按合约精度查询余额，FM代币从网关查询
+		balances, err := this.wm.GetTokenBalances(contract, address)
+		if err != nil || len(balances) == 0 {
 			log.Errorf("get address[%v] erc20 token balance failed, err=%v", address, err)
 			return
 		}
-		balanceAll := new(big.Int)
-		for _, b := range balances {
-			bI := new(big.Int)
-			bI.SetString(b.Balance, 10)
-			balanceAll.Add(balanceAll, bI)
-		}
-
-		//		log.Debugf("got balanceAll of [%v] :%v", address, balanceAll)
-		balanceUnconfirmed := big.NewInt(0)
-		//balanceUnconfirmed.Sub(balanceAll, balanceConfirmed)
-		bstr := common.BigIntToDecimals(balanceAll, int32(contract.Decimals))
-		//bstr, err := ConvertAmountToFloatDecimal(balanceAll.String(), int(contract.Decimals))
-		if err != nil {
-			log.Errorf("convert balanceAll to float string failed, err=%v", err)
-			return
-		}
-
-		cbstr := common.BigIntToDecimals(balanceConfirmed, int32(contract.Decimals))
-		//cbstr, err := ConvertAmountToFloatDecimal(balanceConfirmed.String(), int(contract.Decimals))
-		if err != nil {
-			log.Errorf("convert balanceConfirmed to float string failed, err=%v", err)
-			return
-		}
-
-		ucbstr := common.BigIntToDecimals(balanceUnconfirmed, int32(contract.Decimals))
-		//ucbstr, err := ConvertAmountToFloatDecimal(balanceUnconfirmed.String(), int(contract.Decimals))
-		if err != nil {
-			log.Errorf("convert balanceUnconfirmed to float string failed, err=%v", err)
-			return
-		}
+		balances[0].Symbol = contract.Symbol
 
 		balance = &openwallet.TokenBalance{
 			Contract: &contract,
-			Balance: &openwallet.Balance{
-				Address:          address,
-				Symbol:           contract.Symbol,
-				Balance:          bstr.String(),
-				ConfirmBalance:   cbstr.String(),
-				UnconfirmBalance: ucbstr.String(),
-			},
+			Balance:  balances[0],
 		}
 	}
 
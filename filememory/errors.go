@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//网关或节点错误的分类
+var (
+	ErrNonceTooLow       = errors.New("nonce too low")
+	ErrAuth              = errors.New("authentication failed")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrUnknownTx         = errors.New("unknown transaction")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrEmptyResponse     = errors.New("response is empty")
+	ErrAlreadyKnown      = errors.New("transaction already known")
+)
+
+//gatewayErrorKinds 按应答消息关键字归类错误，消息统一转小写后匹配
+var gatewayErrorKinds = []struct {
+	kind     error
+	keywords []string
+}{
+	{ErrNonceTooLow, []string{"nonce too low", "nonce is too low"}},
+	{ErrInsufficientFunds, []string{"insufficient funds", "insufficient balance"}},
+	{ErrAuth, []string{"invalid token", "token error", "token expired", "unauthorized", "authentication", "permission denied"}},
+	{ErrRateLimited, []string{"rate limit", "too many requests", "too frequent", "frequently"}},
+	{ErrUnknownTx, []string{"unknown transaction", "transaction not found", "tx not found"}},
+	{ErrAlreadyKnown, []string{"already known", "known transaction", "already imported"}},
+}
+
+//GatewayError 网关或节点返回的错误应答
+type GatewayError struct {
+	Method string //请求方法
+	Code   int64  //错误码
+	Msg    string //错误信息
+	Body   string //应答原文
+	Kind   error  //错误分类，无法归类时为空
+}
+
+//NewGatewayError 创建错误应答，并按错误信息归类
+func NewGatewayError(method string, code int64, msg string, body string) *GatewayError {
+	e := &GatewayError{
+		Method: method,
+		Code:   code,
+		Msg:    msg,
+		Body:   body,
+	}
+	lower := strings.ToLower(msg)
+	for _, k := range gatewayErrorKinds {
+		for _, keyword := range k.keywords {
+			if strings.Contains(lower, keyword) {
+				e.Kind = k.kind
+				return e
+			}
+		}
+	}
+	return e
+}
+
+//Error 保持原来的[code]msg格式
+func (e *GatewayError) Error() string {
+	return fmt.Sprintf("[%d]%s", e.Code, e.Msg)
+}
+
+//Is 错误分类与target相同，包装后的错误用IsGatewayError或GatewayErrorKind判断
+func (e *GatewayError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+//GatewayErrorKind 获取错误分类，不是GatewayError或无法归类时返回nil
+//包装的错误实现Unwrap时逐层查找
+func GatewayErrorKind(err error) error {
+	for err != nil {
+		if e, ok := err.(*GatewayError); ok {
+			return e.Kind
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+//IsGatewayError 判断错误是否属于指定分类
+func IsGatewayError(err error, kind error) bool {
+	return kind != nil && GatewayErrorKind(err) == kind
+}
+
+//ConvertGatewayError 把网关错误转为对应错误码的openwallet.Error，无法归类时使用defaultCode
+func ConvertGatewayError(err error, defaultCode uint64, format string, a ...interface{}) *openwallet.Error {
+	if err == nil {
+		return nil
+	}
+	if owErr, ok := err.(*openwallet.Error); ok {
+		return owErr
+	}
+	code := defaultCode
+	switch GatewayErrorKind(err) {
+	case ErrNonceTooLow:
+		code = openwallet.ErrNonceInvaild
+	case ErrInsufficientFunds:
+		code = openwallet.ErrInsufficientFees
+	case ErrAuth, ErrRateLimited, ErrEmptyResponse:
+		code = openwallet.ErrCallFullNodeAPIFailed
+	case ErrAlreadyKnown:
+		//交易已在节点的交易池中，重复广播
+		code = openwallet.ErrSubmitRawTransactionFailed
+	case ErrUnknownTx:
+		//节点查不到交易，没有对应的错误码
+		code = openwallet.ErrUnknownException
+	}
+	return openwallet.Errorf(code, "%s: %v", fmt.Sprintf(format, a...), err)
+}
+
+//调用方的Coin无法确定主币或代币交易时的错误分类
+var (
+	ErrUnsupportedCoin       = errors.New("unsupported coin")
+	ErrContractRequired      = errors.New("contract address is required for token transaction")
+	ErrUnexpectedContract    = errors.New("contract address is not allowed for native coin transaction")
+	ErrUnsupportedCoinAction = errors.New("unsupported action for the coin")
+)
+
+//CoinModeError 调用方的Coin不支持的交易模式
+type CoinModeError struct {
+	Action string          //交易操作：create、submit、summary
+	Coin   openwallet.Coin //调用方的Coin
+	Kind   error           //错误分类
+}
+
+//Error 包含调用方的币种和合约信息
+func (e *CoinModeError) Error() string {
+	return fmt.Sprintf("%s %s transaction failed: %v (isContract: %v, contract: %s, protocol: %s)",
+		e.Action, e.Coin.Symbol, e.Kind, e.Coin.IsContract, e.Coin.Contract.Address, e.Coin.Contract.Protocol)
+}
+
+//Is 不支持的模式分类与target相同
+func (e *CoinModeError) Is(target error) bool {
+	return e.Kind == target
+}
+
+//ErrNetworkMismatch 节点所在网络与配置不一致
+var ErrNetworkMismatch = errors.New("network does not match the configuration")
+
+//NetworkMismatchError 节点返回的网络信息与配置不一致的项
+type NetworkMismatchError struct {
+	Field  string //不一致的项：chainID、networkID、referenceBlock
+	Node   string //节点返回的值
+	Config string //配置的值
+}
+
+//Error 包含节点和配置的值
+func (e *NetworkMismatchError) Error() string {
+	return fmt.Sprintf("%v: %s of node is %s, configured %s", ErrNetworkMismatch, e.Field, e.Node, e.Config)
+}
+
+//Is target为ErrNetworkMismatch
+func (e *NetworkMismatchError) Is(target error) bool {
+	return target == ErrNetworkMismatch
+}
+
+//ErrNetworkUnverified 无法向节点查询网络信息，不能确认节点所在的网络
+var ErrNetworkUnverified = errors.New("network of the node can not be verified")
+
+//NetworkUnverifiedError 握手时查询网络信息失败
+type NetworkUnverifiedError struct {
+	Endpoint string //节点地址
+	Err      error  //查询失败的原因
+}
+
+//Error 包含节点地址和失败原因
+func (e *NetworkUnverifiedError) Error() string {
+	return fmt.Sprintf("%v: %s, err=%v", ErrNetworkUnverified, e.Endpoint, e.Err)
+}
+
+//Is target为ErrNetworkUnverified
+func (e *NetworkUnverifiedError) Is(target error) bool {
+	return target == ErrNetworkUnverified
+}
+
+//Unwrap 查询失败的原因
+func (e *NetworkUnverifiedError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestNewGatewayError_Kind(t *testing.T) {
+	tests := []struct {
+		msg  string
+		kind error
+	}{
+		{"Returned error: nonce too low", ErrNonceTooLow},
+		{"Returned error: insufficient funds for gas * price + value", ErrInsufficientFunds},
+		{"invalid token", ErrAuth},
+		{"Too Many Requests", ErrRateLimited},
+		{"unknown transaction", ErrUnknownTx},
+		{"already known", ErrAlreadyKnown},
+		{"known transaction: 0xd6866d33", ErrAlreadyKnown},
+		{"system error", nil},
+	}
+	for _, test := range tests {
+		e := NewGatewayError("pushtx", 10001, test.msg, "")
+		if e.Kind != test.kind {
+			t.Errorf("kind of [%s] = %v, want %v", test.msg, e.Kind, test.kind)
+		}
+		if e.Error() != "[10001]"+test.msg {
+			t.Errorf("unexpected error string: %s", e.Error())
+		}
+	}
+}
+
+func TestClient_GatewayError(t *testing.T) {
+	node := NewFakeNode()
+	client := node.NewClient()
+
+	node.FailNext("pushtx", 10001, "Returned error: nonce too low")
+	_, err := client.fmSendRawTransaction("0x00")
+	gwErr, ok := err.(*GatewayError)
+	if !ok {
+		t.Fatalf("err type = %T, want *GatewayError", err)
+	}
+	if gwErr.Method != "pushtx" || gwErr.Code != 10001 || gwErr.Body == "" {
+		t.Errorf("unexpected gateway error: %+v", gwErr)
+	}
+	if !IsGatewayError(err, ErrNonceTooLow) {
+		t.Errorf("err should be ErrNonceTooLow")
+	}
+
+	node.FailNext("eth_call", -32000, "insufficient funds for transfer")
+	_, err = client.Call("eth_call", 1, nil)
+	if !IsGatewayError(err, ErrInsufficientFunds) || err.(*GatewayError).Method != "eth_call" {
+		t.Errorf("eth_call err = %v, want ErrInsufficientFunds", err)
+	}
+
+	_, err = client.EthGetTransactionByHash("0x01")
+	if !IsGatewayError(err, ErrUnknownTx) {
+		t.Errorf("missing tx err = %v, want ErrUnknownTx", err)
+	}
+}
+
+func TestClient_RetryRateLimited(t *testing.T) {
+	node := NewFakeNode()
+	node.SetTip(3)
+	client := testRetryClient(node)
+
+	node.FailNext("blocknumber", 10005, "too many requests")
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Errorf("rate limited call should be retried, err=%v", err)
+	}
+	if node.Calls("blocknumber") != 2 {
+		t.Errorf("blocknumber calls = %d, want 2", node.Calls("blocknumber"))
+	}
+}
+
+func TestConvertGatewayError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code uint64
+	}{
+		{NewGatewayError("pushtx", 10001, "nonce too low", ""), openwallet.ErrNonceInvaild},
+		{NewGatewayError("pushtx", 10001, "insufficient funds for gas * price + value", ""), openwallet.ErrInsufficientFees},
+		{NewGatewayError("pushtx", 10003, "invalid token", ""), openwallet.ErrCallFullNodeAPIFailed},
+		{NewGatewayError("pushtx", 10001, "system error", ""), openwallet.ErrSubmitRawTransactionFailed},
+		{errors.New("connection refused"), openwallet.ErrSubmitRawTransactionFailed},
+		{NewGatewayError("pushtx", 10001, "already known", ""), openwallet.ErrSubmitRawTransactionFailed},
+		{NewGatewayError("gettx", 10001, "transaction not found", ""), openwallet.ErrUnknownException},
+		{openwallet.Errorf(openwallet.ErrNonceInvaild, "local nonce"), openwallet.ErrNonceInvaild},
+		{&NetworkUnverifiedError{Endpoint: "fake://", Err: NewGatewayError("eth_chainId", 10003, "invalid token", "")}, openwallet.ErrCallFullNodeAPIFailed},
+		{&NetworkUnverifiedError{Endpoint: "fake://", Err: errors.New("connection refused")}, openwallet.ErrSubmitRawTransactionFailed},
+	}
+	for _, test := range tests {
+		owErr := ConvertGatewayError(test.err, openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild")
+		if owErr.Code() != test.code {
+			t.Errorf("code of [%v] = %d, want %d", test.err, owErr.Code(), test.code)
+		}
+	}
+}
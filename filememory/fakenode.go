@@ -0,0 +1,364 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+//FakeNodeURL 连接内存模拟节点时Client使用的BaseURL
+const FakeNodeURL = "fake://filememory/"
+
+//FakeHandler 模拟节点的自定义方法处理，返回data/result或错误码，调用时节点已加锁
+type FakeHandler func(params gjson.Result) (result interface{}, code int64, msg string)
+
+//fakeFailure 预设的失败应答
+type fakeFailure struct {
+	code int64
+	msg  string
+	err  error
+}
+
+//FakeNode 内存模拟节点，实现Transport接口，
+//按预设的数据应答网关接口（blocknumber、blocktxs、balance、getnonce、pushtx、getfee）和eth_*方法
+type FakeNode struct {
+	mu       sync.Mutex
+	tip      uint64
+	blocks   map[uint64]*FMBlock
+	balances map[string]*big.Int
+	nonces   map[string]uint64
+	txs      map[string]*BlockTransaction
+	receipts map[string]*EthTransactionReceipt
+	results  map[string]interface{}
+	handlers map[string]FakeHandler
+	failures map[string][]*fakeFailure
+	calls    map[string]int
+	pushed   []string
+	auth     *GatewayAuth
+}
+
+//NewFakeNode 创建内存模拟节点
+func NewFakeNode() *FakeNode {
+	node := FakeNode{
+		blocks:   make(map[uint64]*FMBlock),
+		balances: make(map[string]*big.Int),
+		nonces:   make(map[string]uint64),
+		txs:      make(map[string]*BlockTransaction),
+		receipts: make(map[string]*EthTransactionReceipt),
+		results:  make(map[string]interface{}),
+		handlers: make(map[string]FakeHandler),
+		failures: make(map[string][]*fakeFailure),
+		calls:    make(map[string]int),
+		pushed:   make([]string, 0),
+	}
+	return &node
+}
+
+//NewClient 创建连接该模拟节点的Client
+func (node *FakeNode) NewClient() *Client {
+	return &Client{BaseURL: FakeNodeURL, Transport: node}
+}
+
+//fakeNodeKey 地址和哈希统一转为小写无前缀的格式
+func fakeNodeKey(s string) string {
+	s = strings.ToLower(s)
+	s = strings.TrimPrefix(s, "fm")
+	s = strings.TrimPrefix(s, "0x")
+	return s
+}
+
+//SetTip 设置节点最新高度
+func (node *FakeNode) SetTip(height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.tip = height
+}
+
+//SetBlock 添加或替换区块，区块高度超过当前最新高度时同时更新最新高度
+func (node *FakeNode) SetBlock(block *FMBlock) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.blocks[block.BlockHeight] = block
+	for i := range block.Transactions {
+		tx := block.Transactions[i]
+		node.txs[fakeNodeKey(tx.Hash)] = &tx
+	}
+	if block.BlockHeight > node.tip {
+		node.tip = block.BlockHeight
+	}
+}
+
+//RemoveBlock 移除指定高度的区块
+func (node *FakeNode) RemoveBlock(height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	delete(node.blocks, height)
+}
+
+//SetBalance 设置地址主币余额
+func (node *FakeNode) SetBalance(address string, balance *big.Int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.balances[fakeNodeKey(address)] = balance
+}
+
+//SetNonce 设置地址nonce
+func (node *FakeNode) SetNonce(address string, nonce uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.nonces[fakeNodeKey(address)] = nonce
+}
+
+//SetTransaction 添加交易，供eth_getTransactionByHash查询
+func (node *FakeNode) SetTransaction(tx *BlockTransaction) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.txs[fakeNodeKey(tx.Hash)] = tx
+}
+
+//SetReceipt 添加交易回执，供eth_getTransactionReceipt查询
+func (node *FakeNode) SetReceipt(txid string, receipt *EthTransactionReceipt) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.receipts[fakeNodeKey(txid)] = receipt
+}
+
+//SetResult 设置方法的固定应答，适用于eth_call、eth_gasPrice、eth_estimateGas、txpool_content等
+func (node *FakeNode) SetResult(method string, result interface{}) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.results[method] = result
+}
+
+//Handle 设置方法的自定义处理，优先于内置处理
+func (node *FakeNode) Handle(method string, handler FakeHandler) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.handlers[method] = handler
+}
+
+//FailNext 下一次调用该方法时返回指定错误，可多次调用按顺序排队
+func (node *FakeNode) FailNext(method string, code int64, msg string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failures[method] = append(node.failures[method], &fakeFailure{code: code, msg: msg})
+}
+
+//FailNextTransport 下一次调用该方法时返回通讯错误，模拟网络中断或超时
+func (node *FakeNode) FailNextTransport(method string, err error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failures[method] = append(node.failures[method], &fakeFailure{err: err})
+}
+
+//RequireAuth 网关接口只接受该密钥的认证，认证失败返回10003 invalid token
+func (node *FakeNode) RequireAuth(scheme, algorithm, key string) error {
+	auth, err := NewGatewayAuth(scheme, algorithm, key)
+	if err != nil {
+		return err
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.auth = auth
+	return nil
+}
+
+//checkAuth 校验网关请求的认证信息
+func (node *FakeNode) checkAuth(header map[string]string, request gjson.Result) bool {
+	if node.auth == nil {
+		return true
+	}
+	key := node.auth.Key()
+	if node.auth.Scheme == AuthSchemeBearer {
+		return header["Authorization"] == "Bearer "+key
+	}
+	callTime := request.Get("time").Int()
+	return request.Get("token").String() == node.auth.Token(key, callTime)
+}
+
+//Calls 方法被调用的次数
+func (node *FakeNode) Calls(method string) int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.calls[method]
+}
+
+//Pushed 通过pushtx广播的签名交易
+func (node *FakeNode) Pushed() []string {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	pushed := make([]string, len(node.pushed))
+	copy(pushed, node.pushed)
+	return pushed
+}
+
+//Post 实现Transport接口
+func (node *FakeNode) Post(url string, header map[string]string, body interface{}, timeout time.Duration) ([]byte, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request := gjson.ParseBytes(raw)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	method := url[strings.LastIndex(url, "/")+1:]
+	if request.Get("jsonrpc").Exists() {
+		method = request.Get("method").String()
+	}
+	if failures := node.failures[method]; len(failures) > 0 && failures[0].err != nil {
+		node.calls[method]++
+		node.failures[method] = failures[1:]
+		return nil, failures[0].err
+	}
+
+	if request.Get("jsonrpc").Exists() {
+		result, code, msg := node.serve(method, request.Get("params"))
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      request.Get("id").Int(),
+		}
+		if code != 0 {
+			resp["error"] = map[string]interface{}{"code": code, "message": msg}
+		} else {
+			resp["result"] = result
+		}
+		return json.Marshal(resp)
+	}
+
+	var result interface{}
+	code, msg := int64(10003), "invalid token"
+	if node.checkAuth(header, request) {
+		result, code, msg = node.serve(method, request)
+	} else {
+		node.calls[method]++
+	}
+	resp := map[string]interface{}{
+		"code": 10000,
+		"msg":  "success",
+		"data": result,
+	}
+	if code != 0 {
+		resp["code"] = code
+		resp["msg"] = msg
+		delete(resp, "data")
+	}
+	return json.Marshal(resp)
+}
+
+//serve 处理一次调用，code不为0时表示失败
+func (node *FakeNode) serve(method string, params gjson.Result) (interface{}, int64, string) {
+	node.calls[method]++
+
+	if failures := node.failures[method]; len(failures) > 0 {
+		node.failures[method] = failures[1:]
+		return nil, failures[0].code, failures[0].msg
+	}
+
+	if handler, exist := node.handlers[method]; exist {
+		return handler(params)
+	}
+
+	if result, exist := node.results[method]; exist {
+		return result, 0, ""
+	}
+
+	switch method {
+	case "blocknumber":
+		return map[string]interface{}{"block_number": node.tip}, 0, ""
+	case "blocktxs":
+		block, exist := node.blocks[params.Get("number").Uint()]
+		if !exist || block.BlockHeight > node.tip {
+			return nil, 10001, "block not found"
+		}
+		return block, 0, ""
+	case "balance":
+		balance, exist := node.balances[fakeNodeKey(params.Get("address").String())]
+		if !exist {
+			balance = big.NewInt(0)
+		}
+		return map[string]interface{}{"balance": balance.String()}, 0, ""
+	case "getnonce":
+		nonce := node.nonces[fakeNodeKey(params.Get("address").String())]
+		return map[string]interface{}{"nonce": fmt.Sprintf("%d", nonce)}, 0, ""
+	case "getfee":
+		return map[string]interface{}{}, 0, ""
+	case "pushtx":
+		return node.pushTx(params.Get("signed").String())
+	case "eth_getTransactionByHash":
+		tx, exist := node.txs[fakeNodeKey(params.Get("0").String())]
+		if !exist {
+			return nil, 0, ""
+		}
+		return tx, 0, ""
+	case "eth_getTransactionReceipt":
+		receipt, exist := node.receipts[fakeNodeKey(params.Get("0").String())]
+		if !exist {
+			return nil, 0, ""
+		}
+		return receipt, 0, ""
+	case "eth_getBlockByHash":
+		hash := fakeNodeKey(params.Get("0").String())
+		for _, block := range node.blocks {
+			if fakeNodeKey(block.BlockHash) == hash {
+				return block, 0, ""
+			}
+		}
+		return nil, 0, ""
+	case "eth_chainId":
+		return "0x1", 0, ""
+	case "net_version":
+		return "1", 0, ""
+	case "eth_call":
+		return "0x0", 0, ""
+	case "eth_gasPrice":
+		return "0x0", 0, ""
+	case "eth_estimateGas":
+		return "0x5208", 0, ""
+	case "txpool_content":
+		return map[string]interface{}{"pending": map[string]interface{}{}}, 0, ""
+	case "txpool_status":
+		return map[string]interface{}{"pending": "0x0", "queued": "0x0"}, 0, ""
+	}
+
+	return nil, -32601, fmt.Sprintf("the method %s does not exist", method)
+}
+
+//pushTx 接收签名交易，返回交易哈希
+func (node *FakeNode) pushTx(signed string) (interface{}, int64, string) {
+	rawHex, err := hex.DecodeString(removeOxFromHex(signed))
+	if err != nil {
+		return nil, 10001, "invalid signed transaction"
+	}
+	tx := &types.Transaction{}
+	err = rlp.DecodeBytes(rawHex, tx)
+	if err != nil {
+		return nil, 10001, "invalid signed transaction"
+	}
+	node.pushed = append(node.pushed, ethcommon.ToHex(rawHex))
+	return map[string]interface{}{"hash": tx.Hash().Hex()}, 0, ""
+}
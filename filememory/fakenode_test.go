@@ -0,0 +1,993 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/hdkeystore"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+//testFakeNodeConfig 连接模拟节点的资产配置，%s为数据目录
+const testFakeNodeConfig = `
+ServerAPI = "fake://filememory/"
+ChainID = 1
+GasLimit = 50000
+GasPrice = 18
+SumThreadControl = 1
+LocalNonce = true
+RPCRetryBackoff = 1
+RPCRetryMaxBackoff = 5
+GatewayTokenKey = test-gateway-key
+NotifyURL = https://wallet.example.com/notify/pushtx
+FeeNotifyURL = https://wallet.example.com/notify/getfee
+dataDir = "%s"
+`
+
+const (
+	testDepositAddress = "FM1a642f0e3c3af545e7acbd38b07251b3990914f1"
+	testOtherAddress   = "FM5050a4f4b3f9338c3472dcc01a87c76a144b3c9c"
+)
+
+//testNewFakeNodeWalletManager 创建连接内存模拟节点的钱包管理器，数据目录为临时目录
+func testNewFakeNodeWalletManager(t *testing.T) (*WalletManager, *FakeNode) {
+	dataDir, err := ioutil.TempDir("", "filememory")
+	if err != nil {
+		t.Fatalf("create temp dir failed, err=%v", err)
+	}
+	c, err := config.NewConfigData("ini", []byte(fmt.Sprintf(testFakeNodeConfig, dataDir)))
+	if err != nil {
+		t.Fatalf("load config failed, err=%v", err)
+	}
+
+	node := NewFakeNode()
+	wm := NewWalletManager()
+	err = wm.LoadAssetsConfig(c)
+	if err != nil {
+		t.Fatalf("LoadAssetsConfig failed, err=%v", err)
+	}
+	wm.WalletClient.Transport = node
+	return wm, node
+}
+
+//testNewFakeNodeScanner 创建连接模拟节点的区块扫描器，只监听testDepositAddress
+func testNewFakeNodeScanner(t *testing.T, wm *WalletManager) (*FMBLockScanner, *testScanObserver) {
+	dai, err := openwallet.NewBlockchainLocal(filepath.Join(wm.Config.DataDir, "blockchain.db"), false)
+	if err != nil {
+		t.Fatalf("NewBlockchainLocal failed, err=%v", err)
+	}
+
+	bs := wm.Blockscanner.(*FMBLockScanner)
+	bs.SetBlockchainDAI(dai)
+	bs.SetBlockScanTargetFunc(func(target openwallet.ScanTarget) (string, bool) {
+		if fakeNodeKey(target.Address) == fakeNodeKey(testDepositAddress) {
+			return "deposit-account", true
+		}
+		return "", false
+	})
+
+	observer := &testScanObserver{extractData: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+	return bs, observer
+}
+
+//testMakeBlock 构造区块，区块哈希由高度和分支标识生成
+func testMakeBlock(height uint64, branch string, txs ...BlockTransaction) *FMBlock {
+	block := &FMBlock{
+		BlockHeader: BlockHeader{
+			BlockNumber:  fmt.Sprintf("%d", height),
+			BlockHash:    fmt.Sprintf("0x%s%062d", branch, height),
+			PreviousHash: fmt.Sprintf("0x%s%062d", branch, height-1),
+			BlockHeight:  height,
+		},
+	}
+	for i := range txs {
+		txs[i].BlockNumber = height
+		txs[i].BlockHash = block.BlockHash
+		//没有手续费信息时使用固定手续费，避免查询交易回执
+		if txs[i].Fee == "" && txs[i].GasUsed == "" && txs[i].GasPrice == "" {
+			txs[i].Fee = "21000"
+		}
+	}
+	block.Transactions = txs
+	return block
+}
+
+//testWalletDAI 测试用的钱包数据，提供资产账户、地址查询和钱包根密钥
+type testWalletDAI struct {
+	openwallet.WalletDAIBase
+	accounts  []*openwallet.AssetsAccount
+	addresses []*openwallet.Address
+	key       *hdkeystore.HDKey
+}
+
+func (w *testWalletDAI) HDKey(password ...string) (*hdkeystore.HDKey, error) {
+	if w.key == nil {
+		return nil, fmt.Errorf("wallet key not found")
+	}
+	return w.key, nil
+}
+
+func (w *testWalletDAI) GetAssetsAccountInfo(accountID string) (*openwallet.AssetsAccount, error) {
+	for _, account := range w.accounts {
+		if account.AccountID == accountID {
+			return account, nil
+		}
+	}
+	return nil, fmt.Errorf("account %s not found", accountID)
+}
+
+func (w *testWalletDAI) GetAddress(address string) (*openwallet.Address, error) {
+	for _, addr := range w.addresses {
+		if fakeNodeKey(addr.Address) == fakeNodeKey(address) {
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("address %s not found", address)
+}
+
+//GetAddressList 支持按AccountID和Address过滤
+func (w *testWalletDAI) GetAddressList(offset, limit int, cols ...interface{}) ([]*openwallet.Address, error) {
+	list := make([]*openwallet.Address, 0)
+	for _, addr := range w.addresses {
+		match := true
+		for i := 0; i+1 < len(cols); i += 2 {
+			switch cols[i] {
+			case "AccountID":
+				match = match && addr.AccountID == cols[i+1]
+			case "Address":
+				match = match && fakeNodeKey(addr.Address) == fakeNodeKey(cols[i+1].(string))
+			}
+		}
+		if match {
+			list = append(list, addr)
+		}
+	}
+	if offset >= len(list) {
+		return []*openwallet.Address{}, nil
+	}
+	list = list[offset:]
+	if limit >= 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+type testScanObserver struct {
+	mu          sync.Mutex
+	extractData map[string][]*openwallet.TxExtractData
+	forks       []*openwallet.BlockHeader
+}
+
+func (o *testScanObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if header.Fork {
+		o.forks = append(o.forks, header)
+	}
+	return nil
+}
+
+//waitForks 等待异步的分叉通知
+func (o *testScanObserver) waitForks(count int) []*openwallet.BlockHeader {
+	for i := 0; i < 100; i++ {
+		o.mu.Lock()
+		n := len(o.forks)
+		o.mu.Unlock()
+		if n >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	forks := make([]*openwallet.BlockHeader, len(o.forks))
+	copy(forks, o.forks)
+	return forks
+}
+
+func (o *testScanObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.extractData[sourceKey] = append(o.extractData[sourceKey], data)
+	return nil
+}
+
+func TestFakeNode_GatewayMethods(t *testing.T) {
+	node := NewFakeNode()
+	client := node.NewClient()
+
+	node.SetBlock(testMakeBlock(10, "aa"))
+	node.SetBalance(testOtherAddress, big.NewInt(123456))
+	node.SetNonce(testOtherAddress, 7)
+
+	height, err := client.FmGetBlockNumber()
+	if err != nil || height != 10 {
+		t.Fatalf("FmGetBlockNumber = %d, %v; want 10", height, err)
+	}
+
+	block, err := client.FMGetBlockSpecByBlockNum(10, true)
+	if err != nil {
+		t.Fatalf("FMGetBlockSpecByBlockNum failed, err=%v", err)
+	}
+	if block.BlockHeight != 10 || block.BlockHash != testMakeBlock(10, "aa").BlockHash {
+		t.Errorf("unexpected block: %+v", block.BlockHeader)
+	}
+
+	balance, err := client.GetAddrBalance2(ReplaceFmToAddress(testOtherAddress), "latest")
+	if err != nil || balance.Int64() != 123456 {
+		t.Errorf("GetAddrBalance2 = %v, %v; want 123456", balance, err)
+	}
+
+	nonce, err := client.fmGetTransactionCount(testOtherAddress)
+	if err != nil || nonce != 7 {
+		t.Errorf("fmGetTransactionCount = %d, %v; want 7", nonce, err)
+	}
+
+	node.FailNext("blocknumber", 10002, "busy")
+	if _, err := client.FmGetBlockNumber(); err == nil {
+		t.Errorf("FmGetBlockNumber should fail with scripted error")
+	}
+	if node.Calls("blocknumber") != 2 {
+		t.Errorf("blocknumber calls = %d, want 2", node.Calls("blocknumber"))
+	}
+}
+
+func TestFakeNode_EthMethods(t *testing.T) {
+	node := NewFakeNode()
+	client := node.NewClient()
+
+	txid := "0x5d5c8e90621947c9f81ddbf97e2fc32436a936562faff404f71d6186bb801752"
+	node.SetTransaction(&BlockTransaction{Hash: txid, From: testOtherAddress, To: testDepositAddress, Value: "100", BlockNumber: 3})
+	node.SetReceipt(txid, &EthTransactionReceipt{Status: "0x1", GasUsed: "0x5208"})
+
+	tx, err := client.EthGetTransactionByHash(txid)
+	if err != nil {
+		t.Fatalf("EthGetTransactionByHash failed, err=%v", err)
+	}
+	if tx.Value != "100" || tx.BlockNumber != 3 {
+		t.Errorf("unexpected tx: %+v", tx)
+	}
+
+	receipt, err := client.EthGetTransactionReceipt(txid)
+	if err != nil || receipt.GasUsed != "0x5208" {
+		t.Errorf("EthGetTransactionReceipt = %+v, %v", receipt, err)
+	}
+
+	if _, err := client.Call("eth_notExist", 1, nil); err == nil {
+		t.Errorf("unknown method should return error")
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_FakeNode(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+
+	deposit := BlockTransaction{
+		Hash:   "0x01",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "250000000",
+		Status: true,
+	}
+	node.SetBlock(testMakeBlock(1, "aa"))
+	node.SetBlock(testMakeBlock(2, "aa", deposit))
+	node.SetBlock(testMakeBlock(3, "aa"))
+
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	height, hash, err := bs.GetLocalBlockHead()
+	if err != nil || height != 3 || hash != testMakeBlock(3, "aa").BlockHash {
+		t.Errorf("local block head = %d %s %v; want 3", height, hash, err)
+	}
+
+	list := observer.extractData["deposit-account"]
+	if len(list) != 1 {
+		t.Fatalf("deposit extract data count = %d, want 1", len(list))
+	}
+	if len(list[0].TxOutputs) != 1 || list[0].TxOutputs[0].Amount != "2.5" {
+		t.Errorf("unexpected deposit outputs: %+v", list[0].TxOutputs)
+	}
+	if list[0].Transaction.BlockHeight != 2 {
+		t.Errorf("deposit block height = %d, want 2", list[0].Transaction.BlockHeight)
+	}
+}
+
+//testDelayTransport 按区块高度延迟应答，高度越低越慢，用于检验并发扫描的提交顺序
+type testDelayTransport struct {
+	node *FakeNode
+	max  uint64
+}
+
+func (d *testDelayTransport) Post(url string, header map[string]string, body interface{}, timeout time.Duration) ([]byte, error) {
+	if params, ok := body.(*map[string]interface{}); ok {
+		if number, exist := (*params)["number"].(uint64); exist && number <= d.max {
+			time.Sleep(time.Duration(d.max-number) * 2 * time.Millisecond)
+		}
+	}
+	return d.node.Post(url, header, body, timeout)
+}
+
+func TestFMBLockScanner_ScanBlockTask_Pipeline(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	bs.SetScanConcurrency(4, 6)
+	wm.WalletClient.Transport = &testDelayTransport{node: node, max: 20}
+
+	node.SetBlock(testMakeBlock(1, "aa"))
+	for height := uint64(2); height <= 20; height++ {
+		deposit := BlockTransaction{
+			Hash:   fmt.Sprintf("0x%064d", height),
+			From:   testOtherAddress,
+			To:     testDepositAddress,
+			Value:  fmt.Sprintf("%d", height*100000000),
+			Status: true,
+		}
+		node.SetBlock(testMakeBlock(height, "aa", deposit))
+	}
+
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	height, hash, err := bs.GetLocalBlockHead()
+	if err != nil || height != 20 || hash != testMakeBlock(20, "aa").BlockHash {
+		t.Errorf("local block head = %d %s %v; want 20", height, hash, err)
+	}
+
+	list := observer.extractData["deposit-account"]
+	if len(list) != 19 {
+		t.Fatalf("deposit extract data count = %d, want 19", len(list))
+	}
+	for i, data := range list {
+		if data.Transaction.BlockHeight != uint64(i+2) {
+			t.Errorf("notify #%d block height = %d, want %d", i, data.Transaction.BlockHeight, i+2)
+		}
+	}
+	if node.Calls("blocktxs") != 19 {
+		t.Errorf("blocktxs calls = %d, want 19", node.Calls("blocktxs"))
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_PipelineStopOnError(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+	bs.SetScanConcurrency(2, 5)
+
+	for height := uint64(1); height <= 6; height++ {
+		node.SetBlock(testMakeBlock(height, "aa"))
+	}
+	//高度4不可用，只提交到高度3
+	node.Handle("blocktxs", func(params gjson.Result) (interface{}, int64, string) {
+		number := params.Get("number").Uint()
+		if number == 4 {
+			return nil, 10001, "block not found"
+		}
+		return node.blocks[number], 0, ""
+	})
+
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	height, _, _ := bs.GetLocalBlockHead()
+	if height != 3 {
+		t.Errorf("local block head = %d, want 3", height)
+	}
+}
+
+//testScanLocalChain 扫描aa分支1-5的区块，然后在节点上把4之后的区块替换为bb分支
+func testScanLocalChain(t *testing.T, bs *FMBLockScanner, node *FakeNode) {
+	for height := uint64(1); height <= 5; height++ {
+		node.SetBlock(testMakeBlock(height, "aa"))
+	}
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	height, _, _ := bs.GetLocalBlockHead()
+	if height != 5 {
+		t.Fatalf("local block head = %d, want 5", height)
+	}
+
+	deposit := BlockTransaction{
+		Hash:   "0xbb",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "100000000",
+		Status: true,
+	}
+	for height := uint64(4); height <= 7; height++ {
+		block := testMakeBlock(height, "bb")
+		if height == 4 {
+			block.PreviousHash = testMakeBlock(3, "aa").BlockHash
+		}
+		if height == 6 {
+			block = testMakeBlock(height, "bb", deposit)
+		}
+		node.SetBlock(block)
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_DeepReorg(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+
+	testScanLocalChain(t, bs, node)
+	bs.ScanBlockTask()
+
+	height, hash, _ := bs.GetLocalBlockHead()
+	if height != 7 || hash != testMakeBlock(7, "bb").BlockHash {
+		t.Errorf("local block head = %d %s; want 7 on branch bb", height, hash)
+	}
+
+	forks := observer.waitForks(2)
+	if len(forks) != 2 {
+		t.Fatalf("fork notify count = %d, want 2", len(forks))
+	}
+	if forks[0].Height != 5 || forks[0].Hash != testMakeBlock(5, "aa").BlockHash ||
+		forks[1].Height != 4 || forks[1].Hash != testMakeBlock(4, "aa").BlockHash {
+		t.Errorf("unexpected fork headers: %+v, %+v", forks[0], forks[1])
+	}
+
+	list := observer.extractData["deposit-account"]
+	if len(list) != 1 || list[0].Transaction.BlockHeight != 6 {
+		t.Errorf("deposit on new branch should be notified once, got %d", len(list))
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_ReorgPrefetchGasFee(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+
+	testScanLocalChain(t, bs, node)
+	//预取的bb6在分叉检查时被丢弃，回退后重新扫描才提交，只请求一次GAS
+	bs.SetScanConcurrency(2, 4)
+	bs.ScanBlockTask()
+
+	if node.Calls("getfee") != 1 {
+		t.Errorf("getfee calls = %d, want 1", node.Calls("getfee"))
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_MaxReorgDepth(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+
+	testScanLocalChain(t, bs, node)
+
+	var alertHeight, alertDepth uint64
+	bs.MaxReorgDepth = 1
+	bs.ReorgAlertFunc = func(height, depth uint64) {
+		alertHeight, alertDepth = height, depth
+	}
+	bs.ScanBlockTask()
+
+	height, hash, _ := bs.GetLocalBlockHead()
+	if height != 5 || hash != testMakeBlock(5, "aa").BlockHash {
+		t.Errorf("local block head = %d %s; should stay at 5 on branch aa", height, hash)
+	}
+	if bs.Scanning {
+		t.Errorf("block scanner should be paused")
+	}
+	if alertHeight != 6 || alertDepth != 2 {
+		t.Errorf("alert = %d, %d; want 6, 2", alertHeight, alertDepth)
+	}
+	if forks := observer.waitForks(0); len(forks) != 0 {
+		t.Errorf("fork should not be notified when reorg is too deep")
+	}
+}
+
+//testStages 按通知顺序列出交易和阶段
+func (o *testScanObserver) testStages(sourceKey string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stages := make([]string, 0)
+	for _, data := range o.extractData[sourceKey] {
+		stages = append(stages, fmt.Sprintf("%s:%s:%d", data.Transaction.TxID, TxStage(data.Transaction), data.Transaction.Confirm))
+	}
+	return stages
+}
+
+func TestFMBLockScanner_ScanBlockTask_RequiredConfirmations(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	bs.RequiredConfirmations = 3
+
+	deposit := BlockTransaction{
+		Hash:   "0xaa",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "100000000",
+		Status: true,
+	}
+	for height := uint64(1); height <= 5; height++ {
+		if height == 4 {
+			node.SetBlock(testMakeBlock(height, "aa", deposit))
+			continue
+		}
+		node.SetBlock(testMakeBlock(height, "aa"))
+	}
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	//确认数按节点最新高度计算，节点出新块后达到确认数
+	node.SetBlock(testMakeBlock(6, "aa"))
+	bs.ScanBlockTask()
+
+	stages := observer.testStages("deposit-account")
+	want := []string{"0xaa:provisional:2", "0xaa:final:3"}
+	if fmt.Sprint(stages) != fmt.Sprint(want) {
+		t.Errorf("notify stages = %v, want %v", stages, want)
+	}
+
+	pending, err := bs.GetPendingConfirmations()
+	if err != nil {
+		t.Fatalf("GetPendingConfirmations failed, err=%v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending confirmations = %d, want 0", len(pending))
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_RevertedBeforeConfirmed(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	bs.RequiredConfirmations = 3
+
+	orphaned := BlockTransaction{
+		Hash:   "0xaa",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "100000000",
+		Status: true,
+	}
+	for height := uint64(1); height <= 4; height++ {
+		node.SetBlock(testMakeBlock(height, "aa"))
+	}
+	node.SetBlock(testMakeBlock(5, "aa", orphaned))
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	deposit := BlockTransaction{
+		Hash:   "0xbb",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "100000000",
+		Status: true,
+	}
+	for height := uint64(4); height <= 7; height++ {
+		block := testMakeBlock(height, "bb")
+		if height == 4 {
+			block.PreviousHash = testMakeBlock(3, "aa").BlockHash
+		}
+		if height == 6 {
+			block = testMakeBlock(height, "bb", deposit)
+		}
+		node.SetBlock(block)
+	}
+	bs.ScanBlockTask()
+
+	stages := observer.testStages("deposit-account")
+	want := []string{"0xaa:provisional:1", "0xaa:reverted:0", "0xbb:provisional:2"}
+	if fmt.Sprint(stages) != fmt.Sprint(want) {
+		t.Errorf("notify stages = %v, want %v", stages, want)
+	}
+
+	pending, err := bs.GetPendingConfirmations()
+	if err != nil {
+		t.Fatalf("GetPendingConfirmations failed, err=%v", err)
+	}
+	if len(pending) != 1 || pending[0].Data.Transaction.TxID != "0xbb" {
+		t.Errorf("only the deposit on the new branch should be pending")
+	}
+}
+
+func TestFMBLockScanner_LocalIndex(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+
+	orphaned := BlockTransaction{
+		Hash:   "0xaa",
+		From:   testOtherAddress,
+		To:     testDepositAddress,
+		Value:  "100000000",
+		Status: true,
+	}
+	for height := uint64(1); height <= 4; height++ {
+		node.SetBlock(testMakeBlock(height, "aa"))
+	}
+	node.SetBlock(testMakeBlock(5, "aa", orphaned))
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	block, err := bs.GetLocalBlock(5)
+	if err != nil {
+		t.Fatalf("GetLocalBlock failed, err=%v", err)
+	}
+	if block.BlockHash != testMakeBlock(5, "aa").BlockHash || len(block.Transactions) != 1 || block.Transactions[0].Hash != "0xaa" {
+		t.Errorf("local block 5 should include its transactions, got %+v", block)
+	}
+
+	tx, err := bs.GetIndexedTransaction("0xaa")
+	if err != nil || tx.BlockNumber != 5 {
+		t.Errorf("GetIndexedTransaction = %+v, %v", tx, err)
+	}
+	txs, err := bs.GetIndexedTransactionsByAddress(strings.ToUpper(testDepositAddress))
+	if err != nil || len(txs) != 1 || txs[0].Hash != "0xaa" {
+		t.Errorf("GetIndexedTransactionsByAddress should find the deposit, got %d, err=%v", len(txs), err)
+	}
+	txs, err = bs.GetIndexedTransactionsByHeight(5)
+	if err != nil || len(txs) != 1 {
+		t.Errorf("GetIndexedTransactionsByHeight should find the deposit, got %d, err=%v", len(txs), err)
+	}
+	records, err := bs.GetIndexedExtractDataByAddress(testDepositAddress)
+	if err != nil || len(records) != 1 || records[0].SourceKey != "deposit-account" || records[0].Stage != TxStageFinal {
+		t.Errorf("GetIndexedExtractDataByAddress should find the final deposit, got %d, err=%v", len(records), err)
+	}
+	records, err = bs.GetIndexedExtractDataByAddress("0x" + strings.ToLower(strings.TrimPrefix(testDepositAddress, "FM")))
+	if err != nil || len(records) != 1 || records[0].ToKey != indexAddressKey(testDepositAddress) {
+		t.Errorf("GetIndexedExtractDataByAddress should match the 0x address, got %d, err=%v", len(records), err)
+	}
+	if records, _ = bs.GetIndexedExtractDataByAddress(testOtherAddress); len(records) != 0 {
+		t.Errorf("GetIndexedExtractDataByAddress of the unwatched sender = %d, want 0", len(records))
+	}
+
+	//分叉后撤销已最终通知的交易，并删除孤立区块的索引
+	for height := uint64(4); height <= 6; height++ {
+		block := testMakeBlock(height, "bb")
+		if height == 4 {
+			block.PreviousHash = testMakeBlock(3, "aa").BlockHash
+		}
+		node.SetBlock(block)
+	}
+	bs.ScanBlockTask()
+
+	stages := observer.testStages("deposit-account")
+	want := []string{"0xaa:final:1", "0xaa:reverted:0"}
+	if fmt.Sprint(stages) != fmt.Sprint(want) {
+		t.Errorf("notify stages = %v, want %v", stages, want)
+	}
+	if _, err := bs.GetIndexedTransaction("0xaa"); err != storm.ErrNotFound {
+		t.Errorf("orphaned transaction should be removed from index, err=%v", err)
+	}
+	records, err = bs.GetIndexedExtractDataByTxID("0xaa")
+	if err != nil || len(records) != 0 {
+		t.Errorf("orphaned extract data should be removed from index, got %d, err=%v", len(records), err)
+	}
+	block, err = bs.GetLocalBlock(5)
+	if err != nil || block.BlockHash != testMakeBlock(5, "bb").BlockHash {
+		t.Errorf("local block 5 should be on branch bb, got %+v, err=%v", block, err)
+	}
+}
+
+func TestFMBLockScanner_ExtractTransactionData_Fees(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+
+	scanTarget := func(target openwallet.ScanTarget) (string, bool) {
+		if fakeNodeKey(target.Address) == fakeNodeKey(testDepositAddress) {
+			return "deposit-account", true
+		}
+		return "", false
+	}
+
+	tests := []struct {
+		name     string
+		tx       BlockTransaction
+		receipt  *EthTransactionReceipt
+		gasPrice string
+	}{
+		{
+			name: "payload fee",
+			tx:   BlockTransaction{Hash: "0x01", Fee: "2100000"},
+		},
+		{
+			name: "payload gas",
+			tx:   BlockTransaction{Hash: "0x02", GasUsed: "21000", GasPrice: "100"},
+		},
+		{
+			name:    "receipt gas used",
+			tx:      BlockTransaction{Hash: "0x03", GasPrice: "0x64"},
+			receipt: &EthTransactionReceipt{GasUsed: "0x5208", Status: "0x1"},
+		},
+		{
+			name:     "receipt and transaction gas price",
+			tx:       BlockTransaction{Hash: "0x04"},
+			receipt:  &EthTransactionReceipt{GasUsed: "0x5208", Status: "0x1"},
+			gasPrice: "0x64",
+		},
+	}
+
+	for i, test := range tests {
+		tx := test.tx
+		tx.From = testDepositAddress
+		tx.To = testOtherAddress
+		tx.Value = "100000000"
+		tx.Status = true
+		tx.BlockNumber = uint64(10 + i)
+		tx.BlockHash = testMakeBlock(tx.BlockNumber, "aa").BlockHash
+		if test.receipt != nil {
+			node.SetReceipt(tx.Hash, test.receipt)
+		}
+		detail := tx
+		detail.GasPrice = test.gasPrice
+		if test.gasPrice == "" {
+			detail.GasPrice = tx.GasPrice
+		}
+		node.SetTransaction(&detail)
+
+		extractData, err := bs.ExtractTransactionData(tx.Hash, scanTarget)
+		if err != nil {
+			t.Errorf("%s: ExtractTransactionData failed, err=%v", test.name, err)
+			continue
+		}
+		list := extractData["deposit-account"]
+		if len(list) != 1 {
+			t.Errorf("%s: extract data count = %d, want 1", test.name, len(list))
+			continue
+		}
+		if list[0].Transaction.Fees != "0.021" {
+			t.Errorf("%s: Fees = %s, want 0.021", test.name, list[0].Transaction.Fees)
+		}
+		if len(list[0].TxInputs) != 2 || list[0].TxInputs[1].Amount != "0.021" {
+			t.Errorf("%s: fee input amount should be 0.021", test.name)
+		}
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_ReceiptNotFound(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+
+	deposit := BlockTransaction{
+		Hash:     "0xaa",
+		From:     testOtherAddress,
+		To:       testDepositAddress,
+		Value:    "100000000",
+		Status:   true,
+		GasPrice: "100",
+	}
+	node.SetBlock(testMakeBlock(1, "aa"))
+	node.SetBlock(testMakeBlock(2, "aa", deposit))
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+
+	if height, _, _ := bs.GetLocalBlockHead(); height != 2 {
+		t.Errorf("local block head = %d, want 2", height)
+	}
+	if stages := observer.testStages("deposit-account"); len(stages) != 0 {
+		t.Errorf("deposit without fee should not be notified, got %v", stages)
+	}
+	records, err := bs.GetUnscanRecords()
+	if err != nil || len(records) != 1 || records[0].TxID != "0xaa" {
+		t.Fatalf("deposit without receipt should be saved as unscanned, got %d, err=%v", len(records), err)
+	}
+
+	//回执可查询后重扫
+	node.SetReceipt("0xaa", &EthTransactionReceipt{GasUsed: "0x5208", Status: "0x1"})
+	bs.ScanBlockTask()
+
+	stages := observer.testStages("deposit-account")
+	if len(stages) != 1 || stages[0] != "0xaa:final:1" {
+		t.Errorf("notify stages = %v, want the deposit after rescan", stages)
+	}
+	if list := observer.extractData["deposit-account"]; len(list) == 1 && list[0].Transaction.Fees != "0.021" {
+		t.Errorf("Fees = %s, want 0.021", list[0].Transaction.Fees)
+	}
+}
+
+func TestFMBLockScanner_ScanBlockTask_DiscardedUnscanRecord(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+	bs.SetScanConcurrency(2, 5)
+
+	deposit := BlockTransaction{Hash: "0xaa", From: testOtherAddress, To: testDepositAddress, Value: "100000000", Status: true, GasPrice: "100"}
+	node.SetBlock(testMakeBlock(1, "aa"))
+	node.SetBlock(testMakeBlock(2, "aa"))
+	node.SetBlock(testMakeBlock(3, "aa", deposit))
+	//高度2第一次获取失败，预取的高度3被丢弃
+	failed := false
+	node.Handle("blocktxs", func(params gjson.Result) (interface{}, int64, string) {
+		number := params.Get("number").Uint()
+		if number == 2 && !failed {
+			failed = true
+			return nil, 10001, "block not found"
+		}
+		return node.blocks[number], 0, ""
+	})
+
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+	if records, err := bs.GetUnscanRecords(); err != nil || len(records) != 0 {
+		t.Fatalf("discarded block should not leave unscan records, got %d, err=%v", len(records), err)
+	}
+
+	bs.ScanBlockTask()
+	records, err := bs.GetUnscanRecords()
+	if err != nil || len(records) != 1 || records[0].TxID != "0xaa" {
+		t.Errorf("committed block should save one unscan record, got %d, err=%v", len(records), err)
+	}
+}
+
+func TestFMBLockScanner_MakeExtractData(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+	token := &ERC20Token{Address: "0x1111111111111111111111111111111111111111", Symbol: "USDT", Name: "Tether", Decimals: 6}
+	if err := wm.SaveERC20TokenConfig(token); err != nil {
+		t.Fatalf("SaveERC20TokenConfig failed, err=%v", err)
+	}
+	bs.reloadWatchedTokens()
+
+	tx := &BlockTransaction{Hash: "0xaa", From: testOtherAddress, To: testDepositAddress, Value: "100000000", Status: true, Fee: "2100000"}
+	tx.FilterFunc = func(address string) (string, bool) { return "account", true }
+	fee, _ := bs.GetTxFeeEthString(tx)
+
+	//主币交易使用节点的手续费和主币精度
+	_, list, err := bs.MakeToExtractData(tx, nil)
+	if err != nil || len(list) != 1 || list[0].Transaction.Fees != fee || list[0].Transaction.Decimal != wm.Decimal() {
+		t.Fatalf("MakeToExtractData = %+v, err=%v; want fees %s", list, err, fee)
+	}
+
+	//代币交易使用合约精度
+	tx.To = token.Address
+	event := &TransferEvent{ContractAddress: token.Address, TokenFrom: testOtherAddress, TokenTo: testDepositAddress, Value: "0x16e360"}
+	for _, makeData := range []func(*BlockTransaction, *TransferEvent) (string, []*openwallet.TxExtractData, error){bs.MakeToExtractData, bs.MakeFromExtractData} {
+		_, list, err = makeData(tx, event)
+		if err != nil || len(list) == 0 {
+			t.Fatalf("make token extract data failed, err=%v", err)
+		}
+		trx := list[0].Transaction
+		if trx.Decimal != 6 || trx.Fees != fee || trx.To[0] != testDepositAddress+":1.5" || trx.Coin.Contract.Token != "USDT" {
+			t.Errorf("token transaction = %+v", trx)
+		}
+	}
+
+	event.ContractAddress = "0x3333333333333333333333333333333333333333"
+	if _, _, err := bs.MakeToExtractData(tx, event); err == nil {
+		t.Errorf("token of unwatched contract should fail")
+	}
+}
+
+//testTransferLog 构造代币Transfer事件日志
+func testTransferLog(contract, from, to string, value *big.Int) EthEvent {
+	return EthEvent{
+		Address: contract,
+		Topics: []string{
+			ETH_TRANSFER_EVENT_ID,
+			"0x000000000000000000000000" + indexAddressKey(from),
+			"0x000000000000000000000000" + indexAddressKey(to),
+		},
+		Data: fmt.Sprintf("0x%064x", value),
+	}
+}
+
+func TestFMBLockScanner_ExtractTransactionData_Tokens(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, _ := testNewFakeNodeScanner(t, wm)
+
+	tokens := []*ERC20Token{
+		{Address: "0x1111111111111111111111111111111111111111", Symbol: "USDT", Name: "Tether", Decimals: 6},
+		{Address: "0x2222222222222222222222222222222222222222", Symbol: "FMT", Name: "FM Token", Decimals: 18},
+	}
+	for _, token := range tokens {
+		if err := wm.SaveERC20TokenConfig(token); err != nil {
+			t.Fatalf("SaveERC20TokenConfig failed, err=%v", err)
+		}
+	}
+
+	tx := BlockTransaction{
+		Hash:        "0xaa",
+		From:        testOtherAddress,
+		To:          testDepositAddress,
+		Value:       "100000000",
+		Status:      true,
+		Fee:         "2100000",
+		BlockNumber: 10,
+		BlockHash:   testMakeBlock(10, "aa").BlockHash,
+	}
+	node.SetTransaction(&tx)
+	twoFMT, _ := new(big.Int).SetString("2000000000000000000", 10)
+	node.SetReceipt(tx.Hash, &EthTransactionReceipt{
+		GasUsed: "0x5208",
+		Status:  "0x1",
+		Logs: []EthEvent{
+			testTransferLog(tokens[0].Address, testOtherAddress, testDepositAddress, big.NewInt(1500000)),
+			testTransferLog(tokens[1].Address, testOtherAddress, testDepositAddress, twoFMT),
+			//未监听的合约不提取
+			testTransferLog("0x3333333333333333333333333333333333333333", testOtherAddress, testDepositAddress, big.NewInt(1)),
+		},
+	})
+
+	extractData, err := bs.ExtractTransactionData(tx.Hash, func(target openwallet.ScanTarget) (string, bool) {
+		if fakeNodeKey(target.Address) == fakeNodeKey(testDepositAddress) {
+			return "deposit-account", true
+		}
+		return "", false
+	})
+	if err != nil {
+		t.Fatalf("ExtractTransactionData failed, err=%v", err)
+	}
+
+	got := make(map[string]string)
+	for _, data := range extractData["deposit-account"] {
+		tx := data.Transaction
+		if len(data.TxOutputs) != 1 {
+			t.Errorf("%s: outputs = %d, want 1", tx.Coin.ContractID, len(data.TxOutputs))
+			continue
+		}
+		output := data.TxOutputs[0]
+		if output.Address != testDepositAddress {
+			t.Errorf("%s: output address = %s, want %s", tx.Coin.ContractID, output.Address, testDepositAddress)
+		}
+		if tx.Coin.IsContract {
+			if tx.TxType != 1 || output.TxType != 1 {
+				t.Errorf("%s: token transfer TxType should be 1", tx.Coin.Contract.Token)
+			}
+			if tx.Fees != "0.021" {
+				t.Errorf("%s: Fees = %s, want 0.021", tx.Coin.Contract.Token, tx.Fees)
+			}
+		}
+		got[fmt.Sprintf("%s:%d", tx.Coin.Contract.Token, tx.Decimal)] = output.Amount
+	}
+
+	want := map[string]string{
+		":8":     "1",
+		"USDT:6": "1.5",
+		"FMT:18": "2",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("extract data = %v, want %v", got, want)
+	}
+	for key, amount := range want {
+		if got[key] != amount {
+			t.Errorf("%s amount = %s, want %s", key, got[key], amount)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+//手续费策略，配置项FeePolicy
+//
+//	fixed       使用配置的GasLimit和GasPrice，默认策略
+//	estimate    gasLimit通过eth_estimateGas估算，gasPrice通过eth_gasPrice查询，节点返回0时使用配置的GasPrice
+//	multiplier  在estimate的基础上乘以FeeMultiplier，并且不超过MaxGasLimit、MaxGasPrice（0表示不限制）
+const (
+	FeePolicyFixed      = "fixed"
+	FeePolicyEstimate   = "estimate"
+	FeePolicyMultiplier = "multiplier"
+)
+
+//DEFAULT_FEE_MULTIPLIER multiplier策略的默认倍率
+const DEFAULT_FEE_MULTIPLIER = "1.2"
+
+//FeePolicy 手续费策略
+type FeePolicy struct {
+	Mode        string
+	GasLimit    *big.Int
+	GasPrice    *big.Int
+	Multiplier  decimal.Decimal
+	MaxGasLimit *big.Int
+	MaxGasPrice *big.Int
+}
+
+//NewFeePolicy 创建手续费策略，mode为空时使用fixed
+func NewFeePolicy(mode string, gasLimit, gasPrice *big.Int, multiplier string, maxGasLimit, maxGasPrice *big.Int) (*FeePolicy, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = FeePolicyFixed
+	}
+	if mode != FeePolicyFixed && mode != FeePolicyEstimate && mode != FeePolicyMultiplier {
+		return nil, fmt.Errorf("unknown fee policy: %s", mode)
+	}
+	if multiplier == "" {
+		multiplier = DEFAULT_FEE_MULTIPLIER
+	}
+	m, err := decimal.NewFromString(multiplier)
+	if err != nil || m.LessThan(decimal.New(1, 0)) {
+		return nil, fmt.Errorf("fee multiplier must be a number not less than 1: %s", multiplier)
+	}
+	policy := &FeePolicy{
+		Mode:        mode,
+		GasLimit:    bigOrZero(gasLimit),
+		GasPrice:    bigOrZero(gasPrice),
+		Multiplier:  m,
+		MaxGasLimit: bigOrZero(maxGasLimit),
+		MaxGasPrice: bigOrZero(maxGasPrice),
+	}
+	return policy, nil
+}
+
+func bigOrZero(v *big.Int) *big.Int {
+	if v == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(v)
+}
+
+//apply 对估算值按策略乘以倍率并限制上限
+func (p *FeePolicy) apply(v *big.Int, max *big.Int) *big.Int {
+	if p.Mode != FeePolicyMultiplier {
+		return v
+	}
+	scaled, _ := new(big.Int).SetString(decimal.NewFromBigInt(v, 0).Mul(p.Multiplier).Ceil().String(), 10)
+	if max.Sign() > 0 && scaled.Cmp(max) > 0 {
+		return new(big.Int).Set(max)
+	}
+	return scaled
+}
+
+//feePolicy 当前配置的手续费策略，配置无效时使用fixed
+func (this *WalletManager) feePolicy() *FeePolicy {
+	policy, err := NewFeePolicy(this.Config.FeePolicy, this.Config.GasLimit, this.Config.GasPrice,
+		this.Config.FeeMultiplier, this.Config.MaxGasLimit, this.Config.MaxGasPrice)
+	if err != nil {
+		this.Log.Errorf("invalid fee policy, use fixed gas instead, err=%v", err)
+		policy, _ = NewFeePolicy(FeePolicyFixed, this.Config.GasLimit, this.Config.GasPrice, "", nil, nil)
+	}
+	return policy
+}
+
+//GetGasPrice 按手续费策略获取创建交易时使用的gasPrice
+func (this *WalletManager) GetGasPrice() (*big.Int, error) {
+	policy := this.feePolicy()
+	if policy.Mode == FeePolicyFixed {
+		return policy.GasPrice, nil
+	}
+	gasPrice, err := this.WalletClient.ethGetGasPrice()
+	if err != nil {
+		return nil, err
+	}
+	if gasPrice.Sign() == 0 {
+		gasPrice = policy.GasPrice
+	}
+	return policy.apply(gasPrice, policy.MaxGasPrice), nil
+}
+
+//GetGasLimit 按手续费策略获取交易的gasLimit
+func (this *WalletManager) GetGasLimit(from string, to string, value *big.Int, data string) (*big.Int, error) {
+	policy := this.feePolicy()
+	if policy.Mode == FeePolicyFixed {
+		return policy.GasLimit, nil
+	}
+	gasLimit, err := this.WalletClient.ethGetGasEstimated(makeGasEstimatePara(from, to, value, data))
+	if err != nil {
+		return nil, err
+	}
+	return policy.apply(gasLimit, policy.MaxGasLimit), nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/astaxie/beego/config"
+	"github.com/tidwall/gjson"
+)
+
+func TestNewFeePolicy(t *testing.T) {
+	tests := []struct {
+		mode       string
+		multiplier string
+		wantMode   string
+		wantErr    bool
+	}{
+		{"", "", FeePolicyFixed, false},
+		{"Estimate", "", FeePolicyEstimate, false},
+		{"multiplier", "1.5", FeePolicyMultiplier, false},
+		{"auto", "", "", true},
+		{"multiplier", "0.5", "", true},
+		{"multiplier", "abc", "", true},
+	}
+	for i, test := range tests {
+		policy, err := NewFeePolicy(test.mode, big.NewInt(50000), big.NewInt(18), test.multiplier, nil, nil)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("case %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if policy.Mode != test.wantMode {
+			t.Errorf("case %d: mode = %s, want %s", i, policy.Mode, test.wantMode)
+		}
+	}
+}
+
+func TestWalletManager_LoadAssetsConfig_FeePolicy(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "filememory")
+	if err != nil {
+		t.Fatalf("create temp dir failed, err=%v", err)
+	}
+	for _, extra := range []string{"FeePolicy = auto", "FeePolicy = multiplier\nFeeMultiplier = 0.8", "MaxGasPrice = 1.5"} {
+		c, err := config.NewConfigData("ini", []byte(fmt.Sprintf(testFakeNodeConfig, dataDir)+extra+"\n"))
+		if err != nil {
+			t.Fatalf("load config failed, err=%v", err)
+		}
+		if err := NewWalletManager().LoadAssetsConfig(c); err == nil {
+			t.Errorf("config with %q: expected error", extra)
+		}
+	}
+}
+
+//testFeeNode 模拟节点返回估算的gas和gasPrice，并记录估算的参数
+func testFeeNode(node *FakeNode, gas, price string, estimateTo *string) {
+	node.SetResult("eth_gasPrice", price)
+	node.Handle("eth_estimateGas", func(params gjson.Result) (interface{}, int64, string) {
+		*estimateTo = params.Get("0.to").String()
+		return gas, 0, ""
+	})
+}
+
+func TestWalletManager_GetTransactionFeeEstimated_Policy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		multiplier  string
+		maxGasLimit int64
+		maxGasPrice int64
+		nodePrice   string
+		wantLimit   int64
+		wantPrice   int64
+	}{
+		{"fixed", FeePolicyFixed, "", 0, 0, "0x64", 50000, 18},
+		{"estimate", FeePolicyEstimate, "", 0, 0, "0x64", 30000, 100},
+		{"estimate zero price", FeePolicyEstimate, "", 0, 0, "0x0", 30000, 18},
+		{"multiplier", FeePolicyMultiplier, "1.5", 0, 0, "0x64", 45000, 150},
+		{"multiplier capped", FeePolicyMultiplier, "1.5", 40000, 120, "0x64", 40000, 120},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm, node := testNewFakeNodeWalletManager(t)
+			wm.Config.FeePolicy = test.policy
+			wm.Config.FeeMultiplier = test.multiplier
+			wm.Config.MaxGasLimit = big.NewInt(test.maxGasLimit)
+			wm.Config.MaxGasPrice = big.NewInt(test.maxGasPrice)
+			var estimateTo string
+			testFeeNode(node, "0x7530", test.nodePrice, &estimateTo)
+
+			fee, err := wm.GetTransactionFeeEstimated(testDepositAddress, testOtherAddress, big.NewInt(1), "")
+			if err != nil {
+				t.Fatalf("GetTransactionFeeEstimated failed, err=%v", err)
+			}
+			if fee.GasLimit.Int64() != test.wantLimit || fee.GasPrice.Int64() != test.wantPrice {
+				t.Errorf("gas = %v/%v, want %d/%d", fee.GasLimit, fee.GasPrice, test.wantLimit, test.wantPrice)
+			}
+			if fee.Fee.Int64() != test.wantLimit*test.wantPrice {
+				t.Errorf("fee = %v, want %d", fee.Fee, test.wantLimit*test.wantPrice)
+			}
+			if test.policy != FeePolicyFixed && estimateTo != "0x"+indexAddressKey(testOtherAddress) {
+				t.Errorf("estimate to = %s, want hex address of %s", estimateTo, testOtherAddress)
+			}
+
+			//报告的费率与创建交易使用的gasPrice一致
+			decoder := NewTransactionDecoder(wm)
+			rate, _, err := decoder.GetRawTransactionFeeRate()
+			if err != nil {
+				t.Fatalf("GetRawTransactionFeeRate failed, err=%v", err)
+			}
+			want, _ := ConverWeiStringToEthDecimal(fee.GasPrice.String())
+			if rate != want.String() {
+				t.Errorf("fee rate = %s, want %s", rate, want.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+)
+
+//FM地址是20字节的账户地址，链上和网关使用FM前缀，节点的eth_*接口使用0x前缀。
+//解析时接受FM、fm、0x前缀或无前缀的40位十六进制，大小写混合时按EIP-55校验；
+//规范格式为FM加小写十六进制，与钱包生成的地址一致，Checksum返回EIP-55大小写的格式
+
+//FMAddressLength 地址的字节数
+const FMAddressLength = 20
+
+//地址解析失败的错误
+var (
+	ErrInvalidAddress         = errors.New("invalid fm address")
+	ErrInvalidAddressChecksum = errors.New("invalid fm address checksum")
+)
+
+//FMAddress FM地址
+type FMAddress [FMAddressLength]byte
+
+//ParseFMAddress 解析地址，支持FM、0x前缀和无前缀的格式
+func ParseFMAddress(address string) (FMAddress, error) {
+	var a FMAddress
+	s := strings.TrimSpace(address)
+	switch {
+	case strings.HasPrefix(s, "FM"), strings.HasPrefix(s, "fm"), strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		s = s[2:]
+	}
+	if len(s) != FMAddressLength*2 {
+		return a, ErrInvalidAddress
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return a, ErrInvalidAddress
+	}
+	copy(a[:], b)
+
+	//大小写混合时校验EIP-55
+	if s != strings.ToLower(s) && s != strings.ToUpper(s) && s != a.Common().Hex()[2:] {
+		return a, ErrInvalidAddressChecksum
+	}
+	return a, nil
+}
+
+//IsFMAddress 是否为合法的地址
+func IsFMAddress(address string) bool {
+	_, err := ParseFMAddress(address)
+	return err == nil
+}
+
+//FMAddressFromCommon 由以太坊格式的地址创建
+func FMAddressFromCommon(address ethcommon.Address) FMAddress {
+	return FMAddress(address)
+}
+
+//NormalizeFMAddress 地址转为规范格式，无法解析时原样返回
+func NormalizeFMAddress(address string) string {
+	a, err := ParseFMAddress(address)
+	if err != nil {
+		return address
+	}
+	return a.String()
+}
+
+//Bytes 地址的字节
+func (a FMAddress) Bytes() []byte {
+	return a[:]
+}
+
+//Common 以太坊格式的地址
+func (a FMAddress) Common() ethcommon.Address {
+	return ethcommon.Address(a)
+}
+
+//Hex 小写、无前缀的十六进制，用于索引和ABI编码
+func (a FMAddress) Hex() string {
+	return hex.EncodeToString(a[:])
+}
+
+//String 规范格式，FM加小写十六进制
+func (a FMAddress) String() string {
+	return "FM" + a.Hex()
+}
+
+//Checksum FM加EIP-55大小写的十六进制
+func (a FMAddress) Checksum() string {
+	return "FM" + a.Common().Hex()[2:]
+}
+
+//Gateway 网关接口使用的格式
+func (a FMAddress) Gateway() string {
+	return a.String()
+}
+
+//RPC 节点eth_*接口使用的格式，0x加小写十六进制
+func (a FMAddress) RPC() string {
+	return "0x" + a.Hex()
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestParseFMAddress(t *testing.T) {
+	hexAddr := strings.TrimPrefix(testDepositAddress, "FM")
+	checksum := mustParseFMAddress(t, testDepositAddress).Checksum()
+
+	valid := []string{
+		testDepositAddress,
+		"fm" + hexAddr,
+		"0x" + hexAddr,
+		"0X" + strings.ToUpper(hexAddr),
+		hexAddr,
+		" " + testDepositAddress + " ",
+		checksum,
+	}
+	for _, s := range valid {
+		a, err := ParseFMAddress(s)
+		if err != nil {
+			t.Errorf("ParseFMAddress(%s) failed, err=%v", s, err)
+			continue
+		}
+		if a.String() != testDepositAddress {
+			t.Errorf("ParseFMAddress(%s) = %s, want %s", s, a.String(), testDepositAddress)
+		}
+	}
+
+	invalid := map[string]error{
+		"":                                   ErrInvalidAddress,
+		"FM1a642f0e":                         ErrInvalidAddress,
+		testDepositAddress + "00":            ErrInvalidAddress,
+		"FM" + strings.Repeat("zz", 20):      ErrInvalidAddress,
+		"1a" + testDepositAddress[4:] + "fm": ErrInvalidAddress,
+	}
+	//大小写错误的EIP-55地址
+	wrongCase := []byte(checksum)
+	for i := 2; i < len(wrongCase); i++ {
+		if c := wrongCase[i]; c >= 'a' && c <= 'f' {
+			wrongCase[i] = c - 'a' + 'A'
+			break
+		} else if c >= 'A' && c <= 'F' {
+			wrongCase[i] = c - 'A' + 'a'
+			break
+		}
+	}
+	invalid[string(wrongCase)] = ErrInvalidAddressChecksum
+
+	for s, want := range invalid {
+		if _, err := ParseFMAddress(s); err != want {
+			t.Errorf("ParseFMAddress(%s) err=%v, want %v", s, err, want)
+		}
+	}
+}
+
+func TestFMAddress_Format(t *testing.T) {
+	a := mustParseFMAddress(t, testDepositAddress)
+	hexAddr := strings.TrimPrefix(testDepositAddress, "FM")
+
+	if a.Hex() != hexAddr || a.Gateway() != testDepositAddress || a.RPC() != "0x"+hexAddr {
+		t.Errorf("formats = %s, %s, %s", a.Hex(), a.Gateway(), a.RPC())
+	}
+	if c := a.Checksum(); !strings.HasPrefix(c, "FM") || strings.ToLower(c[2:]) != hexAddr || c[2:] != a.Common().Hex()[2:] {
+		t.Errorf("Checksum() = %s", c)
+	}
+	if NormalizeFMAddress("0x"+strings.ToUpper(hexAddr)) != testDepositAddress {
+		t.Errorf("NormalizeFMAddress should return the canonical format")
+	}
+	if NormalizeFMAddress("unknown") != "unknown" {
+		t.Errorf("NormalizeFMAddress should keep invalid address")
+	}
+	if AppendOxToAddress(testDepositAddress) != a.RPC() || ReplaceFmToAddress(a.RPC()) != testDepositAddress {
+		t.Errorf("address conversion mismatch")
+	}
+}
+
+func TestMakeTransactionData_Address(t *testing.T) {
+	amount := big.NewInt(1)
+	want := ""
+	for _, to := range []interface{}{testDepositAddress, "0x" + strings.TrimPrefix(testDepositAddress, "FM"), mustParseFMAddress(t, testDepositAddress)} {
+		data, err := makeTransactionData(ETH_TRANSFER_TOKEN_BALANCE_METHOD, []SolidityParam{
+			{ParamType: SOLIDITY_TYPE_ADDRESS, ParamValue: to},
+			{ParamType: SOLIDITY_TYPE_UINT256, ParamValue: amount},
+		})
+		if err != nil {
+			t.Fatalf("makeTransactionData(%v) failed, err=%v", to, err)
+		}
+		if want == "" {
+			want = data
+		} else if data != want {
+			t.Errorf("makeTransactionData(%v) = %s, want %s", to, data, want)
+		}
+	}
+
+	//地址中间含有fm的字符串不能当作FM地址
+	_, err := makeTransactionData(ETH_TRANSFER_TOKEN_BALANCE_METHOD, []SolidityParam{
+		{ParamType: SOLIDITY_TYPE_ADDRESS, ParamValue: "1a642ffm0e3c3af545e7acbd38b07251b3990914f1"},
+	})
+	if err == nil {
+		t.Errorf("address with fm in the middle should fail")
+	}
+}
+
+func TestNormalizedScanAddressFunc(t *testing.T) {
+	var got []string
+	f := normalizedScanAddressFunc(func(address string) (string, bool) {
+		got = append(got, address)
+		return "", address == testDepositAddress
+	})
+	hexAddr := strings.TrimPrefix(testDepositAddress, "FM")
+	for _, s := range []string{"0x" + hexAddr, "fm" + strings.ToUpper(hexAddr), testDepositAddress} {
+		if _, ok := f(s); !ok {
+			t.Errorf("FilterFunc(%s) not matched, got %v", s, got)
+		}
+	}
+}
+
+func mustParseFMAddress(t *testing.T, address string) FMAddress {
+	a, err := ParseFMAddress(address)
+	if err != nil {
+		t.Fatalf("ParseFMAddress(%s) failed, err=%v", address, err)
+	}
+	return a
+}
@@ -17,6 +17,7 @@ package filememory
 import (
 	"bufio"
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -79,7 +80,12 @@ type WalletManager struct {
 	Decoder      openwallet.AddressDecoder     //地址编码器
 	TxDecoder    openwallet.TransactionDecoder //交易单编码器
 	//	RootDir        string                        //
-	locker          sync.Mutex //防止并发修改和读取配置, 可能用不上
+	locker          sync.Mutex              //防止并发修改和读取配置, 可能用不上
+	nonceLocker     sync.Mutex              //保护本地nonce账本的分配和更新
+	networkLocker   sync.Mutex              //保护网络握手的结果
+	networkInfo     map[string]*NetworkInfo //网络握手通过的节点地址及其网络信息
+	networkRejected map[string]error        //网络与配置不一致的节点地址
+	addressLocker   sync.Mutex              //保护地址索引的分配和充值地址池
 	WalletInSumOld  map[string]*Wallet
 	ContractDecoder openwallet.SmartContractDecoder //
 	//StorageOld      *keystore.HDKeystore
@@ -130,6 +136,31 @@ func NewWalletManager() *WalletManager {
 	return &wm
 }
 
+//GetServerAPIStatus 探测所有节点并返回各节点状态，未配置节点池时返回空
+func (this *WalletManager) GetServerAPIStatus() []EndpointStatus {
+	if this.WalletClient == nil || this.WalletClient.Pool == nil {
+		return nil
+	}
+	this.WalletClient.Pool.Check(this.WalletClient)
+	return this.WalletClient.Pool.Status()
+}
+
+//RotateGatewayKey 换用新的网关密钥，无需重启，原密钥保留为备用
+func (this *WalletManager) RotateGatewayKey(key string) error {
+	if len(key) == 0 {
+		return errors.New("gateway key is empty")
+	}
+	if this.WalletClient.Auth == nil {
+		auth, err := NewGatewayAuth(AuthSchemeHMAC, "hmac-sha256", TOKEN_KEY)
+		if err != nil {
+			return err
+		}
+		this.WalletClient.Auth = auth
+	}
+	this.WalletClient.Auth.Rotate(key)
+	return nil
+}
+
 func (this *WalletManager) CreateWallet(name string, password string) (*Wallet, string, error) {
 	//检查钱包名是否存在
 	wallets, err := GetWalletKeys(this.GetConfig().KeyDir)
@@ -392,18 +423,52 @@ func (this *WalletManager) UnlockWallet(wallet *Wallet, password string) error {
 	return nil
 }
 
-//exportAddressToFile 导出地址到文件中
+//exportAddressToFile 导出地址到文件中，按扩展名选择格式：.csv和.json导出地址、索引和HD路径，其他为每行一个地址
 func (this *WalletManager) exportAddressToFile(addrs []*Address, filePath string) error {
 
-	var content string
+	var content bytes.Buffer
 
-	for _, a := range addrs {
-		//log.Std.Info("Export: %s ", a.Address)
-		content = content + AppendFmToAddress(a.Address) + "\n"
+	//csv和json是完整的文件，覆盖写入；纯文本追加写入
+	appendContent := false
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case "." + AddressExportCSV:
+		w := csv.NewWriter(&content)
+		w.Write([]string{"address", "index", "hdpath", "publickey"})
+		for _, a := range addrs {
+			w.Write([]string{AppendFmToAddress(a.Address), strconv.Itoa(a.Index), a.HDPath, a.PublicKey})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	case "." + AddressExportJSON:
+		type exportAddress struct {
+			Address   string `json:"address"`
+			Index     int    `json:"index"`
+			HDPath    string `json:"hdpath"`
+			PublicKey string `json:"publickey"`
+		}
+		list := make([]exportAddress, 0, len(addrs))
+		for _, a := range addrs {
+			list = append(list, exportAddress{AppendFmToAddress(a.Address), a.Index, a.HDPath, a.PublicKey})
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		content.Write(data)
+		content.WriteString("\n")
+	default:
+		appendContent = true
+		for _, a := range addrs {
+			//log.Std.Info("Export: %s ", a.Address)
+			content.WriteString(AppendFmToAddress(a.Address))
+			content.WriteString("\n")
+		}
 	}
 
-	file.MkdirAll(this.GetConfig().AddressDir)
-	if !file.WriteFile(filePath, []byte(content), true) {
+	file.MkdirAll(filepath.Dir(filePath))
+	if !file.WriteFile(filePath, content.Bytes(), appendContent) {
 		return errors.New("export address to file failed.")
 	}
 	return nil
@@ -460,34 +525,21 @@ func (this *txFeeInfo) CalcFee() error {
 	return nil
 }
 
+//GetTransactionFeeEstimated 按手续费策略计算交易的gasLimit、gasPrice和手续费
 func (this *WalletManager) GetTransactionFeeEstimated(from string, to string, value *big.Int, data string) (*txFeeInfo, error) {
 
-	var (
-		gasLimit, gasPrice = big.NewInt(this.Config.GasLimit.Int64()), big.NewInt(this.Config.GasPrice.Int64())
-	)
-	/*
-	20200310 与项目方沟通,使用固定值GAS
-	if this.Config.GasLimit.Cmp(big.NewInt(0)) > 0 {
-		//配置设置固定gasLimit
-		gasLimit = this.Config.GasLimit
-	} else {
-		//动态计算gas消耗
-		gasLimit, err = this.WalletClient.ethGetGasEstimated(makeGasEstimatePara(from, to, value, data))
-		if err != nil {
-			this.Log.Errorf(fmt.Sprintf("get gas limit failed, err = %v\n", err))
-			return nil, err
-		}
+	gasLimit, err := this.GetGasLimit(from, to, value, data)
+	if err != nil {
+		this.Log.Errorf("get gas limit failed, err = %v", err)
+		return nil, err
 	}
 
-	gasPrice, err = this.WalletClient.ethGetGasPrice()
+	gasPrice, err := this.GetGasPrice()
 	if err != nil {
-		this.Log.Errorf(fmt.Sprintf("get gas price failed, err = %v\n", err))
+		this.Log.Errorf("get gas price failed, err = %v", err)
 		return nil, err
 	}
 
-	fee := new(big.Int)
-	fee.Mul(gasLimit, gasPrice)*/
-
 	feeInfo := &txFeeInfo{
 		GasLimit: gasLimit,
 		GasPrice: gasPrice,
@@ -652,10 +704,6 @@ func (this *Client) LockAddr(address string) error {
 	return msg[:], nil
 }*/
 
-func verifyTransaction(nonce uint64, to string, amount *big.Int, gasLimit uint64, gasPrice *big.Int, data []byte) error {
-	return nil
-}
-
 func (this *Client) ethGetGasPrice() (*big.Int, error) {
 	params := []interface{}{}
 	result, err := this.Call("eth_gasPrice", 1, params)
@@ -680,19 +728,6 @@ func (this *Client) ethGetGasPrice() (*big.Int, error) {
 
 func (this *WalletManager) GetNonceForAddress2(address string) (uint64, error) {
 	address = ReplaceFmToAddress(address)
-	//txpool, err := this.WalletClient.EthGetTxPoolContent()
-	//if err != nil {
-	//	this.Log.Errorf("EthGetTxPoolContent failed, err = %v", err)
-	//	return 0, err
-	//}
-	//
-	//_, max, count, err := txpool.GetSequentTxNonce(address)
-	//if err != nil {
-	//	log.Error("get txpool sequent tx nonce failed, err=%v", err)
-	//	return 0, err
-	//}
-	//log.Debugf("sequent max nonce:%v", max)
-	//log.Debugf("sequent nonce count:%v", count)
 	txCount, err := this.WalletClient.fmGetTransactionCount(address)
 	if err != nil {
 		log.Error("fmGetTransactionCount failed, err=", err)
@@ -700,10 +735,6 @@ func (this *WalletManager) GetNonceForAddress2(address string) (uint64, error) {
 	}
 	log.Debugf("txCount:%v", txCount)
 	return txCount, nil
-	//if count == 0 || max < txCount {
-	//	return txCount, nil
-	//}
-	//return max + 1, nil
 }
 
 func (this *WalletManager) GetNonceForAddress(address string) (uint64, error) {
@@ -18,6 +18,7 @@ package filememory
 import (
 	"fmt"
 	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/common/file"
 	"github.com/blocktree/openwallet/log"
 	"math/big"
 	"path/filepath"
@@ -40,6 +41,17 @@ func testNewWalletManager() *WalletManager {
 	//读取配置
 	absFile := filepath.Join("conf", "conf.ini")
 	//log.Debug("absFile:", absFile)
+	if !file.Exists(absFile) {
+		//没有配置文件时连接内存模拟节点
+		log.Warningf("%s not found, wallet manager connect to fake node", absFile)
+		c, err := config.NewConfigData("ini", []byte(fmt.Sprintf(testFakeNodeConfig, "")))
+		if err != nil {
+			panic(err)
+		}
+		wm.LoadAssetsConfig(c)
+		wm.WalletClient.Transport = NewFakeNode()
+		return wm
+	}
 	c, err := config.NewConfig("ini", absFile)
 	if err != nil {
 		panic(err)
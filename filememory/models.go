@@ -23,6 +23,7 @@ import (
 	"math/big"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/asdine/storm"
@@ -52,22 +53,26 @@ type ERC20Token struct {
 	Symbol   string `json:"symbol" storm:"index"`
 	Name     string `json:"name"`
 	Decimals int    `json:"decimals"`
+	Disabled bool   `json:"disabled"` //停用后不再监听，也不能用于创建交易
 	balance  *big.Int
 }
 
 type EthEvent struct {
 	Address string   `json:"address"`
 	Topics  []string `json:"topics"`
-	Data    string   `josn:"data"`
+	Data    string   `json:"data"`
 	//BlockNumber string
 	LogIndex string `json:"logIndex"`
 	Removed  bool   `json:"removed"`
 }
 
 type EthTransactionReceipt struct {
-	Logs    []EthEvent `json:"logs"`
-	GasUsed string     `json:"gasUsed"`
-	Status  string     `json:"status"`
+	Logs              []EthEvent `json:"logs"`
+	GasUsed           string     `json:"gasUsed"`
+	EffectiveGasPrice string     `json:"effectiveGasPrice"`
+	Status            string     `json:"status"`
+	BlockNumber       string     `json:"blockNumber"`
+	BlockHash         string     `json:"blockHash"`
 }
 
 type TransferEvent struct {
@@ -147,6 +152,8 @@ type Address struct {
 	tokenBalance *big.Int
 	TxCount      uint64
 	CreatedAt    time.Time
+	Pooled       bool `storm:"index"` //在充值地址池中，尚未分配
+	AssignedAt   time.Time
 }
 
 func (this *Address) CalcPrivKey(masterKey *hdkeystore.HDKey) ([]byte, error) {
@@ -178,7 +185,11 @@ type BlockTransaction struct {
 	Value       string `json:"value"`
 	Timestamp   uint64 `json:"timestamp"`
 	BlockHeight uint64 //transaction scanning 的时候对其进行赋值
-	FilterFunc  openwallet.BlockScanAddressFunc
+	Gas         string `json:"gas"`      //gas上限
+	GasPrice    string `json:"gasPrice"` //gas价格，单位wei
+	GasUsed     string `json:"gasUsed"`  //实际使用的gas，网关没有返回时从交易回执获取
+	Fee         string `json:"fee"`      //网关返回的手续费，单位wei
+	FilterFunc  openwallet.BlockScanAddressFunc `json:"-"`
 }
 
 func (this *BlockTransaction) GetAmountEthString() (string, error) {
@@ -195,21 +206,37 @@ func (this *BlockTransaction) GetAmountEthString() (string, error) {
 	return amountVal.String(), nil
 }
 
-func (this *BlockTransaction) GetTxFeeEthString() (string, error) {
+//GetTxFee 交易实际支付的手续费，单位wei。网关返回了fee时直接使用，否则为gasUsed × gasPrice
+func (this *BlockTransaction) GetTxFee() (*big.Int, error) {
+	if len(this.Fee) > 0 {
+		return convertNumberString(this.Fee)
+	}
 
-	gasPrice, err := ConvertToBigInt("18", 10)
+	if len(this.GasUsed) == 0 || len(this.GasPrice) == 0 {
+		return nil, fmt.Errorf("transaction[%v] has no gas used or gas price", this.Hash)
+	}
+
+	gasPrice, err := convertNumberString(this.GasPrice)
 	if err != nil {
 		log.Errorf("convert tx.GasPrice failed, err= %v", err)
-		return "", err
+		return nil, err
 	}
 
-	gas, err := ConvertToBigInt("900000", 10)
+	gasUsed, err := convertNumberString(this.GasUsed)
 	if err != nil {
-		log.Errorf("convert tx.Gas failed, err=%v", err)
-		return "", err
+		log.Errorf("convert tx.GasUsed failed, err=%v", err)
+		return nil, err
 	}
 	fee := big.NewInt(0)
-	fee.Mul(gasPrice, gas)
+	fee.Mul(gasPrice, gasUsed)
+	return fee, nil
+}
+
+func (this *BlockTransaction) GetTxFeeEthString() (string, error) {
+	fee, err := this.GetTxFee()
+	if err != nil {
+		return "", err
+	}
 	feeprice, err := ConverWeiStringToEthDecimal(fee.String())
 	if err != nil {
 		log.Errorf("convert fee failed, err=%v", err)
@@ -218,6 +245,14 @@ func (this *BlockTransaction) GetTxFeeEthString() (string, error) {
 	return feeprice.String(), nil
 }
 
+//convertNumberString 解析网关返回的数值，0x开头为十六进制，否则为十进制
+func convertNumberString(value string) (*big.Int, error) {
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		return ConvertToBigInt(strings.ToLower(value), 16)
+	}
+	return ConvertToBigInt(value, 10)
+}
+
 type BlockHeader struct {
 	BlockNumber     string `json:"number" storm:"id"`
 	BlockHash       string `json:"hash"`
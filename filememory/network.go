@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/blocktree/openwallet/log"
+	"github.com/tidwall/gjson"
+)
+
+//网络握手：扫描或签名前向当前节点查询链ID、网络ID和参考区块的哈希，与配置比对，
+//不一致时拒绝扫描和签名，避免连错节点或网络时产生不会被接受的交易。
+//握手结果按节点地址缓存，多节点切换到未握手的节点时重新握手；
+//节点不支持查询时返回ErrNetworkUnverified，与网络不一致的ErrNetworkMismatch区分
+//
+//	NetworkCheck = true          是否握手，默认true，不支持查询的旧网关可以关闭
+//	ChainID = 1                  链ID，与eth_chainId比对，节点不支持时使用net_version
+//	NetworkID = 1                网络ID，与net_version比对，为空不比对
+//	ReferenceBlockHeight = 0     参考区块高度，默认0即创世区块
+//	ReferenceBlockHash = 0x...   参考区块哈希，为空不比对
+
+//NetworkInfo 节点所在网络的信息
+type NetworkInfo struct {
+	ChainID         uint64 //链ID
+	NetworkID       string //网络ID
+	ReferenceHeight uint64 //参考区块高度
+	ReferenceHash   string //参考区块哈希，未配置时为空
+}
+
+//EthChainID 查询节点的链ID，节点不支持eth_chainId时使用net_version
+func (this *Client) EthChainID() (uint64, error) {
+	result, err := this.Call("eth_chainId", 1, nil)
+	if err == nil && result.Type == gjson.String {
+		return strconv.ParseUint(removeOxFromHex(result.String()), 16, 64)
+	}
+	log.Warningf("eth_chainId is not supported, use net_version instead, err=%v", err)
+
+	version, err := this.NetVersion()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(version, 10, 64)
+}
+
+//NetVersion 查询节点的网络ID
+func (this *Client) NetVersion() (string, error) {
+	result, err := this.Call("net_version", 1, nil)
+	if err != nil {
+		return "", err
+	}
+	if result.Type != gjson.String && result.Type != gjson.Number {
+		return "", fmt.Errorf("net_version result type error: %s", result.Raw)
+	}
+	return result.String(), nil
+}
+
+//GetNetworkInfo 向节点查询网络信息，没有配置参考区块哈希时不查询参考区块
+func (this *WalletManager) GetNetworkInfo() (*NetworkInfo, error) {
+	return this.getNetworkInfo(this.WalletClient)
+}
+
+func (this *WalletManager) getNetworkInfo(client *Client) (*NetworkInfo, error) {
+	chainID, err := client.EthChainID()
+	if err != nil {
+		return nil, err
+	}
+	info := &NetworkInfo{ChainID: chainID, ReferenceHeight: this.Config.ReferenceBlockHeight}
+	if len(this.Config.NetworkID) > 0 {
+		info.NetworkID, err = client.NetVersion()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(this.Config.ReferenceBlockHash) > 0 {
+		block, err := client.FMGetBlockSpecByBlockNum(this.Config.ReferenceBlockHeight, false)
+		if err != nil {
+			return nil, err
+		}
+		info.ReferenceHash = block.BlockHash
+	}
+	return info, nil
+}
+
+//CheckNetwork 与当前节点握手并比对网络信息与配置，一致时按节点地址缓存结果
+func (this *WalletManager) CheckNetwork() (*NetworkInfo, error) {
+	this.networkLocker.Lock()
+	defer this.networkLocker.Unlock()
+	return this.checkEndpointNetwork(this.WalletClient.Endpoint())
+}
+
+//checkEndpointNetwork 与指定节点握手，网络不一致的节点记录下来，调用时已加锁
+func (this *WalletManager) checkEndpointNetwork(endpoint string) (*NetworkInfo, error) {
+	delete(this.networkInfo, endpoint)
+	delete(this.networkRejected, endpoint)
+	info, err := this.getNetworkInfo(this.WalletClient.endpointClient(endpoint))
+	if err != nil {
+		return nil, &NetworkUnverifiedError{Endpoint: endpoint, Err: err}
+	}
+	err = this.Config.matchNetwork(info)
+	if err != nil {
+		if this.networkRejected == nil {
+			this.networkRejected = make(map[string]error)
+		}
+		this.networkRejected[endpoint] = err
+		return info, err
+	}
+	if this.networkInfo == nil {
+		this.networkInfo = make(map[string]*NetworkInfo)
+	}
+	this.networkInfo[endpoint] = info
+	this.Log.Infof("network check of %s passed, chainID: %d, networkID: %s", endpoint, info.ChainID, info.NetworkID)
+	return info, nil
+}
+
+//matchNetwork 比对节点的网络信息与配置
+func (this *WalletConfig) matchNetwork(info *NetworkInfo) error {
+	if info.ChainID != this.ChainID {
+		return &NetworkMismatchError{Field: "chainID", Node: strconv.FormatUint(info.ChainID, 10), Config: strconv.FormatUint(this.ChainID, 10)}
+	}
+	if len(this.NetworkID) > 0 && info.NetworkID != this.NetworkID {
+		return &NetworkMismatchError{Field: "networkID", Node: info.NetworkID, Config: this.NetworkID}
+	}
+	if len(this.ReferenceBlockHash) > 0 && !strings.EqualFold(removeOxFromHex(info.ReferenceHash), removeOxFromHex(this.ReferenceBlockHash)) {
+		return &NetworkMismatchError{
+			Field:  fmt.Sprintf("block %d hash", info.ReferenceHeight),
+			Node:   info.ReferenceHash,
+			Config: this.ReferenceBlockHash,
+		}
+	}
+	return nil
+}
+
+//networkReady 扫描和签名前确认当前节点已通过网络握手
+func (this *WalletManager) networkReady() error {
+	err := this.endpointReady(this.WalletClient.Endpoint())
+	if err != nil {
+		this.Log.Errorf("network check failed, err=%v", err)
+		return err
+	}
+	return nil
+}
+
+//endpointReady 确认节点已通过网络握手，未握手时先握手。多节点切换到某个节点前也会调用，
+//网络不一致的节点在重新加载配置或调用CheckNetwork之前不再握手，直接跳过
+func (this *WalletManager) endpointReady(endpoint string) error {
+	if !this.Config.NetworkCheck {
+		return nil
+	}
+	this.networkLocker.Lock()
+	defer this.networkLocker.Unlock()
+	if this.networkInfo[endpoint] != nil {
+		return nil
+	}
+	if err := this.networkRejected[endpoint]; err != nil {
+		return err
+	}
+	_, err := this.checkEndpointNetwork(endpoint)
+	return err
+}
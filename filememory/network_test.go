@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestWalletManager_CheckNetwork(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	node.SetBlock(testMakeBlock(5, "aa"))
+
+	info, err := wm.CheckNetwork()
+	if err != nil || info.ChainID != 1 {
+		t.Fatalf("CheckNetwork = %+v, err=%v", info, err)
+	}
+
+	//握手通过后不再查询
+	calls := node.Calls("eth_chainId")
+	if err := wm.networkReady(); err != nil || node.Calls("eth_chainId") != calls {
+		t.Errorf("networkReady should use the cached result, err=%v", err)
+	}
+
+	//节点不支持eth_chainId时使用net_version
+	node.FailNext("eth_chainId", -32601, "the method eth_chainId does not exist")
+	if info, err := wm.CheckNetwork(); err != nil || info.ChainID != 1 {
+		t.Errorf("CheckNetwork with net_version = %+v, err=%v", info, err)
+	}
+
+	tests := []struct {
+		name  string
+		setup func()
+		field string
+	}{
+		{"chainID", func() {
+			node.SetResult("eth_chainId", "0x2")
+		}, "chainID"},
+		{"networkID", func() {
+			wm.Config.NetworkID = "7"
+		}, "networkID"},
+		{"referenceBlock", func() {
+			wm.Config.ReferenceBlockHeight = 5
+			wm.Config.ReferenceBlockHash = testMakeBlock(5, "bb").BlockHash
+		}, "block 5 hash"},
+	}
+	for _, test := range tests {
+		node.SetResult("eth_chainId", "0x1")
+		wm.Config.NetworkID, wm.Config.ReferenceBlockHeight, wm.Config.ReferenceBlockHash = "1", 5, testMakeBlock(5, "aa").BlockHash
+		if _, err := wm.CheckNetwork(); err != nil {
+			t.Fatalf("%s: CheckNetwork failed, err=%v", test.name, err)
+		}
+		test.setup()
+		_, err := wm.CheckNetwork()
+		if e, ok := err.(*NetworkMismatchError); !ok || e.Field != test.field || !e.Is(ErrNetworkMismatch) {
+			t.Errorf("%s: err = %v, want mismatch of %s", test.name, err, test.field)
+		}
+	}
+}
+
+func TestWalletManager_CheckNetwork_Refuse(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	rawTx := testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	node.SetResult("eth_chainId", "0x2")
+	if _, err := wm.CheckNetwork(); err == nil {
+		t.Fatalf("CheckNetwork should fail on chainID mismatch")
+	}
+
+	//不扫描
+	node.SetBlock(testMakeBlock(1, "aa"))
+	node.SetBlock(testMakeBlock(2, "aa", BlockTransaction{Hash: "0xaa", From: testOtherAddress, To: testDepositAddress, Value: "100", Status: true}))
+	bs.SaveLocalBlockHead(1, testMakeBlock(1, "aa").BlockHash)
+	bs.Scanning = true
+	bs.ScanBlockTask()
+	if node.Calls("blocktxs") != 0 || len(observer.extractData) != 0 {
+		t.Errorf("scanner should not scan on network mismatch")
+	}
+
+	//不签名
+	if err := wm.TxDecoder.SignRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("sign should fail on network mismatch")
+	}
+
+	//关闭握手
+	wm.Config.NetworkCheck = false
+	bs.ScanBlockTask()
+	if node.Calls("blocktxs") == 0 {
+		t.Errorf("scanner should scan when network check is disabled")
+	}
+}
+
+func TestWalletManager_CheckNetwork_Unverified(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	//节点不支持网络查询时不能确认网络，与网络不一致区分
+	node.FailNext("eth_chainId", -32601, "the method eth_chainId does not exist")
+	node.FailNext("net_version", -32601, "the method net_version does not exist")
+	err := wm.networkReady()
+	if e, ok := err.(*NetworkUnverifiedError); !ok || !e.Is(ErrNetworkUnverified) || e.Is(ErrNetworkMismatch) {
+		t.Fatalf("networkReady err = %v, want unverified", err)
+	}
+	if err := wm.networkReady(); err != nil {
+		t.Errorf("networkReady should pass once the node answers, err=%v", err)
+	}
+}
+
+func TestWalletManager_CheckNetwork_Failover(t *testing.T) {
+	wm, _ := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	client, routes := testNodePoolClient("fake://a/", "fake://b/", "fake://c/")
+	client.Pool.CheckInterval = time.Hour
+	client.endpointCheck = wm.endpointReady
+	wm.WalletClient = client
+	for _, node := range routes {
+		node.SetTip(100)
+		node.SetBlock(testMakeBlock(1, "aa"))
+	}
+	routes["fake://b/"].SetResult("eth_chainId", "0x2")
+
+	if err := wm.networkReady(); err != nil {
+		t.Fatalf("networkReady on node a failed, err=%v", err)
+	}
+
+	//节点a不可用时跳过网络不一致的节点b，切换到握手通过的节点c
+	for i := 0; i < 2; i++ {
+		routes["fake://a/"].FailNextTransport("blocktxs", errors.New("connection refused"))
+		if _, err := client.FMGetBlockSpecByBlockNum(1, true); err != nil || client.Endpoint() != "fake://c/" {
+			t.Fatalf("failover to node c failed, endpoint=%s, err=%v", client.Endpoint(), err)
+		}
+	}
+	if calls := routes["fake://b/"].Calls("blocktxs"); calls != 0 {
+		t.Errorf("node b with another chainID got %d requests", calls)
+	}
+	if calls := routes["fake://b/"].Calls("eth_chainId"); calls != 1 {
+		t.Errorf("node b should be checked once, got %d", calls)
+	}
+	if calls := routes["fake://c/"].Calls("eth_chainId"); calls != 1 {
+		t.Errorf("node c should be checked once, got %d", calls)
+	}
+	if err := wm.networkReady(); err != nil {
+		t.Errorf("networkReady on node c failed, err=%v", err)
+	}
+
+	//所有可用节点都不一致时请求失败
+	routes["fake://c/"].SetResult("eth_chainId", "0x2")
+	if _, err := wm.CheckNetwork(); err == nil {
+		t.Fatalf("CheckNetwork on node c should fail")
+	}
+	routes["fake://a/"].FailNextTransport("blocktxs", errors.New("connection refused"))
+	if _, err := client.FMGetBlockSpecByBlockNum(1, true); err == nil {
+		t.Errorf("request should fail when no other node passes the network check")
+	}
+}
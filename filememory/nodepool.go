@@ -0,0 +1,279 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/log"
+)
+
+const (
+	DefaultNodeCheckInterval = 30 * time.Second
+	DefaultNodeMaxLag        = 3
+)
+
+//EndpointStatus 节点状态
+type EndpointStatus struct {
+	URL         string    //节点地址
+	Healthy     bool      //最近一次请求或探测是否成功
+	BlockHeight uint64    //最近一次探测到的区块高度
+	Lag         uint64    //落后于所有节点最高高度的区块数
+	Failures    int       //连续失败次数
+	LastError   string    //最近一次失败原因
+	LastCheck   time.Time //最近一次探测时间
+}
+
+//NodePool 多节点池，定期用FmGetBlockNumber探测各节点，
+//请求优先发往可用且高度最接近最新高度的节点，失败时自动切换到下一个节点
+type NodePool struct {
+	mu        sync.Mutex
+	endpoints []*EndpointStatus
+	checking  bool
+	lastCheck time.Time
+	current   string //最近一次请求成功的节点
+	//探测间隔，0表示每次选择节点前都探测
+	CheckInterval time.Duration
+	//允许落后最高高度的区块数，超过后只作为备用节点
+	MaxLag uint64
+}
+
+//NewNodePool 创建节点池，节点初始都视为可用
+func NewNodePool(urls []string) *NodePool {
+	pool := NodePool{
+		endpoints:     make([]*EndpointStatus, 0, len(urls)),
+		CheckInterval: DefaultNodeCheckInterval,
+		MaxLag:        DefaultNodeMaxLag,
+	}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &EndpointStatus{URL: url, Healthy: true})
+	}
+	return &pool
+}
+
+//Check 探测所有节点的可用性和区块高度
+func (pool *NodePool) Check(c *Client) {
+	pool.mu.Lock()
+	if pool.checking {
+		pool.mu.Unlock()
+		return
+	}
+	pool.checking = true
+	urls := make([]string, 0, len(pool.endpoints))
+	for _, e := range pool.endpoints {
+		urls = append(urls, e.URL)
+	}
+	pool.mu.Unlock()
+
+	type probeResult struct {
+		height uint64
+		err    error
+	}
+	results := make([]probeResult, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			probe := &Client{
+				BaseURL:   url,
+				Debug:     c.Debug,
+				Transport: c.Transport,
+				Auth:      c.Auth,
+				Retry:     &RetryPolicy{Timeout: c.retryPolicy().timeout("blocknumber")},
+			}
+			height, err := probe.FmGetBlockNumber()
+			results[i] = probeResult{height: height, err: err}
+		}(i, url)
+	}
+	wg.Wait()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	now := time.Now()
+	for i, e := range pool.endpoints {
+		e.LastCheck = now
+		if results[i].err != nil {
+			e.Healthy = false
+			e.Failures++
+			e.LastError = results[i].err.Error()
+			log.Warningf("node %s is unavailable, err=%v", e.URL, results[i].err)
+			continue
+		}
+		e.Healthy = true
+		e.Failures = 0
+		e.LastError = ""
+		e.BlockHeight = results[i].height
+	}
+	pool.updateLag()
+	pool.lastCheck = now
+	pool.checking = false
+}
+
+//updateLag 计算各节点落后最高高度的区块数，调用时已加锁
+func (pool *NodePool) updateLag() {
+	var tip uint64
+	for _, e := range pool.endpoints {
+		if e.Healthy && e.BlockHeight > tip {
+			tip = e.BlockHeight
+		}
+	}
+	for _, e := range pool.endpoints {
+		if e.BlockHeight < tip {
+			e.Lag = tip - e.BlockHeight
+		} else {
+			e.Lag = 0
+		}
+	}
+}
+
+//candidates 按优先级排列的节点地址，到了探测间隔时先探测
+//可用且未落后的节点按高度从高到低在前，落后或不可用的节点作为备用
+func (pool *NodePool) candidates(c *Client) []string {
+	pool.mu.Lock()
+	due := pool.CheckInterval <= 0 || time.Since(pool.lastCheck) >= pool.CheckInterval
+	pool.mu.Unlock()
+	if due {
+		pool.Check(c)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	list := make([]*EndpointStatus, len(pool.endpoints))
+	copy(list, pool.endpoints)
+	rank := func(e *EndpointStatus) int {
+		switch {
+		case e.Healthy && e.Lag <= pool.MaxLag:
+			return 0
+		case e.Healthy:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		ri, rj := rank(list[i]), rank(list[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 2 {
+			return list[i].Failures < list[j].Failures
+		}
+		return list[i].BlockHeight > list[j].BlockHeight
+	})
+	urls := make([]string, 0, len(list))
+	for _, e := range list {
+		urls = append(urls, e.URL)
+	}
+	return urls
+}
+
+//markSuccess 请求成功，节点恢复可用
+func (pool *NodePool) markSuccess(url string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.current = url
+	for _, e := range pool.endpoints {
+		if e.URL == url {
+			e.Healthy = true
+			e.Failures = 0
+			e.LastError = ""
+		}
+	}
+}
+
+//markFailure 请求失败，节点标记为不可用，直到下一次请求成功或探测成功
+func (pool *NodePool) markFailure(url string, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, e := range pool.endpoints {
+		if e.URL == url {
+			e.Healthy = false
+			e.Failures++
+			e.LastError = err.Error()
+			log.Warningf("node %s failed, switch to next node, err=%v", url, err)
+		}
+	}
+}
+
+//Status 各节点状态的快照，按配置顺序排列
+func (pool *NodePool) Status() []EndpointStatus {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	status := make([]EndpointStatus, 0, len(pool.endpoints))
+	for _, e := range pool.endpoints {
+		status = append(status, *e)
+	}
+	return status
+}
+
+//Current 最近一次请求成功的节点，还没有成功的请求时为空
+func (pool *NodePool) Current() string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.current
+}
+
+//Endpoint 当前使用的节点地址，多节点时为最近一次请求成功的节点
+func (c *Client) Endpoint() string {
+	if c.Pool != nil {
+		if url := c.Pool.Current(); len(url) > 0 {
+			return url
+		}
+	}
+	return c.BaseURL
+}
+
+//endpointClient 只向指定节点发送请求的客户端，不切换节点
+func (c *Client) endpointClient(url string) *Client {
+	client := *c
+	client.BaseURL = url
+	client.Pool = nil
+	client.endpointCheck = nil
+	return &client
+}
+
+//failover 依次向候选节点发送请求，通讯错误或可重试的错误码时切换到下一个节点
+func (c *Client) failover(call func(baseURL string) *callError) *callError {
+	if c.Pool == nil {
+		return call(c.BaseURL)
+	}
+	urls := c.Pool.candidates(c)
+	if len(urls) == 0 {
+		return call(c.BaseURL)
+	}
+	var cerr *callError
+	for _, url := range urls {
+		if c.endpointCheck != nil {
+			if err := c.endpointCheck(url); err != nil {
+				log.Warningf("node %s is skipped, err=%v", url, err)
+				cerr = &callError{err: err}
+				continue
+			}
+		}
+		cerr = call(url)
+		if cerr == nil {
+			c.Pool.markSuccess(url)
+			return nil
+		}
+		if !cerr.retryable {
+			return cerr
+		}
+		c.Pool.markFailure(url, cerr.err)
+	}
+	return cerr
+}
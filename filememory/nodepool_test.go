@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/config"
+)
+
+//testRouteTransport 按URL前缀把请求转发到不同的模拟节点
+type testRouteTransport map[string]*FakeNode
+
+func (routes testRouteTransport) Post(url string, header map[string]string, body interface{}, timeout time.Duration) ([]byte, error) {
+	for prefix, node := range routes {
+		if strings.HasPrefix(url, prefix) {
+			return node.Post(url, header, body, timeout)
+		}
+	}
+	return nil, fmt.Errorf("no route to %s", url)
+}
+
+func testNodePoolClient(urls ...string) (*Client, testRouteTransport) {
+	routes := make(testRouteTransport)
+	for _, url := range urls {
+		routes[url] = NewFakeNode()
+	}
+	client := &Client{
+		BaseURL:   urls[0],
+		Transport: routes,
+		Pool:      NewNodePool(urls),
+	}
+	return client, routes
+}
+
+func TestNodePool_RouteToHighestNode(t *testing.T) {
+	client, routes := testNodePoolClient("fake://a/", "fake://b/", "fake://c/")
+	routes["fake://a/"].SetTip(90)
+	routes["fake://b/"].SetTip(100)
+	routes["fake://c/"].SetTip(99)
+
+	height, err := client.FmGetBlockNumber()
+	if err != nil || height != 100 {
+		t.Fatalf("FmGetBlockNumber = %d, %v; want 100 from node b", height, err)
+	}
+
+	status := client.Pool.Status()
+	if len(status) != 3 || status[0].Lag != 10 || status[1].Lag != 0 || status[2].Lag != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	//探测间隔内不再探测
+	client.FmGetBlockNumber()
+	if routes["fake://a/"].Calls("blocknumber") != 1 {
+		t.Errorf("node a blocknumber calls = %d, want 1", routes["fake://a/"].Calls("blocknumber"))
+	}
+}
+
+func TestNodePool_Failover(t *testing.T) {
+	client, routes := testNodePoolClient("fake://a/", "fake://b/")
+	routes["fake://a/"].SetTip(100)
+	routes["fake://b/"].SetTip(100)
+	client.Pool.Check(client)
+
+	routes["fake://a/"].FailNextTransport("getnonce", errors.New("connection refused"))
+	routes["fake://b/"].SetNonce(testOtherAddress, 5)
+	nonce, err := client.fmGetTransactionCount(testOtherAddress)
+	if err != nil || nonce != 5 {
+		t.Fatalf("fmGetTransactionCount = %d, %v; want 5 from node b", nonce, err)
+	}
+
+	status := client.Pool.Status()
+	if status[0].Healthy || status[0].LastError != "connection refused" || !status[1].Healthy {
+		t.Errorf("unexpected status after failover: %+v", status)
+	}
+
+	//不可用节点排在最后
+	routes["fake://b/"].SetTip(101)
+	height, err := client.FmGetBlockNumber()
+	if err != nil || height != 101 {
+		t.Errorf("FmGetBlockNumber = %d, %v; want 101", height, err)
+	}
+
+	//错误码不是节点故障，不切换节点
+	routes["fake://b/"].FailNext("balance", 10001, "invalid address")
+	if _, err := client.GetAddrBalance2(testOtherAddress, "latest"); err == nil {
+		t.Errorf("fatal code should be returned")
+	}
+	if routes["fake://a/"].Calls("balance") != 0 {
+		t.Errorf("fatal code should not fail over")
+	}
+}
+
+func TestWalletManager_GetServerAPIStatus(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "filememory")
+	if err != nil {
+		t.Fatalf("create temp dir failed, err=%v", err)
+	}
+	defer os.RemoveAll(dataDir)
+	c, err := config.NewConfigData("ini", []byte(fmt.Sprintf(`
+ServerAPI = "fake://a/, fake://b/"
+ChainID = 1
+ServerAPIMaxLag = 5
+GatewayTokenKey = test-gateway-key
+dataDir = "%s"
+`, dataDir)))
+	if err != nil {
+		t.Fatalf("load config failed, err=%v", err)
+	}
+	wm := NewWalletManager()
+	if err := wm.LoadAssetsConfig(c); err != nil {
+		t.Fatalf("LoadAssetsConfig failed, err=%v", err)
+	}
+	if wm.WalletClient.Pool == nil || wm.WalletClient.Pool.MaxLag != 5 {
+		t.Fatalf("node pool is not loaded")
+	}
+
+	routes := testRouteTransport{"fake://a/": NewFakeNode()}
+	routes["fake://a/"].SetTip(7)
+	wm.WalletClient.Transport = routes
+
+	status := wm.GetServerAPIStatus()
+	if len(status) != 2 {
+		t.Fatalf("status count = %d, want 2", len(status))
+	}
+	if status[0].URL != "fake://a/" || !status[0].Healthy || status[0].BlockHeight != 7 {
+		t.Errorf("unexpected status of node a: %+v", status[0])
+	}
+	if status[1].URL != "fake://b/" || status[1].Healthy || status[1].LastError == "" {
+		t.Errorf("unexpected status of node b: %+v", status[1])
+	}
+}
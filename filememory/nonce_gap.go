@@ -0,0 +1,433 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Assetsadapter/filememory-adapter/filememory_txsigner"
+	"github.com/asdine/storm"
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+//nonce缺口检查比较地址的链上nonce、交易池中的nonce和本地nonce账本，
+//链上nonce到最大已知nonce之间既不在交易池pending中、也不在queued中的nonce为缺口，缺口之后的交易永远无法打包。
+//缺口可以用从该地址转给自己、数量为0的交易填补，交易用钱包的HDKey签名
+
+//DEFAULT_NONCE_GAP_CHECK_INTERVAL nonce缺口检查的默认间隔，单位秒
+const DEFAULT_NONCE_GAP_CHECK_INTERVAL = 60
+
+//nonce缺口的原因
+const (
+	NonceGapMissing  = "missing"  //账本中没有记录，交易池中也没有
+	NonceGapDropped  = "dropped"  //已广播但不在交易池中，可能被网关丢弃
+	NonceGapReserved = "reserved" //已预留还没有广播，不自动填补
+)
+
+//NonceGap 地址的nonce缺口
+type NonceGap struct {
+	Address    string
+	Nonce      uint64
+	ChainNonce uint64 //检查时的链上nonce
+	Reason     string
+	TxID       string //账本中记录的交易
+	FillTxID   string //填补缺口的交易
+	FillError  error  //填补失败的原因
+}
+
+//Fillable 缺口是否可以自动填补
+func (gap *NonceGap) Fillable() bool {
+	return gap.Reason != NonceGapReserved
+}
+
+func (gap *NonceGap) String() string {
+	return fmt.Sprintf("address %s nonce %d is %s (chain nonce %d)", gap.Address, gap.Nonce, gap.Reason, gap.ChainNonce)
+}
+
+//CheckNonceGaps 检查地址的nonce缺口，按nonce从小到大排列
+func (this *WalletManager) CheckNonceGaps(address string) ([]*NonceGap, error) {
+	chainNonce, err := this.WalletClient.fmGetTransactionCount(address)
+	if err != nil {
+		return nil, err
+	}
+	txpool, err := this.WalletClient.EthGetTxPoolContent()
+	if err != nil {
+		return nil, err
+	}
+
+	//queued中的交易已广播，只是在等待前面的nonce，不是缺口
+	inPool, err := txpool.TxNonces(address)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := this.GetNonceRecords(address)
+	if err != nil {
+		return nil, err
+	}
+
+	//已知的最大nonce，包括交易池中的交易和账本中已广播的交易
+	var (
+		maxKnown uint64
+		hasKnown bool
+		recorded = make(map[uint64]*NonceRecord)
+	)
+	for nonce := range inPool {
+		if nonce >= chainNonce && (!hasKnown || nonce > maxKnown) {
+			maxKnown, hasKnown = nonce, true
+		}
+	}
+	for _, record := range records {
+		recorded[record.Nonce] = record
+		if record.Status == NonceStatusSubmitted && record.Nonce >= chainNonce && (!hasKnown || record.Nonce > maxKnown) {
+			maxKnown, hasKnown = record.Nonce, true
+		}
+	}
+
+	gaps := make([]*NonceGap, 0)
+	if !hasKnown {
+		return gaps, nil
+	}
+
+	now := time.Now().Unix()
+	for nonce := chainNonce; nonce <= maxKnown; nonce++ {
+		if inPool[nonce] {
+			continue
+		}
+		gap := &NonceGap{Address: address, Nonce: nonce, ChainNonce: chainNonce, Reason: NonceGapMissing}
+		if record := recorded[nonce]; record != nil {
+			gap.TxID = record.TxID
+			if record.Status == NonceStatusSubmitted {
+				gap.Reason = NonceGapDropped
+			} else if !record.expired(this.Config.NonceReserveTimeout, now) {
+				gap.Reason = NonceGapReserved
+			}
+		}
+		gaps = append(gaps, gap)
+	}
+	return gaps, nil
+}
+
+//nonceLedgerAddresses 本地nonce账本中有记录的地址
+func (this *WalletManager) nonceLedgerAddresses() ([]string, error) {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []*NonceRecord
+	err = db.All(&records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	addresses := make([]string, 0)
+	for _, record := range records {
+		if !keys[record.AddressKey] {
+			keys[record.AddressKey] = true
+			addresses = append(addresses, AppendFmToAddress(record.AddressKey))
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+//holdGapNonce 填补缺口前在账本中占用nonce，返回原来的记录，已预留的nonce不能占用
+func (this *WalletManager) holdGapNonce(address string, nonce uint64) (*NonceRecord, error) {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	old, err := this.getNonceRecord(address, nonce)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if old != nil && old.Status == NonceStatusReserved && !old.expired(this.Config.NonceReserveTimeout, time.Now().Unix()) {
+		return nil, fmt.Errorf("nonce %d of address %s is reserved by another transaction", nonce, address)
+	}
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	key := indexAddressKey(address)
+	err = db.Save(&NonceRecord{
+		ID:         nonceRecordID(key, nonce),
+		AddressKey: key,
+		Nonce:      nonce,
+		Status:     NonceStatusReserved,
+		UpdateTime: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+//restoreGapNonce 填补失败时恢复账本中原来的记录
+func (this *WalletManager) restoreGapNonce(address string, nonce uint64, old *NonceRecord) error {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if old != nil {
+		return db.Save(old)
+	}
+	return db.DeleteStruct(&NonceRecord{ID: nonceRecordID(indexAddressKey(address), nonce)})
+}
+
+//FillNonceGap 用从地址转给自己、数量为0的交易填补nonce缺口，交易用钱包的HDKey签名，返回交易ID
+func (this *WalletManager) FillNonceGap(wrapper openwallet.WalletDAI, gap *NonceGap) (string, error) {
+	if !gap.Fillable() {
+		return "", fmt.Errorf("nonce %d of address %s is reserved and can not be filled", gap.Nonce, gap.Address)
+	}
+
+	addr, err := wrapper.GetAddress(gap.Address)
+	if err != nil {
+		return "", openwallet.NewError(openwallet.ErrAddressNotFound, err.Error())
+	}
+
+	//检查结果可能已过期，填补前重新确认nonce不在链上和交易池中，避免替换真实的交易
+	used, err := this.nonceInUse(gap.Address, gap.Nonce)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", fmt.Errorf("nonce %d of address %s is already used or in txpool", gap.Nonce, gap.Address)
+	}
+
+	fee, err := this.GetTransactionFeeEstimated(gap.Address, gap.Address, big.NewInt(0), "")
+	if err != nil {
+		return "", err
+	}
+
+	old, err := this.holdGapNonce(gap.Address, gap.Nonce)
+	if err != nil {
+		return "", err
+	}
+
+	txid, err := this.sendGapFiller(wrapper, addr, gap.Nonce, fee)
+	if err != nil {
+		if restoreErr := this.restoreGapNonce(gap.Address, gap.Nonce, old); restoreErr != nil {
+			this.Log.Errorf("restore nonce %d of address %s failed, err=%v", gap.Nonce, gap.Address, restoreErr)
+		}
+		return "", err
+	}
+
+	err = this.MarkNonceSubmitted(gap.Address, gap.Nonce, txid)
+	if err != nil {
+		this.Log.Errorf("mark nonce %d of address %s submitted failed, err=%v", gap.Nonce, gap.Address, err)
+	}
+	return txid, nil
+}
+
+//nonceInUse nonce是否已上链，或在交易池的pending、queued中
+func (this *WalletManager) nonceInUse(address string, nonce uint64) (bool, error) {
+	chainNonce, err := this.WalletClient.fmGetTransactionCount(address)
+	if err != nil {
+		return false, err
+	}
+	if nonce < chainNonce {
+		return true, nil
+	}
+	txpool, err := this.WalletClient.EthGetTxPoolContent()
+	if err != nil {
+		return false, err
+	}
+	inPool, err := txpool.TxNonces(address)
+	if err != nil {
+		return false, err
+	}
+	return inPool[nonce], nil
+}
+
+//sendGapFiller 签名并广播填补缺口的交易
+func (this *WalletManager) sendGapFiller(wrapper openwallet.WalletDAI, addr *openwallet.Address, nonce uint64, fee *txFeeInfo) (string, error) {
+	err := this.networkReady()
+	if err != nil {
+		return "", err
+	}
+	key, err := wrapper.HDKey()
+	if err != nil {
+		return "", err
+	}
+	childKey, err := key.DerivedKeyWithPath(addr.HDPath, owcrypt.ECC_CURVE_SECP256K1)
+	if err != nil {
+		return "", err
+	}
+	keyBytes, err := childKey.GetPrivateKeyBytes()
+	if err != nil {
+		return "", err
+	}
+
+	signer := types.NewEIP155Signer(big.NewInt(int64(this.GetConfig().ChainID)))
+	tx := types.NewTransaction(nonce, ethcommon.HexToAddress(indexAddressKey(addr.Address)),
+		big.NewInt(0), fee.GasLimit.Uint64(), fee.GasPrice, []byte(""))
+	msg := signer.Hash(tx)
+	sig, err := filememory_txsigner.Default.SignTransactionHash(msg[:], keyBytes, owcrypt.ECC_CURVE_SECP256K1)
+	if err != nil {
+		return "", err
+	}
+	tx, err = tx.WithSignature(signer, sig)
+	if err != nil {
+		return "", err
+	}
+
+	rawTxPara, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return "", err
+	}
+	txid, err := this.WalletClient.fmSendRawTransaction(ethcommon.ToHex(rawTxPara))
+	if err != nil {
+		return "", ConvertGatewayError(err, openwallet.ErrSubmitRawTransactionFailed, "send nonce gap filler failed")
+	}
+	return txid, nil
+}
+
+//NonceGapChecker 后台定期检查nonce缺口，AutoFill为true且设置了Wrapper时自动填补
+type NonceGapChecker struct {
+	wm *WalletManager
+	//签名填补交易的钱包，为空时只报告缺口
+	Wrapper openwallet.WalletDAI
+	//检查间隔
+	Interval time.Duration
+	//是否自动填补缺口
+	AutoFill bool
+	//除本地nonce账本中的地址外，额外检查的地址
+	Addresses []string
+	//发现缺口时的回调
+	OnGaps func(gaps []*NonceGap)
+
+	mu       sync.Mutex
+	stop     chan struct{}
+	lastGaps []*NonceGap
+}
+
+//NewNonceGapChecker 创建nonce缺口检查器，检查间隔和是否自动填补使用配置
+func (this *WalletManager) NewNonceGapChecker(wrapper openwallet.WalletDAI) *NonceGapChecker {
+	return &NonceGapChecker{
+		wm:       this,
+		Wrapper:  wrapper,
+		Interval: time.Duration(this.Config.NonceGapCheckInterval) * time.Second,
+		AutoFill: this.Config.NonceGapAutoFill,
+	}
+}
+
+//Check 检查一次所有地址的nonce缺口，自动填补时记录填补结果
+func (checker *NonceGapChecker) Check() ([]*NonceGap, error) {
+	wm := checker.wm
+	addresses, err := wm.nonceLedgerAddresses()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		seen[indexAddressKey(address)] = true
+	}
+	for _, address := range checker.Addresses {
+		if !seen[indexAddressKey(address)] {
+			seen[indexAddressKey(address)] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	gaps := make([]*NonceGap, 0)
+	for _, address := range addresses {
+		addrGaps, err := wm.CheckNonceGaps(address)
+		if err != nil {
+			wm.Log.Errorf("check nonce gaps of address %s failed, err=%v", address, err)
+			continue
+		}
+		for _, gap := range addrGaps {
+			wm.Log.Warningf("nonce gap: %s", gap)
+			if checker.AutoFill && checker.Wrapper != nil && gap.Fillable() {
+				gap.FillTxID, gap.FillError = wm.FillNonceGap(checker.Wrapper, gap)
+				if gap.FillError != nil {
+					wm.Log.Errorf("fill nonce gap failed: %s, err=%v", gap, gap.FillError)
+				} else {
+					wm.Log.Infof("nonce gap filled: %s, txid=%s", gap, gap.FillTxID)
+				}
+			}
+		}
+		gaps = append(gaps, addrGaps...)
+	}
+
+	checker.mu.Lock()
+	checker.lastGaps = gaps
+	onGaps := checker.OnGaps
+	checker.mu.Unlock()
+	if onGaps != nil && len(gaps) > 0 {
+		onGaps(gaps)
+	}
+	return gaps, nil
+}
+
+//Gaps 最近一次检查发现的缺口
+func (checker *NonceGapChecker) Gaps() []*NonceGap {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	return checker.lastGaps
+}
+
+//Start 启动后台检查，已启动或检查间隔为0时不做处理
+func (checker *NonceGapChecker) Start() {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.stop != nil || checker.Interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	checker.stop = stop
+	go func() {
+		ticker := time.NewTicker(checker.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checker.Check()
+			}
+		}
+	}()
+}
+
+//Stop 停止后台检查
+func (checker *NonceGapChecker) Stop() {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.stop != nil {
+		close(checker.stop)
+		checker.stop = nil
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/hdkeystore"
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const testGapHDPath = "m/44'/88'/0'/0/0"
+
+//testGapWallet 创建有根密钥的钱包，地址由根密钥按testGapHDPath派生
+func testGapWallet(t *testing.T) (*testWalletDAI, string) {
+	key, err := hdkeystore.NewHDKey(bytes.Repeat([]byte{1}, 32), "gap", "m/44'/88'")
+	if err != nil {
+		t.Fatalf("NewHDKey failed, err=%v", err)
+	}
+	childKey, err := key.DerivedKeyWithPath(testGapHDPath, owcrypt.ECC_CURVE_SECP256K1)
+	if err != nil {
+		t.Fatalf("DerivedKeyWithPath failed, err=%v", err)
+	}
+	keyBytes, err := childKey.GetPrivateKeyBytes()
+	if err != nil {
+		t.Fatalf("GetPrivateKeyBytes failed, err=%v", err)
+	}
+	prv, err := crypto.ToECDSA(keyBytes)
+	if err != nil {
+		t.Fatalf("ToECDSA failed, err=%v", err)
+	}
+	address := ReplaceFmToAddress(crypto.PubkeyToAddress(prv.PublicKey).Hex())
+	wrapper := &testWalletDAI{
+		key:       key,
+		addresses: []*openwallet.Address{{AccountID: "account", Address: address, HDPath: testGapHDPath}},
+	}
+	return wrapper, address
+}
+
+//testGapPool 设置交易池中地址的nonce
+func testGapPool(node *FakeNode, address string, nonces ...string) {
+	txs := make(map[string]interface{})
+	for _, nonce := range nonces {
+		txs[nonce] = map[string]interface{}{}
+	}
+	node.SetResult("txpool_content", map[string]interface{}{
+		"pending": map[string]interface{}{"0x" + indexAddressKey(address): txs},
+	})
+}
+
+//testGapLedger 链上nonce为5，交易池中有6、8，账本中7已预留、9已广播但不在交易池中
+func testGapLedger(t *testing.T, wm *WalletManager, node *FakeNode, address string) {
+	node.SetNonce(address, 5)
+	testReserveNonces(t, wm, address, 5)
+	for _, nonce := range []uint64{5, 6, 8} {
+		if err := wm.ReleaseNonce(address, nonce); err != nil {
+			t.Fatalf("ReleaseNonce failed, err=%v", err)
+		}
+	}
+	if err := wm.MarkNonceSubmitted(address, 9, "0x09"); err != nil {
+		t.Fatalf("MarkNonceSubmitted failed, err=%v", err)
+	}
+	testGapPool(node, address, "6", "8")
+}
+
+func TestWalletManager_CheckNonceGaps(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testGapLedger(t, wm, node, testDepositAddress)
+
+	gaps, err := wm.CheckNonceGaps(testDepositAddress)
+	if err != nil {
+		t.Fatalf("CheckNonceGaps failed, err=%v", err)
+	}
+	want := []struct {
+		nonce  uint64
+		reason string
+	}{{5, NonceGapMissing}, {7, NonceGapReserved}, {9, NonceGapDropped}}
+	if len(gaps) != len(want) {
+		t.Fatalf("gaps = %v, want %d gaps", gaps, len(want))
+	}
+	for i, w := range want {
+		if gaps[i].Nonce != w.nonce || gaps[i].Reason != w.reason || gaps[i].ChainNonce != 5 {
+			t.Errorf("gap %d = %s, want nonce %d %s", i, gaps[i], w.nonce, w.reason)
+		}
+	}
+	if gaps[2].TxID != "0x09" || gaps[1].Fillable() {
+		t.Errorf("dropped gap should keep txid, reserved gap should not be fillable")
+	}
+
+	//queued中的交易已广播，只报告前面真正的缺口
+	if err := wm.MarkNonceSubmitted(testOtherAddress, 1, "0x01"); err != nil {
+		t.Fatalf("MarkNonceSubmitted failed, err=%v", err)
+	}
+	node.SetResult("txpool_content", map[string]interface{}{
+		"pending": map[string]interface{}{},
+		"queued": map[string]interface{}{
+			"0x" + indexAddressKey(testOtherAddress): map[string]interface{}{"1": map[string]interface{}{}},
+		},
+	})
+	gaps, err = wm.CheckNonceGaps(testOtherAddress)
+	if err != nil || len(gaps) != 1 || gaps[0].Nonce != 0 || gaps[0].Reason != NonceGapMissing {
+		t.Errorf("gaps = %v, err=%v; want only nonce 0 missing", gaps, err)
+	}
+	if _, err := wm.FillNonceGap(&testWalletDAI{}, &NonceGap{Address: testOtherAddress, Nonce: 1, Reason: NonceGapDropped}); err == nil {
+		t.Errorf("fill a queued nonce should fail")
+	}
+	if len(node.Pushed()) != 0 {
+		t.Errorf("queued nonce should not be filled")
+	}
+
+	//交易池连续时没有缺口
+	testGapPool(node, testOtherAddress, "0", "1")
+	if gaps, err := wm.CheckNonceGaps(testOtherAddress); err != nil || len(gaps) != 0 {
+		t.Errorf("gaps = %v, err=%v; want none", gaps, err)
+	}
+}
+
+func TestNonceGapChecker_AutoFill(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wrapper, address := testGapWallet(t)
+	testGapLedger(t, wm, node, address)
+
+	checker := wm.NewNonceGapChecker(wrapper)
+	checker.AutoFill = true
+	gaps, err := checker.Check()
+	if err != nil || len(gaps) != 3 {
+		t.Fatalf("Check: gaps=%v, err=%v", gaps, err)
+	}
+
+	//只填补5和9，7已预留
+	pushed := node.Pushed()
+	if len(pushed) != 2 {
+		t.Fatalf("pushed %d fillers, want 2", len(pushed))
+	}
+	signer := types.NewEIP155Signer(big.NewInt(int64(wm.Config.ChainID)))
+	for i, nonce := range []uint64{5, 9} {
+		tx := &types.Transaction{}
+		if err := rlp.DecodeBytes(ethcommon.FromHex(pushed[i]), tx); err != nil {
+			t.Fatalf("decode filler failed, err=%v", err)
+		}
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			t.Fatalf("recover filler sender failed, err=%v", err)
+		}
+		self := ethcommon.HexToAddress(indexAddressKey(address))
+		if tx.Nonce() != nonce || tx.Value().Sign() != 0 || *tx.To() != self || from != self {
+			t.Errorf("filler %d: nonce=%d value=%v to=%s from=%s", i, tx.Nonce(), tx.Value(), tx.To().Hex(), from.Hex())
+		}
+	}
+	if gaps[0].FillTxID == "" || gaps[1].FillTxID != "" || gaps[2].FillTxID == "" {
+		t.Errorf("fill txids = %q %q %q", gaps[0].FillTxID, gaps[1].FillTxID, gaps[2].FillTxID)
+	}
+
+	records, err := wm.GetNonceRecords(address)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("records = %v, err=%v", records, err)
+	}
+	if records[0].Nonce != 5 || records[0].Status != NonceStatusSubmitted || records[0].TxID != gaps[0].FillTxID {
+		t.Errorf("record of nonce 5 = %+v, want submitted by filler", records[0])
+	}
+}
+
+func TestNonceGapChecker_FillFailed(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wrapper, address := testGapWallet(t)
+	testGapLedger(t, wm, node, address)
+
+	//广播失败时恢复账本记录
+	node.FailNext("pushtx", 10001, "rejected")
+	gap := &NonceGap{Address: address, Nonce: 5, Reason: NonceGapMissing}
+	if _, err := wm.FillNonceGap(wrapper, gap); err == nil {
+		t.Fatalf("fill should fail")
+	}
+	if _, err := wm.getNonceRecord(address, 5); err == nil {
+		t.Errorf("record of nonce 5 should be removed after fill failed")
+	}
+
+	//已预留的nonce不能填补
+	if _, err := wm.FillNonceGap(wrapper, &NonceGap{Address: address, Nonce: 7, Reason: NonceGapMissing}); err == nil {
+		t.Errorf("fill reserved nonce should fail")
+	}
+}
+
+func TestNonceGapChecker_Start(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testGapLedger(t, wm, node, testDepositAddress)
+
+	found := make(chan []*NonceGap, 1)
+	checker := wm.NewNonceGapChecker(nil)
+	checker.Interval = 10 * time.Millisecond
+	checker.OnGaps = func(gaps []*NonceGap) {
+		select {
+		case found <- gaps:
+		default:
+		}
+	}
+	checker.Start()
+	defer checker.Stop()
+
+	select {
+	case gaps := <-found:
+		if len(gaps) != 3 {
+			t.Errorf("gaps = %v, want 3", gaps)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("checker did not report gaps")
+	}
+	if len(node.Pushed()) != 0 {
+		t.Errorf("checker without wrapper should not fill gaps")
+	}
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+//本地nonce账本记录每个地址已分配的nonce，保存在数据目录，重启后仍然有效。
+//创建交易时预留nonce，并用交易单的签名哈希绑定预留，广播前要求签名哈希一致，广播成功后标记为已提交，
+//链上nonce超过后删除记录；预留后长时间没有广播或调用ReleaseNonce的nonce视为放弃，可以重新分配，
+//放弃的交易单与新的预留不一致，不能再广播。
+//分配时跳过链上已使用、交易池（pending和queued）中和账本中占用的nonce，取最小的可用值
+
+//NONCE_LEDGER_DB 本地nonce账本数据库文件名
+const NONCE_LEDGER_DB = "nonce_ledger.db"
+
+//DEFAULT_NONCE_RESERVE_TIMEOUT 预留nonce的默认有效时间，单位秒
+const DEFAULT_NONCE_RESERVE_TIMEOUT = 30 * 60
+
+//nonce记录的状态
+const (
+	NonceStatusReserved  = "reserved"
+	NonceStatusSubmitted = "submitted"
+)
+
+//NonceRecord 地址已分配的nonce
+type NonceRecord struct {
+	ID         string `storm:"id"`
+	AddressKey string `storm:"index"`
+	Nonce      uint64
+	Status     string `storm:"index"`
+	TxID       string
+	Token      string //预留该nonce的交易单，为未签名交易的签名哈希
+	UpdateTime int64
+}
+
+func nonceRecordID(addressKey string, nonce uint64) string {
+	return fmt.Sprintf("%s_%d", addressKey, nonce)
+}
+
+//expired 预留的nonce是否超时未广播
+func (record *NonceRecord) expired(timeout int64, now int64) bool {
+	return record.Status == NonceStatusReserved && timeout > 0 && now-record.UpdateTime > timeout
+}
+
+//openNonceDB 打开本地nonce账本
+func (this *WalletManager) openNonceDB() (*storm.DB, error) {
+	return OpenDB(this.Config.DbPath, NONCE_LEDGER_DB)
+}
+
+//chainNonceState 查询地址链上nonce和交易池pending、queued中的nonce
+func (this *WalletManager) chainNonceState(address string) (uint64, map[uint64]bool, error) {
+	chainNonce, err := this.WalletClient.fmGetTransactionCount(address)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	txpool, err := this.WalletClient.EthGetTxPoolContent()
+	if err != nil {
+		//交易池查询失败时只按链上nonce和账本分配
+		this.Log.Warningf("get txpool content failed, err=%v", err)
+		return chainNonce, make(map[uint64]bool), nil
+	}
+	//queued中的交易已广播，nonce同样被占用
+	inPool, err := txpool.TxNonces(address)
+	if err != nil {
+		this.Log.Warningf("get txpool nonces failed, err=%v", err)
+		return chainNonce, make(map[uint64]bool), nil
+	}
+	return chainNonce, inPool, nil
+}
+
+//reconcileNonceRecords 删除链上已使用和超时放弃的记录，返回仍占用的nonce
+func (this *WalletManager) reconcileNonceRecords(db storm.Node, addressKey string, chainNonce uint64) (map[uint64]*NonceRecord, error) {
+	var records []*NonceRecord
+	err := db.Find("AddressKey", addressKey, &records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	timeout := this.Config.NonceReserveTimeout
+	used := make(map[uint64]*NonceRecord)
+	for _, record := range records {
+		if record.Nonce < chainNonce || record.expired(timeout, now) {
+			err = db.DeleteStruct(record)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		used[record.Nonce] = record
+	}
+	return used, nil
+}
+
+//ReserveNonce 为地址分配并预留下一个可用的nonce
+func (this *WalletManager) ReserveNonce(address string) (uint64, error) {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	chainNonce, pending, err := this.chainNonceState(address)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	dbTx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer dbTx.Rollback()
+
+	key := indexAddressKey(address)
+	used, err := this.reconcileNonceRecords(dbTx, key, chainNonce)
+	if err != nil {
+		return 0, err
+	}
+
+	nonce := chainNonce
+	for used[nonce] != nil || pending[nonce] {
+		nonce++
+	}
+
+	err = dbTx.Save(&NonceRecord{
+		ID:         nonceRecordID(key, nonce),
+		AddressKey: key,
+		Nonce:      nonce,
+		Status:     NonceStatusReserved,
+		UpdateTime: time.Now().Unix(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return nonce, dbTx.Commit()
+}
+
+//BindReservedNonce 预留的nonce绑定到交易单，token为交易单的签名哈希
+func (this *WalletManager) BindReservedNonce(address string, nonce uint64, token string) error {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	record, err := this.getNonceRecord(address, nonce)
+	if err != nil {
+		return err
+	}
+	if record.Status != NonceStatusReserved {
+		return fmt.Errorf("nonce %d of address %s has been submitted by tx %s", nonce, address, record.TxID)
+	}
+	if record.Token != "" && record.Token != token {
+		return fmt.Errorf("nonce %d of address %s is reserved by another transaction", nonce, address)
+	}
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	record.Token = token
+	record.UpdateTime = time.Now().Unix()
+	return db.Save(record)
+}
+
+//CheckReservedNonce 检查nonce是否为该交易单预留且未提交，广播前调用
+func (this *WalletManager) CheckReservedNonce(address string, nonce uint64, token string) error {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	record, err := this.getNonceRecord(address, nonce)
+	if err != nil {
+		return err
+	}
+	if record.Status != NonceStatusReserved {
+		return fmt.Errorf("nonce %d of address %s has been submitted by tx %s", nonce, address, record.TxID)
+	}
+	if record.Token != token {
+		return fmt.Errorf("nonce %d of address %s is reserved by another transaction", nonce, address)
+	}
+	return nil
+}
+
+//MarkNonceSubmitted 广播成功后标记nonce为已提交
+func (this *WalletManager) MarkNonceSubmitted(address string, nonce uint64, txid string) error {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	key := indexAddressKey(address)
+	db, err := this.openNonceDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Save(&NonceRecord{
+		ID:         nonceRecordID(key, nonce),
+		AddressKey: key,
+		Nonce:      nonce,
+		Status:     NonceStatusSubmitted,
+		TxID:       txid,
+		UpdateTime: time.Now().Unix(),
+	})
+}
+
+//ReleaseNonce 放弃交易时释放预留的nonce，已提交的nonce不能释放
+func (this *WalletManager) ReleaseNonce(address string, nonce uint64) error {
+	return this.releaseNonce(address, nonce, "")
+}
+
+//releaseNonce 释放预留的nonce，token不为空时只释放该交易单的预留，已被其他交易单重新预留时忽略
+func (this *WalletManager) releaseNonce(address string, nonce uint64, token string) error {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	record, err := this.getNonceRecord(address, nonce)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if token != "" && record.Token != token {
+		return nil
+	}
+	if record.Status != NonceStatusReserved {
+		return fmt.Errorf("nonce %d of address %s has been submitted by tx %s", nonce, address, record.TxID)
+	}
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.DeleteStruct(record)
+}
+
+//GetNonceRecords 地址在账本中的nonce记录，按nonce从小到大排列
+func (this *WalletManager) GetNonceRecords(address string) ([]*NonceRecord, error) {
+	this.nonceLocker.Lock()
+	defer this.nonceLocker.Unlock()
+
+	db, err := this.openNonceDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []*NonceRecord
+	err = db.Find("AddressKey", indexAddressKey(address), &records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Nonce < records[j].Nonce
+	})
+	return records, nil
+}
+
+func (this *WalletManager) getNonceRecord(address string, nonce uint64) (*NonceRecord, error) {
+	db, err := this.openNonceDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var record NonceRecord
+	err = db.One("ID", nonceRecordID(indexAddressKey(address), nonce), &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
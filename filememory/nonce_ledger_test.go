@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//testReserveNonces 连续预留n个nonce
+func testReserveNonces(t *testing.T, wm *WalletManager, address string, n int) []uint64 {
+	nonces := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		nonce, err := wm.ReserveNonce(address)
+		if err != nil {
+			t.Fatalf("ReserveNonce failed, err=%v", err)
+		}
+		nonces = append(nonces, nonce)
+	}
+	return nonces
+}
+
+func TestWalletManager_ReserveNonce(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	node.SetNonce(testDepositAddress, 5)
+
+	if nonces := testReserveNonces(t, wm, testDepositAddress, 2); nonces[0] != 5 || nonces[1] != 6 {
+		t.Errorf("nonces = %v, want [5 6]", nonces)
+	}
+
+	//重启后账本仍然有效，跳过交易池中的nonce
+	restarted := NewWalletManager()
+	restarted.Config = wm.Config
+	restarted.WalletClient = node.NewClient()
+	node.SetResult("txpool_content", map[string]interface{}{
+		"pending": map[string]interface{}{
+			"0x" + indexAddressKey(testDepositAddress): map[string]interface{}{
+				"7": map[string]interface{}{},
+			},
+		},
+	})
+	if nonces := testReserveNonces(t, restarted, testDepositAddress, 1); nonces[0] != 8 {
+		t.Errorf("nonce after restart = %v, want 8", nonces[0])
+	}
+
+	//链上nonce超过后删除旧记录
+	node.SetResult("txpool_content", map[string]interface{}{"pending": map[string]interface{}{}})
+	node.SetNonce(testDepositAddress, 9)
+	if nonces := testReserveNonces(t, restarted, testDepositAddress, 1); nonces[0] != 9 {
+		t.Errorf("nonce after confirmed = %v, want 9", nonces[0])
+	}
+	records, err := restarted.GetNonceRecords(testDepositAddress)
+	if err != nil || len(records) != 1 || records[0].Nonce != 9 {
+		t.Errorf("records = %+v, err=%v; want only nonce 9", records, err)
+	}
+
+	//其他地址独立分配
+	if nonces := testReserveNonces(t, restarted, testOtherAddress, 1); nonces[0] != 0 {
+		t.Errorf("nonce of other address = %v, want 0", nonces[0])
+	}
+}
+
+func TestWalletManager_ReleaseNonce(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	node.SetNonce(testDepositAddress, 5)
+	testReserveNonces(t, wm, testDepositAddress, 3)
+
+	//释放中间的nonce后重新分配
+	if err := wm.ReleaseNonce(testDepositAddress, 6); err != nil {
+		t.Fatalf("ReleaseNonce failed, err=%v", err)
+	}
+	if nonces := testReserveNonces(t, wm, testDepositAddress, 2); nonces[0] != 6 || nonces[1] != 8 {
+		t.Errorf("nonces = %v, want [6 8]", nonces)
+	}
+
+	//已提交的nonce不能释放
+	if err := wm.MarkNonceSubmitted(testDepositAddress, 5, "0xabc"); err != nil {
+		t.Fatalf("MarkNonceSubmitted failed, err=%v", err)
+	}
+	if err := wm.ReleaseNonce(testDepositAddress, 5); err == nil {
+		t.Errorf("release submitted nonce should fail")
+	}
+	if err := wm.CheckReservedNonce(testDepositAddress, 5, ""); err == nil {
+		t.Errorf("submitted nonce should not pass the check")
+	}
+
+	//超时未广播的nonce视为放弃
+	db, err := wm.openNonceDB()
+	if err != nil {
+		t.Fatalf("openNonceDB failed, err=%v", err)
+	}
+	err = db.UpdateField(&NonceRecord{ID: nonceRecordID(indexAddressKey(testDepositAddress), 7)}, "UpdateTime", time.Now().Unix()-wm.Config.NonceReserveTimeout-1)
+	db.Close()
+	if err != nil {
+		t.Fatalf("update record failed, err=%v", err)
+	}
+	if nonces := testReserveNonces(t, wm, testDepositAddress, 1); nonces[0] != 7 {
+		t.Errorf("nonce after expired = %v, want 7", nonces[0])
+	}
+}
+
+func TestEthTransactionDecoder_SubmitRawTransaction_NonceLedger(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	create := func() *openwallet.RawTransaction {
+		return testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	}
+
+	//未广播的交易单各自预留nonce
+	first, second := create(), create()
+	if n1, n2 := testDecodeRawTx(t, first.RawHex).Nonce(), testDecodeRawTx(t, second.RawHex).Nonce(); n1 != 7 || n2 != 8 {
+		t.Fatalf("nonces = %d, %d; want 7, 8", n1, n2)
+	}
+
+	//广播顺序不影响，广播后标记为已提交
+	tx := testSubmitRawTx(t, wm, wrapper, second)
+	testSubmitRawTx(t, wm, wrapper, first)
+	records, err := wm.GetNonceRecords(testDepositAddress)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("records = %+v, err=%v", records, err)
+	}
+	if records[1].Status != NonceStatusSubmitted || records[1].TxID != tx.TxID {
+		t.Errorf("record of nonce 8 = %+v, want submitted by %s", records[1], tx.TxID)
+	}
+
+	//同一nonce不能再用于其他交易，重复提交同一交易单不会再次广播
+	if err := wm.CheckReservedNonce(testDepositAddress, 7, first.Signatures["account"][0].Message); err == nil {
+		t.Errorf("submitted nonce should not be reserved")
+	}
+	if resubmit, err := wm.TxDecoder.SubmitRawTransaction(wrapper, first); err != nil || resubmit.TxID != first.TxID {
+		t.Errorf("resubmit = %+v, err=%v; want %s", resubmit, err, first.TxID)
+	}
+	if len(node.Pushed()) != 2 {
+		t.Errorf("pushed %d txs, want 2", len(node.Pushed()))
+	}
+
+	//放弃的交易单释放nonce
+	third := create()
+	if err := wm.TxDecoder.(*EthTransactionDecoder).ReleaseRawTransactionNonce(third); err != nil {
+		t.Fatalf("ReleaseRawTransactionNonce failed, err=%v", err)
+	}
+	if fourth := create(); testDecodeRawTx(t, fourth.RawHex).Nonce() != 9 {
+		t.Errorf("released nonce should be reused")
+	}
+}
+
+func TestEthTransactionDecoder_SubmitRawTransaction_ExpiredReservation(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	create := func(amount string) *openwallet.RawTransaction {
+		return testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, amount)
+	}
+
+	//交易单A的预留超时后，nonce被交易单B重新预留
+	a := create("0.1")
+	db, err := wm.openNonceDB()
+	if err != nil {
+		t.Fatalf("openNonceDB failed, err=%v", err)
+	}
+	err = db.UpdateField(&NonceRecord{ID: nonceRecordID(indexAddressKey(testDepositAddress), 7)}, "UpdateTime", time.Now().Unix()-wm.Config.NonceReserveTimeout-1)
+	db.Close()
+	if err != nil {
+		t.Fatalf("update record failed, err=%v", err)
+	}
+	b := create("0.2")
+	if testDecodeRawTx(t, b.RawHex).Nonce() != 7 {
+		t.Fatalf("expired nonce should be reserved again")
+	}
+
+	//A释放nonce不影响B的预留，A不能再广播
+	if err := wm.TxDecoder.(*EthTransactionDecoder).ReleaseRawTransactionNonce(a); err != nil {
+		t.Fatalf("ReleaseRawTransactionNonce failed, err=%v", err)
+	}
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, a); err == nil {
+		t.Errorf("submit with an expired reservation should fail")
+	}
+	if len(node.Pushed()) != 0 {
+		t.Fatalf("pushed %d txs, want 0", len(node.Pushed()))
+	}
+	if tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, b); err != nil || tx.TxID != b.TxID {
+		t.Errorf("submit b = %+v, err=%v", tx, err)
+	}
+}
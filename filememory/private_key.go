@@ -0,0 +1,283 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+//单个私钥的导入导出：十六进制格式，以及与以太坊keystore相同的加密JSON格式（Web3 Secret Storage v3），
+//加密JSON可以在其他以太坊钱包中导入，导出时address字段为无前缀的小写十六进制
+
+//加密JSON的scrypt参数，与go-ethereum keystore的标准参数一致
+var (
+	keyJSONScryptN = 1 << 18
+	keyJSONScryptP = 1
+)
+
+const (
+	keyJSONVersion     = 3
+	keyJSONScryptR     = 8
+	keyJSONScryptDKLen = 32
+	keyJSONCipher      = "aes-128-ctr"
+
+	//导入时允许的密钥派生参数上限，避免构造的JSON占用过多内存和CPU
+	keyJSONMaxScryptMem = 1 << 30 //scrypt占用的内存128*n*r字节
+	keyJSONMaxScryptP   = 16
+	keyJSONMaxDKLen     = 64
+)
+
+//私钥导入导出的错误
+var (
+	ErrInvalidPrivateKey = errors.New("invalid secp256k1 private key")
+	ErrDecryptPrivateKey = errors.New("could not decrypt key with given password")
+)
+
+//keyJSON 加密JSON格式
+type keyJSON struct {
+	Address string        `json:"address"`
+	Crypto  keyJSONCrypto `json:"crypto"`
+	ID      string        `json:"id"`
+	Version int           `json:"version"`
+}
+
+type keyJSONCrypto struct {
+	Cipher       string                 `json:"cipher"`
+	CipherText   string                 `json:"ciphertext"`
+	CipherParams keyJSONCipherParams    `json:"cipherparams"`
+	KDF          string                 `json:"kdf"`
+	KDFParams    map[string]interface{} `json:"kdfparams"`
+	MAC          string                 `json:"mac"`
+}
+
+type keyJSONCipherParams struct {
+	IV string `json:"iv"`
+}
+
+//PrivateKeyToHex 私钥导出为无前缀的十六进制
+func PrivateKeyToHex(priv []byte) (string, error) {
+	if _, err := ethcrypto.ToECDSA(priv); err != nil {
+		return "", ErrInvalidPrivateKey
+	}
+	return hex.EncodeToString(priv), nil
+}
+
+//HexToPrivateKey 导入十六进制私钥，支持0x前缀
+func HexToPrivateKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	priv, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	if _, err := ethcrypto.ToECDSA(priv); err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	return priv, nil
+}
+
+//PrivateKeyToAddress 私钥对应的地址
+func PrivateKeyToAddress(priv []byte) (FMAddress, error) {
+	key, err := ethcrypto.ToECDSA(priv)
+	if err != nil {
+		return FMAddress{}, ErrInvalidPrivateKey
+	}
+	return FMAddressFromCommon(ethcrypto.PubkeyToAddress(key.PublicKey)), nil
+}
+
+//EncryptPrivateKey 使用密码把私钥导出为加密JSON
+func EncryptPrivateKey(priv []byte, password string) ([]byte, error) {
+	address, err := PrivateKeyToAddress(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	derivedKey, err := scrypt.Key([]byte(password), salt, keyJSONScryptN, keyJSONScryptR, keyJSONScryptP, keyJSONScryptDKLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := aesCTRXOR(derivedKey[:16], priv, iv)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	//UUID v4
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	return json.Marshal(keyJSON{
+		Address: address.Hex(),
+		Crypto: keyJSONCrypto{
+			Cipher:       keyJSONCipher,
+			CipherText:   hex.EncodeToString(cipherText),
+			CipherParams: keyJSONCipherParams{IV: hex.EncodeToString(iv)},
+			KDF:          "scrypt",
+			KDFParams: map[string]interface{}{
+				"n":     keyJSONScryptN,
+				"r":     keyJSONScryptR,
+				"p":     keyJSONScryptP,
+				"dklen": keyJSONScryptDKLen,
+				"salt":  hex.EncodeToString(salt),
+			},
+			MAC: hex.EncodeToString(ethcrypto.Keccak256(derivedKey[16:32], cipherText)),
+		},
+		ID:      fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Version: keyJSONVersion,
+	})
+}
+
+//DecryptPrivateKey 使用密码导入加密JSON中的私钥，支持scrypt和pbkdf2两种密钥派生
+func DecryptPrivateKey(keyjson []byte, password string) ([]byte, error) {
+	var k keyJSON
+	if err := json.Unmarshal(keyjson, &k); err != nil {
+		return nil, fmt.Errorf("invalid key json: %v", err)
+	}
+	if k.Version != keyJSONVersion {
+		return nil, fmt.Errorf("key json version %d is not supported", k.Version)
+	}
+	if k.Crypto.Cipher != keyJSONCipher {
+		return nil, fmt.Errorf("cipher %s is not supported", k.Crypto.Cipher)
+	}
+
+	mac, err := hex.DecodeString(k.Crypto.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mac: %v", err)
+	}
+	iv, err := hex.DecodeString(k.Crypto.CipherParams.IV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iv: %v", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid iv length: %d", len(iv))
+	}
+	cipherText, err := hex.DecodeString(k.Crypto.CipherText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cipher text: %v", err)
+	}
+	derivedKey, err := keyJSONDerivedKey(k.Crypto, password)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ethcrypto.Keccak256(derivedKey[16:32], cipherText), mac) {
+		return nil, ErrDecryptPrivateKey
+	}
+	priv, err := aesCTRXOR(derivedKey[:16], cipherText, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	//JSON中记录的地址必须与私钥一致
+	address, err := PrivateKeyToAddress(priv)
+	if err != nil {
+		return nil, err
+	}
+	if k.Address != "" {
+		recorded, err := ParseFMAddress(k.Address)
+		if err != nil || recorded != address {
+			return nil, fmt.Errorf("key json address [%s] does not match the private key", k.Address)
+		}
+	}
+	return priv, nil
+}
+
+//keyJSONDerivedKey 按kdfparams派生解密密钥
+func keyJSONDerivedKey(c keyJSONCrypto, password string) ([]byte, error) {
+	salt, err := hex.DecodeString(kdfParamString(c.KDFParams, "salt"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid kdf salt: %v", err)
+	}
+	dkLen := kdfParamInt(c.KDFParams, "dklen")
+	if dkLen < 32 || dkLen > keyJSONMaxDKLen {
+		return nil, fmt.Errorf("invalid kdf dklen: %d", dkLen)
+	}
+
+	switch c.KDF {
+	case "scrypt":
+		n, r, p := kdfParamInt(c.KDFParams, "n"), kdfParamInt(c.KDFParams, "r"), kdfParamInt(c.KDFParams, "p")
+		if n <= 1 || n&(n-1) != 0 || r <= 0 || p <= 0 || p > keyJSONMaxScryptP || r > keyJSONMaxScryptMem/128/n {
+			return nil, fmt.Errorf("invalid scrypt params: n=%d, r=%d, p=%d", n, r, p)
+		}
+		return scrypt.Key([]byte(password), salt, n, r, p, dkLen)
+	case "pbkdf2":
+		if prf := kdfParamString(c.KDFParams, "prf"); prf != "hmac-sha256" {
+			return nil, fmt.Errorf("pbkdf2 prf %s is not supported", prf)
+		}
+		iter := kdfParamInt(c.KDFParams, "c")
+		if iter <= 0 {
+			return nil, fmt.Errorf("invalid pbkdf2 iterations: %d", iter)
+		}
+		return pbkdf2.Key([]byte(password), salt, iter, dkLen, sha256.New), nil
+	default:
+		return nil, fmt.Errorf("kdf %s is not supported", c.KDF)
+	}
+}
+
+func kdfParamInt(params map[string]interface{}, name string) int {
+	v, _ := params[name].(float64)
+	return int(v)
+}
+
+func kdfParamString(params map[string]interface{}, name string) string {
+	v, _ := params[name].(string)
+	return v
+}
+
+func aesCTRXOR(key, in, iv []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid iv length: %d", len(iv))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
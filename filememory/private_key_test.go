@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+//Web3 Secret Storage的测试向量
+const (
+	testKeyJSONScrypt = `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"83dbcc02d8ccb40e466191a123791e0e"},"ciphertext":"d172bf743a674da9cdad04534d56926ef8358534d458fffccd4e6ad2fbde479c","kdf":"scrypt","kdfparams":{"dklen":32,"n":262144,"r":1,"p":8,"salt":"ab0c7876052600dd703518d6fc3fe8984592145b591fc8fb5c6d43190334ba19"},"mac":"2103ac29920d71da29f15d75b4a16dbe95cfd7ff8faea1056c33131d846e3097"},"id":"3198bc9c-6672-5ab3-d995-4942343ae5b6","version":3}`
+	testKeyJSONPBKDF2 = `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"6087dab2f9fdbbfaddc31a909735c1e6"},"ciphertext":"5318b4d5bcd28de64ee5559e671353e16f075ecae9f99c7a79a38af5f869aa46","kdf":"pbkdf2","kdfparams":{"c":262144,"dklen":32,"prf":"hmac-sha256","salt":"ae3cd4e7013836a3df6bd7241b12db061dbe2c6785853cce422d148a624ce0bd"},"mac":"517ead924a9d0dc3124507e3393d175ce3ff7c1e96529c6c555ce9e51205e9b2"},"id":"3198bc9c-6672-5ab3-d995-4942343ae5b6","version":3}`
+	testKeyJSONPriv   = "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d"
+)
+
+func TestDecryptPrivateKey_TestVectors(t *testing.T) {
+	for name, keyjson := range map[string]string{"scrypt": testKeyJSONScrypt, "pbkdf2": testKeyJSONPBKDF2} {
+		priv, err := DecryptPrivateKey([]byte(keyjson), "testpassword")
+		if err != nil || hex.EncodeToString(priv) != testKeyJSONPriv {
+			t.Errorf("%s: DecryptPrivateKey = %x, err=%v", name, priv, err)
+		}
+	}
+	if _, err := DecryptPrivateKey([]byte(testKeyJSONPBKDF2), "wrong"); err != ErrDecryptPrivateKey {
+		t.Errorf("decrypt with wrong password err=%v, want %v", err, ErrDecryptPrivateKey)
+	}
+}
+
+func TestDecryptPrivateKey_InvalidParams(t *testing.T) {
+	tests := map[string][2]string{
+		"iv":       {`"iv":"83dbcc02d8ccb40e466191a123791e0e"`, `"iv":"83dbcc02"`},
+		"n":        {`"n":262144`, `"n":262145`},
+		"memory":   {`"n":262144`, `"n":1073741824`},
+		"p":        {`"p":8`, `"p":1000000`},
+		"dklen":    {`"dklen":32`, `"dklen":1000000000`},
+		"negative": {`"r":1`, `"r":-1`},
+	}
+	for name, test := range tests {
+		keyjson := strings.Replace(testKeyJSONScrypt, test[0], test[1], 1)
+		if _, err := DecryptPrivateKey([]byte(keyjson), "testpassword"); err == nil {
+			t.Errorf("%s: key json with invalid params should fail", name)
+		}
+	}
+}
+
+func TestEncryptPrivateKey(t *testing.T) {
+	//降低scrypt参数以加快测试
+	n, p := keyJSONScryptN, keyJSONScryptP
+	keyJSONScryptN, keyJSONScryptP = 1<<12, 6
+	defer func() { keyJSONScryptN, keyJSONScryptP = n, p }()
+
+	priv, _ := hex.DecodeString(strings.Repeat("01", 32))
+	keyjson, err := EncryptPrivateKey(priv, "password")
+	if err != nil {
+		t.Fatalf("EncryptPrivateKey failed, err=%v", err)
+	}
+
+	var k keyJSON
+	if err := json.Unmarshal(keyjson, &k); err != nil {
+		t.Fatalf("unmarshal key json failed, err=%v", err)
+	}
+	if k.Address != strings.TrimPrefix(testDepositAddress, "FM") || k.Version != 3 || len(k.ID) != 36 || k.Crypto.KDF != "scrypt" {
+		t.Errorf("key json = %s", keyjson)
+	}
+
+	decrypted, err := DecryptPrivateKey(keyjson, "password")
+	if err != nil || hex.EncodeToString(decrypted) != hex.EncodeToString(priv) {
+		t.Errorf("DecryptPrivateKey = %x, err=%v", decrypted, err)
+	}
+	if _, err := DecryptPrivateKey(keyjson, "wrong"); err != ErrDecryptPrivateKey {
+		t.Errorf("decrypt with wrong password err=%v, want %v", err, ErrDecryptPrivateKey)
+	}
+
+	//地址与私钥不一致
+	k.Address = strings.TrimPrefix(testOtherAddress, "FM")
+	tampered, _ := json.Marshal(k)
+	if _, err := DecryptPrivateKey(tampered, "password"); err == nil {
+		t.Errorf("key json with another address should fail")
+	}
+
+	if _, err := EncryptPrivateKey(priv[1:], "password"); err != ErrInvalidPrivateKey {
+		t.Errorf("encrypt invalid key err=%v, want %v", err, ErrInvalidPrivateKey)
+	}
+}
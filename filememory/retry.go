@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/log"
+)
+
+const (
+	DefaultRPCTimeout      = 30 * time.Second
+	DefaultRetryMax        = 3
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultRetryMaxBackoff = 10 * time.Second
+	DefaultRetryBudget     = 60 * time.Second
+)
+
+//RetryPolicy 节点请求的超时和重试策略
+type RetryPolicy struct {
+	//默认请求超时，0表示不限制
+	Timeout time.Duration
+	//按方法设置的请求超时，优先于Timeout
+	MethodTimeouts map[string]time.Duration
+	//失败后最多重试次数
+	MaxRetries int
+	//首次重试的等待时间，之后每次翻倍
+	Backoff time.Duration
+	//单次等待的最大时间
+	MaxBackoff time.Duration
+	//一次调用累计耗时上限，超过后不再重试，0表示不限制
+	Budget time.Duration
+	//可重试的网关错误码，其他错误码直接返回
+	RetryableCodes map[int64]bool
+}
+
+//noRetryPolicy Client未设置策略时使用，只请求一次
+var noRetryPolicy = &RetryPolicy{}
+
+//NewRetryPolicy 创建默认策略，通讯错误重试3次，网关错误码不重试
+func NewRetryPolicy() *RetryPolicy {
+	policy := RetryPolicy{
+		Timeout:        DefaultRPCTimeout,
+		MethodTimeouts: make(map[string]time.Duration),
+		MaxRetries:     DefaultRetryMax,
+		Backoff:        DefaultRetryBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+		Budget:         DefaultRetryBudget,
+		RetryableCodes: make(map[int64]bool),
+	}
+	return &policy
+}
+
+//LoadRetryPolicy 从资产配置读取超时和重试策略
+//
+//	RPCTimeout = 30            默认请求超时，单位秒
+//	RPCMethodTimeout = blocktxs:60,pushtx:60   按方法设置超时，单位秒
+//	RPCRetryMax = 3            最多重试次数
+//	RPCRetryBackoff = 500      首次重试等待，单位毫秒
+//	RPCRetryMaxBackoff = 10000 单次等待上限，单位毫秒
+//	RPCRetryBudget = 60        一次调用累计耗时上限，单位秒
+//	RPCRetryableCodes = 10002,-32000   可重试的错误码
+func LoadRetryPolicy(c config.Configer) (*RetryPolicy, error) {
+	policy := NewRetryPolicy()
+	policy.Timeout = time.Duration(c.DefaultInt64("RPCTimeout", int64(DefaultRPCTimeout/time.Second))) * time.Second
+	policy.MaxRetries = c.DefaultInt("RPCRetryMax", DefaultRetryMax)
+	policy.Backoff = time.Duration(c.DefaultInt64("RPCRetryBackoff", int64(DefaultRetryBackoff/time.Millisecond))) * time.Millisecond
+	policy.MaxBackoff = time.Duration(c.DefaultInt64("RPCRetryMaxBackoff", int64(DefaultRetryMaxBackoff/time.Millisecond))) * time.Millisecond
+	policy.Budget = time.Duration(c.DefaultInt64("RPCRetryBudget", int64(DefaultRetryBudget/time.Second))) * time.Second
+
+	if policy.Timeout < 0 || policy.MaxRetries < 0 || policy.Backoff < 0 || policy.MaxBackoff < 0 || policy.Budget < 0 {
+		return nil, fmt.Errorf("retry policy values can not be negative")
+	}
+
+	for _, item := range splitConfigList(c.String("RPCMethodTimeout")) {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("RPCMethodTimeout item [%s] is invalid, want method:seconds", item)
+		}
+		seconds, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("RPCMethodTimeout item [%s] is invalid, want method:seconds", item)
+		}
+		policy.MethodTimeouts[strings.TrimSpace(kv[0])] = time.Duration(seconds) * time.Second
+	}
+
+	for _, item := range splitConfigList(c.String("RPCRetryableCodes")) {
+		code, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("RPCRetryableCodes item [%s] is not a number", item)
+		}
+		policy.RetryableCodes[code] = true
+	}
+
+	return policy, nil
+}
+
+//splitConfigList 解析逗号分隔的配置项，忽略空项
+func splitConfigList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+//timeout 获取方法的请求超时
+func (p *RetryPolicy) timeout(method string) time.Duration {
+	if t, exist := p.MethodTimeouts[method]; exist {
+		return t
+	}
+	return p.Timeout
+}
+
+//isRetryableCode 网关或节点返回的错误码是否可重试
+func (p *RetryPolicy) isRetryableCode(code int64) bool {
+	return p.RetryableCodes[code]
+}
+
+//backoff 第attempt次重试前的等待时间，指数递增并加入随机抖动
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 0; i < attempt && i < 30 && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	//在[wait/2, wait]之间抖动，避免多个实例同时重试
+	half := int64(wait / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+//callError 一次请求的失败原因，retryable表示可以重试
+type callError struct {
+	err       error
+	retryable bool
+}
+
+//do 按策略执行请求，直到成功、遇到不可重试的错误或重试次数、耗时用完
+func (p *RetryPolicy) do(method string, call func(timeout time.Duration) *callError) error {
+	start := time.Now()
+	timeout := p.timeout(method)
+	for attempt := 0; ; attempt++ {
+		cerr := call(timeout)
+		if cerr == nil {
+			return nil
+		}
+		if !cerr.retryable || attempt >= p.MaxRetries {
+			return cerr.err
+		}
+		wait := p.backoff(attempt)
+		if p.Budget > 0 && time.Since(start)+wait > p.Budget {
+			return cerr.err
+		}
+		log.Warningf("call %s failed, retry after %v, err=%v", method, wait, cerr.err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/config"
+)
+
+func testRetryClient(node *FakeNode) *Client {
+	client := node.NewClient()
+	client.Retry = NewRetryPolicy()
+	client.Retry.Backoff = time.Millisecond
+	client.Retry.MaxBackoff = 2 * time.Millisecond
+	client.Retry.RetryableCodes[10002] = true
+	return client
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	c, err := config.NewConfigData("ini", []byte(`
+RPCTimeout = 5
+RPCMethodTimeout = blocktxs:20, pushtx:60
+RPCRetryMax = 4
+RPCRetryBackoff = 100
+RPCRetryMaxBackoff = 2000
+RPCRetryBudget = 30
+RPCRetryableCodes = 10002, -32000
+`))
+	if err != nil {
+		t.Fatalf("load config failed, err=%v", err)
+	}
+	policy, err := LoadRetryPolicy(c)
+	if err != nil {
+		t.Fatalf("LoadRetryPolicy failed, err=%v", err)
+	}
+	if policy.timeout("blocknumber") != 5*time.Second || policy.timeout("blocktxs") != 20*time.Second || policy.timeout("pushtx") != time.Minute {
+		t.Errorf("unexpected timeouts: %v %v", policy.Timeout, policy.MethodTimeouts)
+	}
+	if policy.MaxRetries != 4 || policy.Backoff != 100*time.Millisecond || policy.MaxBackoff != 2*time.Second || policy.Budget != 30*time.Second {
+		t.Errorf("unexpected retry policy: %+v", policy)
+	}
+	if !policy.isRetryableCode(10002) || !policy.isRetryableCode(-32000) || policy.isRetryableCode(10001) {
+		t.Errorf("unexpected retryable codes: %v", policy.RetryableCodes)
+	}
+
+	//未配置时使用默认值
+	c, _ = config.NewConfigData("ini", []byte(""))
+	policy, err = LoadRetryPolicy(c)
+	if err != nil || policy.Timeout != DefaultRPCTimeout || policy.MaxRetries != DefaultRetryMax {
+		t.Errorf("default policy = %+v, %v", policy, err)
+	}
+
+	c, _ = config.NewConfigData("ini", []byte("RPCMethodTimeout = blocktxs"))
+	if _, err := LoadRetryPolicy(c); err == nil {
+		t.Errorf("invalid RPCMethodTimeout should fail")
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		wait := policy.backoff(attempt)
+		if wait < max/2 || wait > max {
+			t.Errorf("backoff(%d) = %v, want in [%v, %v]", attempt, wait, max/2, max)
+		}
+	}
+}
+
+func TestClient_RetryTransportError(t *testing.T) {
+	node := NewFakeNode()
+	node.SetTip(8)
+	client := testRetryClient(node)
+
+	node.FailNextTransport("blocknumber", errors.New("connection reset"))
+	node.FailNextTransport("blocknumber", errors.New("i/o timeout"))
+	height, err := client.FmGetBlockNumber()
+	if err != nil || height != 8 {
+		t.Fatalf("FmGetBlockNumber = %d, %v; want 8", height, err)
+	}
+	if node.Calls("blocknumber") != 3 {
+		t.Errorf("blocknumber calls = %d, want 3", node.Calls("blocknumber"))
+	}
+
+	//重试次数用完后返回最后一次错误
+	for i := 0; i <= client.Retry.MaxRetries; i++ {
+		node.FailNextTransport("eth_gasPrice", errors.New("connection refused"))
+	}
+	if _, err := client.Call("eth_gasPrice", 1, nil); err == nil || err.Error() != "connection refused" {
+		t.Errorf("eth_gasPrice err = %v, want connection refused", err)
+	}
+	if node.Calls("eth_gasPrice") != client.Retry.MaxRetries+1 {
+		t.Errorf("eth_gasPrice calls = %d, want %d", node.Calls("eth_gasPrice"), client.Retry.MaxRetries+1)
+	}
+}
+
+func TestClient_RetryGatewayCode(t *testing.T) {
+	node := NewFakeNode()
+	node.SetTip(8)
+	client := testRetryClient(node)
+
+	node.FailNext("blocknumber", 10002, "busy")
+	if _, err := client.FmGetBlockNumber(); err != nil {
+		t.Errorf("retryable code should be retried, err=%v", err)
+	}
+	if node.Calls("blocknumber") != 2 {
+		t.Errorf("blocknumber calls = %d, want 2", node.Calls("blocknumber"))
+	}
+
+	node.FailNext("getnonce", 10001, "invalid address")
+	if _, err := client.fmGetTransactionCount(testOtherAddress); err == nil {
+		t.Errorf("fatal code should be returned")
+	}
+	if node.Calls("getnonce") != 1 {
+		t.Errorf("getnonce calls = %d, want 1", node.Calls("getnonce"))
+	}
+}
+
+func TestClient_RetryBudget(t *testing.T) {
+	node := NewFakeNode()
+	client := testRetryClient(node)
+	client.Retry.Backoff = 50 * time.Millisecond
+	client.Retry.MaxBackoff = 50 * time.Millisecond
+	client.Retry.Budget = 10 * time.Millisecond
+
+	node.FailNextTransport("blocknumber", errors.New("connection reset"))
+	if _, err := client.FmGetBlockNumber(); err == nil {
+		t.Errorf("call should fail when retry budget exhausted")
+	}
+	if node.Calls("blocknumber") != 1 {
+		t.Errorf("blocknumber calls = %d, want 1", node.Calls("blocknumber"))
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//代币库记录可用的ERC20合约及其名称、符号和精度，保存在ERC20TOKEN_DB，
+//区块扫描监听库中未停用的合约，创建交易、汇总和查询余额时按调用方指定的合约补全精度。
+//CONTRACT_ADDRESS为网关记账的FM代币，余额从网关查询，调用方没有指定合约时使用
+
+//normalizeContractAddress 合约地址统一为0x开头的小写格式
+func normalizeContractAddress(address string) (string, error) {
+	key := indexAddressKey(address)
+	if len(key) != 40 {
+		return "", fmt.Errorf("invalid contract address: %s", address)
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return "", fmt.Errorf("invalid contract address: %s", address)
+	}
+	return "0x" + key, nil
+}
+
+//isDefaultContract 是否为网关记账的FM代币合约
+func isDefaultContract(address string) bool {
+	return indexAddressKey(address) == indexAddressKey(CONTRACT_ADDRESS)
+}
+
+//DefaultContract 网关记账的FM代币合约
+func (this *WalletManager) DefaultContract() openwallet.SmartContract {
+	return openwallet.SmartContract{
+		ContractID: openwallet.GenContractID(this.Symbol(), CONTRACT_ADDRESS),
+		Symbol:     this.Symbol(),
+		Address:    CONTRACT_ADDRESS,
+		Token:      Symbol,
+		Protocol:   "ERC20",
+		Name:       Symbol,
+		Decimals:   Decimal,
+	}
+}
+
+//DiscoverERC20Token 通过eth_call查询合约的名称、符号和精度
+func (this *WalletManager) DiscoverERC20Token(address string) (*ERC20Token, error) {
+	contractAddr, err := normalizeContractAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := this.WalletClient.EthCall(contractAddr, ETH_GET_TOKEN_SYMBOL_METHOD)
+	if err != nil {
+		return nil, fmt.Errorf("get contract[%v] symbol failed, err=%v", contractAddr, err)
+	}
+	symbol, err := decodeABIString(result)
+	if err != nil || symbol == "" {
+		return nil, fmt.Errorf("contract[%v] symbol is invalid: %s", contractAddr, result)
+	}
+
+	result, err = this.WalletClient.EthCall(contractAddr, ETH_GET_TOKEN_DECIMALS_METHOD)
+	if err != nil {
+		return nil, fmt.Errorf("get contract[%v] decimals failed, err=%v", contractAddr, err)
+	}
+	decimals, ok := new(big.Int).SetString(removeOxFromHex(result), 16)
+	if !ok || decimals.Cmp(big.NewInt(77)) > 0 {
+		return nil, fmt.Errorf("contract[%v] decimals is invalid: %s", contractAddr, result)
+	}
+
+	//name为可选方法，查询失败时使用符号
+	name := symbol
+	result, err = this.WalletClient.EthCall(contractAddr, ETH_GET_TOKEN_NAME_METHOD)
+	if err == nil {
+		if n, err := decodeABIString(result); err == nil && n != "" {
+			name = n
+		}
+	}
+
+	return &ERC20Token{
+		Address:  contractAddr,
+		Symbol:   symbol,
+		Name:     name,
+		Decimals: int(decimals.Int64()),
+	}, nil
+}
+
+//decodeABIString 解析合约返回的string，兼容返回bytes32的旧合约
+func decodeABIString(result string) (string, error) {
+	data, err := hex.DecodeString(removeOxFromHex(result))
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 32 {
+		return strings.TrimRight(string(data), "\x00"), nil
+	}
+	if len(data) < 64 {
+		return "", fmt.Errorf("abi string is too short")
+	}
+	offset := new(big.Int).SetBytes(data[:32])
+	if !offset.IsUint64() || offset.Uint64()+32 > uint64(len(data)) {
+		return "", fmt.Errorf("abi string offset out of range")
+	}
+	start := offset.Uint64() + 32
+	length := new(big.Int).SetBytes(data[offset.Uint64():start])
+	if !length.IsUint64() || start+length.Uint64() > uint64(len(data)) {
+		return "", fmt.Errorf("abi string length out of range")
+	}
+	return string(data[start : start+length.Uint64()]), nil
+}
+
+//AddERC20Token 添加代币合约到代币库，名称、符号和精度从合约查询，已存在时更新信息并重新启用
+func (this *WalletManager) AddERC20Token(address string) (*ERC20Token, error) {
+	token, err := this.DiscoverERC20Token(address)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := this.GetERC20Token(address); err == nil {
+		//沿用已保存记录的主键
+		token.Address = old.Address
+	}
+	err = this.SaveERC20TokenConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+//GetERC20Token 获取代币库中的合约，不存在时返回storm.ErrNotFound
+func (this *WalletManager) GetERC20Token(address string) (*ERC20Token, error) {
+	tokens, err := this.GetERC20TokenList()
+	if err != nil {
+		return nil, err
+	}
+	key := indexAddressKey(address)
+	for i := range tokens {
+		if indexAddressKey(tokens[i].Address) == key {
+			return &tokens[i], nil
+		}
+	}
+	return nil, storm.ErrNotFound
+}
+
+//ListERC20Tokens 列出代币库中的合约，includeDisabled为false时不包括已停用的合约
+func (this *WalletManager) ListERC20Tokens(includeDisabled bool) ([]*ERC20Token, error) {
+	tokens, err := this.GetERC20TokenList()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*ERC20Token, 0, len(tokens))
+	for i := range tokens {
+		if tokens[i].Disabled && !includeDisabled {
+			continue
+		}
+		list = append(list, &tokens[i])
+	}
+	return list, nil
+}
+
+//DisableERC20Token 停用代币合约
+func (this *WalletManager) DisableERC20Token(address string) error {
+	return this.setERC20TokenDisabled(address, true)
+}
+
+//EnableERC20Token 重新启用代币合约
+func (this *WalletManager) EnableERC20Token(address string) error {
+	return this.setERC20TokenDisabled(address, false)
+}
+
+func (this *WalletManager) setERC20TokenDisabled(address string, disabled bool) error {
+	token, err := this.GetERC20Token(address)
+	if err != nil {
+		return err
+	}
+	token.Disabled = disabled
+	return this.SaveERC20TokenConfig(token)
+}
+
+//ResolveContract 补全调用方指定的合约信息。没有指定合约地址时使用默认的FM代币合约；
+//调用方指定的精度优先，未指定时依次从代币库和合约查询。已停用的合约返回ErrContractNotFound
+func (this *WalletManager) ResolveContract(contract openwallet.SmartContract) (openwallet.SmartContract, error) {
+	if contract.Address == "" {
+		return this.DefaultContract(), nil
+	}
+
+	address, err := normalizeContractAddress(contract.Address)
+	if err != nil {
+		return contract, openwallet.Errorf(openwallet.ErrContractNotFound, err.Error())
+	}
+
+	token, err := this.GetERC20Token(address)
+	if err != nil && err != storm.ErrNotFound {
+		return contract, err
+	}
+	if token != nil && token.Disabled {
+		return contract, openwallet.Errorf(openwallet.ErrContractNotFound, "contract %s is disabled", address)
+	}
+	if token == nil {
+		if isDefaultContract(address) {
+			def := this.DefaultContract()
+			token = &ERC20Token{Address: def.Address, Symbol: def.Token, Name: def.Name, Decimals: int(def.Decimals)}
+		} else if contract.Decimals == 0 {
+			token, err = this.DiscoverERC20Token(address)
+			if err != nil {
+				return contract, openwallet.Errorf(openwallet.ErrContractNotFound, err.Error())
+			}
+		} else {
+			token = &ERC20Token{Address: address, Symbol: contract.Token, Name: contract.Name, Decimals: int(contract.Decimals)}
+		}
+	}
+
+	contract.Address = address
+	contract.ContractID = openwallet.GenContractID(this.Symbol(), address)
+	if contract.Symbol == "" {
+		contract.Symbol = this.Symbol()
+	}
+	if contract.Token == "" {
+		contract.Token = token.Symbol
+	}
+	if contract.Name == "" {
+		contract.Name = token.Name
+	}
+	if contract.Protocol == "" {
+		contract.Protocol = "ERC20"
+	}
+	if contract.Decimals == 0 {
+		contract.Decimals = uint64(token.Decimals)
+	}
+	return contract, nil
+}
+
+//GetTokenBalances 按合约精度查询地址的代币余额，FM代币从网关查询，其他合约通过balanceOf查询
+func (this *WalletManager) GetTokenBalances(contract openwallet.SmartContract, address ...string) ([]*openwallet.Balance, error) {
+	if isDefaultContract(contract.Address) {
+		return this.Blockscanner.GetBalanceByAddress(address...)
+	}
+
+	balances := make([]*openwallet.Balance, 0, len(address))
+	for _, addr := range address {
+		balance, err := this.WalletClient.ERC20GetAddressBalance(indexAddressKey(addr), contract.Address)
+		if err != nil {
+			return nil, ConvertGatewayError(err, openwallet.ErrCallFullNodeAPIFailed, "get token balance of addresses failed")
+		}
+		amount, err := ConvertAmountToFloatDecimal(balance.String(), int(contract.Decimals))
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, &openwallet.Balance{
+			Symbol:           contract.Token,
+			Address:          addr,
+			Balance:          amount.String(),
+			ConfirmBalance:   amount.String(),
+			UnconfirmBalance: "0",
+		})
+	}
+	return balances, nil
+}
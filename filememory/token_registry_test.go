@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
+)
+
+const testTokenAddress = "0x1111111111111111111111111111111111111111"
+
+//testABIString 按ABI编码string返回值
+func testABIString(s string) string {
+	data := hex.EncodeToString([]byte(s))
+	if pad := len(data) % 64; pad > 0 || len(data) == 0 {
+		data += strings.Repeat("0", 64-pad)
+	}
+	return fmt.Sprintf("0x%064x%064x%s", 32, len(s), data)
+}
+
+//testHandleToken 模拟节点应答代币合约的name、symbol、decimals和balanceOf
+func testHandleToken(node *FakeNode, contract, symbol, name string, decimals int, balances map[string]*big.Int) {
+	node.Handle("eth_call", func(params gjson.Result) (interface{}, int64, string) {
+		if fakeNodeKey(params.Get("0.to").String()) != fakeNodeKey(contract) {
+			return "0x", 0, ""
+		}
+		data := params.Get("0.data").String()
+		switch {
+		case data == ETH_GET_TOKEN_SYMBOL_METHOD:
+			return testABIString(symbol), 0, ""
+		case data == ETH_GET_TOKEN_NAME_METHOD:
+			return testABIString(name), 0, ""
+		case data == ETH_GET_TOKEN_DECIMALS_METHOD:
+			return fmt.Sprintf("0x%064x", decimals), 0, ""
+		case strings.HasPrefix(data, ETH_GET_TOKEN_BALANCE_METHOD):
+			balance := balances[data[len(data)-40:]]
+			if balance == nil {
+				balance = big.NewInt(0)
+			}
+			return fmt.Sprintf("0x%064x", balance), 0, ""
+		}
+		return nil, -32000, "execution reverted"
+	})
+}
+
+func TestDecodeABIString(t *testing.T) {
+	tests := []struct {
+		result string
+		want   string
+	}{
+		{testABIString("USDT"), "USDT"},
+		{testABIString("A Very Long Token Name That Spans Two Words"), "A Very Long Token Name That Spans Two Words"},
+		{"0x" + hex.EncodeToString([]byte("MKR")) + strings.Repeat("0", 58), "MKR"},
+	}
+	for _, test := range tests {
+		got, err := decodeABIString(test.result)
+		if err != nil || got != test.want {
+			t.Errorf("decodeABIString(%s) = %q, %v; want %q", test.result, got, err, test.want)
+		}
+	}
+	if _, err := decodeABIString("0x" + strings.Repeat("0", 62) + "ff" + strings.Repeat("0", 64)); err == nil {
+		t.Errorf("decodeABIString should fail on out of range offset")
+	}
+}
+
+func TestWalletManager_TokenRegistry(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testHandleToken(node, testTokenAddress, "USDT", "Tether USD", 6, nil)
+
+	token, err := wm.AddERC20Token(strings.ToUpper(testTokenAddress[2:]))
+	if err != nil {
+		t.Fatalf("AddERC20Token failed, err=%v", err)
+	}
+	if token.Address != testTokenAddress || token.Symbol != "USDT" || token.Name != "Tether USD" || token.Decimals != 6 {
+		t.Errorf("AddERC20Token = %+v", token)
+	}
+
+	if _, err := wm.AddERC20Token("0x2222222222222222222222222222222222222222"); err == nil {
+		t.Errorf("AddERC20Token should fail when the contract does not answer")
+	}
+
+	if list, _ := wm.ListERC20Tokens(false); len(list) != 1 {
+		t.Errorf("ListERC20Tokens = %d, want 1", len(list))
+	}
+
+	err = wm.DisableERC20Token(testTokenAddress)
+	if err != nil {
+		t.Fatalf("DisableERC20Token failed, err=%v", err)
+	}
+	if list, _ := wm.ListERC20Tokens(false); len(list) != 0 {
+		t.Errorf("disabled token should not be listed, got %d", len(list))
+	}
+	if list, _ := wm.ListERC20Tokens(true); len(list) != 1 || !list[0].Disabled {
+		t.Errorf("disabled token should be listed with includeDisabled")
+	}
+	bs := wm.Blockscanner.(*FMBLockScanner)
+	bs.LoadWatchedTokens()
+	if _, ok := bs.WatchedToken(testTokenAddress); ok {
+		t.Errorf("disabled token should not be watched")
+	}
+	_, err = wm.ResolveContract(openwallet.SmartContract{Address: testTokenAddress})
+	if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrContractNotFound {
+		t.Errorf("ResolveContract on disabled token should fail with ErrContractNotFound, err=%v", err)
+	}
+
+	err = wm.EnableERC20Token(testTokenAddress)
+	if err != nil {
+		t.Fatalf("EnableERC20Token failed, err=%v", err)
+	}
+	contract, err := wm.ResolveContract(openwallet.SmartContract{Address: "FM" + testTokenAddress[2:]})
+	if err != nil {
+		t.Fatalf("ResolveContract failed, err=%v", err)
+	}
+	if contract.Address != testTokenAddress || contract.Decimals != 6 || contract.Token != "USDT" ||
+		contract.ContractID != openwallet.GenContractID(Symbol, testTokenAddress) {
+		t.Errorf("ResolveContract = %+v", contract)
+	}
+
+	contract, _ = wm.ResolveContract(openwallet.SmartContract{})
+	if contract.Address != CONTRACT_ADDRESS || contract.Decimals != Decimal {
+		t.Errorf("ResolveContract without address should use the default contract, got %+v", contract)
+	}
+
+	contract, _ = wm.ResolveContract(openwallet.SmartContract{Address: "0x3333333333333333333333333333333333333333", Decimals: 18})
+	if contract.Decimals != 18 {
+		t.Errorf("ResolveContract should honour the requested decimals, got %d", contract.Decimals)
+	}
+}
+
+func TestEthContractDecoder_GetTokenBalanceByAddress_Contract(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testHandleToken(node, testTokenAddress, "USDT", "Tether USD", 6, map[string]*big.Int{
+		fakeNodeKey(testDepositAddress): big.NewInt(1500000),
+	})
+	node.SetBalance(testDepositAddress, big.NewInt(250000000))
+
+	balances, err := wm.ContractDecoder.GetTokenBalanceByAddress(openwallet.SmartContract{Address: testTokenAddress}, testDepositAddress)
+	if err != nil || len(balances) != 1 {
+		t.Fatalf("GetTokenBalanceByAddress failed, err=%v", err)
+	}
+	if balances[0].Balance.Balance != "1.5" {
+		t.Errorf("token balance = %s, want 1.5", balances[0].Balance.Balance)
+	}
+
+	//FM代币从网关查询
+	balances, err = wm.ContractDecoder.GetTokenBalanceByAddress(openwallet.SmartContract{Address: CONTRACT_ADDRESS}, testDepositAddress)
+	if err != nil || len(balances) != 1 {
+		t.Fatalf("GetTokenBalanceByAddress failed, err=%v", err)
+	}
+	if balances[0].Balance.Balance != "2.5" {
+		t.Errorf("FM balance = %s, want 2.5", balances[0].Balance.Balance)
+	}
+}
+
+func TestEthTransactionDecoder_CreateRawTransaction_Contract(t *testing.T) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testHandleToken(node, testTokenAddress, "USDT", "Tether USD", 6, map[string]*big.Int{
+		fakeNodeKey(testDepositAddress): big.NewInt(5000000),
+	})
+	if _, err := wm.AddERC20Token(testTokenAddress); err != nil {
+		t.Fatalf("AddERC20Token failed, err=%v", err)
+	}
+	node.SetBalance(testDepositAddress, big.NewInt(1000000))
+
+	wrapper := &testWalletDAI{addresses: []*openwallet.Address{
+		{AccountID: "account", Address: testDepositAddress},
+	}}
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     Symbol,
+			IsContract: true,
+			Contract:   openwallet.SmartContract{Address: testTokenAddress},
+		},
+		Account: &openwallet.AssetsAccount{AccountID: "account", Symbol: Symbol},
+		To:      map[string]string{testOtherAddress: "1.5"},
+	}
+	err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("CreateRawTransaction failed, err=%v", err)
+	}
+	if rawTx.Coin.Contract.Decimals != 6 || rawTx.Coin.Contract.Address != testTokenAddress {
+		t.Errorf("raw tx contract = %+v", rawTx.Coin.Contract)
+	}
+	if rawTx.TxAmount != "-1.500000" {
+		t.Errorf("TxAmount = %s, want -1.500000", rawTx.TxAmount)
+	}
+
+	rawHex, _ := hex.DecodeString(rawTx.RawHex)
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(rawHex, tx); err != nil {
+		t.Fatalf("decode raw tx failed, err=%v", err)
+	}
+	if tx.To() == nil || *tx.To() != ethcommon.HexToAddress(testTokenAddress) {
+		t.Errorf("raw tx should call %s, got %v", testTokenAddress, tx.To())
+	}
+	data, _ := makeERC20TokenTransData(testTokenAddress, testOtherAddress, big.NewInt(1500000))
+	if ethcommon.ToHex(tx.Data()) != data {
+		t.Errorf("raw tx data = %s, want %s", ethcommon.ToHex(tx.Data()), data)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"context"
+	"time"
+
+	"github.com/imroc/req"
+)
+
+//Transport 节点通讯接口，Client通过它把请求发送到网关或节点
+type Transport interface {
+	//Post 以JSON格式提交body到url，返回应答报文，timeout为0时不限制请求时间
+	Post(url string, header map[string]string, body interface{}, timeout time.Duration) ([]byte, error)
+}
+
+//DefaultTransport Client未设置Transport时使用的HTTP通讯实现
+var DefaultTransport Transport = &HTTPTransport{}
+
+//HTTPTransport 基于HTTP的通讯实现
+type HTTPTransport struct{}
+
+//Post 发送HTTP POST请求
+func (t *HTTPTransport) Post(url string, header map[string]string, body interface{}, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r, err := req.Post(url, req.BodyJSON(body), req.Header(header), ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.Bytes(), nil
+}
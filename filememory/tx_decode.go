@@ -28,6 +28,7 @@ import (
 	"math/big"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -39,14 +40,18 @@ import (
 )
 
 type EthTxExtPara struct {
-	Data     string `json:"data"`
-	GasLimit string `json:"gasLimit"`
+	Data        string `json:"data"`
+	GasLimit    string `json:"gasLimit"`
+	ReplaceTxID string `json:"replaceTxID,omitempty"` //加速或取消的交易
+	ReplaceKind string `json:"replaceKind,omitempty"` //speedup或cancel
 }
 
 func NewEthTxExtPara(j gjson.Result) *EthTxExtPara {
 	obj := EthTxExtPara{}
 	obj.GasLimit = j.Get("gasLimit").String()
 	obj.Data = j.Get("data").String()
+	obj.ReplaceTxID = j.Get("replaceTxID").String()
+	obj.ReplaceKind = j.Get("replaceKind").String()
 	return &obj
 }
 
@@ -194,8 +199,119 @@ func (this *EthTransactionDecoder) RunClearAddrStatic() {
 	}()
 }
 
+//submitNonceStatis 广播前获取地址的nonce统计，使用本地nonce账本时返回nil
+func (this *EthTransactionDecoder) submitNonceStatis(address string) (*AddressTxStatistic, error) {
+	if this.wm.Config.LocalNonce {
+		return nil, nil
+	}
+	txStatis, _, err := this.GetTransactionCount2(address)
+	return txStatis, err
+}
+
+//checkSubmitNonce 广播前检查交易的nonce，替换交易要求原交易还没有打包，
+//本地nonce账本要求nonce已预留且未提交，否则要求与缓存的nonce一致
+func (this *EthTransactionDecoder) checkSubmitNonce(txStatis *AddressTxStatistic, rawTx *openwallet.RawTransaction, address string, nonce uint64) error {
+	if replaceTxID, _ := replaceParaOf(rawTx); replaceTxID != "" {
+		_, err := this.wm.checkReplaceable(replaceTxID, address, nonce)
+		if err != nil {
+			this.wm.Log.Std.Error("replace transaction %s failed, err=%v", replaceTxID, err)
+			return openwallet.Errorf(openwallet.ErrNonceInvaild, err.Error())
+		}
+		return nil
+	}
+	if txStatis == nil {
+		err := this.wm.CheckReservedNonce(address, nonce, rawTxNonceToken(rawTx))
+		if err != nil {
+			this.wm.Log.Std.Error("nonce %d is not reserved, err=%v", nonce, err)
+			return openwallet.Errorf(openwallet.ErrNonceInvaild, "nonce out of dated, please try to start ur tx once again. ")
+		}
+		return nil
+	}
+	if nonce != *txStatis.TransactionCount {
+		this.wm.Log.Std.Error("nonce out of dated, please try to start ur tx once again. ")
+		return openwallet.Errorf(openwallet.ErrNonceInvaild, "nonce out of dated, please try to start ur tx once again. ")
+	}
+	return nil
+}
+
+//rawTxNonceToken 交易单预留nonce时绑定的签名哈希
+func rawTxNonceToken(rawTx *openwallet.RawTransaction) string {
+	if rawTx.Account == nil || len(rawTx.Signatures[rawTx.Account.AccountID]) == 0 {
+		return ""
+	}
+	return rawTx.Signatures[rawTx.Account.AccountID][0].Message
+}
+
+//submittedNonce 广播成功后记录交易和已使用的nonce，替换交易不占用新的nonce
+func (this *EthTransactionDecoder) submittedNonce(txStatis *AddressTxStatistic, rawTx *openwallet.RawTransaction, address string, nonce uint64, txid string, signedHex string) {
+	this.recordSentTransaction(rawTx, address, nonce, txid, signedHex)
+	if replaceTxID, _ := replaceParaOf(rawTx); replaceTxID != "" && txStatis != nil {
+		return
+	}
+	if txStatis == nil {
+		err := this.wm.MarkNonceSubmitted(address, nonce, txid)
+		if err != nil {
+			this.wm.Log.Errorf("mark nonce %d of address %s submitted failed, err=%v", nonce, address, err)
+		}
+		return
+	}
+	txStatis.UpdateTime()
+	(*txStatis.TransactionCount)++
+}
+
+//submittedTransaction 广播成功后的交易记录
+func (this *EthTransactionDecoder) submittedTransaction(rawTx *openwallet.RawTransaction) *openwallet.Transaction {
+	decimals := int32(0)
+	if rawTx.Coin.IsContract {
+		decimals = int32(rawTx.Coin.Contract.Decimals)
+	} else {
+		decimals = int32(this.wm.Decimal())
+	}
+
+	//记录一个交易单
+	tx := &openwallet.Transaction{
+		From:       rawTx.TxFrom,
+		To:         rawTx.TxTo,
+		Amount:     rawTx.TxAmount,
+		Coin:       rawTx.Coin,
+		TxID:       rawTx.TxID,
+		Decimal:    decimals,
+		AccountID:  rawTx.Account.AccountID,
+		Fees:       rawTx.Fees,
+		SubmitTime: time.Now().Unix(),
+		TxType:     0,
+	}
+
+	tx.WxID = openwallet.GenTransactionWxID(tx)
+	return tx
+}
+
+//ReleaseRawTransactionNonce 放弃未广播的交易单时释放预留的nonce
+func (this *EthTransactionDecoder) ReleaseRawTransactionNonce(rawTx *openwallet.RawTransaction) error {
+	if !this.wm.Config.LocalNonce {
+		return nil
+	}
+	for _, signatures := range rawTx.Signatures {
+		for _, signature := range signatures {
+			if signature.Address == nil {
+				continue
+			}
+			nonce, err := strconv.ParseUint(removeOxFromHex(signature.Nonce), 16, 64)
+			if err != nil {
+				return fmt.Errorf("parse nonce of raw tx failed, err=%v", err)
+			}
+			err = this.wm.releaseNonce(signature.Address.Address, nonce, signature.Message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//GetRawTransactionFeeRate 获取创建交易时实际使用的gasPrice
 func (this *EthTransactionDecoder) GetRawTransactionFeeRate() (feeRate string, unit string, err error) {
-	price, err := this.wm.WalletClient.ethGetGasPrice()
+	price, err := this.wm.GetGasPrice()
 	if err != nil {
 		this.wm.Log.Errorf("get gas price failed, err=%v", err)
 		return "", "Gas", err
@@ -214,6 +330,12 @@ func VerifyRawTransaction(rawTx *openwallet.RawTransaction) error {
 		return errors.New("only one to address can be set.")
 	}
 
+	for to := range rawTx.To {
+		if _, err := ParseFMAddress(to); err != nil {
+			return fmt.Errorf("to address [%s] is invalid: %v", to, err)
+		}
+	}
+
 	return nil
 }
 
@@ -342,8 +464,8 @@ func (this *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwa
 		callData        string
 	)
 
-	tokenDecimals := Decimal
-	contractAddress := CONTRACT_ADDRESS
+	tokenDecimals := int(rawTx.Coin.Contract.Decimals)
+	contractAddress := rawTx.Coin.Contract.Address
 
 	//check交易交易单基本字段
 	err := VerifyRawTransaction(rawTx)
@@ -368,7 +490,7 @@ func (this *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwa
 		searchAddrs = append(searchAddrs, address.Address)
 	}
 
-	addrBalanceArray, err := this.wm.Blockscanner.GetBalanceByAddress(searchAddrs...)
+	addrBalanceArray, err := this.wm.GetTokenBalances(rawTx.Coin.Contract, searchAddrs...)
 	if err != nil {
 		return openwallet.NewError(openwallet.ErrCallFullNodeAPIFailed, err.Error())
 	}
@@ -431,12 +553,12 @@ func (this *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwa
 			continue
 		}
 
-		//if coinBalance.Cmp(fee.Fee) < 0 {
-		//	coinBalance, _ := ConverWeiStringToEthDecimal(coinBalance.String())
-		//	errBalance = fmt.Sprintf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
-		//	balanceNotEnough = true
-		//	continue
-		//}
+		if coinBalance.Cmp(fee.Fee) < 0 {
+			coinBalance, _ := ConverWeiStringToEthDecimal(coinBalance.String())
+			errBalance = fmt.Sprintf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
+			balanceNotEnough = true
+			continue
+		}
 
 		//只要找到一个合适使用的地址余额就停止遍历
 		findAddrBalance = &AddrBalance{Address: addrBalance.Address, Balance: coinBalance, TokenBalance: addrBalance_BI}
@@ -452,6 +574,7 @@ func (this *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwa
 		if balanceNotEnough {
 			return openwallet.Errorf(openwallet.ErrInsufficientFees, errBalance)
 		}
+		return openwallet.Errorf(openwallet.ErrInsufficientTokenBalanceOfAddress, "the token balance of all addresses is not enough")
 	}
 
 	//最后创建交易单
@@ -469,21 +592,63 @@ func (this *EthTransactionDecoder) CreateErc20TokenRawTransaction(wrapper openwa
 	return nil
 }
 
+//交易操作，用于CoinModeError
+const (
+	coinActionCreate  = "create"
+	coinActionSubmit  = "submit"
+	coinActionSummary = "summary"
+)
+
+//resolveCoin 按调用方的Coin确定主币或代币交易：IsContract为false时为主币交易，不能指定合约；
+//IsContract为true时为代币交易，必须指定ERC20合约地址，精度等信息从代币库补全
+func (this *EthTransactionDecoder) resolveCoin(action string, coin openwallet.Coin, accountSymbol string) (openwallet.Coin, error) {
+	if coin.Symbol == "" {
+		coin.Symbol = accountSymbol
+	}
+	modeErr := func(kind error) error {
+		return &CoinModeError{Action: action, Coin: coin, Kind: kind}
+	}
+	if !strings.EqualFold(coin.Symbol, this.wm.Symbol()) {
+		return coin, modeErr(ErrUnsupportedCoin)
+	}
+
+	if !coin.IsContract {
+		if coin.Contract.Address != "" {
+			return coin, modeErr(ErrUnexpectedContract)
+		}
+		return openwallet.Coin{Symbol: this.wm.Symbol()}, nil
+	}
+
+	if coin.Contract.Address == "" {
+		return coin, modeErr(ErrContractRequired)
+	}
+	if coin.Contract.Protocol != "" && !strings.EqualFold(coin.Contract.Protocol, "ERC20") {
+		return coin, modeErr(ErrUnsupportedCoin)
+	}
+	contract, err := this.wm.ResolveContract(coin.Contract)
+	if err != nil {
+		return coin, err
+	}
+	return openwallet.Coin{
+		Symbol:     this.wm.Symbol(),
+		IsContract: true,
+		ContractID: contract.ContractID,
+		Contract:   contract,
+	}, nil
+}
+
 //CreateRawTransaction 创建交易单
 func (this *EthTransactionDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
-	coin := openwallet.Coin{
-		Symbol:     rawTx.Account.Symbol,
-		IsContract: true,
-		ContractID: "",
-		Contract: openwallet.SmartContract{
-			ContractID: "",
-			Symbol:     Symbol,
-			Address:    CONTRACT_ADDRESS,
-			Name:       Symbol,
-			Decimals:   8,
-		},
+	coin, err := this.resolveCoin(coinActionCreate, rawTx.Coin, rawTx.Account.Symbol)
+	if err != nil {
+		return err
 	}
 	rawTx.Coin = coin
+	for to := range rawTx.To {
+		if _, err := ParseFMAddress(to); err != nil {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "to address [%s] is invalid: %v", to, err)
+		}
+	}
 	if !rawTx.Coin.IsContract {
 		return this.CreateSimpleRawTransaction(wrapper, rawTx, nil)
 	}
@@ -500,6 +665,12 @@ func (this *EthTransactionDecoder) SignRawTransaction(wrapper openwallet.WalletD
 		return err
 	}
 
+	//节点所在网络与配置不一致时不签名
+	err = this.wm.networkReady()
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrSignRawTransactionFailed, "network check failed: %v", err)
+	}
+
 	if rawTx.Signatures == nil || len(rawTx.Signatures) == 0 {
 		//this.wm.Log.Std.Error("len of signatures error. ")
 		return openwallet.Errorf(openwallet.ErrSignRawTransactionFailed, "transaction signature is empty")
@@ -583,7 +754,7 @@ func (this *EthTransactionDecoder) SubmitSimpleRawTransaction(wrapper openwallet
 
 	signer := types.NewEIP155Signer(big.NewInt(int64(this.wm.GetConfig().ChainID)))
 
-	txStatis, _, err := this.GetTransactionCount2(from)
+	txStatis, err := this.submitNonceStatis(from)
 	if err != nil {
 		this.wm.Log.Std.Error("get transaction count2 failed, err=%v", err)
 		return nil, openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "get transaction count2 faile")
@@ -595,9 +766,12 @@ func (this *EthTransactionDecoder) SubmitSimpleRawTransaction(wrapper openwallet
 		return nil, err
 	}
 
+	var submitted *openwallet.Transaction
 	err = func() error {
-		txStatis.AddressLocker.Lock()
-		defer txStatis.AddressLocker.Unlock()
+		if txStatis != nil {
+			txStatis.AddressLocker.Lock()
+			defer txStatis.AddressLocker.Unlock()
+		}
 
 		tx := &types.Transaction{}
 		err = rlp.DecodeBytes(rawHex, tx)
@@ -606,17 +780,19 @@ func (this *EthTransactionDecoder) SubmitSimpleRawTransaction(wrapper openwallet
 			return err
 		}
 
-		if tx.Nonce() != *txStatis.TransactionCount {
-			this.wm.Log.Std.Error("nonce out of dated, please try to start ur tx once again. ")
-			return openwallet.Errorf(openwallet.ErrNonceInvaild, "nonce out of dated, please try to start ur tx once again. ")
-		}
-
 		tx, err = tx.WithSignature(signer, ethcommon.FromHex(sig))
 		if err != nil {
 			this.wm.Log.Std.Error("tx with signature failed, err=%v ", err)
 			return errors.New("tx with signature failed. ")
 		}
 
+		//核对交易内容和签名地址
+		err = this.verifyTransaction(wrapper, rawTx, tx, rawTx.Signatures[rawTx.Account.AccountID][0])
+		if err != nil {
+			this.wm.Log.Std.Error("verify transaction failed, err=%v", err)
+			return err
+		}
+
 		txstr, _ := json.MarshalIndent(tx, "", " ")
 		this.wm.Log.Debug("**after signed txStr:", string(txstr))
 
@@ -626,16 +802,21 @@ func (this *EthTransactionDecoder) SubmitSimpleRawTransaction(wrapper openwallet
 			return errors.New("encode tx to rlp failed. ")
 		}
 
-		txid, err := this.wm.WalletClient.fmSendRawTransaction(ethcommon.ToHex(rawTxPara))
+		//重复提交已广播的交易直接返回原交易记录
+		txid := tx.Hash().Hex()
+		if submitted = this.resubmittedTransaction(rawTx, txid); submitted != nil {
+			return nil
+		}
+
+		err = this.submitSignedTransaction(txStatis, rawTx, from, tx.Nonce(), txid, ethcommon.ToHex(rawTxPara))
 		if err != nil {
 			this.wm.Log.Std.Error("sent raw tx faild, err=%v", err)
-			return openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild. unexpected error: %v", err)
+			return ConvertGatewayError(err, openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild")
 		}
 
 		rawTx.TxID = txid
 		rawTx.IsSubmit = true
-		txStatis.UpdateTime()
-		(*txStatis.TransactionCount)++
+		this.submittedNonce(txStatis, rawTx, from, tx.Nonce(), txid, ethcommon.ToHex(rawTxPara))
 
 		this.wm.Log.Debug("transaction[", txid, "] has been sent out.")
 		return nil
@@ -645,31 +826,11 @@ func (this *EthTransactionDecoder) SubmitSimpleRawTransaction(wrapper openwallet
 		this.wm.Log.Errorf("send raw transaction failed, err= %v", err)
 		return nil, err
 	}
-
-	decimals := int32(0)
-	if rawTx.Coin.IsContract {
-		decimals = int32(rawTx.Coin.Contract.Decimals)
-	} else {
-		decimals = int32(this.wm.Decimal())
+	if submitted != nil {
+		return submitted, nil
 	}
 
-	//记录一个交易单
-	tx := &openwallet.Transaction{
-		From:       rawTx.TxFrom,
-		To:         rawTx.TxTo,
-		Amount:     rawTx.TxAmount,
-		Coin:       rawTx.Coin,
-		TxID:       rawTx.TxID,
-		Decimal:    decimals,
-		AccountID:  rawTx.Account.AccountID,
-		Fees:       rawTx.Fees,
-		SubmitTime: time.Now().Unix(),
-		TxType:     0,
-	}
-
-	tx.WxID = openwallet.GenTransactionWxID(tx)
-
-	return tx, nil
+	return this.submittedTransaction(rawTx), nil
 }
 
 func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
@@ -711,7 +872,7 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 
 	signer := types.NewEIP155Signer(big.NewInt(int64(this.wm.GetConfig().ChainID)))
 
-	txStatis, _, err := this.GetTransactionCount2(from)
+	txStatis, err := this.submitNonceStatis(from)
 	if err != nil {
 		this.wm.Log.Std.Error("get transaction count2 failed, err=%v", err)
 		return nil, errors.New("get transaction count2 faile")
@@ -729,9 +890,12 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 		return nil, err
 	}
 
+	var submitted *openwallet.Transaction
 	err = func() error {
-		txStatis.AddressLocker.Lock()
-		defer txStatis.AddressLocker.Unlock()
+		if txStatis != nil {
+			txStatis.AddressLocker.Lock()
+			defer txStatis.AddressLocker.Unlock()
+		}
 		//
 		//nonceSigned, err := strconv.ParseUint(removeOxFromHex(rawTx.Signatures[rawTx.Account.AccountID][0].Nonce),
 		//	16, 64)
@@ -752,11 +916,6 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 			return err
 		}
 
-		if tx.Nonce() != *txStatis.TransactionCount {
-			this.wm.Log.Std.Error("nonce out of dated, please try to start ur tx once again. ")
-			return errors.New("nonce out of dated, please try to start ur tx once again. ")
-		}
-
 		//tx := types.NewTransaction(nonceSigned, ethcommon.HexToAddress(rawTx.Coin.Contract.Address),
 		//	big.NewInt(0), gaslimit.Uint64(), gasPrice, common.FromHex(data))
 		tx, err = tx.WithSignature(signer, ethcommon.FromHex(sig))
@@ -765,6 +924,13 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 			return errors.New("tx with signature failed. ")
 		}
 
+		//核对交易内容和签名地址
+		err = this.verifyTransaction(wrapper, rawTx, tx, rawTx.Signatures[rawTx.Account.AccountID][0])
+		if err != nil {
+			this.wm.Log.Std.Error("verify transaction failed, err=%v", err)
+			return err
+		}
+
 		txstr, _ := json.MarshalIndent(tx, "", " ")
 		this.wm.Log.Debug("**after signed txStr:", string(txstr))
 
@@ -774,23 +940,28 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 			return errors.New("encode tx to rlp failed. ")
 		}
 
-		txid, err := this.wm.WalletClient.fmSendRawTransaction(ethcommon.ToHex(rawTxPara))
+		//重复提交已广播的交易直接返回原交易记录
+		txid := tx.Hash().Hex()
+		if submitted = this.resubmittedTransaction(rawTx, txid); submitted != nil {
+			return nil
+		}
+
+		err = this.submitSignedTransaction(txStatis, rawTx, from, tx.Nonce(), txid, ethcommon.ToHex(rawTxPara))
 		if err != nil {
 			// GAS 缺失,请求接口获取 GAS
-			if err.Error() == "[10001]Returned error: insufficient funds for gas * price + value" {
-				this.wm.WalletClient.FmGetFee(txStatis.Address)
+			if IsGatewayError(err, ErrInsufficientFunds) {
+				this.wm.WalletClient.FmGetFee(from)
 			}
 			this.wm.Log.Std.Error("sent raw tx faild, err=%v", err)
-			return openwallet.Errorf(openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild. unexpected error: %v", err)
+			return ConvertGatewayError(err, openwallet.ErrSubmitRawTransactionFailed, "sent raw tx faild")
 		}
 
 		rawTx.TxID = txid
 		rawTx.IsSubmit = true
-		txStatis.UpdateTime()
-		(*txStatis.TransactionCount)++
+		this.submittedNonce(txStatis, rawTx, from, tx.Nonce(), txid, ethcommon.ToHex(rawTxPara))
 
 		// 交易发送成功之后提起一次获取GAS的请求.
-		this.wm.WalletClient.FmGetFee(txStatis.Address)
+		this.wm.WalletClient.FmGetFee(from)
 
 		this.wm.Log.Debug("transaction[", txid, "] has been sent out.")
 		return nil
@@ -800,46 +971,18 @@ func (this *EthTransactionDecoder) SubmitErc20TokenRawTransaction(wrapper openwa
 		this.wm.Log.Errorf("send raw transaction failed, err= %v", err)
 		return nil, err
 	}
-
-	decimals := int32(0)
-	if rawTx.Coin.IsContract {
-		decimals = int32(rawTx.Coin.Contract.Decimals)
-	} else {
-		decimals = int32(this.wm.Decimal())
-	}
-
-	//记录一个交易单
-	tx := &openwallet.Transaction{
-		From:       rawTx.TxFrom,
-		To:         rawTx.TxTo,
-		Amount:     rawTx.TxAmount,
-		Coin:       rawTx.Coin,
-		TxID:       rawTx.TxID,
-		Decimal:    decimals,
-		AccountID:  rawTx.Account.AccountID,
-		Fees:       "0",
-		SubmitTime: time.Now().Unix(),
-		TxType:     0,
+	if submitted != nil {
+		return submitted, nil
 	}
 
-	tx.WxID = openwallet.GenTransactionWxID(tx)
-
-	return tx, nil
+	return this.submittedTransaction(rawTx), nil
 }
 
 //SendRawTransaction 广播交易单
 func (this *EthTransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
-	coin := openwallet.Coin{
-		Symbol:     rawTx.Account.Symbol,
-		IsContract: true,
-		ContractID: "",
-		Contract: openwallet.SmartContract{
-			ContractID: "",
-			Symbol:     Symbol,
-			Address:    CONTRACT_ADDRESS,
-			Name:       Symbol,
-			Decimals:   8,
-		},
+	coin, err := this.resolveCoin(coinActionSubmit, rawTx.Coin, rawTx.Account.Symbol)
+	if err != nil {
+		return nil, err
 	}
 	rawTx.Coin = coin
 	if !rawTx.Coin.IsContract {
@@ -892,21 +1035,14 @@ func (this *EthTransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 		return errors.New(errinfo)
 	}
 
-	return nil
+	//核对交易内容与交易单一致，签名地址与账户地址一致
+	return this.verifySignedRawTransaction(wrapper, rawTx)
 }
 
 //CreateSummaryRawTransaction 创建汇总交易，返回原始交易单数组
 func (this *EthTransactionDecoder) CreateSummaryRawTransaction(wrapper openwallet.WalletDAI, sumRawTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransaction, error) {
-	var (
-		rawTxWithErrArray []*openwallet.RawTransactionWithError
-		rawTxArray        = make([]*openwallet.RawTransaction, 0)
-		err               error
-	)
-	if sumRawTx.Coin.IsContract {
-		rawTxWithErrArray, err = this.CreateErc20TokenSummaryRawTransaction(wrapper, sumRawTx)
-	} else {
-		rawTxWithErrArray, err = this.CreateSimpleSummaryRawTransaction(wrapper, sumRawTx)
-	}
+	rawTxArray := make([]*openwallet.RawTransaction, 0)
+	rawTxWithErrArray, err := this.CreateSummaryRawTransactionWithError(wrapper, sumRawTx)
 	if err != nil {
 		return nil, err
 	}
@@ -1026,7 +1162,9 @@ func (this *EthTransactionDecoder) CreateSimpleSummaryRawTransaction(wrapper ope
 	return rawTxArray, nil
 }
 
-//CreateErc20TokenSummaryRawTransaction 创建ERC20Token汇总交易
+//CreateErc20TokenSummaryRawTransaction 创建ERC20Token汇总交易。
+//地址主币余额不足手续费时，有手续费账户则创建从手续费账户转入主币的交易单，该地址下次再汇总，
+//手续费交易单的nonce从手续费地址当前nonce开始连续递增；没有手续费账户则返回带ErrInsufficientFees的交易单
 func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper openwallet.WalletDAI, sumRawTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransactionWithError, error) {
 
 	var (
@@ -1035,35 +1173,46 @@ func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper
 		minTransfer        *big.Int
 		retainedBalance    *big.Int
 		feesSupportAccount *openwallet.AssetsAccount
+		feesSupportAddress *AddrBalance
 		tmpNonce           uint64
 	)
 
 	// 如果有提供手续费账户，检查账户是否存在
-	//if feesAcount := sumRawTx.FeesSupportAccount; feesAcount != nil {
-	//	account, supportErr := wrapper.GetAssetsAccountInfo(feesAcount.AccountID)
-	//	if supportErr != nil {
-	//		return nil, openwallet.Errorf(openwallet.ErrAccountNotFound, "can not find fees support account")
-	//	}
-	//
-	//	feesSupportAccount = account
-	//
-	//	//获取手续费支持账户的地址nonce
-	//	feesAddresses, feesSupportErr := wrapper.GetAddressList(0, 1,
-	//		"AccountID", feesSupportAccount.AccountID)
-	//	if feesSupportErr != nil {
-	//		return nil, openwallet.NewError(openwallet.ErrAddressNotFound, "fees support account have not addresses")
-	//	}
-	//
-	//	if len(feesAddresses) == 0 {
-	//		return nil, openwallet.Errorf(openwallet.ErrAccountNotAddress, "fees support account have not addresses")
-	//	}
-	//
-	//	_, nonce, feesSupportErr := this.GetTransactionCount2(feesAddresses[0].Address)
-	//	if feesSupportErr != nil {
-	//		return nil, openwallet.NewError(openwallet.ErrNonceInvaild, "fees support account get nonce failed")
-	//	}
-	//	tmpNonce = nonce
-	//}
+	if feesAcount := sumRawTx.FeesSupportAccount; feesAcount != nil && feesAcount.AccountID != "" {
+		account, supportErr := wrapper.GetAssetsAccountInfo(feesAcount.AccountID)
+		if supportErr != nil {
+			return nil, openwallet.Errorf(openwallet.ErrAccountNotFound, "can not find fees support account")
+		}
+
+		feesSupportAccount = account
+
+		//获取手续费支持账户的地址nonce
+		feesAddresses, feesSupportErr := wrapper.GetAddressList(0, 1,
+			"AccountID", feesSupportAccount.AccountID)
+		if feesSupportErr != nil {
+			return nil, openwallet.NewError(openwallet.ErrAddressNotFound, "fees support account have not addresses")
+		}
+
+		if len(feesAddresses) == 0 {
+			return nil, openwallet.Errorf(openwallet.ErrAccountNotAddress, "fees support account have not addresses")
+		}
+
+		//使用本地nonce账本时由账本分配
+		if !this.wm.Config.LocalNonce {
+			_, nonce, feesSupportErr := this.GetTransactionCount2(feesAddresses[0].Address)
+			if feesSupportErr != nil {
+				return nil, openwallet.NewError(openwallet.ErrNonceInvaild, "fees support account get nonce failed")
+			}
+			tmpNonce = nonce
+		}
+
+		supportBalance, feesSupportErr := this.wm.WalletClient.GetAddrBalance2(feesAddresses[0].Address, "pending")
+		if feesSupportErr != nil {
+			return nil, ConvertGatewayError(feesSupportErr, openwallet.ErrCallFullNodeAPIFailed, "get fees support address balance failed")
+		}
+		feesSupportAddress = &AddrBalance{Address: feesAddresses[0].Address, Balance: supportBalance}
+	}
+
 	//tokenCoin := sumRawTx.Coin.Contract.Token
 	tokenDecimals := int(sumRawTx.Coin.Contract.Decimals)
 	contractAddress := sumRawTx.Coin.Contract.Address
@@ -1093,7 +1242,7 @@ func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper
 	}
 
 	//查询Token余额
-	addrBalanceArray, err := this.wm.Blockscanner.GetBalanceByAddress(searchAddrs...)
+	addrBalanceArray, err := this.wm.GetTokenBalances(sumRawTx.Coin.Contract, searchAddrs...)
 	if err != nil {
 		return nil, err
 	}
@@ -1111,6 +1260,9 @@ func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper
 		sumAmount_BI.Sub(addrBalance_BI, retainedBalance)
 
 		callData, err := makeERC20TokenTransData(contractAddress, sumRawTx.SummaryAddress, sumAmount_BI)
+		if err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "make token transfer data failed, err=%v", err)
+		}
 
 		//this.wm.Log.Debug("sumAmount:", sumAmount)
 		//计算手续费
@@ -1132,88 +1284,76 @@ func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper
 		sumAmount, _ := ConvertAmountToFloatDecimal(sumAmount_BI.String(), tokenDecimals)
 		fees, _ := ConverWeiStringToEthDecimal(fee.Fee.String())
 
-		coinBalance, createErr := this.wm.WalletClient.GetAddrBalance2(AppendOxToAddress(addrBalance.Address), "pending")
-		if err != nil {
+		//创建一笔交易单
+		rawTx := &openwallet.RawTransaction{
+			Coin:    sumRawTx.Coin,
+			Account: sumRawTx.Account,
+			To: map[string]string{
+				sumRawTx.SummaryAddress: sumAmount.StringFixed(int32(tokenDecimals)),
+			},
+			Required: 1,
+		}
+
+		coinBalance, createErr := this.wm.WalletClient.GetAddrBalance2(addrBalance.Address, "pending")
+		if createErr != nil {
+			rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+				RawTx: rawTx,
+				Error: ConvertGatewayError(createErr, openwallet.ErrCallFullNodeAPIFailed, "get address[%s] balance failed", addrBalance.Address),
+			})
 			continue
 		}
 
 		//判断主币余额是否够手续费
 		if coinBalance.Cmp(fee.Fee) < 0 {
 
-			//有手续费账户支持
-			if feesSupportAccount != nil {
-
-				//通过手续费账户创建交易单
-				supportAddress := addrBalance.Address
-				supportAmount := decimal.Zero
-				feesSupportScale, _ := decimal.NewFromString(sumRawTx.FeesSupportAccount.FeesSupportScale)
-				fixSupportAmount, _ := decimal.NewFromString(sumRawTx.FeesSupportAccount.FixSupportAmount)
+			//没有手续费账户支持，返回错误，不创建无法上链的交易
+			if feesSupportAccount == nil {
+				coinBalanceDec, _ := ConverWeiStringToEthDecimal(coinBalance.String())
+				rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+					RawTx: rawTx,
+					Error: openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s of address %s is not enough to call smart contract", sumRawTx.Coin.Symbol, coinBalanceDec, addrBalance.Address),
+				})
+				continue
+			}
 
-				//优先采用固定支持数量
-				if fixSupportAmount.GreaterThan(decimal.Zero) {
-					supportAmount = fixSupportAmount
+			//通过手续费账户创建交易单
+			supportAddress := addrBalance.Address
+			supportAmount := decimal.Zero
+			feesSupportScale, _ := decimal.NewFromString(sumRawTx.FeesSupportAccount.FeesSupportScale)
+			fixSupportAmount, _ := decimal.NewFromString(sumRawTx.FeesSupportAccount.FixSupportAmount)
+
+			//优先采用固定支持数量
+			if fixSupportAmount.GreaterThan(decimal.Zero) {
+				supportAmount = fixSupportAmount
+			} else {
+				//没有固定支持数量，有手续费倍率，计算支持数量
+				if feesSupportScale.GreaterThan(decimal.Zero) {
+					supportAmount = feesSupportScale.Mul(fees)
 				} else {
-					//没有固定支持数量，有手续费倍率，计算支持数量
-					if feesSupportScale.GreaterThan(decimal.Zero) {
-						supportAmount = feesSupportScale.Mul(fees)
-					} else {
-						//默认支持数量为手续费
-						supportAmount = fees
-					}
-				}
-
-				this.wm.Log.Debugf("create transaction for fees support account")
-				this.wm.Log.Debugf("fees account: %s", feesSupportAccount.AccountID)
-				this.wm.Log.Debugf("mini support amount: %s", fees.String())
-				this.wm.Log.Debugf("allow support amount: %s", supportAmount.String())
-				this.wm.Log.Debugf("support address: %s", supportAddress)
-
-				supportCoin := openwallet.Coin{
-					Symbol:     sumRawTx.Coin.Symbol,
-					IsContract: false,
-				}
-
-				//创建一笔交易单
-				rawTx := &openwallet.RawTransaction{
-					Coin:    supportCoin,
-					Account: feesSupportAccount,
-					To: map[string]string{
-						addrBalance.Address: supportAmount.String(),
-					},
-					Required: 1,
+					//默认支持数量为手续费
+					supportAmount = fees
 				}
+			}
 
-				createTxErr := this.CreateSimpleRawTransaction(wrapper, rawTx, &tmpNonce)
-				rawTxWithErr := &openwallet.RawTransactionWithError{
-					RawTx: rawTx,
-					Error: openwallet.ConvertError(createTxErr),
-				}
+			this.wm.Log.Debugf("create transaction for fees support account")
+			this.wm.Log.Debugf("fees account: %s", feesSupportAccount.AccountID)
+			this.wm.Log.Debugf("mini support amount: %s", fees.String())
+			this.wm.Log.Debugf("allow support amount: %s", supportAmount.String())
+			this.wm.Log.Debugf("support address: %s", supportAddress)
 
-				//创建成功，添加到队列
-				rawTxArray = append(rawTxArray, rawTxWithErr)
+			rawTxWithErr := this.createFeesSupportRawTransaction(wrapper, sumRawTx, feesSupportAccount, feesSupportAddress, supportAddress, supportAmount, &tmpNonce)
 
-				//需要手续费支持的地址会有很多个，nonce要连续递增以保证交易广播生效
-				tmpNonce++
+			//创建成功，添加到队列
+			rawTxArray = append(rawTxArray, rawTxWithErr)
 
-				//汇总下一个
-				continue
-			}
+			//汇总下一个
+			continue
 		}
 
 		this.wm.Log.Debugf("balance: %v", addrBalance.Balance)
 		this.wm.Log.Debugf("%s fees: %v", sumRawTx.Coin.Symbol, fees)
 		this.wm.Log.Debugf("sumAmount: %v", sumAmount)
 
-		//创建一笔交易单
-		rawTx := &openwallet.RawTransaction{
-			Coin:    sumRawTx.Coin,
-			Account: sumRawTx.Account,
-			To: map[string]string{
-				sumRawTx.SummaryAddress: sumAmount.StringFixed(int32(tokenDecimals)),
-			},
-			Required: 1,
-		}
-
 		createTxErr := this.createRawTransaction(
 			wrapper,
 			rawTx,
@@ -1234,6 +1374,64 @@ func (this *EthTransactionDecoder) CreateErc20TokenSummaryRawTransaction(wrapper
 	return rawTxArray, nil
 }
 
+//createFeesSupportRawTransaction 创建从手续费地址向汇总地址转入主币的交易单。
+//创建成功后tmpNonce递增，手续费地址的余额扣除转账数量和手续费，需要手续费支持的地址会有很多个，nonce要连续递增以保证交易广播生效
+func (this *EthTransactionDecoder) createFeesSupportRawTransaction(
+	wrapper openwallet.WalletDAI,
+	sumRawTx *openwallet.SummaryRawTransaction,
+	feesSupportAccount *openwallet.AssetsAccount,
+	feesSupportAddress *AddrBalance,
+	to string,
+	amount decimal.Decimal,
+	tmpNonce *uint64) *openwallet.RawTransactionWithError {
+
+	supportCoin := openwallet.Coin{
+		Symbol:     sumRawTx.Coin.Symbol,
+		IsContract: false,
+	}
+
+	//创建一笔交易单
+	rawTx := &openwallet.RawTransaction{
+		Coin:    supportCoin,
+		Account: feesSupportAccount,
+		FeeRate: sumRawTx.FeeRate,
+		To: map[string]string{
+			to: amount.StringFixed(this.wm.Decimal()),
+		},
+		Required: 1,
+	}
+	rawTxWithErr := &openwallet.RawTransactionWithError{
+		RawTx: rawTx,
+	}
+
+	amount_BI, _ := ConvertEthStringToWei(amount.String())
+	fee, err := this.wm.GetTransactionFeeEstimated(feesSupportAddress.Address, to, amount_BI, "")
+	if err != nil {
+		rawTxWithErr.Error = openwallet.ConvertError(err)
+		return rawTxWithErr
+	}
+	if sumRawTx.FeeRate != "" {
+		fee.GasPrice, err = ConvertEthStringToWei(sumRawTx.FeeRate)
+		if err != nil {
+			rawTxWithErr.Error = openwallet.ConvertError(err)
+			return rawTxWithErr
+		}
+		fee.CalcFee()
+	}
+
+	createTxErr := this.createRawTransaction(wrapper, rawTx, feesSupportAddress, fee, "", tmpNonce)
+	if createTxErr != nil {
+		rawTxWithErr.Error = createTxErr
+		return rawTxWithErr
+	}
+
+	//扣除本次支出，余额不足时后续的手续费交易单返回错误
+	spent := new(big.Int).Add(amount_BI, fee.Fee)
+	feesSupportAddress.Balance = new(big.Int).Sub(feesSupportAddress.Balance, spent)
+	(*tmpNonce)++
+	return rawTxWithErr
+}
+
 //createRawTransaction
 func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, addrBalance *AddrBalance, fee *txFeeInfo, callData string, tmpNonce *uint64) *openwallet.Error {
 
@@ -1299,7 +1497,11 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 	rawTx.FeeRate = gasprice.String()
 	rawTx.Fees = totalFeeDecimal.String()
 	rawTx.ExtParam = string(extparastr)
-	rawTx.TxAmount = accountTotalSent.StringFixed(this.wm.Decimal())
+	if isContract {
+		rawTx.TxAmount = accountTotalSent.StringFixed(int32(tokenDecimals))
+	} else {
+		rawTx.TxAmount = accountTotalSent.StringFixed(this.wm.Decimal())
+	}
 	rawTx.TxFrom = txFrom
 	rawTx.TxTo = txTo
 
@@ -1308,23 +1510,16 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 		return openwallet.NewError(openwallet.ErrAccountNotAddress, err.Error())
 	}
 
-	var nonce uint64
-	if tmpNonce == nil {
-		_, txNonce, err := this.GetTransactionCount2(addrBalance.Address)
-		if err != nil {
-			this.wm.Log.Std.Error("GetTransactionCount2 failed, err=%v", err)
-			return openwallet.NewError(openwallet.ErrNonceInvaild, err.Error())
-		}
-		nonce = txNonce
-	} else {
-		nonce = *tmpNonce
-	}
-
 	//this.wm.Log.Debug("chainID:", this.wm.GetConfig().ChainID)
 	signer := types.NewEIP155Signer(big.NewInt(int64(this.wm.GetConfig().ChainID)))
 
 	gasLimit := fee.GasLimit.Uint64()
 
+	var (
+		toAddress ethcommon.Address
+		value     *big.Int
+		data      []byte
+	)
 	if isContract {
 		//构建合约交易
 		amount, _ := ConvertFloatStringToBigInt(amountStr, tokenDecimals)
@@ -1333,14 +1528,12 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 			//return openwallet.Errorf("the token balance: %s is not enough", amountStr)
 		}
 
-		//if addrBalance.Balance.Cmp(fee.Fee) < 0 {
-		//	coinBalance, _ := ConverWeiStringToEthDecimal(addrBalance.Balance.String())
-		//	return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
-		//	//return openwallet.Errorf("the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
-		//}
+		if addrBalance.Balance.Cmp(fee.Fee) < 0 {
+			coinBalance, _ := ConverWeiStringToEthDecimal(addrBalance.Balance.String())
+			return openwallet.Errorf(openwallet.ErrInsufficientFees, "the [%s] balance: %s is not enough to call smart contract", rawTx.Coin.Symbol, coinBalance)
+		}
 
-		tx = types.NewTransaction(nonce, ethcommon.HexToAddress(rawTx.Coin.Contract.Address),
-			big.NewInt(0), gasLimit, fee.GasPrice, ethcommon.FromHex(callData))
+		toAddress, value, data = ethcommon.HexToAddress(indexAddressKey(rawTx.Coin.Contract.Address)), big.NewInt(0), ethcommon.FromHex(callData)
 	} else {
 		//构建ETH交易
 		amount, _ := ConvertEthStringToWei(amountStr)
@@ -1352,10 +1545,36 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 			//return openwallet.Errorf("the [%s] balance: %s is not enough", rawTx.Coin.Symbol, amountStr)
 		}
 
-		tx = types.NewTransaction(nonce, ethcommon.HexToAddress(destination),
-			amount, gasLimit, fee.GasPrice, []byte(""))
+		//目标地址为FM格式，转为十六进制地址
+		to, err := ParseFMAddress(destination)
+		if err != nil {
+			return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "to address [%s] is invalid: %v", destination, err)
+		}
+		toAddress, value, data = to.Common(), amount, []byte("")
 	}
 
+	//余额检查通过后再分配nonce，使用本地nonce账本时忽略tmpNonce，同一地址连续创建的交易单nonce依次递增
+	var nonce uint64
+	if this.wm.Config.LocalNonce {
+		reserved, err := this.wm.ReserveNonce(addrBalance.Address)
+		if err != nil {
+			this.wm.Log.Std.Error("ReserveNonce failed, err=%v", err)
+			return openwallet.NewError(openwallet.ErrNonceInvaild, err.Error())
+		}
+		nonce = reserved
+	} else if tmpNonce == nil {
+		_, txNonce, err := this.GetTransactionCount2(addrBalance.Address)
+		if err != nil {
+			this.wm.Log.Std.Error("GetTransactionCount2 failed, err=%v", err)
+			return openwallet.NewError(openwallet.ErrNonceInvaild, err.Error())
+		}
+		nonce = txNonce
+	} else {
+		nonce = *tmpNonce
+	}
+
+	tx = types.NewTransaction(nonce, toAddress, value, gasLimit, fee.GasPrice, data)
+
 	rawHex, err := rlp.EncodeToBytes(tx)
 	if err != nil {
 		this.wm.Log.Error("Transaction RLP encode failed, err:", err)
@@ -1366,6 +1585,18 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 	this.wm.Log.Debug("**txStr:", string(txstr))
 	msg := signer.Hash(tx)
 
+	//预留的nonce绑定到这笔交易单，其他交易单不能用同一个预留广播
+	if this.wm.Config.LocalNonce {
+		err = this.wm.BindReservedNonce(addrBalance.Address, nonce, hex.EncodeToString(msg[:]))
+		if err != nil {
+			this.wm.Log.Std.Error("BindReservedNonce failed, err=%v", err)
+			if releaseErr := this.wm.ReleaseNonce(addrBalance.Address, nonce); releaseErr != nil {
+				this.wm.Log.Std.Error("ReleaseNonce failed, err=%v", releaseErr)
+			}
+			return openwallet.NewError(openwallet.ErrNonceInvaild, err.Error())
+		}
+	}
+
 	if rawTx.Signatures == nil {
 		rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
 	}
@@ -1389,19 +1620,14 @@ func (this *EthTransactionDecoder) createRawTransaction(wrapper openwallet.Walle
 func (this *EthTransactionDecoder) CreateSummaryRawTransactionWithError(
 	wrapper openwallet.WalletDAI,
 	sumRawTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransactionWithError, error) {
-	coin := openwallet.Coin{
-		Symbol:     sumRawTx.Account.Symbol,
-		IsContract: true,
-		ContractID: "",
-		Contract: openwallet.SmartContract{
-			ContractID: "",
-			Symbol:     Symbol,
-			Address:    CONTRACT_ADDRESS,
-			Name:       Symbol,
-			Decimals:   8,
-		},
+	coin, err := this.resolveCoin(coinActionSummary, sumRawTx.Coin, sumRawTx.Account.Symbol)
+	if err != nil {
+		return nil, err
 	}
 	sumRawTx.Coin = coin
+	if _, err := ParseFMAddress(sumRawTx.SummaryAddress); err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "summary address [%s] is invalid: %v", sumRawTx.SummaryAddress, err)
+	}
 	if sumRawTx.Coin.IsContract {
 		return this.CreateErc20TokenSummaryRawTransaction(wrapper, sumRawTx)
 	} else {
@@ -16,8 +16,19 @@
 package filememory
 
 import (
-	"github.com/tidwall/gjson"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strings"
 	"testing"
+
+	"github.com/Assetsadapter/filememory-adapter/filememory_txsigner"
+	"github.com/blocktree/go-owcrypt"
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tidwall/gjson"
 )
 
 func TestNewEthTxExtPara(t *testing.T) {
@@ -26,3 +37,376 @@ func TestNewEthTxExtPara(t *testing.T) {
 	t.Logf("extPara.GasLimit: %s\n", extPara.GasLimit)
 	t.Logf("extPara.Data: %s\n", extPara.Data)
 }
+
+const testSummaryAddress = "FM5555555555555555555555555555555555555555"
+
+//testSweepWallet 创建汇总测试的钱包：testDepositAddress有2.5 FM和3 USDT，testOtherAddress有1 USDT和只够手续费的0.01 FM
+func testSweepWallet(t *testing.T) (*WalletManager, *FakeNode, *testWalletDAI) {
+	wm, node := testNewFakeNodeWalletManager(t)
+	testHandleToken(node, testTokenAddress, "USDT", "Tether USD", 6, map[string]*big.Int{
+		fakeNodeKey(testDepositAddress): big.NewInt(3000000),
+		fakeNodeKey(testOtherAddress):   big.NewInt(1000000),
+	})
+	if _, err := wm.AddERC20Token(testTokenAddress); err != nil {
+		t.Fatalf("AddERC20Token failed, err=%v", err)
+	}
+	node.SetBalance(testDepositAddress, big.NewInt(250000000))
+	node.SetBalance(testOtherAddress, big.NewInt(1000000))
+	node.SetNonce(testDepositAddress, 7)
+
+	wrapper := &testWalletDAI{addresses: []*openwallet.Address{
+		{AccountID: "account", Address: testDepositAddress},
+		{AccountID: "account", Address: testOtherAddress},
+	}}
+	return wm, node, wrapper
+}
+
+func testSweep(coin openwallet.Coin, minTransfer string) *openwallet.SummaryRawTransaction {
+	return &openwallet.SummaryRawTransaction{
+		Coin:            coin,
+		Account:         &openwallet.AssetsAccount{AccountID: "account", Symbol: Symbol},
+		SummaryAddress:  testSummaryAddress,
+		MinTransfer:     minTransfer,
+		RetainedBalance: "0",
+		AddressLimit:    10,
+	}
+}
+
+//testDepositWallet 只从testDepositAddress转出的汇总测试钱包
+func testDepositWallet(t *testing.T) (*WalletManager, *FakeNode, *testWalletDAI) {
+	wm, node, wrapper := testSweepWallet(t)
+	wrapper.addresses = wrapper.addresses[:1]
+	return wm, node, wrapper
+}
+
+//testSignedRawTx 从testDepositAddress创建转到testSummaryAddress的交易单并签名，不广播
+func testSignedRawTx(t *testing.T, wm *WalletManager, wrapper openwallet.WalletDAI, coin openwallet.Coin, amount string) *openwallet.RawTransaction {
+	rawTx := &openwallet.RawTransaction{
+		Coin:    coin,
+		Account: &openwallet.AssetsAccount{AccountID: "account", Symbol: Symbol},
+		To:      map[string]string{testSummaryAddress: amount},
+	}
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateRawTransaction failed, err=%v", err)
+	}
+	testSignRawTx(t, rawTx)
+	return rawTx
+}
+
+//testCreateAndSubmit 从testDepositAddress创建并广播一笔交易
+func testCreateAndSubmit(t *testing.T, wm *WalletManager, wrapper openwallet.WalletDAI, coin openwallet.Coin, amount string) *openwallet.RawTransaction {
+	rawTx := testSignedRawTx(t, wm, wrapper, coin, amount)
+	testSubmitRawTx(t, wm, wrapper, rawTx)
+	return rawTx
+}
+
+//testSignAndSubmit 用固定私钥签名并广播交易单
+func testSignAndSubmit(t *testing.T, wm *WalletManager, wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) *openwallet.Transaction {
+	testSignRawTx(t, rawTx)
+	return testSubmitRawTx(t, wm, wrapper, rawTx)
+}
+
+//testSubmitRawTx 广播已签名的交易单
+func testSubmitRawTx(t *testing.T, wm *WalletManager, wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) *openwallet.Transaction {
+	tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("SubmitRawTransaction failed, err=%v", err)
+	}
+	return tx
+}
+
+//testSignRawTx 用固定私钥签名交易单，testDepositAddress和testOtherAddress分别对应私钥0x01...01和0x02...02
+func testSignRawTx(t *testing.T, rawTx *openwallet.RawTransaction) {
+	for _, keySig := range rawTx.Signatures[rawTx.Account.AccountID] {
+		key := ethcommon.FromHex("0x" + strings.Repeat("01", 32))
+		if fakeNodeKey(keySig.Address.Address) == fakeNodeKey(testOtherAddress) {
+			key = ethcommon.FromHex("0x" + strings.Repeat("02", 32))
+		}
+		msg, _ := hex.DecodeString(keySig.Message)
+		sig, err := filememory_txsigner.Default.SignTransactionHash(msg, key, owcrypt.ECC_CURVE_SECP256K1)
+		if err != nil {
+			t.Fatalf("sign raw tx failed, err=%v", err)
+		}
+		keySig.Signature = hex.EncodeToString(sig)
+	}
+}
+
+//testDecodeRawTx 解析交易单的未签名交易
+func testDecodeRawTx(t *testing.T, rawHex string) *types.Transaction {
+	data, _ := hex.DecodeString(rawHex)
+	tx := &types.Transaction{}
+	if err := rlp.DecodeBytes(data, tx); err != nil {
+		t.Fatalf("decode raw tx failed, err=%v", err)
+	}
+	return tx
+}
+
+func TestEthTransactionDecoder_NativeSweep(t *testing.T) {
+	wm, node, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	rawTxs, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, testSweep(openwallet.Coin{Symbol: Symbol}, "0.1"))
+	if err != nil {
+		t.Fatalf("CreateSummaryRawTransactionWithError failed, err=%v", err)
+	}
+	if len(rawTxs) != 1 || rawTxs[0].Error != nil {
+		t.Fatalf("native sweep should create 1 raw tx, got %d", len(rawTxs))
+	}
+
+	//手续费 = 50000 * 18 = 0.009
+	rawTx := rawTxs[0].RawTx
+	if rawTx.Coin.IsContract || rawTx.To[testSummaryAddress] != "2.49100000" {
+		t.Errorf("native sweep raw tx: contract=%v, to=%v", rawTx.Coin.IsContract, rawTx.To)
+	}
+	tx := testDecodeRawTx(t, rawTx.RawHex)
+	if *tx.To() != ethcommon.HexToAddress(indexAddressKey(testSummaryAddress)) || tx.Value().Int64() != 249100000 || len(tx.Data()) != 0 || tx.Nonce() != 7 {
+		t.Errorf("native sweep tx: to=%v, value=%v, data=%x, nonce=%d", tx.To(), tx.Value(), tx.Data(), tx.Nonce())
+	}
+
+	submitted := testSignAndSubmit(t, wm, wrapper, rawTx)
+	if submitted.Coin.IsContract || submitted.Decimal != 8 || len(node.Pushed()) != 1 {
+		t.Errorf("submitted native sweep: contract=%v, decimal=%d, pushed=%d", submitted.Coin.IsContract, submitted.Decimal, len(node.Pushed()))
+	}
+}
+
+func TestEthTransactionDecoder_TokenSweep(t *testing.T) {
+	wm, node, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	coin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	rawTxs, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, testSweep(coin, "0.5"))
+	if err != nil {
+		t.Fatalf("CreateSummaryRawTransactionWithError failed, err=%v", err)
+	}
+	if len(rawTxs) != 2 {
+		t.Fatalf("token sweep should create 2 raw txs, got %d", len(rawTxs))
+	}
+
+	want := map[string]int64{
+		testDepositAddress: 3000000,
+		testOtherAddress:   1000000,
+	}
+	for _, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.Error != nil {
+			t.Fatalf("token sweep raw tx failed, err=%v", rawTxWithErr.Error)
+		}
+		rawTx := rawTxWithErr.RawTx
+		from := rawTx.Signatures["account"][0].Address.Address
+		if !rawTx.Coin.IsContract || rawTx.Coin.Contract.Decimals != 6 {
+			t.Errorf("token sweep coin = %+v", rawTx.Coin)
+		}
+		tx := testDecodeRawTx(t, rawTx.RawHex)
+		data, _ := makeERC20TokenTransData(testTokenAddress, testSummaryAddress, big.NewInt(want[from]))
+		if *tx.To() != ethcommon.HexToAddress(testTokenAddress) || tx.Value().Sign() != 0 || ethcommon.ToHex(tx.Data()) != data {
+			t.Errorf("token sweep tx from %s: to=%v, value=%v, data=%x", from, tx.To(), tx.Value(), tx.Data())
+		}
+
+		submitted := testSignAndSubmit(t, wm, wrapper, rawTx)
+		if !submitted.Coin.IsContract || submitted.Decimal != 6 {
+			t.Errorf("submitted token sweep: contract=%v, decimal=%d", submitted.Coin.IsContract, submitted.Decimal)
+		}
+	}
+	if len(node.Pushed()) != 2 {
+		t.Errorf("pushed = %d, want 2", len(node.Pushed()))
+	}
+}
+
+func TestEthTransactionDecoder_MixedSweep(t *testing.T) {
+	wm, node, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	//先汇总代币，再汇总主币，同一地址的nonce连续
+	tokenCoin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	rawTxs, err := wm.TxDecoder.CreateSummaryRawTransaction(wrapper, testSweep(tokenCoin, "0.5"))
+	if err != nil || len(rawTxs) != 2 {
+		t.Fatalf("token sweep should create 2 raw txs, got %d, err=%v", len(rawTxs), err)
+	}
+	for _, rawTx := range rawTxs {
+		testSignAndSubmit(t, wm, wrapper, rawTx)
+	}
+
+	rawTxs, err = wm.TxDecoder.CreateSummaryRawTransaction(wrapper, testSweep(openwallet.Coin{Symbol: Symbol}, "0.1"))
+	if err != nil || len(rawTxs) != 1 {
+		t.Fatalf("native sweep should create 1 raw tx, got %d, err=%v", len(rawTxs), err)
+	}
+	if tx := testDecodeRawTx(t, rawTxs[0].RawHex); tx.Nonce() != 8 || tx.Value().Int64() != 249100000 {
+		t.Errorf("native sweep after token sweep: nonce=%d, value=%v; want 8, 249100000", tx.Nonce(), tx.Value())
+	}
+	testSignAndSubmit(t, wm, wrapper, rawTxs[0])
+
+	pushed := node.Pushed()
+	if len(pushed) != 3 {
+		t.Fatalf("pushed = %d, want 3", len(pushed))
+	}
+	contracts := 0
+	for _, raw := range pushed {
+		tx := testDecodeRawTx(t, strings.TrimPrefix(raw, "0x"))
+		if *tx.To() == ethcommon.HexToAddress(testTokenAddress) {
+			contracts++
+		}
+	}
+	if contracts != 2 {
+		t.Errorf("pushed token transfers = %d, want 2", contracts)
+	}
+}
+
+func TestEthTransactionDecoder_UnsupportedCoin(t *testing.T) {
+	wm, _, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	if err := wm.DisableERC20Token(testTokenAddress); err != nil {
+		t.Fatalf("DisableERC20Token failed, err=%v", err)
+	}
+
+	tests := []struct {
+		name string
+		coin openwallet.Coin
+		kind error
+	}{
+		{"native with contract", openwallet.Coin{Symbol: Symbol, Contract: openwallet.SmartContract{Address: testTokenAddress}}, ErrUnexpectedContract},
+		{"token without contract", openwallet.Coin{Symbol: Symbol, IsContract: true}, ErrContractRequired},
+		{"other symbol", openwallet.Coin{Symbol: "ETH"}, ErrUnsupportedCoin},
+		{"other protocol", openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress, Protocol: "ERC721"}}, ErrUnsupportedCoin},
+	}
+	for _, test := range tests {
+		_, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, testSweep(test.coin, "0.1"))
+		if modeErr, ok := err.(*CoinModeError); !ok || !modeErr.Is(test.kind) || modeErr.Action != "summary" {
+			t.Errorf("%s: summary err = %v, want %v", test.name, err, test.kind)
+		}
+		rawTx := &openwallet.RawTransaction{
+			Coin:    test.coin,
+			Account: &openwallet.AssetsAccount{AccountID: "account", Symbol: Symbol},
+			To:      map[string]string{testSummaryAddress: "0.1"},
+		}
+		err = wm.TxDecoder.CreateRawTransaction(wrapper, rawTx)
+		if modeErr, ok := err.(*CoinModeError); !ok || modeErr.Kind != test.kind || modeErr.Action != "create" {
+			t.Errorf("%s: create err = %v, want %v", test.name, err, test.kind)
+		}
+	}
+
+	coin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	_, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, testSweep(coin, "0.1"))
+	if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrContractNotFound {
+		t.Errorf("disabled token: summary err = %v, want ErrContractNotFound", err)
+	}
+}
+
+func TestEthTransactionDecoder_TokenSweep_InsufficientFees(t *testing.T) {
+	wm, node, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	node.SetBalance(testOtherAddress, big.NewInt(0))
+
+	coin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	rawTxs, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, testSweep(coin, "0.5"))
+	if err != nil || len(rawTxs) != 2 {
+		t.Fatalf("token sweep should return 2 entries, got %d, err=%v", len(rawTxs), err)
+	}
+	failed := 0
+	for _, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.Error == nil {
+			continue
+		}
+		failed++
+		if rawTxWithErr.Error.Code() != openwallet.ErrInsufficientFees || rawTxWithErr.RawTx.IsBuilt {
+			t.Errorf("address without fees: err=%v, built=%v", rawTxWithErr.Error, rawTxWithErr.RawTx.IsBuilt)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("failed entries = %d, want 1", failed)
+	}
+}
+
+func TestEthTransactionDecoder_TokenSweep_FeesSupport(t *testing.T) {
+	wm, node, wrapper := testSweepWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	const (
+		thirdAddress   = "FMcccccccccccccccccccccccccccccccccccccccc"
+		supportAddress = "FMdddddddddddddddddddddddddddddddddddddddd"
+	)
+	//两个地址只有代币没有主币，手续费地址有0.03 FM，只够支持一次（0.0135 + 手续费0.009）
+	node.SetBalance(testOtherAddress, big.NewInt(0))
+	node.SetBalance(supportAddress, big.NewInt(3000000))
+	node.SetNonce(supportAddress, 3)
+	testHandleToken(node, testTokenAddress, "USDT", "Tether USD", 6, map[string]*big.Int{
+		fakeNodeKey(testDepositAddress): big.NewInt(3000000),
+		fakeNodeKey(testOtherAddress):   big.NewInt(1000000),
+		fakeNodeKey(thirdAddress):       big.NewInt(2000000),
+	})
+	wrapper.addresses = append(wrapper.addresses,
+		&openwallet.Address{AccountID: "account", Address: thirdAddress},
+		&openwallet.Address{AccountID: "support", Address: supportAddress},
+	)
+	wrapper.accounts = []*openwallet.AssetsAccount{{AccountID: "support", Symbol: Symbol}}
+
+	coin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	sweep := testSweep(coin, "0.5")
+	sweep.FeesSupportAccount = &openwallet.FeesSupportAccount{AccountID: "support", FeesSupportScale: "1.5"}
+	rawTxs, err := wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, sweep)
+	if err != nil || len(rawTxs) != 3 {
+		t.Fatalf("token sweep should return 3 entries, got %d, err=%v", len(rawTxs), err)
+	}
+
+	var sweeps, supports, failed int
+	for _, rawTxWithErr := range rawTxs {
+		rawTx := rawTxWithErr.RawTx
+		if rawTx.Account.AccountID != "support" {
+			if rawTxWithErr.Error != nil || !rawTx.Coin.IsContract {
+				t.Errorf("sweep entry: err=%v, coin=%+v", rawTxWithErr.Error, rawTx.Coin)
+			}
+			if from := rawTx.Signatures["account"][0].Address.Address; from != testDepositAddress {
+				t.Errorf("only %s has fees to sweep, got %s", testDepositAddress, from)
+			}
+			sweeps++
+			continue
+		}
+		if rawTx.Coin.IsContract {
+			t.Errorf("fees support tx should transfer native coin")
+		}
+		if rawTxWithErr.Error != nil {
+			if rawTxWithErr.Error.Code() != openwallet.ErrInsufficientFees {
+				t.Errorf("fees support tx err = %v, want ErrInsufficientFees", rawTxWithErr.Error)
+			}
+			failed++
+			continue
+		}
+		//支持数量 = 手续费0.009 * 1.5
+		tx := testDecodeRawTx(t, rawTx.RawHex)
+		if tx.Nonce() != 3 || tx.Value().Int64() != 1350000 {
+			t.Errorf("fees support tx: nonce=%d, value=%v; want 3, 1350000", tx.Nonce(), tx.Value())
+		}
+		if rawTx.Signatures["support"][0].Address.Address != supportAddress {
+			t.Errorf("fees support tx should be sent from %s", supportAddress)
+		}
+		supports++
+	}
+	if sweeps != 1 || supports != 1 || failed != 1 {
+		t.Errorf("sweeps=%d, supports=%d, failed=%d; want 1, 1, 1", sweeps, supports, failed)
+	}
+
+	//放弃第一批交易单，释放预留的nonce；手续费地址余额充足时nonce连续递增
+	for _, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.Error == nil {
+			if err := wm.TxDecoder.(*EthTransactionDecoder).ReleaseRawTransactionNonce(rawTxWithErr.RawTx); err != nil {
+				t.Fatalf("ReleaseRawTransactionNonce failed, err=%v", err)
+			}
+		}
+	}
+	node.SetBalance(supportAddress, big.NewInt(100000000))
+	rawTxs, err = wm.TxDecoder.CreateSummaryRawTransactionWithError(wrapper, sweep)
+	if err != nil {
+		t.Fatalf("CreateSummaryRawTransactionWithError failed, err=%v", err)
+	}
+	nonces := make(map[uint64]bool)
+	for _, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.RawTx.Account.AccountID != "support" {
+			continue
+		}
+		if rawTxWithErr.Error != nil {
+			t.Fatalf("fees support tx failed, err=%v", rawTxWithErr.Error)
+		}
+		nonces[testDecodeRawTx(t, rawTxWithErr.RawTx.RawHex).Nonce()] = true
+	}
+	if len(nonces) != 2 || !nonces[3] || !nonces[4] {
+		t.Errorf("fees support nonces = %v, want 3 and 4", nonces)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/shopspring/decimal"
+	"github.com/tidwall/gjson"
+)
+
+//已广播的交易保存签名后的交易，用于加速和取消还没有打包的交易。
+//加速使用相同的nonce和交易内容、更高的gasPrice重新创建交易单；取消用相同的nonce转给自己0个主币。
+//新交易单通过SignRawTransaction、SubmitRawTransaction签名广播，同一nonce的交易只有一笔会被打包，
+//ConfirmedReplacement查询最终打包的交易
+
+//SENT_TX_DB 已广播交易的数据库文件名
+const SENT_TX_DB = "sent_tx.db"
+
+//REPLACE_GAS_PRICE_BUMP 替换交易的gasPrice至少比原交易高的百分比，低于该比例节点不接受替换
+const REPLACE_GAS_PRICE_BUMP = 10
+
+//交易的类型
+const (
+	SentTxNormal  = "normal"
+	SentTxSpeedUp = "speedup"
+	SentTxCancel  = "cancel"
+)
+
+//SentTransaction 已广播的交易
+type SentTransaction struct {
+	TxID        string `storm:"id"`
+	AddressKey  string `storm:"index"`
+	Nonce       uint64
+	AccountID   string
+	Coin        openwallet.Coin
+	Kind        string
+	SignedHex   string //签名后的交易
+	ReplaceTxID string //替换的交易
+	ReplacedBy  string //被哪笔交易替换
+	SubmitTime  int64  //广播时间，单位纳秒
+
+	Status        string                  `storm:"index"` //交易状态，见SentTxPending等
+	BlockHeight   uint64                  //打包的区块高度
+	BlockHash     string                  //打包的区块哈希
+	Confirmations int64                   //确认数
+	UpdateTime    int64                   //状态更新时间
+	Transaction   *openwallet.Transaction //广播成功时返回的交易记录
+}
+
+//openSentTxDB 打开已广播交易的数据库
+func (this *WalletManager) openSentTxDB() (*storm.DB, error) {
+	return OpenDB(this.Config.DbPath, SENT_TX_DB)
+}
+
+//saveSentTransaction 记录已广播的交易，替换交易同时更新原交易的ReplacedBy
+func (this *WalletManager) saveSentTransaction(sent *SentTransaction) error {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbTx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	err = dbTx.Save(sent)
+	if err != nil {
+		return err
+	}
+	if sent.ReplaceTxID != "" {
+		err = dbTx.UpdateField(&SentTransaction{TxID: sent.ReplaceTxID}, "ReplacedBy", sent.TxID)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return dbTx.Commit()
+}
+
+//GetSentTransaction 获取已广播的交易，不存在时返回storm.ErrNotFound
+func (this *WalletManager) GetSentTransaction(txid string) (*SentTransaction, error) {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var sent SentTransaction
+	err = db.One("TxID", txid, &sent)
+	if err != nil {
+		return nil, err
+	}
+	return &sent, nil
+}
+
+//GetSentTransactionsByNonce 地址使用同一nonce广播的所有交易，按广播时间排列
+func (this *WalletManager) GetSentTransactionsByNonce(address string, nonce uint64) ([]*SentTransaction, error) {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var all []*SentTransaction
+	err = db.Find("AddressKey", indexAddressKey(address), &all)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	list := make([]*SentTransaction, 0)
+	for _, sent := range all {
+		if sent.Nonce == nonce {
+			list = append(list, sent)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].SubmitTime < list[j].SubmitTime
+	})
+	return list, nil
+}
+
+//checkReplaceable 检查交易是否可以被替换：已记录、发送地址和nonce一致、没有被替换过、还没有打包
+func (this *WalletManager) checkReplaceable(txid string, address string, nonce uint64) (*SentTransaction, error) {
+	sent, err := this.GetSentTransaction(txid)
+	if err != nil {
+		return nil, fmt.Errorf("transaction %s is not sent by this wallet", txid)
+	}
+	if address != "" && (indexAddressKey(address) != sent.AddressKey || nonce != sent.Nonce) {
+		return nil, fmt.Errorf("replacement of transaction %s must use the same address and nonce", txid)
+	}
+	if sent.ReplacedBy != "" {
+		return nil, fmt.Errorf("transaction %s has been replaced by %s", txid, sent.ReplacedBy)
+	}
+	chainNonce, err := this.WalletClient.fmGetTransactionCount(AppendFmToAddress(sent.AddressKey))
+	if err != nil {
+		return nil, err
+	}
+	if chainNonce > sent.Nonce {
+		return nil, fmt.Errorf("nonce %d of transaction %s has been confirmed", sent.Nonce, txid)
+	}
+	return sent, nil
+}
+
+//ConfirmedReplacement 查询与txid使用同一nonce的交易中最终打包的交易，都没有打包时返回空
+func (this *WalletManager) ConfirmedReplacement(txid string) (string, error) {
+	sent, err := this.GetSentTransaction(txid)
+	if err != nil {
+		return "", err
+	}
+	list, err := this.GetSentTransactionsByNonce(AppendFmToAddress(sent.AddressKey), sent.Nonce)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range list {
+		_, err := this.WalletClient.EthGetTransactionReceipt(s.TxID)
+		if err == nil {
+			return s.TxID, nil
+		}
+		if !IsGatewayError(err, ErrUnknownTx) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+//replaceGasPrice 替换交易的gasPrice，取调用方指定、手续费策略和原交易加价后的最大值
+func (this *EthTransactionDecoder) replaceGasPrice(old *big.Int, feeRate string) (*big.Int, error) {
+	price, err := this.wm.GetGasPrice()
+	if err != nil {
+		return nil, err
+	}
+	if feeRate != "" {
+		rate, err := ConvertEthStringToWei(feeRate)
+		if err != nil {
+			return nil, err
+		}
+		if rate.Cmp(price) > 0 {
+			price = rate
+		}
+	}
+	bumped := new(big.Int).Mul(old, big.NewInt(100+REPLACE_GAS_PRICE_BUMP))
+	bumped.Add(bumped, big.NewInt(99))
+	bumped.Div(bumped, big.NewInt(100))
+	if bumped.Cmp(old) <= 0 {
+		bumped = new(big.Int).Add(old, big.NewInt(1))
+	}
+	if bumped.Cmp(price) > 0 {
+		price = bumped
+	}
+	return price, nil
+}
+
+//CreateSpeedUpRawTransaction 用相同的nonce和交易内容、更高的gasPrice重新创建交易单，feeRate为空时按原交易加价
+func (this *EthTransactionDecoder) CreateSpeedUpRawTransaction(wrapper openwallet.WalletDAI, txid string, feeRate string) (*openwallet.RawTransaction, error) {
+	return this.createReplaceRawTransaction(wrapper, txid, feeRate, SentTxSpeedUp)
+}
+
+//CreateCancelRawTransaction 用相同的nonce、更高的gasPrice创建转给自己0个主币的交易单，打包后原交易失效
+func (this *EthTransactionDecoder) CreateCancelRawTransaction(wrapper openwallet.WalletDAI, txid string, feeRate string) (*openwallet.RawTransaction, error) {
+	return this.createReplaceRawTransaction(wrapper, txid, feeRate, SentTxCancel)
+}
+
+func (this *EthTransactionDecoder) createReplaceRawTransaction(wrapper openwallet.WalletDAI, txid string, feeRate string, kind string) (*openwallet.RawTransaction, error) {
+	sent, err := this.wm.checkReplaceable(txid, "", 0)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrNonceInvaild, err.Error())
+	}
+
+	old := &types.Transaction{}
+	err = rlp.DecodeBytes(ethcommon.FromHex(sent.SignedHex), old)
+	if err != nil {
+		return nil, openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "decode transaction %s failed, err=%v", txid, err)
+	}
+
+	from := AppendFmToAddress(sent.AddressKey)
+	addr, err := wrapper.GetAddress(from)
+	if err != nil {
+		return nil, openwallet.NewError(openwallet.ErrAddressNotFound, err.Error())
+	}
+
+	gasPrice, err := this.replaceGasPrice(old.GasPrice(), feeRate)
+	if err != nil {
+		return nil, openwallet.ConvertError(err)
+	}
+
+	var (
+		tx     *types.Transaction
+		coin   = sent.Coin
+		to     string
+		amount string
+	)
+	if kind == SentTxCancel {
+		fee, err := this.wm.GetTransactionFeeEstimated(from, from, big.NewInt(0), "")
+		if err != nil {
+			return nil, openwallet.ConvertError(err)
+		}
+		coin = openwallet.Coin{Symbol: sent.Coin.Symbol}
+		to, amount = from, "0"
+		tx = types.NewTransaction(old.Nonce(), ethcommon.HexToAddress(sent.AddressKey), big.NewInt(0), fee.GasLimit.Uint64(), gasPrice, []byte(""))
+	} else {
+		tx = types.NewTransaction(old.Nonce(), *old.To(), old.Value(), old.Gas(), gasPrice, old.Data())
+		to, amount = replaceTxTarget(old, sent.Coin)
+	}
+
+	fee := &txFeeInfo{GasLimit: new(big.Int).SetUint64(tx.Gas()), GasPrice: gasPrice}
+	fee.CalcFee()
+	fees, _ := ConverWeiStringToEthDecimal(fee.Fee.String())
+	rate, _ := ConverWeiStringToEthDecimal(gasPrice.String())
+	gasLimit, _ := ConverWeiStringToEthDecimal(fee.GasLimit.String())
+	extpara, _ := json.Marshal(EthTxExtPara{GasLimit: gasLimit.String(), ReplaceTxID: txid, ReplaceKind: kind})
+
+	rawHex, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		return nil, openwallet.ConvertError(err)
+	}
+	signer := types.NewEIP155Signer(big.NewInt(int64(this.wm.GetConfig().ChainID)))
+	msg := signer.Hash(tx)
+
+	rawTx := &openwallet.RawTransaction{
+		Coin:     coin,
+		Account:  &openwallet.AssetsAccount{AccountID: sent.AccountID, Symbol: sent.Coin.Symbol},
+		To:       map[string]string{to: amount},
+		FeeRate:  rate.String(),
+		Fees:     fees.String(),
+		ExtParam: string(extpara),
+		RawHex:   hex.EncodeToString(rawHex),
+		TxFrom:   []string{fmt.Sprintf("%s:%s", from, amount)},
+		TxTo:     []string{fmt.Sprintf("%s:%s", to, amount)},
+		TxAmount: "-" + amount,
+		Required: 1,
+		IsBuilt:  true,
+		Signatures: map[string][]*openwallet.KeySignature{
+			sent.AccountID: {{
+				EccType: this.wm.Config.CurveType,
+				Nonce:   "0x" + strconv.FormatUint(tx.Nonce(), 16),
+				Address: addr,
+				Message: hex.EncodeToString(msg[:]),
+			}},
+		},
+	}
+	if amount == "0" {
+		rawTx.TxAmount = "0"
+	}
+	return rawTx, nil
+}
+
+//replaceTxTarget 原交易的接收地址和数量，合约交易从转账数据中解析
+func replaceTxTarget(tx *types.Transaction, coin openwallet.Coin) (string, string) {
+	if coin.IsContract {
+		data := hex.EncodeToString(tx.Data())
+		if len(data) >= 136 && data[:8] == removeOxFromHex(ETH_TRANSFER_TOKEN_BALANCE_METHOD) {
+			to := ReplaceFmToAddress(data[32:72])
+			value, _ := new(big.Int).SetString(data[72:136], 16)
+			if value == nil {
+				value = big.NewInt(0)
+			}
+			amount := decimal.NewFromBigInt(value, -int32(coin.Contract.Decimals))
+			return to, amount.String()
+		}
+	}
+	amount, _ := ConverWeiStringToEthDecimal(tx.Value().String())
+	return ReplaceFmToAddress(indexAddressKey(tx.To().Hex())), amount.String()
+}
+
+//replaceParaOf 交易单替换的交易和替换类型，不是替换交易时返回空
+func replaceParaOf(rawTx *openwallet.RawTransaction) (string, string) {
+	if rawTx.ExtParam == "" {
+		return "", SentTxNormal
+	}
+	para := NewEthTxExtPara(gjson.Parse(rawTx.ExtParam))
+	if para.ReplaceTxID == "" {
+		return "", SentTxNormal
+	}
+	return para.ReplaceTxID, para.ReplaceKind
+}
+
+//recordSentTransaction 广播成功后记录交易
+func (this *EthTransactionDecoder) recordSentTransaction(rawTx *openwallet.RawTransaction, address string, nonce uint64, txid string, signedHex string) {
+	replaceTxID, kind := replaceParaOf(rawTx)
+	err := this.wm.saveSentTransaction(&SentTransaction{
+		TxID:        txid,
+		AddressKey:  indexAddressKey(address),
+		Nonce:       nonce,
+		AccountID:   rawTx.Account.AccountID,
+		Coin:        rawTx.Coin,
+		Kind:        kind,
+		SignedHex:   signedHex,
+		ReplaceTxID: replaceTxID,
+		SubmitTime:  time.Now().UnixNano(),
+		Status:      SentTxPending,
+		UpdateTime:  time.Now().Unix(),
+		Transaction: this.submittedTransaction(rawTx),
+	})
+	if err != nil {
+		this.wm.Log.Errorf("save sent transaction %s failed, err=%v", txid, err)
+	}
+}
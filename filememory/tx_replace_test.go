@@ -0,0 +1,146 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"os"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+)
+
+func testReplaceDecoder(wm *WalletManager) *EthTransactionDecoder {
+	return wm.TxDecoder.(*EthTransactionDecoder)
+}
+
+func TestEthTransactionDecoder_SpeedUpAndCancel(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	decoder := testReplaceDecoder(wm)
+
+	original := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	origTx := testDecodeRawTx(t, original.RawHex)
+
+	//加速：相同的nonce和内容，gasPrice至少提高10%
+	speedUp, err := decoder.CreateSpeedUpRawTransaction(wrapper, original.TxID, "")
+	if err != nil {
+		t.Fatalf("CreateSpeedUpRawTransaction failed, err=%v", err)
+	}
+	tx := testDecodeRawTx(t, speedUp.RawHex)
+	if tx.Nonce() != 7 || *tx.To() != *origTx.To() || tx.Value().Cmp(origTx.Value()) != 0 || tx.GasPrice().Int64() != 20 {
+		t.Errorf("speed up tx: nonce=%d, to=%s, value=%v, gasPrice=%v", tx.Nonce(), tx.To().Hex(), tx.Value(), tx.GasPrice())
+	}
+	if speedUp.To[testSummaryAddress] != "0.1" {
+		t.Errorf("speed up to = %v, want %s:0.1", speedUp.To, testSummaryAddress)
+	}
+	testSignAndSubmit(t, wm, wrapper, speedUp)
+	if speedUp.TxID == original.TxID {
+		t.Fatalf("speed up should have a new txid")
+	}
+
+	sent, err := wm.GetSentTransaction(original.TxID)
+	if err != nil || sent.ReplacedBy != speedUp.TxID {
+		t.Errorf("original replaced by = %+v, err=%v; want %s", sent, err, speedUp.TxID)
+	}
+	records, _ := wm.GetNonceRecords(testDepositAddress)
+	if len(records) != 1 || records[0].TxID != speedUp.TxID {
+		t.Errorf("nonce records = %+v, want nonce 7 submitted by speed up", records)
+	}
+
+	//被替换的交易不能再次替换
+	if _, err := decoder.CreateSpeedUpRawTransaction(wrapper, original.TxID, ""); err == nil {
+		t.Errorf("speed up a replaced tx should fail")
+	}
+
+	//取消：转给自己0个主币，使用指定的更高费率
+	cancel, err := decoder.CreateCancelRawTransaction(wrapper, speedUp.TxID, "0.0000005")
+	if err != nil {
+		t.Fatalf("CreateCancelRawTransaction failed, err=%v", err)
+	}
+	tx = testDecodeRawTx(t, cancel.RawHex)
+	self := ethcommon.HexToAddress(indexAddressKey(testDepositAddress))
+	if tx.Nonce() != 7 || *tx.To() != self || tx.Value().Sign() != 0 || len(tx.Data()) != 0 || tx.GasPrice().Int64() != 50 {
+		t.Errorf("cancel tx: nonce=%d, to=%s, value=%v, gasPrice=%v", tx.Nonce(), tx.To().Hex(), tx.Value(), tx.GasPrice())
+	}
+	testSignAndSubmit(t, wm, wrapper, cancel)
+	if sent, _ := wm.GetSentTransaction(cancel.TxID); sent == nil || sent.Kind != SentTxCancel || sent.ReplaceTxID != speedUp.TxID {
+		t.Errorf("cancel record = %+v", sent)
+	}
+
+	//查询最终打包的交易
+	if confirmed, err := wm.ConfirmedReplacement(original.TxID); err != nil || confirmed != "" {
+		t.Errorf("confirmed = %q, err=%v; want none", confirmed, err)
+	}
+	node.SetReceipt(cancel.TxID, &EthTransactionReceipt{})
+	node.SetNonce(testDepositAddress, 8)
+	for _, txid := range []string{original.TxID, speedUp.TxID, cancel.TxID} {
+		if confirmed, err := wm.ConfirmedReplacement(txid); err != nil || confirmed != cancel.TxID {
+			t.Errorf("confirmed of %s = %q, err=%v; want %s", txid, confirmed, err, cancel.TxID)
+		}
+	}
+
+	//已打包的nonce不能替换
+	if _, err := decoder.CreateSpeedUpRawTransaction(wrapper, cancel.TxID, ""); err == nil {
+		t.Errorf("speed up a confirmed tx should fail")
+	}
+	if len(node.Pushed()) != 3 {
+		t.Errorf("pushed %d txs, want 3", len(node.Pushed()))
+	}
+}
+
+func TestEthTransactionDecoder_SpeedUp_Token(t *testing.T) {
+	wm, _, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	coin := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+	original := testCreateAndSubmit(t, wm, wrapper, coin, "1.5")
+
+	speedUp, err := testReplaceDecoder(wm).CreateSpeedUpRawTransaction(wrapper, original.TxID, "")
+	if err != nil {
+		t.Fatalf("CreateSpeedUpRawTransaction failed, err=%v", err)
+	}
+	origTx, tx := testDecodeRawTx(t, original.RawHex), testDecodeRawTx(t, speedUp.RawHex)
+	if ethcommon.ToHex(tx.Data()) != ethcommon.ToHex(origTx.Data()) || *tx.To() != ethcommon.HexToAddress(testTokenAddress) {
+		t.Errorf("token speed up should keep the contract call")
+	}
+	if !speedUp.Coin.IsContract || speedUp.To[testSummaryAddress] != "1.5" {
+		t.Errorf("token speed up: coin=%+v, to=%v", speedUp.Coin, speedUp.To)
+	}
+	submitted := testSignAndSubmit(t, wm, wrapper, speedUp)
+	if !submitted.Coin.IsContract || submitted.Decimal != 6 {
+		t.Errorf("submitted token speed up: contract=%v, decimal=%d", submitted.Coin.IsContract, submitted.Decimal)
+	}
+}
+
+func TestEthTransactionDecoder_SpeedUp_WithoutLedger(t *testing.T) {
+	wm, _, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	wm.Config.LocalNonce = false
+
+	original := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	speedUp, err := testReplaceDecoder(wm).CreateSpeedUpRawTransaction(wrapper, original.TxID, "")
+	if err != nil {
+		t.Fatalf("CreateSpeedUpRawTransaction failed, err=%v", err)
+	}
+	testSignAndSubmit(t, wm, wrapper, speedUp)
+
+	//替换交易不占用新的nonce
+	next := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	if nonce := testDecodeRawTx(t, next.RawHex).Nonce(); nonce != 8 {
+		t.Errorf("next nonce = %d, want 8", nonce)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//广播前在本地由签名后的交易计算交易哈希，并以哈希为键保存广播记录。
+//网关超时后重试时，节点返回already known等重复交易错误视为广播成功，返回同一个txid；
+//已广播成功的交易再次提交不会重复广播，直接返回原交易记录
+
+//SubmitRecord 交易的广播记录，与已广播交易保存在同一个数据库
+type SubmitRecord struct {
+	TxID       string `storm:"id"`
+	AddressKey string `storm:"index"`
+	Nonce      uint64
+	SignedHex  string
+	Attempts   int    //广播次数
+	Accepted   bool   //网关是否已接受
+	LastError  string //最近一次广播失败的原因
+	CreateTime int64
+	UpdateTime int64
+}
+
+//GetSubmitRecord 查询交易的广播记录
+func (this *WalletManager) GetSubmitRecord(txid string) (*SubmitRecord, error) {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var record SubmitRecord
+	err = db.One("TxID", txid, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+//GetSubmitRecords 查询地址的所有广播记录，包括还没有被网关接受的
+func (this *WalletManager) GetSubmitRecords(address string) ([]*SubmitRecord, error) {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var records []*SubmitRecord
+	err = db.Find("AddressKey", indexAddressKey(address), &records)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return records, nil
+}
+
+//saveSubmitRecord 保存广播记录
+func (this *WalletManager) saveSubmitRecord(record *SubmitRecord) error {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	record.UpdateTime = time.Now().Unix()
+	return db.Save(record)
+}
+
+//beginSubmit 广播前保存广播记录，已有记录时累加广播次数
+func (this *WalletManager) beginSubmit(address string, nonce uint64, txid string, signedHex string) (*SubmitRecord, error) {
+	record, err := this.GetSubmitRecord(txid)
+	if err != nil {
+		record = &SubmitRecord{
+			TxID:       txid,
+			AddressKey: indexAddressKey(address),
+			Nonce:      nonce,
+			SignedHex:  signedHex,
+			CreateTime: time.Now().Unix(),
+		}
+	}
+	record.Attempts++
+	err = this.saveSubmitRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//broadcastSignedTransaction 广播签名后的交易，txid为本地计算的交易哈希。
+//网关返回重复交易错误，或返回nonce过低而节点中已有该交易时，视为已广播
+func (this *EthTransactionDecoder) broadcastSignedTransaction(address string, nonce uint64, txid string, signedHex string) error {
+	record, err := this.wm.beginSubmit(address, nonce, txid, signedHex)
+	if err != nil {
+		this.wm.Log.Errorf("save submit record of %s failed, err=%v", txid, err)
+		return err
+	}
+
+	hash, err := this.wm.WalletClient.fmSendRawTransaction(signedHex)
+	if IsGatewayError(err, ErrNonceTooLow) {
+		//nonce已被使用，如果使用它的正是这笔交易，视为已广播
+		if known, knownErr := this.wm.transactionKnownByNode(txid); knownErr == nil && known {
+			this.wm.Log.Infof("transaction %s is already on chain, attempts: %d", txid, record.Attempts)
+			return this.wm.acceptSubmitRecord(record)
+		}
+	}
+	if err != nil && !IsGatewayError(err, ErrAlreadyKnown) {
+		record.LastError = err.Error()
+		if saveErr := this.wm.saveSubmitRecord(record); saveErr != nil {
+			this.wm.Log.Errorf("save submit record of %s failed, err=%v", txid, saveErr)
+		}
+		return err
+	}
+	if err != nil {
+		this.wm.Log.Infof("transaction %s is already known by the gateway, attempts: %d", txid, record.Attempts)
+	} else if !strings.EqualFold(hash, txid) {
+		this.wm.Log.Warningf("gateway returned hash %s, local hash is %s", hash, txid)
+	}
+
+	return this.wm.acceptSubmitRecord(record)
+}
+
+//submitSignedTransaction 检查nonce并广播交易。之前广播过的交易可能已被网关接受而应答超时，
+//重试时先向节点查询本地哈希，节点已有该交易（交易池中或已打包）时不再检查nonce和广播
+func (this *EthTransactionDecoder) submitSignedTransaction(txStatis *AddressTxStatistic, rawTx *openwallet.RawTransaction, address string, nonce uint64, txid string, signedHex string) error {
+	record, err := this.wm.GetSubmitRecord(txid)
+	if err == nil && record.Attempts > 0 {
+		known, err := this.wm.transactionKnownByNode(txid)
+		if err != nil {
+			this.wm.Log.Warningf("query submitted transaction %s failed, err=%v", txid, err)
+		} else if known {
+			this.wm.Log.Infof("transaction %s is found on the node, skip broadcasting, attempts: %d", txid, record.Attempts)
+			return this.wm.acceptSubmitRecord(record)
+		}
+	}
+
+	err = this.checkSubmitNonce(txStatis, rawTx, address, nonce)
+	if err != nil {
+		return err
+	}
+	return this.broadcastSignedTransaction(address, nonce, txid, signedHex)
+}
+
+//acceptSubmitRecord 标记交易已被网关接受，保存失败只记录日志
+func (this *WalletManager) acceptSubmitRecord(record *SubmitRecord) error {
+	record.Accepted = true
+	record.LastError = ""
+	err := this.saveSubmitRecord(record)
+	if err != nil {
+		this.Log.Errorf("save submit record of %s failed, err=%v", record.TxID, err)
+	}
+	return nil
+}
+
+//transactionKnownByNode 节点中是否有该交易，查询交易和回执，都找不到时返回false
+func (this *WalletManager) transactionKnownByNode(txid string) (bool, error) {
+	_, err := this.WalletClient.EthGetTransactionByHash(txid)
+	if err == nil {
+		return true, nil
+	}
+	if !IsGatewayError(err, ErrUnknownTx) {
+		return false, err
+	}
+	_, err = this.WalletClient.EthGetTransactionReceipt(txid)
+	if err == nil {
+		return true, nil
+	}
+	if !IsGatewayError(err, ErrUnknownTx) {
+		return false, err
+	}
+	return false, nil
+}
+
+//resubmittedTransaction 交易已广播成功时返回原交易记录，否则返回nil
+func (this *EthTransactionDecoder) resubmittedTransaction(rawTx *openwallet.RawTransaction, txid string) *openwallet.Transaction {
+	sent, err := this.wm.GetSentTransaction(txid)
+	if err != nil {
+		return nil
+	}
+	this.wm.Log.Infof("transaction %s has been submitted, skip broadcasting", txid)
+
+	rawTx.TxID = txid
+	rawTx.IsSubmit = true
+	if sent.Transaction != nil {
+		return sent.Transaction
+	}
+	return this.submittedTransaction(rawTx)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"os"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/tidwall/gjson"
+)
+
+func TestEthTransactionDecoder_SubmitRawTransaction_Resubmit(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	rawTx := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	record, err := wm.GetSubmitRecord(rawTx.TxID)
+	if err != nil || !record.Accepted || record.Attempts != 1 || record.Nonce != 7 {
+		t.Fatalf("submit record = %+v, err=%v", record, err)
+	}
+
+	//同一交易单再次提交不会广播
+	tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil || tx.TxID != rawTx.TxID || tx.Amount != "-0.10000000" {
+		t.Fatalf("resubmit = %+v, err=%v; want %s", tx, err, rawTx.TxID)
+	}
+	if len(node.Pushed()) != 1 {
+		t.Errorf("pushed %d txs, want 1", len(node.Pushed()))
+	}
+	if list, _ := wm.ListSentTransactions(); len(list) != 1 {
+		t.Errorf("sent transactions = %d, want 1", len(list))
+	}
+}
+
+func TestEthTransactionDecoder_SubmitRawTransaction_AlreadyKnown(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	//第一次广播网关已接受但应答超时，重试时网关返回already known
+	calls := 0
+	node.Handle("pushtx", func(params gjson.Result) (interface{}, int64, string) {
+		calls++
+		if calls == 1 {
+			return nil, 10001, "gateway timeout"
+		}
+		return nil, -32000, "already known"
+	})
+
+	rawTx := testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx); err == nil {
+		t.Fatalf("submit should fail when the gateway times out")
+	}
+	records, _ := wm.GetSubmitRecords(testDepositAddress)
+	if len(records) != 1 || records[0].Accepted || records[0].LastError == "" {
+		t.Fatalf("submit records = %+v", records)
+	}
+	txid := records[0].TxID
+
+	tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil || tx.TxID != txid {
+		t.Fatalf("retry = %+v, err=%v; want %s", tx, err, txid)
+	}
+	record, _ := wm.GetSubmitRecord(txid)
+	if !record.Accepted || record.Attempts != 2 {
+		t.Errorf("submit record = %+v", record)
+	}
+	nonces, _ := wm.GetNonceRecords(testDepositAddress)
+	if len(nonces) != 1 || nonces[0].Status != NonceStatusSubmitted || nonces[0].TxID != txid {
+		t.Errorf("nonce records = %+v", nonces)
+	}
+}
+
+func TestEthTransactionDecoder_SubmitRawTransaction_RetryMined(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	//第一次广播网关已接受但应答超时，重试前交易已打包，再广播会返回nonce too low
+	accepted := false
+	node.Handle("pushtx", func(params gjson.Result) (interface{}, int64, string) {
+		if !accepted {
+			accepted = true
+			return nil, 10001, "gateway timeout"
+		}
+		return nil, -32000, "nonce too low"
+	})
+	node.Handle("eth_getTransactionByHash", func(params gjson.Result) (interface{}, int64, string) {
+		if !accepted {
+			return nil, 0, ""
+		}
+		return map[string]interface{}{"hash": params.Get("0").String()}, 0, ""
+	})
+
+	rawTx := testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx); err == nil {
+		t.Fatalf("submit should fail when the gateway times out")
+	}
+	records, _ := wm.GetSubmitRecords(testDepositAddress)
+	if len(records) != 1 || records[0].Accepted {
+		t.Fatalf("submit records = %+v", records)
+	}
+	txid := records[0].TxID
+	node.SetNonce(testDepositAddress, 8)
+
+	tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil || tx.TxID != txid {
+		t.Fatalf("retry = %+v, err=%v; want %s", tx, err, txid)
+	}
+	if node.Calls("pushtx") != 1 {
+		t.Errorf("pushtx called %d times, want 1", node.Calls("pushtx"))
+	}
+	if record, _ := wm.GetSubmitRecord(txid); !record.Accepted || record.Attempts != 1 {
+		t.Errorf("submit record = %+v", record)
+	}
+	if _, err := wm.GetSentTransaction(txid); err != nil {
+		t.Errorf("sent transaction should be recorded, err=%v", err)
+	}
+}
+
+func TestEthTransactionDecoder_SubmitRawTransaction_NonceTooLow(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+
+	//nonce too low时，节点中有本地哈希的交易视为已广播，否则返回错误
+	known := true
+	node.Handle("pushtx", func(params gjson.Result) (interface{}, int64, string) {
+		return nil, -32000, "nonce too low"
+	})
+	node.Handle("eth_getTransactionByHash", func(params gjson.Result) (interface{}, int64, string) {
+		if !known {
+			return nil, 0, ""
+		}
+		return map[string]interface{}{"hash": params.Get("0").String()}, 0, ""
+	})
+
+	rawTx := testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	tx, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if err != nil || tx.TxID != rawTx.TxID {
+		t.Fatalf("submit = %+v, err=%v", tx, err)
+	}
+	if record, _ := wm.GetSubmitRecord(rawTx.TxID); !record.Accepted {
+		t.Errorf("submit record = %+v", record)
+	}
+
+	known = false
+	rawTx = testSignedRawTx(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	_, err = wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx)
+	if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrNonceInvaild {
+		t.Errorf("submit err=%v, want nonce invalid", err)
+	}
+}
+
+func TestGatewayError_AlreadyKnownKeywords(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"already known":                       true,
+		"known transaction: 0xabc":            true,
+		"transaction already imported":        true,
+		"duplicate request id":                false,
+		"account already exists":              false,
+		"replacement transaction underpriced": false,
+	} {
+		if got := IsGatewayError(NewGatewayError("pushtx", -32000, msg, ""), ErrAlreadyKnown); got != want {
+			t.Errorf("%q already known = %v, want %v", msg, got, want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//已广播的交易在每轮区块扫描后跟踪状态，状态变化时通知区块扫描的观测者：
+//
+//	pending    已广播，还没有打包
+//	mined      已打包，确认数不足RequiredConfirmations
+//	confirmed  已打包并达到确认数
+//	failed     已打包但执行失败
+//	dropped    节点中找不到交易且超过SentTxDropTimeout，或者nonce已被其他交易使用
+//	replaced   同一nonce的加速或取消交易已打包
+//
+//已打包的交易所在区块被孤立后回到pending
+
+//已广播交易的状态
+const (
+	SentTxPending   = "pending"
+	SentTxMined     = "mined"
+	SentTxConfirmed = "confirmed"
+	SentTxFailed    = "failed"
+	SentTxDropped   = "dropped"
+	SentTxReplaced  = "replaced"
+)
+
+//DEFAULT_SENT_TX_DROP_TIMEOUT 节点中找不到已广播交易多久后视为丢弃，单位秒
+const DEFAULT_SENT_TX_DROP_TIMEOUT = 30 * 60
+
+//SentTxObserver 观测者实现该接口时直接接收已广播交易的状态变化，否则通过BlockExtractDataNotify通知
+type SentTxObserver interface {
+	SentTransactionNotify(sent *SentTransaction) error
+}
+
+//isFinal 交易状态是否不再变化
+func (sent *SentTransaction) isFinal(required uint64) bool {
+	switch sent.Status {
+	case SentTxConfirmed, SentTxDropped, SentTxReplaced:
+		return true
+	case SentTxFailed:
+		return required <= 1 || sent.Confirmations >= int64(required)
+	}
+	return false
+}
+
+//ListSentTransactions 查询已广播的交易，status为空时返回全部
+func (this *WalletManager) ListSentTransactions(status ...string) ([]*SentTransaction, error) {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var all []*SentTransaction
+	err = db.All(&all)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if len(status) == 0 {
+		return all, nil
+	}
+	list := make([]*SentTransaction, 0)
+	for _, sent := range all {
+		for _, s := range status {
+			if sent.Status == s {
+				list = append(list, sent)
+				break
+			}
+		}
+	}
+	return list, nil
+}
+
+//GetSentTransactionStatus 查询已广播交易的状态，返回最近一次跟踪的结果
+func (this *WalletManager) GetSentTransactionStatus(txid string) (string, error) {
+	sent, err := this.GetSentTransaction(txid)
+	if err != nil {
+		return "", err
+	}
+	return sent.Status, nil
+}
+
+//requiredConfirmations 交易达到确认需要的确认数
+func (this *WalletManager) requiredConfirmations() uint64 {
+	if bs, ok := this.Blockscanner.(*FMBLockScanner); ok {
+		return bs.RequiredConfirmations
+	}
+	return this.Config.RequiredConfirmations
+}
+
+//TrackSentTransactions 刷新所有未结束的已广播交易的状态，返回状态有变化的交易并通知观测者
+func (this *WalletManager) TrackSentTransactions() ([]*SentTransaction, error) {
+	required := this.requiredConfirmations()
+	list, err := this.ListSentTransactions(SentTxPending, SentTxMined, SentTxFailed)
+	if err != nil {
+		return nil, err
+	}
+	tracking := make([]*SentTransaction, 0, len(list))
+	for _, sent := range list {
+		if !sent.isFinal(required) {
+			tracking = append(tracking, sent)
+		}
+	}
+	if len(tracking) == 0 {
+		return nil, nil
+	}
+
+	tip, err := this.WalletClient.FmGetBlockNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]*SentTransaction, 0)
+	for _, sent := range tracking {
+		oldStatus, oldConfirmations := sent.Status, sent.Confirmations
+		err = this.refreshSentTransaction(sent, tip, required)
+		if err != nil {
+			this.Log.Errorf("track sent transaction %s failed, err=%v", sent.TxID, err)
+			continue
+		}
+		if sent.Status == oldStatus && sent.Confirmations == oldConfirmations {
+			continue
+		}
+		sent.UpdateTime = time.Now().Unix()
+		err = this.updateSentTransaction(sent)
+		if err != nil {
+			this.Log.Errorf("save sent transaction %s failed, err=%v", sent.TxID, err)
+			continue
+		}
+		if sent.Status != oldStatus {
+			this.Log.Infof("sent transaction %s: %s -> %s", sent.TxID, oldStatus, sent.Status)
+			this.notifySentTransaction(sent)
+			changed = append(changed, sent)
+		}
+	}
+	return changed, nil
+}
+
+//refreshSentTransaction 按交易回执和节点中的交易刷新状态
+func (this *WalletManager) refreshSentTransaction(sent *SentTransaction, tip uint64, required uint64) error {
+	receipt, err := this.WalletClient.EthGetTransactionReceipt(sent.TxID)
+	if err == nil {
+		height, err := parseBlockNumber(receipt.BlockNumber)
+		if err != nil {
+			return err
+		}
+		confirms := int64(1)
+		if tip > height {
+			confirms = int64(tip-height) + 1
+		}
+		sent.BlockHeight, sent.BlockHash, sent.Confirmations = height, receipt.BlockHash, confirms
+		switch {
+		case receipt.Status == "0x0" || receipt.Status == "0":
+			sent.Status = SentTxFailed
+		case required <= 1 || confirms >= int64(required):
+			sent.Status = SentTxConfirmed
+		default:
+			sent.Status = SentTxMined
+		}
+		return nil
+	}
+	if !IsGatewayError(err, ErrUnknownTx) {
+		return err
+	}
+
+	//没有打包，已打包过的交易所在区块被孤立
+	sent.BlockHeight, sent.BlockHash, sent.Confirmations = 0, "", 0
+
+	confirmed, err := this.ConfirmedReplacement(sent.TxID)
+	if err != nil {
+		return err
+	}
+	if confirmed != "" && confirmed != sent.TxID {
+		sent.Status = SentTxReplaced
+		return nil
+	}
+
+	_, err = this.WalletClient.EthGetTransactionByHash(sent.TxID)
+	if err == nil {
+		sent.Status = SentTxPending
+		return nil
+	}
+	if !IsGatewayError(err, ErrUnknownTx) {
+		return err
+	}
+
+	chainNonce, err := this.WalletClient.fmGetTransactionCount(AppendFmToAddress(sent.AddressKey))
+	if err != nil {
+		return err
+	}
+	timeout := this.Config.SentTxDropTimeout
+	if chainNonce > sent.Nonce || (timeout > 0 && time.Now().Unix()-sent.SubmitTime/int64(time.Second) > timeout) {
+		sent.Status = SentTxDropped
+		return nil
+	}
+	sent.Status = SentTxPending
+	return nil
+}
+
+//updateSentTransaction 保存跟踪结果
+func (this *WalletManager) updateSentTransaction(sent *SentTransaction) error {
+	db, err := this.openSentTxDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Save(sent)
+}
+
+//parseBlockNumber 解析区块高度，兼容0x开头的十六进制和十进制
+func parseBlockNumber(number string) (uint64, error) {
+	if strings.HasPrefix(number, "0x") {
+		return strconv.ParseUint(removeOxFromHex(number), 16, 64)
+	}
+	return strconv.ParseUint(number, 10, 64)
+}
+
+//notifySentTransaction 把已广播交易的状态变化通知给区块扫描的观测者。
+//没有实现SentTxObserver的观测者收到交易记录：mined、confirmed的Status为"1"，
+//confirmed的ConfirmTime不为0；其他状态的Status为"0"，Reason为状态，区块被孤立时Reason为reverted
+func (this *WalletManager) notifySentTransaction(sent *SentTransaction) {
+	bs, ok := this.Blockscanner.(*FMBLockScanner)
+	if !ok {
+		return
+	}
+
+	var tx openwallet.Transaction
+	if sent.Transaction != nil {
+		tx = *sent.Transaction
+	} else {
+		tx = openwallet.Transaction{TxID: sent.TxID, AccountID: sent.AccountID, Coin: sent.Coin}
+	}
+	tx.BlockHeight = sent.BlockHeight
+	tx.BlockHash = sent.BlockHash
+	tx.Confirm = sent.Confirmations
+	tx.ConfirmTime = 0
+	tx.Status = "0"
+	tx.Reason = sent.Status
+	switch sent.Status {
+	case SentTxMined:
+		tx.Status, tx.Reason = "1", ""
+	case SentTxConfirmed:
+		tx.Status, tx.Reason = "1", ""
+		tx.ConfirmTime = sent.UpdateTime
+	case SentTxPending:
+		tx.Reason = TxStageReverted
+	}
+	data := &openwallet.TxExtractData{Transaction: &tx}
+
+	for o := range bs.Observers {
+		var err error
+		if observer, ok := o.(SentTxObserver); ok {
+			err = observer.SentTransactionNotify(sent)
+		} else {
+			err = o.BlockExtractDataNotify(sent.AccountID, data)
+		}
+		if err != nil {
+			this.Log.Errorf("notify sent transaction %s failed, err=%v", sent.TxID, err)
+		}
+	}
+}
+
+//trackSentTransactions 每轮扫描后跟踪已广播交易的状态
+func (this *FMBLockScanner) trackSentTransactions() {
+	_, err := this.wm.TrackSentTransactions()
+	if err != nil {
+		this.wm.Log.Errorf("track sent transactions failed, err=%v", err)
+	}
+}
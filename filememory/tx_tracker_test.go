@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//testTrackStatus 跟踪一轮并返回txid的状态
+func testTrackStatus(t *testing.T, wm *WalletManager, txid string) string {
+	if _, err := wm.TrackSentTransactions(); err != nil {
+		t.Fatalf("TrackSentTransactions failed, err=%v", err)
+	}
+	status, err := wm.GetSentTransactionStatus(txid)
+	if err != nil {
+		t.Fatalf("GetSentTransactionStatus failed, err=%v", err)
+	}
+	return status
+}
+
+//testSentNotices 列出观测者收到的已广播交易通知
+func (o *testScanObserver) testSentNotices(sourceKey string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	notices := make([]string, 0)
+	for _, data := range o.extractData[sourceKey] {
+		tx := data.Transaction
+		notices = append(notices, fmt.Sprintf("%s:%s:%s", tx.Status, TxStage(tx), tx.Reason))
+	}
+	return notices
+}
+
+func TestWalletManager_TrackSentTransactions_Confirmed(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	bs.RequiredConfirmations = 3
+
+	rawTx := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	if list, _ := wm.ListSentTransactions(SentTxPending); len(list) != 1 || list[0].TxID != rawTx.TxID {
+		t.Fatalf("pending sent transactions = %+v", list)
+	}
+
+	//还没有打包
+	node.SetTip(100)
+	if status := testTrackStatus(t, wm, rawTx.TxID); status != SentTxPending {
+		t.Errorf("status = %s, want %s", status, SentTxPending)
+	}
+
+	node.SetReceipt(rawTx.TxID, &EthTransactionReceipt{BlockNumber: "0x64", BlockHash: "0x64aa", Status: "0x1"})
+	node.SetTip(101)
+	if status := testTrackStatus(t, wm, rawTx.TxID); status != SentTxMined {
+		t.Errorf("status = %s, want %s", status, SentTxMined)
+	}
+	node.SetTip(102)
+	if status := testTrackStatus(t, wm, rawTx.TxID); status != SentTxConfirmed {
+		t.Errorf("status = %s, want %s", status, SentTxConfirmed)
+	}
+	sent, _ := wm.GetSentTransaction(rawTx.TxID)
+	if sent.BlockHeight != 100 || sent.BlockHash != "0x64aa" || sent.Confirmations != 3 {
+		t.Errorf("sent block = %d %s %d", sent.BlockHeight, sent.BlockHash, sent.Confirmations)
+	}
+
+	//已结束的交易不再查询
+	calls := node.Calls("eth_getTransactionReceipt")
+	testTrackStatus(t, wm, rawTx.TxID)
+	if node.Calls("eth_getTransactionReceipt") != calls {
+		t.Errorf("confirmed tx should not be tracked")
+	}
+
+	want := []string{"1:provisional:", "1:final:"}
+	if notices := observer.testSentNotices("account"); fmt.Sprint(notices) != fmt.Sprint(want) {
+		t.Errorf("notices = %v, want %v", notices, want)
+	}
+	data := observer.extractData["account"][0]
+	if data.Transaction.TxID != rawTx.TxID || data.Transaction.Amount != "-0.10000000" || data.Transaction.Confirm != 2 {
+		t.Errorf("notified tx = %+v", data.Transaction)
+	}
+}
+
+func TestWalletManager_TrackSentTransactions_FailedAndReverted(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	bs, observer := testNewFakeNodeScanner(t, wm)
+	bs.RequiredConfirmations = 3
+	node.SetTip(100)
+
+	failed := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	node.SetReceipt(failed.TxID, &EthTransactionReceipt{BlockNumber: "100", BlockHash: "0x64aa", Status: "0x0"})
+	if status := testTrackStatus(t, wm, failed.TxID); status != SentTxFailed {
+		t.Errorf("status = %s, want %s", status, SentTxFailed)
+	}
+
+	//已打包的交易所在区块被孤立，交易回到交易池
+	reverted := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.2")
+	node.SetReceipt(reverted.TxID, &EthTransactionReceipt{BlockNumber: "100", BlockHash: "0x64aa", Status: "0x1"})
+	if status := testTrackStatus(t, wm, reverted.TxID); status != SentTxMined {
+		t.Errorf("status = %s, want %s", status, SentTxMined)
+	}
+	node.SetReceipt(reverted.TxID, nil)
+	node.SetTransaction(&BlockTransaction{Hash: reverted.TxID})
+	if status := testTrackStatus(t, wm, reverted.TxID); status != SentTxPending {
+		t.Errorf("status = %s, want %s", status, SentTxPending)
+	}
+
+	want := []string{"0:provisional:failed", "1:provisional:", "0:reverted:reverted"}
+	if notices := observer.testSentNotices("account"); fmt.Sprint(notices) != fmt.Sprint(want) {
+		t.Errorf("notices = %v, want %v", notices, want)
+	}
+}
+
+func TestWalletManager_TrackSentTransactions_DroppedAndReplaced(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	testNewFakeNodeScanner(t, wm)
+	node.SetTip(100)
+
+	original := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	speedUp, err := testReplaceDecoder(wm).CreateSpeedUpRawTransaction(wrapper, original.TxID, "")
+	if err != nil {
+		t.Fatalf("CreateSpeedUpRawTransaction failed, err=%v", err)
+	}
+	testSignAndSubmit(t, wm, wrapper, speedUp)
+	node.SetReceipt(speedUp.TxID, &EthTransactionReceipt{BlockNumber: "100", BlockHash: "0x64aa", Status: "0x1"})
+	node.SetNonce(testDepositAddress, 8)
+	if status := testTrackStatus(t, wm, original.TxID); status != SentTxReplaced {
+		t.Errorf("original status = %s, want %s", status, SentTxReplaced)
+	}
+	if status, _ := wm.GetSentTransactionStatus(speedUp.TxID); status != SentTxConfirmed {
+		t.Errorf("speed up status = %s, want %s", status, SentTxConfirmed)
+	}
+
+	//nonce已被节点外的交易使用
+	dropped := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	if status := testTrackStatus(t, wm, dropped.TxID); status != SentTxPending {
+		t.Errorf("status = %s, want %s", status, SentTxPending)
+	}
+	node.SetNonce(testDepositAddress, 9)
+	if status := testTrackStatus(t, wm, dropped.TxID); status != SentTxDropped {
+		t.Errorf("status = %s, want %s", status, SentTxDropped)
+	}
+
+	//超时未出现在节点中
+	wm.Config.SentTxDropTimeout = 1
+	timeout := testCreateAndSubmit(t, wm, wrapper, openwallet.Coin{Symbol: Symbol}, "0.1")
+	sent, _ := wm.GetSentTransaction(timeout.TxID)
+	sent.SubmitTime -= 2e9
+	wm.updateSentTransaction(sent)
+	if status := testTrackStatus(t, wm, timeout.TxID); status != SentTxDropped {
+		t.Errorf("status = %s, want %s", status, SentTxDropped)
+	}
+
+	if list, _ := wm.ListSentTransactions(SentTxDropped, SentTxReplaced); len(list) != 3 {
+		t.Errorf("dropped and replaced = %d, want 3", len(list))
+	}
+	if list, _ := wm.ListSentTransactions(); len(list) != 4 {
+		t.Errorf("sent transactions = %d, want 4", len(list))
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+package filememory
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/blocktree/openwallet/openwallet"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/shopspring/decimal"
+)
+
+//广播前逐项核对RawHex中的交易与交易单的描述是否一致：
+//
+//	接收地址和数量    To、TxTo，代币交易核对合约地址和transfer参数
+//	手续费           FeeRate、Fees
+//	账户支出         TxAmount为负的转账数量，转给账户自己的地址时为0
+//	签名             Message、Nonce与交易一致，按ChainID恢复的签名地址与签名的地址一致
+
+//verifyError 交易单校验失败
+func verifyError(format string, a ...interface{}) *openwallet.Error {
+	return openwallet.Errorf(openwallet.ErrVerifyRawTransactionFailed, format, a...)
+}
+
+//decodeSignedRawTransaction 解析交易单的RawHex并加入签名
+func (this *EthTransactionDecoder) decodeSignedRawTransaction(rawTx *openwallet.RawTransaction, keySig *openwallet.KeySignature) (*types.Transaction, error) {
+	rawHex, err := hex.DecodeString(rawTx.RawHex)
+	if err != nil {
+		return nil, verifyError("raw hex is invalid: %v", err)
+	}
+	tx := &types.Transaction{}
+	err = rlp.DecodeBytes(rawHex, tx)
+	if err != nil {
+		return nil, verifyError("transaction RLP decode failed: %v", err)
+	}
+	signer := types.NewEIP155Signer(new(big.Int).SetUint64(this.wm.GetConfig().ChainID))
+	tx, err = tx.WithSignature(signer, ethcommon.FromHex(keySig.Signature))
+	if err != nil {
+		return nil, verifyError("tx with signature failed: %v", err)
+	}
+	return tx, nil
+}
+
+//verifyTransaction 核对签名后的交易与交易单的描述，keySig为账户的签名
+func (this *EthTransactionDecoder) verifyTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, tx *types.Transaction, keySig *openwallet.KeySignature) error {
+	if len(rawTx.To) != 1 {
+		return verifyError("only one to address can be set")
+	}
+	var destination, amountStr string
+	for k, v := range rawTx.To {
+		destination, amountStr = k, v
+	}
+	if tx.To() == nil {
+		return verifyError("contract creation is not allowed")
+	}
+
+	//接收地址和数量
+	decimals := int32(this.wm.Decimal())
+	if rawTx.Coin.IsContract {
+		decimals = int32(rawTx.Coin.Contract.Decimals)
+		if *tx.To() != ethcommon.HexToAddress(indexAddressKey(rawTx.Coin.Contract.Address)) {
+			return verifyError("transaction calls %s, want contract %s", tx.To().Hex(), rawTx.Coin.Contract.Address)
+		}
+		if tx.Value().Sign() != 0 {
+			return verifyError("token transaction should not transfer %s", rawTx.Coin.Symbol)
+		}
+		to, value, ok := decodeTokenTransfer(tx.Data())
+		if !ok {
+			return verifyError("transaction data is not a token transfer")
+		}
+		amount, _ := ConvertFloatStringToBigInt(amountStr, int(decimals))
+		if to != ethcommon.HexToAddress(indexAddressKey(destination)) || value.Cmp(amount) != 0 {
+			return verifyError("token transfer %s to %s, want %s to %s", value, to.Hex(), amountStr, destination)
+		}
+	} else {
+		if len(tx.Data()) != 0 {
+			return verifyError("%s transaction should not carry data", rawTx.Coin.Symbol)
+		}
+		amount, _ := ConvertEthStringToWei(amountStr)
+		if *tx.To() != ethcommon.HexToAddress(indexAddressKey(destination)) || tx.Value().Cmp(amount) != 0 {
+			return verifyError("transaction sends %s to %s, want %s to %s", tx.Value(), tx.To().Hex(), amountStr, destination)
+		}
+	}
+	amountDec, err := decimal.NewFromString(amountStr)
+	if err != nil {
+		return verifyError("amount %s is invalid", amountStr)
+	}
+	if len(rawTx.TxTo) != 1 {
+		return verifyError("TxTo should have one entry")
+	}
+	if !txAmountEntryMatches(rawTx.TxTo[0], destination, amountDec) {
+		return verifyError("TxTo %s does not match %s:%s", rawTx.TxTo[0], destination, amountStr)
+	}
+
+	//手续费
+	gasPrice, err := ConvertEthStringToWei(rawTx.FeeRate)
+	if err != nil || gasPrice.Cmp(tx.GasPrice()) != 0 {
+		return verifyError("fee rate %s does not match gas price %s", rawTx.FeeRate, tx.GasPrice())
+	}
+	fees, err := ConvertEthStringToWei(rawTx.Fees)
+	fee := new(big.Int).Mul(tx.GasPrice(), new(big.Int).SetUint64(tx.Gas()))
+	if err != nil || fees.Cmp(fee) != 0 {
+		return verifyError("fees %s does not match gas %d * gas price %s", rawTx.Fees, tx.Gas(), tx.GasPrice())
+	}
+
+	//账户支出
+	if rawTx.TxAmount != "" {
+		txAmount, err := decimal.NewFromString(rawTx.TxAmount)
+		if err != nil {
+			return verifyError("TxAmount %s is invalid", rawTx.TxAmount)
+		}
+		if !txAmount.Equal(amountDec.Neg()) && !(txAmount.IsZero() && this.isAccountAddress(wrapper, rawTx, destination)) {
+			return verifyError("TxAmount %s does not match amount %s", rawTx.TxAmount, amountStr)
+		}
+	}
+
+	//签名
+	from := keySig.Address.Address
+	signer := types.NewEIP155Signer(new(big.Int).SetUint64(this.wm.GetConfig().ChainID))
+	msg := signer.Hash(tx)
+	if !strings.EqualFold(removeOxFromHex(keySig.Message), hex.EncodeToString(msg[:])) {
+		return verifyError("signature message does not match the transaction")
+	}
+	if keySig.Nonce != "" {
+		nonce, err := strconv.ParseUint(removeOxFromHex(keySig.Nonce), 16, 64)
+		if err != nil || nonce != tx.Nonce() {
+			return verifyError("signature nonce %s does not match transaction nonce %d", keySig.Nonce, tx.Nonce())
+		}
+	}
+	sender, err := types.Sender(signer, tx)
+	if err != nil {
+		return verifyError("recover signer failed: %v", err)
+	}
+	if sender != ethcommon.HexToAddress(indexAddressKey(from)) {
+		return verifyError("transaction is signed by %s, want %s", ReplaceFmToAddress(sender.Hex()), from)
+	}
+	if len(rawTx.TxFrom) == 1 && !txAmountEntryMatches(rawTx.TxFrom[0], from, amountDec) {
+		return verifyError("TxFrom %s does not match %s:%s", rawTx.TxFrom[0], from, amountStr)
+	}
+	return nil
+}
+
+//decodeTokenTransfer 解析代币transfer调用的接收地址和数量
+func decodeTokenTransfer(data []byte) (ethcommon.Address, *big.Int, bool) {
+	method := ethcommon.FromHex(ETH_TRANSFER_TOKEN_BALANCE_METHOD)
+	if len(data) != 68 || !bytes.Equal(data[:4], method) {
+		return ethcommon.Address{}, nil, false
+	}
+	return ethcommon.BytesToAddress(data[16:36]), new(big.Int).SetBytes(data[36:68]), true
+}
+
+//txAmountEntryMatches 交易单TxFrom、TxTo中的address:amount是否与地址和数量一致
+func txAmountEntryMatches(entry string, address string, amount decimal.Decimal) bool {
+	i := strings.LastIndex(entry, ":")
+	if i < 0 {
+		return false
+	}
+	value, err := decimal.NewFromString(entry[i+1:])
+	return err == nil && indexAddressKey(entry[:i]) == indexAddressKey(address) && value.Equal(amount)
+}
+
+//isAccountAddress 地址是否属于交易单的账户
+func (this *EthTransactionDecoder) isAccountAddress(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, address string) bool {
+	if wrapper == nil {
+		return false
+	}
+	addresses, err := wrapper.GetAddressList(0, -1, "AccountID", rawTx.Account.AccountID, "Address", address)
+	return err == nil && len(addresses) > 0
+}
+
+//verifySignedRawTransaction 解析交易单并核对交易内容和签名
+func (this *EthTransactionDecoder) verifySignedRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
+	accountSig := rawTx.Signatures[rawTx.Account.AccountID]
+	if len(accountSig) != 1 {
+		return verifyError("len of signatures error")
+	}
+	tx, err := this.decodeSignedRawTransaction(rawTx, accountSig[0])
+	if err != nil {
+		return err
+	}
+	err = this.verifyTransaction(wrapper, rawTx, tx, accountSig[0])
+	if err != nil {
+		this.wm.Log.Std.Error("verify transaction failed, err=%v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package filememory
+
+import (
+	"os"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestEthTransactionDecoder_VerifyRawTransaction_Content(t *testing.T) {
+	wm, node, wrapper := testDepositWallet(t)
+	defer os.RemoveAll(wm.Config.DataDir)
+	decoder := testReplaceDecoder(wm)
+	native := openwallet.Coin{Symbol: Symbol}
+	token := openwallet.Coin{Symbol: Symbol, IsContract: true, Contract: openwallet.SmartContract{Address: testTokenAddress}}
+
+	tests := []struct {
+		name   string
+		coin   openwallet.Coin
+		tamper func(rawTx *openwallet.RawTransaction)
+		valid  bool
+	}{
+		{"native", native, func(rawTx *openwallet.RawTransaction) {}, true},
+		{"token", token, func(rawTx *openwallet.RawTransaction) {}, true},
+		{"amount", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.To = map[string]string{testSummaryAddress: "0.2"}
+		}, false},
+		{"to", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.To = map[string]string{testOtherAddress: "0.1"}
+		}, false},
+		{"txTo", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.TxTo = []string{testOtherAddress + ":0.1"}
+		}, false},
+		{"txAmount", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.TxAmount = "-0.01"
+		}, false},
+		{"fees", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.Fees = "0.0001"
+		}, false},
+		{"feeRate", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.FeeRate = "0.00000001"
+		}, false},
+		{"contract", token, func(rawTx *openwallet.RawTransaction) {
+			rawTx.Coin.Contract.Address = "0x2222222222222222222222222222222222222222"
+		}, false},
+		{"token amount", token, func(rawTx *openwallet.RawTransaction) {
+			rawTx.To = map[string]string{testSummaryAddress: "2"}
+		}, false},
+		{"signer", native, func(rawTx *openwallet.RawTransaction) {
+			rawTx.Signatures["account"][0].Address = &openwallet.Address{Address: testOtherAddress}
+			testSignRawTx(t, rawTx)
+			rawTx.Signatures["account"][0].Address = &openwallet.Address{Address: testDepositAddress}
+		}, false},
+		{"chainID", native, func(rawTx *openwallet.RawTransaction) {
+			wm.Config.ChainID = 2
+		}, false},
+	}
+	for _, test := range tests {
+		wm.Config.ChainID = 1
+		amount := "0.1"
+		if test.coin.IsContract {
+			amount = "1.5"
+		}
+		rawTx := testSignedRawTx(t, wm, wrapper, test.coin, amount)
+		if err := decoder.ReleaseRawTransactionNonce(rawTx); err != nil {
+			t.Fatalf("ReleaseRawTransactionNonce failed, err=%v", err)
+		}
+		test.tamper(rawTx)
+		err := decoder.verifySignedRawTransaction(wrapper, rawTx)
+		if test.valid && err != nil {
+			t.Errorf("%s: verify failed, err=%v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: tampered raw tx should be rejected", test.name)
+		}
+	}
+	wm.Config.ChainID = 1
+
+	//核对失败的交易单不会广播
+	rawTx := testSignedRawTx(t, wm, wrapper, native, "0.1")
+	rawTx.To = map[string]string{testSummaryAddress: "0.2"}
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("submit tampered raw tx should fail")
+	} else if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrVerifyRawTransactionFailed {
+		t.Errorf("submit err = %v, want ErrVerifyRawTransactionFailed", err)
+	}
+	if len(node.Pushed()) != 0 {
+		t.Errorf("pushed %d txs, want 0", len(node.Pushed()))
+	}
+}
@@ -17,6 +17,7 @@ require (
 	github.com/steakknife/hamming v0.0.0-20180906055917-c99c65617cd3 // indirect
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/tidwall/gjson v1.2.1
+	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5
 	golang.org/x/sys v0.0.0-20190813064441-fde4db37ae7a // indirect
 )
 